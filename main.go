@@ -3,14 +3,26 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/nanlour/da/src/consensus"
+	"github.com/nanlour/da/src/db"
 )
 
 func main() {
 	// Define command-line flag for config path
 	configPath := flag.String("config", "", "Path to configuration file")
+	fsck := flag.Bool("fsck", false, "Check the database for consistency and exit without modifying it, the node must be stopped")
+	importPath := flag.String("import", "", "Chain file to feed through block verification once the node is up")
+	exportPath := flag.String("export", "", "Write the stored main chain to this file and exit, the node must be stopped")
+	selftest := flag.Bool("selftest", false, "Run a throwaway single node through mining and a transfer, then exit")
 	flag.Parse()
+
+	if *selftest {
+		os.Exit(runSelfTest())
+	}
 	log.Printf("Config Path: %s", *configPath)
 
 	bc := consensus.BlockChain{}
@@ -19,6 +31,130 @@ func main() {
 		log.Fatalf("Failed to get config: %v", err)
 	}
 
+	if *fsck {
+		os.Exit(checkDB(config))
+	}
+	if *exportPath != "" {
+		os.Exit(exportChain(config, *exportPath))
+	}
+
 	bc.SetConfig(config)
-	bc.Init()
+
+	// Stop the node cleanly on interrupt. Stop needs everything Init brings up, so an interrupt
+	// during Init waits for it to finish, a failed Init exits through Run instead.
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		log.Println("Shutting down node...")
+		<-bc.Ready()
+		bc.Stop()
+	}()
+
+	if *importPath != "" {
+		go func() {
+			<-bc.Ready()
+			if err := importChain(&bc, *importPath); err != nil {
+				log.Printf("Import of %s failed: %v", *importPath, err)
+			}
+		}()
+	}
+
+	if err := bc.Run(); err != nil {
+		log.Fatalf("Node failed: %v", err)
+	}
+}
+
+// checkDB reports database inconsistencies and returns the process exit code. The database is
+// opened read-only, so a wrong path is an error instead of a new empty database.
+func checkDB(config *consensus.Config) int {
+	options := config.DBOptions
+	options.ReadOnly = true
+	mainDB, err := db.InitialDB(config.DbPath, &options)
+	if err != nil {
+		log.Printf("Failed to open db: %v", err)
+		return 1
+	}
+	defer mainDB.Close()
+
+	problems, err := mainDB.Verify()
+	if err != nil {
+		log.Printf("Failed to check db: %v", err)
+		return 1
+	}
+
+	// Replaying the chain verifies every VDF proof, which takes a while on long chains
+	log.Printf("fsck: validating the chain from genesis")
+	if err := consensus.ValidateStoredChain(config, mainDB); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	for _, problem := range problems {
+		log.Printf("fsck: %s", problem)
+	}
+	if len(problems) > 0 {
+		log.Printf("fsck: %d problem(s) found in %s", len(problems), config.DbPath)
+		return 1
+	}
+
+	log.Printf("fsck: %s is consistent", config.DbPath)
+	return 0
+}
+
+// exportChain writes the stored main chain to path and returns the process exit code, the
+// database is opened read-only
+func exportChain(config *consensus.Config, path string) int {
+	options := config.DBOptions
+	options.ReadOnly = true
+	mainDB, err := db.InitialDB(config.DbPath, &options)
+	if err != nil {
+		log.Printf("Failed to open db: %v", err)
+		return 1
+	}
+	defer mainDB.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		log.Printf("Failed to create %s: %v", path, err)
+		return 1
+	}
+	if err := consensus.ExportStoredChain(config, mainDB, f); err != nil {
+		f.Close()
+		log.Printf("Failed to export chain: %v", err)
+		return 1
+	}
+	if err := f.Close(); err != nil {
+		log.Printf("Failed to write %s: %v", path, err)
+		return 1
+	}
+
+	log.Printf("Exported the chain in %s to %s", config.DbPath, path)
+	return 0
+}
+
+// importChain feeds the blocks in the file at path to the running node
+func importChain(bc *consensus.BlockChain, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return bc.ImportBlocks(f)
+}
+
+// runSelfTest runs the node self-test in a temporary directory and returns the process exit code
+func runSelfTest() int {
+	dir, err := os.MkdirTemp("", "da-selftest-")
+	if err != nil {
+		log.Printf("Failed to create self-test directory: %v", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	if err := consensus.SelfTest(dir); err != nil {
+		log.Printf("selftest: failed: %v", err)
+		return 1
+	}
+	return 0
 }
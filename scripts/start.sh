@@ -10,7 +10,7 @@ cd /app
 echo "Waiting 5 seconds for blockchain node to initialize..."
 sleep 5
 
-# Start the web UI
-./web-ui -rpc localhost:9000 -basedir web -port 8080 > weblog 2>&1 &
+# Start the web UI, bound to all interfaces so the published container port reaches it
+./web-ui -rpc localhost:9000 -basedir web -bind 0.0.0.0 -port 8080 > weblog 2>&1 &
 
 tail -f /dev/null
\ No newline at end of file
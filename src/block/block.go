@@ -7,18 +7,196 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"math/big"
 )
 
+// MaxTxOutputs is how many recipients a split transaction can pay, outputs are a fixed
+// array so blocks keep their fixed-size binary encoding
+const MaxTxOutputs = 8
+
+// TxOutput is one recipient of a split transaction
+type TxOutput struct {
+	ToAddress [32]byte
+	Amount    float64
+}
+
+// TxType tells what a transaction does, transactions made before types existed are transfers
+type TxType uint8
+
+const (
+	TxTransfer TxType = iota // Pays Amount to ToAddress, or to Outputs when split
+	TxDelegate               // Delegates the sender's stake to the validator at ToAddress, no funds move
+)
+
 type Transaction struct {
 	FromAddress [32]byte // Address of the sender
 	ToAddress   [32]byte // Address of the receiver
 	Amount      float64  // Amount to be transferred
 	Height      uint64
+	Nonce       uint64  // Per-sender sequence number, must be the sender's previous nonce + 1
+	Fee         float64 // Paid by the sender to the block's miner on top of Amount
+	Type        TxType  // What the transaction does, a transfer unless set
+	OutputCount uint8   // Non-zero for a split transaction paying Outputs[:OutputCount], Amount is their total
+	Outputs     [MaxTxOutputs]TxOutput
 	Signature   [64]byte
 	PublicKey   [64]byte
 }
 
+// NewSplitTransaction builds an unsigned transaction paying every output from one sender
+func NewSplitTransaction(from [32]byte, outputs []TxOutput, height, nonce uint64) (*Transaction, error) {
+	if len(outputs) == 0 || len(outputs) > MaxTxOutputs {
+		return nil, fmt.Errorf("split transaction needs 1 to %d outputs, got %d", MaxTxOutputs, len(outputs))
+	}
+
+	txn := &Transaction{
+		FromAddress: from,
+		Height:      height,
+		Nonce:       nonce,
+		OutputCount: uint8(len(outputs)),
+	}
+	copy(txn.Outputs[:], outputs)
+	for _, output := range outputs {
+		txn.Amount += output.Amount
+	}
+	return txn, nil
+}
+
+// NewDelegation builds an unsigned transaction delegating the sender's stake to validator,
+// naming the sender itself takes the stake back
+func NewDelegation(from, validator [32]byte, height, nonce uint64) *Transaction {
+	return &Transaction{
+		FromAddress: from,
+		ToAddress:   validator,
+		Height:      height,
+		Nonce:       nonce,
+		Type:        TxDelegate,
+	}
+}
+
+// IsSplit reports whether the transaction pays its Outputs rather than ToAddress
+func (txn *Transaction) IsSplit() bool {
+	return txn.OutputCount > 0
+}
+
+// TxOutputs returns every recipient, a simple transaction has ToAddress as its single output
+func (txn *Transaction) TxOutputs() []TxOutput {
+	if !txn.IsSplit() {
+		return []TxOutput{{ToAddress: txn.ToAddress, Amount: txn.Amount}}
+	}
+	return txn.Outputs[:min(int(txn.OutputCount), MaxTxOutputs)]
+}
+
+// CheckOutputs checks that a split transaction's outputs are positive, sum to its Amount and
+// leave the unused fields empty. A simple transaction must carry a finite, non-negative amount,
+// zero marks the empty transaction and a delegation
+func (txn *Transaction) CheckOutputs() error {
+	if !txn.IsSplit() {
+		if !(txn.Amount >= 0) || math.IsInf(txn.Amount, 0) {
+			return fmt.Errorf("invalid transaction amount %v", txn.Amount)
+		}
+		if txn.Outputs != ([MaxTxOutputs]TxOutput{}) {
+			return errors.New("simple transaction carries outputs")
+		}
+		return nil
+	}
+
+	if int(txn.OutputCount) > MaxTxOutputs {
+		return fmt.Errorf("split transaction has %d outputs, at most %d allowed", txn.OutputCount, MaxTxOutputs)
+	}
+	if txn.ToAddress != ([32]byte{}) {
+		return errors.New("split transaction sets ToAddress")
+	}
+
+	var total float64
+	for i, output := range txn.Outputs {
+		if i >= int(txn.OutputCount) {
+			if output != (TxOutput{}) {
+				return fmt.Errorf("unused output %d is not empty", i)
+			}
+			continue
+		}
+		if !(output.Amount > 0) || math.IsInf(output.Amount, 1) {
+			return fmt.Errorf("output %d has invalid amount %v", i, output.Amount)
+		}
+		total += output.Amount
+	}
+
+	if total != txn.Amount {
+		return fmt.Errorf("outputs sum to %v, transaction amount is %v", total, txn.Amount)
+	}
+	return nil
+}
+
+// writeOutputs adds a split transaction's outputs to its hash, simple transactions hash as before
+func (txn *Transaction) writeOutputs(buf *bytes.Buffer) {
+	if !txn.IsSplit() {
+		return
+	}
+
+	buf.WriteByte(txn.OutputCount)
+	for _, output := range txn.TxOutputs() {
+		buf.Write(output.ToAddress[:])
+		buf.Write(EncodeUint64(math.Float64bits(output.Amount)))
+	}
+}
+
+// writeFee adds a non-zero fee to the hash, transactions without one hash as before fees existed
+func (txn *Transaction) writeFee(buf *bytes.Buffer) {
+	if txn.Fee == 0 {
+		return
+	}
+	buf.Write(EncodeUint64(math.Float64bits(txn.Fee)))
+}
+
+// CheckFee checks that the fee is a finite non-negative amount and that only a transaction
+// moving funds carries one
+func (txn *Transaction) CheckFee() error {
+	if !(txn.Fee >= 0) || math.IsInf(txn.Fee, 1) {
+		return fmt.Errorf("invalid fee %v", txn.Fee)
+	}
+	if txn.Fee > 0 && txn.Amount == 0 {
+		return errors.New("empty transaction carries a fee")
+	}
+	return nil
+}
+
+// writeType adds a type other than transfer to the hash, transfers hash as before types existed
+func (txn *Transaction) writeType(buf *bytes.Buffer) {
+	if txn.Type == TxTransfer {
+		return
+	}
+	buf.WriteByte(byte(txn.Type))
+}
+
+// CheckType checks that the type is known and that a delegation names a validator and moves
+// no funds
+func (txn *Transaction) CheckType() error {
+	switch txn.Type {
+	case TxTransfer:
+		return nil
+	case TxDelegate:
+		if txn.Amount != 0 || txn.Fee != 0 || txn.IsSplit() || txn.Outputs != ([MaxTxOutputs]TxOutput{}) {
+			return errors.New("delegation moves funds")
+		}
+		if txn.ToAddress == ([32]byte{}) {
+			return errors.New("delegation names no validator")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown transaction type %d", txn.Type)
+}
+
+// EncodeUint64 encodes heights, nonces and amounts wherever they are hashed or signed, in
+// big-endian network order. The difficulty seed uses it too, so every node hashes a height
+// to the same bytes.
+func EncodeUint64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
 // In theory i should add a signature for block content, ignore for prototype
 type Block struct {
 	PreHash        [32]byte // Hash of the previous block head
@@ -26,10 +204,20 @@ type Block struct {
 	EpochBeginHash [32]byte // Hash marking the beginning of the epoch
 	Txn            Transaction
 	Signature      [64]byte  // Signature of difficulty
+	Difficulty     uint64    // VDF iterations the proof claims, recomputable from Signature and stake
 	PublicKey      [64]byte  // Public key associated with the block
 	Proof          [516]byte // Mining proof
 }
 
+// writeDifficulty adds a claimed difficulty to the hash, genesis claims none and hashes as
+// before blocks carried one
+func (b *Block) writeDifficulty(buf *bytes.Buffer) {
+	if b.Difficulty == 0 {
+		return
+	}
+	buf.Write(EncodeUint64(b.Difficulty))
+}
+
 // hash computes and returns the SHA-256 hash of the transaction data
 func (txn *Transaction) hash() [32]byte {
 	var buf bytes.Buffer
@@ -38,15 +226,14 @@ func (txn *Transaction) hash() [32]byte {
 	buf.Write(txn.FromAddress[:])
 	buf.Write(txn.ToAddress[:])
 
-	// Convert float64 amount to bytes
-	amountBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(amountBytes, uint64(txn.Amount))
-	buf.Write(amountBytes)
+	// Amount, height and nonce in the shared encoding
+	buf.Write(EncodeUint64(math.Float64bits(txn.Amount)))
+	buf.Write(EncodeUint64(txn.Height))
+	buf.Write(EncodeUint64(txn.Nonce))
 
-	// Convert uint64 Rand to bytes
-	randBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(randBytes, txn.Height)
-	buf.Write(randBytes)
+	txn.writeOutputs(&buf)
+	txn.writeFee(&buf)
+	txn.writeType(&buf)
 
 	// Calculate the hash of the transaction data
 	return sha256.Sum256(buf.Bytes())
@@ -60,15 +247,14 @@ func (txn *Transaction) Hash() [32]byte {
 	buf.Write(txn.FromAddress[:])
 	buf.Write(txn.ToAddress[:])
 
-	// Convert float64 amount to bytes
-	amountBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(amountBytes, uint64(txn.Amount))
-	buf.Write(amountBytes)
+	// Amount, height and nonce in the shared encoding
+	buf.Write(EncodeUint64(math.Float64bits(txn.Amount)))
+	buf.Write(EncodeUint64(txn.Height))
+	buf.Write(EncodeUint64(txn.Nonce))
 
-	// Convert uint64 Rand to bytes
-	randBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(randBytes, txn.Height)
-	buf.Write(randBytes)
+	txn.writeOutputs(&buf)
+	txn.writeFee(&buf)
+	txn.writeType(&buf)
 
 	buf.Write(txn.Signature[:])
 	buf.Write(txn.PublicKey[:])
@@ -77,6 +263,15 @@ func (txn *Transaction) Hash() [32]byte {
 	return sha256.Sum256(buf.Bytes())
 }
 
+// halfOrder is n/2 for P256. Transaction hashes cover the signature, so a signature with s
+// above it is rejected, otherwise anyone could flip s to n-s and change the hash without the key.
+var halfOrder = new(big.Int).Rsh(elliptic.P256().Params().N, 1)
+
+// IsLowS reports whether s is the canonical low-S form of a P256 signature, at most n/2
+func IsLowS(s *big.Int) bool {
+	return s.Cmp(halfOrder) <= 0
+}
+
 func (txn *Transaction) Sign(prvKey *ecdsa.PrivateKey) {
 	// Calculate the hash of the transaction data
 	txnHash := txn.hash()
@@ -87,6 +282,11 @@ func (txn *Transaction) Sign(prvKey *ecdsa.PrivateKey) {
 		panic("Failed to sign transaction: " + err.Error())
 	}
 
+	// (r, n-s) verifies too, always pick the low-S form so Verify accepts it
+	if !IsLowS(s) {
+		s.Sub(elliptic.P256().Params().N, s)
+	}
+
 	// Convert signature (r, s) to bytes and store in transaction
 	rBytes := r.Bytes()
 	sBytes := s.Bytes()
@@ -103,13 +303,10 @@ func (txn *Transaction) Sign(prvKey *ecdsa.PrivateKey) {
 	// Store public key components
 	pubKey := prvKey.PublicKey
 
-	// Store X coordinate in first 32 bytes
-	xBytes := pubKey.X.Bytes()
-	copy(txn.PublicKey[32-len(xBytes):32], xBytes)
-
-	// Store Y coordinate in last 32 bytes
-	yBytes := pubKey.Y.Bytes()
-	copy(txn.PublicKey[64-len(yBytes):64], yBytes)
+	// Store X in the first 32 bytes and Y in the last, zero-padded so a key signed with
+	// before leaves nothing behind
+	pubKey.X.FillBytes(txn.PublicKey[:32])
+	pubKey.Y.FillBytes(txn.PublicKey[32:])
 }
 
 // VerifySignature verifies if the transaction's signature is valid
@@ -132,6 +329,11 @@ func (txn *Transaction) Verify() bool {
 	r := new(big.Int).SetBytes(txn.Signature[:32])
 	s := new(big.Int).SetBytes(txn.Signature[32:])
 
+	// Only the canonical low-S form is valid, the hash covers the signature
+	if !IsLowS(s) {
+		return false
+	}
+
 	// Verify the signature
 	return ecdsa.Verify(pubKey, txnHash[:], r, s)
 }
@@ -143,10 +345,7 @@ func (b *Block) Hash() [32]byte {
 	// Write all block fields to buffer in sequence
 	buf.Write(b.PreHash[:])
 
-	// Convert uint64 to bytes and write
-	heightBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(heightBytes, b.Height)
-	buf.Write(heightBytes)
+	buf.Write(EncodeUint64(b.Height))
 
 	buf.Write(b.EpochBeginHash[:])
 
@@ -154,12 +353,10 @@ func (b *Block) Hash() [32]byte {
 	txnHash := b.Txn.Hash()
 	buf.Write(txnHash[:])
 
-	// Convert float64 to bytes
-	amountBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(amountBytes, uint64(b.Txn.Amount))
-	buf.Write(amountBytes)
+	buf.Write(EncodeUint64(math.Float64bits(b.Txn.Amount)))
 
 	buf.Write(b.Signature[:])
+	b.writeDifficulty(&buf)
 	buf.Write(b.PublicKey[:])
 	buf.Write(b.Proof[:])
 
@@ -174,10 +371,7 @@ func (b *Block) HashwithoutProof() [32]byte {
 	// Write all block fields to buffer in sequence
 	buf.Write(b.PreHash[:])
 
-	// Convert uint64 to bytes and write
-	heightBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(heightBytes, b.Height)
-	buf.Write(heightBytes)
+	buf.Write(EncodeUint64(b.Height))
 
 	buf.Write(b.EpochBeginHash[:])
 
@@ -185,14 +379,113 @@ func (b *Block) HashwithoutProof() [32]byte {
 	txnHash := b.Txn.Hash()
 	buf.Write(txnHash[:])
 
-	// Convert float64 to bytes
-	amountBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(amountBytes, uint64(b.Txn.Amount))
-	buf.Write(amountBytes)
+	buf.Write(EncodeUint64(math.Float64bits(b.Txn.Amount)))
 
 	buf.Write(b.Signature[:])
+	b.writeDifficulty(&buf)
 	buf.Write(b.PublicKey[:])
 
 	// Calculate SHA-256 hash
 	return sha256.Sum256(buf.Bytes())
 }
+
+// Lengths of the binary encodings, every field is fixed-size so every block and
+// transaction encodes to the same length
+var (
+	TxnBinarySize   = binary.Size(Transaction{})
+	BlockBinarySize = binary.Size(Block{})
+)
+
+// Marshal encodes the transaction field by field in big-endian order, a far more compact
+// wire format than JSON
+func (txn *Transaction) Marshal() []byte {
+	data, err := binary.Append(make([]byte, 0, TxnBinarySize), binary.BigEndian, txn)
+	if err != nil {
+		panic("block: failed to encode transaction: " + err.Error())
+	}
+	return data
+}
+
+// Unmarshal decodes a transaction encoded by Marshal
+func (txn *Transaction) Unmarshal(data []byte) error {
+	if len(data) != TxnBinarySize {
+		return fmt.Errorf("transaction encoding is %d bytes, expected %d", len(data), TxnBinarySize)
+	}
+	_, err := binary.Decode(data, binary.BigEndian, txn)
+	return err
+}
+
+// Marshal encodes the block field by field in big-endian order, a far more compact wire
+// format than JSON
+func (b *Block) Marshal() []byte {
+	data, err := binary.Append(make([]byte, 0, BlockBinarySize), binary.BigEndian, b)
+	if err != nil {
+		panic("block: failed to encode block: " + err.Error())
+	}
+	return data
+}
+
+// Unmarshal decodes a block encoded by Marshal
+func (b *Block) Unmarshal(data []byte) error {
+	if len(data) != BlockBinarySize {
+		return fmt.Errorf("block encoding is %d bytes, expected %d", len(data), BlockBinarySize)
+	}
+	_, err := binary.Decode(data, binary.BigEndian, b)
+	return err
+}
+
+// MaxTxnSize is the longest JSON encoding of a transaction, the encoding every peer message uses
+var MaxTxnSize = encodedSize(worstCaseTxn())
+
+// maxSingleTxnBlockSize is the longest JSON encoding of a block
+var maxSingleTxnBlockSize = encodedSize(&Block{
+	PreHash:        worstCaseHash(),
+	Height:         math.MaxUint64,
+	EpochBeginHash: worstCaseHash(),
+	Txn:            *worstCaseTxn(),
+	Signature:      [64]byte(bytes.Repeat([]byte{0xff}, 64)),
+	Difficulty:     math.MaxUint64,
+	PublicKey:      [64]byte(bytes.Repeat([]byte{0xff}, 64)),
+	Proof:          [516]byte(bytes.Repeat([]byte{0xff}, 516)),
+})
+
+// MaxBlockSize returns the longest JSON encoding of a block carrying up to maxTxns
+// transactions. Blocks carry one transaction today, every further one adds at most
+// MaxTxnSize and a separator.
+func MaxBlockSize(maxTxns int) int {
+	return maxSingleTxnBlockSize + max(maxTxns-1, 0)*(MaxTxnSize+1)
+}
+
+// worstCaseTxn fills every field with the value that takes the most characters to encode
+func worstCaseTxn() *Transaction {
+	// No float64 encodes longer than the negated largest one, e.g. -1.7976931348623157e+308
+	amount := -math.MaxFloat64
+	txn := &Transaction{
+		FromAddress: worstCaseHash(),
+		ToAddress:   worstCaseHash(),
+		Amount:      amount,
+		Height:      math.MaxUint64,
+		Nonce:       math.MaxUint64,
+		Fee:         amount,
+		Type:        math.MaxUint8,
+		OutputCount: math.MaxUint8,
+		Signature:   [64]byte(bytes.Repeat([]byte{0xff}, 64)),
+		PublicKey:   [64]byte(bytes.Repeat([]byte{0xff}, 64)),
+	}
+	for i := range txn.Outputs {
+		txn.Outputs[i] = TxOutput{ToAddress: worstCaseHash(), Amount: amount}
+	}
+	return txn
+}
+
+func worstCaseHash() [32]byte {
+	return [32]byte(bytes.Repeat([]byte{0xff}, 32))
+}
+
+func encodedSize(v any) int {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic("block: failed to encode worst case value: " + err.Error())
+	}
+	return len(data)
+}
@@ -5,6 +5,9 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"encoding/json"
+	"math"
+	"math/big"
 	"reflect"
 	"testing"
 )
@@ -33,6 +36,25 @@ func TestTransactionHash(t *testing.T) {
 	if hash1 == hash3 {
 		t.Errorf("Transaction hash did not change after modifying the transaction")
 	}
+
+	// The nonce is part of the signed content
+	txn.Nonce = 1
+	hash4 := txn.hash()
+	if hash3 == hash4 {
+		t.Errorf("Transaction hash did not change after modifying the nonce")
+	}
+
+	// The whole amount is signed, not just its integer part
+	txn.Amount = 200.5
+	if txn.hash() == hash4 {
+		t.Errorf("Transaction hash did not change with the fractional part of the amount")
+	}
+	b1 := Block{Height: 1, Txn: txn}
+	b2 := Block{Height: 1, Txn: txn}
+	b2.Txn.Amount = 200.25
+	if b1.Hash() == b2.Hash() || b1.HashwithoutProof() == b2.HashwithoutProof() {
+		t.Errorf("Block hash did not change with the fractional part of the amount")
+	}
 }
 
 func TestTransactionSigningAndVerification(t *testing.T) {
@@ -65,6 +87,45 @@ func TestTransactionSigningAndVerification(t *testing.T) {
 	}
 }
 
+// TestTransactionSignLowS checks Sign only produces low-S signatures and Verify rejects the
+// malleated high-S form, which would give the same transaction another hash
+func TestTransactionSignLowS(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate private key: %v", err)
+	}
+	n := elliptic.P256().Params().N
+
+	for i := uint64(0); i < 50; i++ {
+		txn := Transaction{
+			FromAddress: [32]byte{1, 2, 3},
+			ToAddress:   [32]byte{4, 5, 6},
+			Amount:      100.0,
+			Height:      10,
+			Nonce:       i,
+		}
+		txn.Sign(privateKey)
+
+		s := new(big.Int).SetBytes(txn.Signature[32:])
+		if !IsLowS(s) {
+			t.Fatalf("Sign produced high S %v", s)
+		}
+		if !txn.Verify() {
+			t.Fatal("Verify rejected the low-S signature")
+		}
+
+		// The malleated signature (r, n-s) is valid ECDSA but must be rejected
+		malleated := txn
+		new(big.Int).Sub(n, s).FillBytes(malleated.Signature[32:])
+		if malleated.Hash() == txn.Hash() {
+			t.Fatal("Malleated signature should change the transaction hash")
+		}
+		if malleated.Verify() {
+			t.Error("Verify accepted a high-S signature")
+		}
+	}
+}
+
 func TestBlockHash(t *testing.T) {
 	// Generate a private key for the transaction
 	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
@@ -210,3 +271,254 @@ func TestBlockWithDifferentTransactions(t *testing.T) {
 		t.Errorf("Blocks with different transactions should have different hashes")
 	}
 }
+
+func TestSplitTransaction(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate private key: %v", err)
+	}
+
+	outputs := []TxOutput{
+		{ToAddress: [32]byte{4}, Amount: 10},
+		{ToAddress: [32]byte{5}, Amount: 20.5},
+		{ToAddress: [32]byte{6}, Amount: 30},
+	}
+	txn, err := NewSplitTransaction([32]byte{1}, outputs, 10, 1)
+	if err != nil {
+		t.Fatalf("Failed to build split transaction: %v", err)
+	}
+	if txn.Amount != 60.5 {
+		t.Errorf("Split transaction amount should be the output total, got %v", txn.Amount)
+	}
+	if !reflect.DeepEqual(txn.TxOutputs(), outputs) {
+		t.Errorf("TxOutputs returned %v, expected %v", txn.TxOutputs(), outputs)
+	}
+	if err := txn.CheckOutputs(); err != nil {
+		t.Errorf("Valid split transaction failed the output check: %v", err)
+	}
+
+	// Outputs are signed, redirecting one invalidates the signature
+	txn.Sign(privateKey)
+	if !txn.Verify() {
+		t.Errorf("Split transaction signature verification failed")
+	}
+	txn.Outputs[1].ToAddress = [32]byte{7}
+	if txn.Verify() {
+		t.Errorf("Signature should not cover a modified output")
+	}
+
+	// Outputs must add up to the amount charged to the sender
+	txn.Outputs[1].ToAddress = [32]byte{5}
+	txn.Amount = 10
+	if txn.CheckOutputs() == nil {
+		t.Errorf("Outputs that exceed the amount should be rejected")
+	}
+	txn.Amount = 60.5
+	txn.Outputs[3] = TxOutput{ToAddress: [32]byte{8}, Amount: 1}
+	if txn.CheckOutputs() == nil {
+		t.Errorf("Data in unused outputs should be rejected")
+	}
+
+	if _, err := NewSplitTransaction([32]byte{1}, nil, 10, 1); err == nil {
+		t.Errorf("Split transaction without outputs should be rejected")
+	}
+	if _, err := NewSplitTransaction([32]byte{1}, make([]TxOutput, MaxTxOutputs+1), 10, 1); err == nil {
+		t.Errorf("Split transaction with too many outputs should be rejected")
+	}
+}
+
+func TestSimpleTransactionOutputs(t *testing.T) {
+	txn := Transaction{ToAddress: [32]byte{4}, Amount: 100}
+	expected := []TxOutput{{ToAddress: [32]byte{4}, Amount: 100}}
+	if !reflect.DeepEqual(txn.TxOutputs(), expected) {
+		t.Errorf("TxOutputs returned %v, expected %v", txn.TxOutputs(), expected)
+	}
+	if err := txn.CheckOutputs(); err != nil {
+		t.Errorf("Simple transaction failed the output check: %v", err)
+	}
+
+	// Zero is the empty transaction, anything below it or not finite is refused
+	for _, amount := range []float64{-1, math.NaN(), math.Inf(1), math.Inf(-1)} {
+		txn.Amount = amount
+		if txn.CheckOutputs() == nil {
+			t.Errorf("Simple transaction with amount %v should be rejected", amount)
+		}
+	}
+	txn = Transaction{}
+	if err := txn.CheckOutputs(); err != nil {
+		t.Errorf("Empty transaction failed the output check: %v", err)
+	}
+}
+
+func TestMaxBlockSize(t *testing.T) {
+	// Realistic blocks stay well below the bound
+	txn := Transaction{FromAddress: [32]byte{1}, ToAddress: [32]byte{2}, Amount: 12.5, Height: 3, Nonce: 4}
+	b := Block{PreHash: [32]byte{5}, Height: 3, Txn: txn}
+	data, err := json.Marshal(&b)
+	if err != nil {
+		t.Fatalf("Failed to encode block: %v", err)
+	}
+	if len(data) > MaxBlockSize(1) {
+		t.Errorf("Block encodes to %d bytes, above the %d byte limit", len(data), MaxBlockSize(1))
+	}
+
+	// A split transaction with large values still fits
+	outputs := make([]TxOutput, MaxTxOutputs)
+	for i := range outputs {
+		outputs[i] = TxOutput{ToAddress: [32]byte{0xff, byte(i)}, Amount: math.MaxFloat64 / MaxTxOutputs}
+	}
+	split, err := NewSplitTransaction([32]byte{0xff}, outputs, math.MaxUint64, math.MaxUint64)
+	if err != nil {
+		t.Fatalf("Failed to build split transaction: %v", err)
+	}
+	data, err = json.Marshal(split)
+	if err != nil {
+		t.Fatalf("Failed to encode transaction: %v", err)
+	}
+	if len(data) > MaxTxnSize {
+		t.Errorf("Transaction encodes to %d bytes, above the %d byte limit", len(data), MaxTxnSize)
+	}
+
+	if MaxBlockSize(2) != MaxBlockSize(1)+MaxTxnSize+1 {
+		t.Errorf("Every further transaction should add MaxTxnSize and a separator")
+	}
+	if MaxBlockSize(0) != MaxBlockSize(1) {
+		t.Errorf("Every block carries at least one transaction")
+	}
+}
+
+func TestBinaryEncoding(t *testing.T) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	txn, err := NewSplitTransaction([32]byte{1}, []TxOutput{{ToAddress: [32]byte{2}, Amount: 1.5}, {ToAddress: [32]byte{3}, Amount: 2}}, 7, 8)
+	if err != nil {
+		t.Fatalf("Failed to build split transaction: %v", err)
+	}
+	txn.Sign(privKey)
+	b := Block{PreHash: [32]byte{4}, Height: 7, EpochBeginHash: [32]byte{5}, Txn: *txn}
+	b.Signature[0], b.PublicKey[63], b.Proof[515] = 6, 7, 8
+
+	data := b.Marshal()
+	if len(data) != BlockBinarySize {
+		t.Fatalf("Block encodes to %d bytes, expected %d", len(data), BlockBinarySize)
+	}
+	var decoded Block
+	if err := decoded.Unmarshal(data); err != nil {
+		t.Fatalf("Failed to decode block: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, b) || decoded.Hash() != b.Hash() {
+		t.Errorf("Block changed in a round trip")
+	}
+	if !decoded.Txn.Verify() {
+		t.Errorf("Decoded transaction no longer verifies")
+	}
+	if err := decoded.Unmarshal(data[1:]); err == nil {
+		t.Errorf("Expected a truncated block to be rejected")
+	}
+
+	var decodedTxn Transaction
+	if err := decodedTxn.Unmarshal(txn.Marshal()); err != nil {
+		t.Fatalf("Failed to decode transaction: %v", err)
+	}
+	if decodedTxn != *txn {
+		t.Errorf("Transaction changed in a round trip")
+	}
+	if err := decodedTxn.Unmarshal(append(txn.Marshal(), 0)); err == nil {
+		t.Errorf("Expected an overlong transaction to be rejected")
+	}
+
+	// Peers bound what they accept by the JSON encoding, the binary one is always shorter
+	if BlockBinarySize > MaxBlockSize(1) || TxnBinarySize > MaxTxnSize {
+		t.Errorf("Binary encodings of %d and %d bytes exceed the JSON bounds", BlockBinarySize, TxnBinarySize)
+	}
+}
+
+// BenchmarkBlockEncoding compares the size and speed of the JSON and binary encodings of a
+// fully populated block
+func BenchmarkBlockEncoding(b *testing.B) {
+	full := Block{
+		PreHash:   worstCaseHash(),
+		Height:    1 << 40,
+		Txn:       Transaction{FromAddress: worstCaseHash(), ToAddress: worstCaseHash(), Amount: 12.5, Height: 1 << 40, Nonce: 3},
+		Signature: [64]byte(bytes.Repeat([]byte{0xab}, 64)),
+		PublicKey: [64]byte(bytes.Repeat([]byte{0xcd}, 64)),
+		Proof:     [516]byte(bytes.Repeat([]byte{0xef}, 516)),
+	}
+
+	b.Run("json", func(b *testing.B) {
+		var size int
+		for b.Loop() {
+			data, err := json.Marshal(&full)
+			if err != nil {
+				b.Fatal(err)
+			}
+			size = len(data)
+		}
+		b.ReportMetric(float64(size), "bytes/block")
+	})
+	b.Run("binary", func(b *testing.B) {
+		var size int
+		for b.Loop() {
+			size = len(full.Marshal())
+		}
+		b.ReportMetric(float64(size), "bytes/block")
+	})
+}
+
+func TestTransactionFee(t *testing.T) {
+	txn := Transaction{FromAddress: [32]byte{1}, ToAddress: [32]byte{2}, Amount: 5, Height: 3, Nonce: 1}
+	unpaid := txn.Hash()
+
+	// A fee is signed like every other field
+	txn.Fee = 0.5
+	if txn.Hash() == unpaid || txn.hash() == (&Transaction{FromAddress: [32]byte{1}, ToAddress: [32]byte{2}, Amount: 5, Height: 3, Nonce: 1}).hash() {
+		t.Errorf("Fee should change the transaction hash")
+	}
+	if err := txn.CheckFee(); err != nil {
+		t.Errorf("Valid fee rejected: %v", err)
+	}
+
+	for _, fee := range []float64{-1, math.NaN(), math.Inf(1)} {
+		txn.Fee = fee
+		if err := txn.CheckFee(); err == nil {
+			t.Errorf("Expected fee %v to be rejected", fee)
+		}
+	}
+
+	empty := Transaction{Height: 3, Fee: 1}
+	if err := empty.CheckFee(); err == nil {
+		t.Errorf("Expected a fee on an empty transaction to be rejected")
+	}
+}
+
+// TestDelegationType tests that a delegation hashes apart from a transfer and moves no funds
+func TestDelegationType(t *testing.T) {
+	from, validator := [32]byte{1}, [32]byte{2}
+	delegation := NewDelegation(from, validator, 3, 1)
+	transfer := Transaction{FromAddress: from, ToAddress: validator, Height: 3, Nonce: 1}
+	if delegation.Hash() == transfer.Hash() || delegation.hash() == transfer.hash() {
+		t.Errorf("Type should change the transaction hash")
+	}
+	if err := delegation.CheckType(); err != nil {
+		t.Errorf("Valid delegation rejected: %v", err)
+	}
+	if err := transfer.CheckType(); err != nil {
+		t.Errorf("Transfer rejected: %v", err)
+	}
+
+	funded := *delegation
+	funded.Amount = 5
+	if err := funded.CheckType(); err == nil {
+		t.Errorf("Expected a delegation moving funds to be rejected")
+	}
+	if err := NewDelegation(from, [32]byte{}, 3, 1).CheckType(); err == nil {
+		t.Errorf("Expected a delegation without a validator to be rejected")
+	}
+	unknown := transfer
+	unknown.Type = TxDelegate + 1
+	if err := unknown.CheckType(); err == nil {
+		t.Errorf("Expected an unknown type to be rejected")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/nanlour/da/src/consensus"
+	"github.com/nanlour/da/src/db"
+)
+
+// parseHash decodes a hex block hash
+func parseHash(s string) ([32]byte, error) {
+	var hash [32]byte
+	raw, err := hex.DecodeString(s)
+	if err != nil {
+		return hash, fmt.Errorf("invalid block hash %q: %v", s, err)
+	}
+	if len(raw) != len(hash) {
+		return hash, fmt.Errorf("block hash must be %d bytes, got %d", len(hash), len(raw))
+	}
+	copy(hash[:], raw)
+	return hash, nil
+}
+
+// dumpBlock opens the node's database read-only and prints the block with the given hex
+// hash, or the main chain block at height when hash is empty
+func dumpBlock(w io.Writer, config *consensus.Config, hashHex string, height int64) error {
+	if (hashHex == "") == (height < 0) {
+		return errors.New("exactly one of -hash and -height is required")
+	}
+
+	options := config.DBOptions
+	options.ReadOnly = true
+	mainDB, err := db.InitialDB(config.DbPath, &options)
+	if err != nil {
+		return fmt.Errorf("failed to open db: %v", err)
+	}
+	defer mainDB.Close()
+
+	var hash [32]byte
+	if hashHex != "" {
+		hash, err = parseHash(hashHex)
+	} else {
+		hash, err = consensus.StoredBlockAtHeight(mainDB, uint64(height))
+	}
+	if err != nil {
+		return err
+	}
+
+	report, err := consensus.InspectStoredBlock(config, mainDB, hash)
+	if err != nil {
+		return err
+	}
+	printReport(w, report)
+	return nil
+}
+
+func validity(valid bool) string {
+	if valid {
+		return "valid"
+	}
+	return "INVALID"
+}
+
+func printReport(w io.Writer, report *consensus.BlockReport) {
+	b := report.Block
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "hash\t%x\n", report.Hash)
+	fmt.Fprintf(tw, "height\t%d\n", b.Height)
+	fmt.Fprintf(tw, "prev hash\t%x\n", b.PreHash)
+	fmt.Fprintf(tw, "epoch begin hash\t%x\n", b.EpochBeginHash)
+	fmt.Fprintf(tw, "public key\t%x\n", b.PublicKey)
+	fmt.Fprintf(tw, "signature\t%x\n", b.Signature)
+
+	if report.Genesis {
+		fmt.Fprintf(tw, "checks\tgenesis block, not verified\n")
+	} else {
+		fmt.Fprintf(tw, "signature check\t%s\n", validity(report.SignatureValid))
+		fmt.Fprintf(tw, "transaction check\t%s\n", validity(report.TxnValid))
+		if report.ProofChecked {
+			fmt.Fprintf(tw, "vdf proof check\t%s at difficulty %d\n", validity(report.ProofValid), report.Difficulty)
+		} else {
+			fmt.Fprintf(tw, "vdf proof check\tskipped, no stake ledger stored for the parent\n")
+		}
+	}
+
+	txn := b.Txn
+	fmt.Fprintf(tw, "txn hash\t%x\n", txn.Hash())
+	fmt.Fprintf(tw, "txn from\t%x\n", txn.FromAddress)
+	for _, output := range txn.TxOutputs() {
+		fmt.Fprintf(tw, "txn to\t%x  %v\n", output.ToAddress, output.Amount)
+	}
+	fmt.Fprintf(tw, "txn amount\t%v\n", txn.Amount)
+	fmt.Fprintf(tw, "txn height\t%d\n", txn.Height)
+	fmt.Fprintf(tw, "txn nonce\t%d\n", txn.Nonce)
+	fmt.Fprintf(tw, "txn signature\t%x\n", txn.Signature)
+	tw.Flush()
+}
+
+func main() {
+	configPath := flag.String("config", "", "Path to the node's configuration file")
+	hashHex := flag.String("hash", "", "Hex hash of the block to dump")
+	height := flag.Int64("height", -1, "Height of the main chain block to dump, instead of -hash")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -config <file> (-hash <hash> | -height <height>)\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Dumps a block from the database of a stopped node, LevelDB's lock keeps it out while the node runs.")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	config, err := consensus.LoadConfigFromFile(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to get config: %v", err)
+	}
+
+	if err := dumpBlock(os.Stdout, config, *hashHex, *height); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/nanlour/da/src/block"
+	"github.com/nanlour/da/src/consensus"
+	"github.com/nanlour/da/src/db"
+	"github.com/nanlour/da/src/ecdsa_da"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// storeTestBlock writes a signed block without a VDF proof on top of genesis and makes it the tip
+func storeTestBlock(t *testing.T) (*consensus.Config, [32]byte) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	address := ecdsa_da.PublicKeyToAddress(&privateKey.PublicKey)
+
+	config := &consensus.Config{
+		ID:               consensus.Account{PrvKey: *privateKey, PubKey: privateKey.PublicKey, Address: address},
+		MiningDifficulty: 10,
+		DbPath:           filepath.Join(t.TempDir(), "db"),
+		InitStake:        map[[32]byte]float64{address: 100},
+		InitBank:         map[[32]byte]float64{address: 1000},
+	}
+	genesisHash := config.GenesisBlock().Hash()
+
+	b := &block.Block{
+		PreHash:        genesisHash,
+		Height:         1,
+		EpochBeginHash: genesisHash,
+		PublicKey:      ecdsa_da.PublicKeyToBytes(&privateKey.PublicKey),
+		Txn: block.Transaction{
+			FromAddress: address,
+			ToAddress:   [32]byte{0xb0},
+			Amount:      5,
+			Height:      1,
+			Nonce:       1,
+			PublicKey:   ecdsa_da.PublicKeyToBytes(&privateKey.PublicKey),
+		},
+	}
+	b.Txn.Sign(privateKey)
+	seed := ecdsa_da.DifficultySeed(&b.EpochBeginHash, b.Height)
+	signature, err := ecdsa_da.Sign(privateKey, seed[:])
+	require.NoError(t, err)
+	copy(b.Signature[:], signature)
+
+	mainDB, err := db.InitialDB(config.DbPath, nil)
+	require.NoError(t, err)
+	hash := b.Hash()
+	require.NoError(t, mainDB.InsertHashBlock(&hash, b))
+	require.NoError(t, mainDB.InsertTipHash(&hash))
+	require.NoError(t, mainDB.Close())
+	return config, hash
+}
+
+func TestDumpBlock(t *testing.T) {
+	config, hash := storeTestBlock(t)
+
+	var out bytes.Buffer
+	require.NoError(t, dumpBlock(&out, config, fmt.Sprintf("%x", hash), -1))
+	assert.Regexp(t, `(?m)^height\s+1$`, out.String())
+	assert.Regexp(t, fmt.Sprintf(`(?m)^hash\s+%x$`, hash), out.String())
+	assert.Regexp(t, `(?m)^signature check\s+valid$`, out.String())
+	assert.Regexp(t, `(?m)^transaction check\s+valid$`, out.String())
+	assert.Regexp(t, `(?m)^vdf proof check\s+INVALID`, out.String())
+
+	// The same block found by height
+	var byHeight bytes.Buffer
+	require.NoError(t, dumpBlock(&byHeight, config, "", 1))
+	assert.Equal(t, out.String(), byHeight.String())
+
+	assert.Error(t, dumpBlock(&out, config, "", 2))
+	assert.Error(t, dumpBlock(&out, config, fmt.Sprintf("%x", [32]byte{1}), -1))
+	assert.Error(t, dumpBlock(&out, config, "", -1))
+}
+
+func TestParseHash(t *testing.T) {
+	hash, err := parseHash(fmt.Sprintf("%x", [32]byte{0xab}))
+	require.NoError(t, err)
+	assert.Equal(t, [32]byte{0xab}, hash)
+
+	for _, bad := range []string{"", "zz", "abcd"} {
+		_, err := parseHash(bad)
+		assert.Error(t, err, "parseHash(%q)", bad)
+	}
+}
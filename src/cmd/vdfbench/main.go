@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nanlour/da/src/ecdsa_da"
+	"github.com/nanlour/da/src/vdf_go"
+)
+
+// result is the timing of one difficulty, averaged over the runs
+type result struct {
+	Difficulty int
+	Generate   time.Duration
+	Verify     time.Duration
+}
+
+func parseDifficulties(s string) ([]int, error) {
+	var difficulties []int
+	for _, field := range strings.Split(s, ",") {
+		d, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid difficulty %q", field)
+		}
+		difficulties = append(difficulties, d)
+	}
+	return difficulties, nil
+}
+
+// measure times VDF generation and verification at each difficulty
+func measure(difficulties []int, intSizeBits, runs int) ([]result, error) {
+	results := make([]result, 0, len(difficulties))
+	for _, difficulty := range difficulties {
+		r := result{Difficulty: difficulty}
+		for run := range runs {
+			seed := sha256.Sum256([]byte(fmt.Sprintf("vdfbench %d %d", difficulty, run)))
+
+			start := time.Now()
+			y, proof, err := vdf_go.GenerateVDF(seed[:], difficulty, intSizeBits)
+			if err != nil {
+				return nil, fmt.Errorf("difficulty %d: %v", difficulty, err)
+			}
+			r.Generate += time.Since(start)
+
+			start = time.Now()
+			if !vdf_go.VerifyVDF(seed[:], append(y, proof...), difficulty, intSizeBits) {
+				return nil, fmt.Errorf("difficulty %d: proof failed verification", difficulty)
+			}
+			r.Verify += time.Since(start)
+		}
+		r.Generate /= time.Duration(runs)
+		r.Verify /= time.Duration(runs)
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// suggestDifficulty returns the MiningDifficulty giving roughly the target block
+// time. The fastest of all miners wins each block, and their stake-dependent
+// parts combine to a mean of MiningDifficulty iterations, so a block takes about
+// floor + MiningDifficulty iterations. The rate comes from the largest
+// difficulty measured, where fixed per-proof costs matter least.
+func suggestDifficulty(results []result, target time.Duration, floor uint64) uint64 {
+	largest := results[0]
+	for _, r := range results[1:] {
+		if r.Difficulty > largest.Difficulty {
+			largest = r
+		}
+	}
+	perIteration := float64(largest.Generate) / float64(largest.Difficulty)
+	iterations := uint64(float64(target) / perIteration)
+	if iterations <= floor {
+		return 1
+	}
+	return iterations - floor
+}
+
+func printResults(w io.Writer, results []result) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "difficulty\tgenerate\tverify\tper iteration\t")
+	for _, r := range results {
+		perIteration := r.Generate / time.Duration(r.Difficulty)
+		fmt.Fprintf(tw, "%d\t%v\t%v\t%v\t\n", r.Difficulty, r.Generate.Round(time.Millisecond), r.Verify.Round(time.Millisecond), perIteration)
+	}
+	tw.Flush()
+}
+
+func main() {
+	difficultiesFlag := flag.String("difficulties", "1000,2000,5000,10000", "Comma separated VDF iteration counts to measure")
+	intSizeBits := flag.Int("bits", vdf_go.SizeInBits, "Integer size of the class group in bits")
+	runs := flag.Int("runs", 1, "Runs averaged per difficulty")
+	target := flag.Duration("target", 10*time.Second, "Target block time for the suggested MiningDifficulty")
+	floor := flag.Uint64("floor", ecdsa_da.DefaultDifficultyFloor, "difficulty_floor the network uses")
+	flag.Parse()
+
+	difficulties, err := parseDifficulties(*difficultiesFlag)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if *runs < 1 {
+		log.Fatalf("runs must be at least 1")
+	}
+
+	// vdf_go logs the duration of every call, the table already has them
+	log.SetOutput(io.Discard)
+	results, err := measure(difficulties, *intSizeBits, *runs)
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		log.Fatalf("Benchmark failed: %v", err)
+	}
+
+	printResults(os.Stdout, results)
+	fmt.Printf("\nSuggested mining_difficulty for a %v block time: %d\n", *target, suggestDifficulty(results, *target, *floor))
+}
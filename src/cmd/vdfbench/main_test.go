@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDifficulties(t *testing.T) {
+	difficulties, err := parseDifficulties("100, 2000,30000")
+	require.NoError(t, err)
+	assert.Equal(t, []int{100, 2000, 30000}, difficulties)
+
+	for _, bad := range []string{"", "100,x", "0", "-5"} {
+		_, err := parseDifficulties(bad)
+		assert.Error(t, err, "parseDifficulties(%q)", bad)
+	}
+}
+
+func TestSuggestDifficulty(t *testing.T) {
+	results := []result{
+		{Difficulty: 10000, Generate: 10 * time.Second},
+		{Difficulty: 1000, Generate: 2 * time.Second},
+	}
+	// One millisecond per iteration from the largest run, minus the floor
+	assert.Equal(t, uint64(4900), suggestDifficulty(results, 5*time.Second, 100))
+	assert.Equal(t, uint64(1), suggestDifficulty(results, 50*time.Millisecond, 100))
+}
+
+// TestMeasureMonotonic checks generation time grows with difficulty. Verification
+// is not compared, it costs about the same at every difficulty.
+func TestMeasureMonotonic(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs real VDFs")
+	}
+
+	results, err := measure([]int{200, 2000, 8000}, 512, 1)
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	for i := 1; i < len(results); i++ {
+		assert.Greater(t, results[i].Generate, results[i-1].Generate,
+			"difficulty %d should take longer than %d", results[i].Difficulty, results[i-1].Difficulty)
+	}
+}
@@ -3,28 +3,25 @@ package main
 import (
 	"flag"
 	"log"
-	"path/filepath"
 
 	"github.com/nanlour/da/src/web"
 )
 
 func main() {
 	// Parse command line flags
-	rpcAddress := flag.String("rpc", "", "RPC server address")
-	baseDir := flag.String("basedir", "", "HTML template path")
+	rpcAddress := flag.String("rpc", "", "RPC server address, host:port or unix: followed by the socket path")
+	baseDir := flag.String("basedir", "", "Directory holding the templates and static directories, empty uses the copies built into the binary")
+	bindAddr := flag.String("bind", "127.0.0.1", "Web UI bind address, use 0.0.0.0 to listen on all interfaces")
 	webPort := flag.Int("port", 8080, "Web UI server port")
 	flag.Parse()
 
-	templatesPath := filepath.Join(*baseDir, "templates")
-	staticPath := filepath.Join(*baseDir, "static")
-
 	// Create and start the web server
-	server, err := web.NewWebServer(*rpcAddress, *webPort, templatesPath, staticPath)
+	server, err := web.NewWebServer(*rpcAddress, *bindAddr, *webPort, *baseDir)
 	if err != nil {
 		log.Fatalf("Failed to create web server: %v", err)
 	}
 
-	log.Printf("Starting web UI on http://0.0.0.0:%d", *webPort)
+	log.Printf("Starting web UI on %s:%d", *bindAddr, *webPort)
 	log.Printf("Connecting to RPC server at %s", *rpcAddress)
 
 	// Start the server
@@ -2,60 +2,696 @@ package consensus
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/nanlour/da/src/block"
+	"github.com/nanlour/da/src/db"
+	"github.com/nanlour/da/src/rpc"
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
+// TransactionPool holds pending transactions by hash. A transaction is only valid in the
+// block at its own height, several may wait for the same height and the block takes the one
+// paying the highest fee. The others leave the pool once that height is in the chain.
 type TransactionPool struct {
-	txnMap map[uint64]*block.Transaction
-	mu     sync.RWMutex
+	txns    map[[32]byte]*block.Transaction
+	addedAt map[[32]byte]time.Time // When each pooled transaction was added, or restored after a restart
+	mu      sync.RWMutex
+	addedCh chan struct{} // Closed and replaced whenever a transaction is added
+	store   *db.DBManager // Persists the pool across restarts, nil keeps it in memory only
+	clock   Clock         // Nil uses the wall clock
 }
 
-func (tp *TransactionPool) AddTransaction(height uint64, tx *block.Transaction) {
+func (tp *TransactionPool) AddTransaction(tx *block.Transaction) {
 	tp.mu.Lock()
 	defer tp.mu.Unlock()
-	tp.txnMap[height] = tx
+	tp.add(tx)
 }
 
-// Get a transaction from the pool
+// addBounded pools tx while the pool holds fewer than limit transactions. A full pool makes
+// room by evicting its lowest-fee transaction, the newest among equals, but only for one that
+// pays more. So a zero-fee transaction, like the empty one a miner fills a block with, only
+// takes free room and is the first to go.
+func (tp *TransactionPool) addBounded(tx *block.Transaction, limit int) error {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if _, pooled := tp.txns[tx.Hash()]; pooled {
+		return nil
+	}
+	if len(tp.txns) >= limit {
+		lowest, ok := tp.lowestFee()
+		if !ok || !(tx.Fee > tp.txns[lowest].Fee) {
+			return fmt.Errorf("%w: %d transactions pooled, fee %v does not outbid the lowest", rpc.ErrMempoolFull, len(tp.txns), tx.Fee)
+		}
+		log.Printf("Mempool full, evicting transaction %x for one paying %v", lowest, tx.Fee)
+		if err := tp.remove(lowest); err != nil {
+			return err
+		}
+	}
+	tp.add(tx)
+	return nil
+}
+
+// lowestFee returns the hash of the pooled transaction paying the lowest fee, the most
+// recently added among equals. The caller holds tp.mu.
+func (tp *TransactionPool) lowestFee() ([32]byte, bool) {
+	var lowest [32]byte
+	found := false
+	for hash, tx := range tp.txns {
+		if found {
+			current := tp.txns[lowest]
+			if tx.Fee > current.Fee || (tx.Fee == current.Fee && !tp.addedAt[hash].After(tp.addedAt[lowest])) {
+				continue
+			}
+		}
+		lowest, found = hash, true
+	}
+	return lowest, found
+}
+
+// add pools tx, the caller holds tp.mu
+func (tp *TransactionPool) add(tx *block.Transaction) {
+	if tp.txns == nil {
+		tp.txns = make(map[[32]byte]*block.Transaction)
+	}
+	if tp.addedAt == nil {
+		tp.addedAt = make(map[[32]byte]time.Time)
+	}
+	hash := tx.Hash()
+	tp.txns[hash] = tx
+	tp.addedAt[hash] = tp.now()
+	if tp.store != nil {
+		if err := tp.store.InsertPendingTxn(tx); err != nil {
+			log.Printf("Failed to persist pending transaction %x: %v", hash, err)
+		}
+	}
+
+	if tp.addedCh != nil {
+		close(tp.addedCh)
+	}
+	tp.addedCh = make(chan struct{})
+}
+
+// Added returns a channel that is closed the next time a transaction is added
+func (tp *TransactionPool) Added() <-chan struct{} {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if tp.addedCh == nil {
+		tp.addedCh = make(chan struct{})
+	}
+	return tp.addedCh
+}
+
+// removeTransaction drops a transaction from the pool and its persisted copy
+func (tp *TransactionPool) removeTransaction(hash [32]byte) error {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return tp.remove(hash)
+}
+
+// remove drops the transaction with the given hash, the caller holds tp.mu
+func (tp *TransactionPool) remove(hash [32]byte) error {
+	tx, ok := tp.txns[hash]
+	if !ok {
+		return nil
+	}
+	delete(tp.txns, hash)
+	delete(tp.addedAt, hash)
+	if tp.store != nil {
+		return tp.store.DeletePendingTxn(tx)
+	}
+	return nil
+}
+
+// prune drops every transaction for a height at or below tipHeight, the block that could
+// include it is already in the chain
+func (tp *TransactionPool) prune(tipHeight uint64) error {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	for hash, tx := range tp.txns {
+		if tx.Height > tipHeight {
+			continue
+		}
+		if err := tp.remove(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tp *TransactionPool) now() time.Time {
+	if tp.clock == nil {
+		return realClock{}.Now()
+	}
+	return tp.clock.Now()
+}
+
+// Stats summarises the pending transactions: how many there are in total and per sender,
+// the amount they move and how long the oldest has waited
+func (tp *TransactionPool) Stats() rpc.MempoolStats {
+	tp.mu.RLock()
+	defer tp.mu.RUnlock()
+
+	now := tp.now()
+	stats := rpc.MempoolStats{BySender: make(map[[32]byte]int)}
+	for hash, tx := range tp.txns {
+		stats.Pending++
+		stats.BySender[tx.FromAddress]++
+		stats.Outflow += tx.Amount
+		if added, ok := tp.addedAt[hash]; ok {
+			stats.OldestAge = max(stats.OldestAge, now.Sub(added))
+		}
+	}
+	return stats
+}
+
+// GetTransaction returns the transaction the block at height should carry: the pooled one
+// for that height paying the highest fee, the earliest added among equals and then the lowest
+// hash, so every call picks the same one
 func (tp *TransactionPool) GetTransaction(height uint64) (*block.Transaction, bool) {
 	tp.mu.RLock()
 	defer tp.mu.RUnlock()
-	tx, exists := tp.txnMap[height]
-	return tx, exists
+	var best *block.Transaction
+	var bestHash [32]byte
+	for hash, tx := range tp.txns {
+		if tx.Height != height {
+			continue
+		}
+		if best != nil {
+			added, bestAdded := tp.addedAt[hash], tp.addedAt[bestHash]
+			switch {
+			case tx.Fee != best.Fee:
+				if tx.Fee < best.Fee {
+					continue
+				}
+			case !added.Equal(bestAdded):
+				if added.After(bestAdded) {
+					continue
+				}
+			case bytes.Compare(hash[:], bestHash[:]) > 0:
+				continue
+			}
+		}
+		best, bestHash = tx, hash
+	}
+	return best, best != nil
 }
 
-func (bc *BlockChain) DoTxn(tx *block.Transaction) error {
-	if tx.Amount == 0 || bytes.Equal(tx.FromAddress[:], tx.ToAddress[:]) {
-		return nil
+// GetTransactionByHash looks up a pending transaction in the pool by its hash
+func (tp *TransactionPool) GetTransactionByHash(hash [32]byte) (*block.Transaction, bool) {
+	tp.mu.RLock()
+	defer tp.mu.RUnlock()
+	tx, ok := tp.txns[hash]
+	return tx, ok
+}
+
+// PendingNonce returns the highest nonce among pooled transactions from an address
+func (tp *TransactionPool) PendingNonce(address [32]byte) (uint64, bool) {
+	tp.mu.RLock()
+	defer tp.mu.RUnlock()
+	var highest uint64
+	found := false
+	for _, tx := range tp.txns {
+		if tx.FromAddress == address && tx.Nonce >= highest {
+			highest = tx.Nonce
+			found = true
+		}
 	}
+	return highest, found
+}
 
-	bfrom, _ := bc.mainDB.GetAccountBalance(&tx.FromAddress)
-	if bfrom < tx.Amount {
-		return nil
+// loadTxnPool restores the transactions pooled before the node last stopped. Those for a
+// height the stored chain already reached, or already included in a block, are dropped.
+func (bc *BlockChain) loadTxnPool() error {
+	var tipHeight uint64
+	tip, err := bc.GetTipBlock()
+	if err == nil {
+		tipHeight = tip.Height
+	} else if !errors.Is(err, leveldb.ErrNotFound) {
+		return err
+	}
+
+	txns, err := bc.mainDB.GetPendingTxns()
+	if err != nil {
+		return err
+	}
+	for _, tx := range txns {
+		txHash := tx.Hash()
+		if _, err := bc.mainDB.GetTxnHeight(&txHash); tx.Height <= tipHeight || err == nil {
+			if err := bc.mainDB.DeletePendingTxn(tx); err != nil {
+				return err
+			}
+			continue
+		}
+		bc.TxnPool.AddTransaction(tx)
+	}
+	if len(bc.TxnPool.txns) > 0 {
+		log.Printf("Restored %d pending transaction(s)", len(bc.TxnPool.txns))
+	}
+	return nil
+}
+
+// MempoolStats reports aggregate figures about the transaction pool
+func (bc *BlockChain) MempoolStats() rpc.MempoolStats {
+	return bc.TxnPool.Stats()
+}
+
+// NextNonce returns the nonce the next transaction from an address should carry,
+// accounting for transactions still waiting in the pool
+func (bc *BlockChain) NextNonce(address [32]byte) uint64 {
+	nonce, err := bc.mainDB.GetAccountNonceOrZero(&address)
+	if err != nil {
+		log.Printf("Failed to read nonce of %x: %v", address, err)
+	}
+	if pending, ok := bc.TxnPool.PendingNonce(address); ok && pending > nonce {
+		nonce = pending
+	}
+	return nonce + 1
+}
+
+// unindexBlockTxn queues the removal of the block's transaction from the indexes in the batch,
+// for when the block leaves the main chain
+func (bc *BlockChain) unindexBlockTxn(batch *leveldb.Batch, b *block.Block) {
+	txHash := b.Txn.Hash()
+	for _, address := range historyAddresses(&b.Txn) {
+		bc.mainDB.BatchDeleteAccountTxn(batch, &address, b.Height, &txHash)
+	}
+	bc.mainDB.BatchDeleteTxnHeight(batch, &txHash)
+}
+
+// historyAddresses returns the sender and every recipient of a transaction, once each. The
+// empty transaction of a block without one touches no account.
+func historyAddresses(txn *block.Transaction) [][32]byte {
+	var addresses [][32]byte
+	if txn.FromAddress != ([32]byte{}) {
+		addresses = append(addresses, txn.FromAddress)
+	}
+	for _, output := range txn.TxOutputs() {
+		if output.ToAddress != ([32]byte{}) && !slices.Contains(addresses, output.ToAddress) {
+			addresses = append(addresses, output.ToAddress)
+		}
+	}
+	return addresses
+}
+
+// GetAccountHistory returns a page of the transactions on the main chain sent from or paying
+// an address, newest first
+func (bc *BlockChain) GetAccountHistory(address [32]byte, offset, limit int) ([]rpc.AccountTxn, error) {
+	stored, err := bc.mainDB.GetAccountHistory(&address, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]rpc.AccountTxn, len(stored))
+	for i, entry := range stored {
+		history[i] = rpc.AccountTxn(entry)
+	}
+	return history, nil
+}
+
+// GetTransactionStatus reports whether a transaction is included in the main chain, the
+// height of the including block and its depth. A transaction still waiting in the pool
+// is reported as unconfirmed without error, an unknown transaction returns an error.
+func (bc *BlockChain) GetTransactionStatus(txHash [32]byte) (bool, uint64, uint64, error) {
+	if height, err := bc.mainDB.GetTxnHeight(&txHash); err == nil {
+		tip, err := bc.GetTipBlock()
+		if err != nil {
+			return false, 0, 0, err
+		}
+		if tip.Height >= height {
+			return true, height, tip.Height - height + 1, nil
+		}
+	}
+
+	if _, exists := bc.TxnPool.GetTransactionByHash(txHash); exists {
+		return false, 0, 0, nil
+	}
+
+	return false, 0, 0, errors.New("transaction not found")
+}
+
+// accountState is the balances and nonces a transaction is applied to
+type accountState interface {
+	balance(address [32]byte) (float64, error)
+	setBalance(address [32]byte, balance float64) error
+	nonce(address [32]byte) (uint64, error)
+	setNonce(address [32]byte, nonce uint64) error
+}
+
+// applyTxn moves the transaction's funds in state and advances the sender's nonce, it
+// reports whether any funds moved
+func applyTxn(state accountState, tx *block.Transaction) (bool, error) {
+	if err := tx.CheckFee(); err != nil {
+		return false, err
+	}
+	if err := tx.CheckType(); err != nil {
+		return false, err
+	}
+	if tx.Type == block.TxDelegate {
+		// No funds move, the block's stake ledger records the delegation
+		if err := checkNonce(state, tx); err != nil {
+			return false, err
+		}
+		return true, state.setNonce(tx.FromAddress, tx.Nonce)
+	}
+	if err := tx.CheckOutputs(); err != nil {
+		return false, err
+	}
+	if tx.Amount == 0 || (!tx.IsSplit() && bytes.Equal(tx.FromAddress[:], tx.ToAddress[:])) {
+		return false, nil
+	}
+	if err := checkNonce(state, tx); err != nil {
+		return false, err
 	}
-	bto, _ := bc.mainDB.GetAccountBalance(&tx.ToAddress)
 
-	bc.mainDB.InsertAccountBalance(&tx.FromAddress, bfrom-tx.Amount)
-	bc.mainDB.InsertAccountBalance(&tx.ToAddress, bto+tx.Amount)
+	// Amount is the total of every output, so either all of them are paid or none. The fee
+	// is taken with them, the caller credits it to the miner.
+	bfrom, err := state.balance(tx.FromAddress)
+	if err != nil {
+		return false, err
+	}
+	if bfrom < tx.Amount+tx.Fee {
+		return false, nil
+	}
 
+	if err := state.setBalance(tx.FromAddress, bfrom-tx.Amount-tx.Fee); err != nil {
+		return false, err
+	}
+	for _, output := range tx.TxOutputs() {
+		bto, err := state.balance(output.ToAddress)
+		if err != nil {
+			return false, err
+		}
+		if err := state.setBalance(output.ToAddress, bto+output.Amount); err != nil {
+			return false, err
+		}
+	}
+	return true, state.setNonce(tx.FromAddress, tx.Nonce)
+}
+
+// checkNonce is the replay protection, transactions from a sender must be applied in nonce order
+func checkNonce(state accountState, tx *block.Transaction) error {
+	nonce, err := state.nonce(tx.FromAddress)
+	if err != nil {
+		return err
+	}
+	if tx.Nonce != nonce+1 {
+		return fmt.Errorf("invalid nonce %d for sender %x, expected %d", tx.Nonce, tx.FromAddress, nonce+1)
+	}
 	return nil
 }
 
-func (bc *BlockChain) UNDoTxn(tx *block.Transaction) error {
-	if tx.Amount == 0 || bytes.Equal(tx.FromAddress[:], tx.ToAddress[:]) {
-		return nil
+// txnReceipts lists a receipt for every output of the transaction, an empty transaction has none
+func txnReceipts(tx *block.Transaction, success bool) []db.Receipt {
+	if tx.Amount == 0 {
+		return []db.Receipt{}
 	}
 
-	bfrom, _ := bc.mainDB.GetAccountBalance(&tx.FromAddress)
-	if bfrom < tx.Amount {
-		return nil
+	txHash := tx.Hash()
+	outputs := tx.TxOutputs()
+	receipts := make([]db.Receipt, 0, len(outputs))
+	for _, output := range outputs {
+		receipts = append(receipts, db.Receipt{
+			TxHash:  txHash,
+			From:    tx.FromAddress,
+			To:      output.ToAddress,
+			Amount:  output.Amount,
+			Success: success,
+		})
 	}
-	bto, _ := bc.mainDB.GetAccountBalance(&tx.ToAddress)
+	return receipts
+}
 
-	bc.mainDB.InsertAccountBalance(&tx.FromAddress, bfrom+tx.Amount)
-	bc.mainDB.InsertAccountBalance(&tx.ToAddress, bto-tx.Amount)
+// GetBlockReceipts returns the receipts of a block on the main chain, blocks that are not
+// on it have none stored and return an error
+func (bc *BlockChain) GetBlockReceipts(blockHash [32]byte) ([]rpc.Receipt, error) {
+	stored, err := bc.mainDB.GetBlockReceipts(&blockHash)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, errors.New("no receipts for block")
+	}
+	if err != nil {
+		return nil, err
+	}
 
+	receipts := make([]rpc.Receipt, len(stored))
+	for i, r := range stored {
+		receipts[i] = rpc.Receipt(r)
+	}
+	return receipts, nil
+}
+
+// batchState is the state of the database with the writes staged in a batch on top, reads
+// see the staged writes and nothing reaches the database until the batch is written. Besides
+// the accounts it tracks what later blocks staged in the same batch read back: the minted
+// supply and the ledgers and cumulative difficulty of the blocks staged so far.
+type batchState struct {
+	mainDB      *db.DBManager
+	batch       *leveldb.Batch
+	balances    map[[32]byte]float64
+	nonces      map[[32]byte]uint64
+	minted      *float64                      // Staged minted supply, nil while unchanged
+	stakes      map[[32]byte]stakeLedger      // Stake ledgers of the staged blocks by hash
+	delegations map[[32]byte]delegationLedger // Delegations of the staged blocks by hash
+	work        map[[32]byte]uint64           // Cumulative difficulties of the staged blocks by hash
+}
+
+func newBatchState(mainDB *db.DBManager, batch *leveldb.Batch) *batchState {
+	return &batchState{
+		mainDB:      mainDB,
+		batch:       batch,
+		balances:    make(map[[32]byte]float64),
+		nonces:      make(map[[32]byte]uint64),
+		stakes:      make(map[[32]byte]stakeLedger),
+		delegations: make(map[[32]byte]delegationLedger),
+		work:        make(map[[32]byte]uint64),
+	}
+}
+
+func (s *batchState) balance(address [32]byte) (float64, error) {
+	if balance, ok := s.balances[address]; ok {
+		return balance, nil
+	}
+	return s.mainDB.GetAccountBalanceOrZero(&address)
+}
+
+func (s *batchState) setBalance(address [32]byte, balance float64) error {
+	s.balances[address] = balance
+	s.mainDB.BatchInsertAccountBalance(s.batch, &address, balance)
+	return nil
+}
+
+func (s *batchState) nonce(address [32]byte) (uint64, error) {
+	if nonce, ok := s.nonces[address]; ok {
+		return nonce, nil
+	}
+	return s.mainDB.GetAccountNonceOrZero(&address)
+}
+
+func (s *batchState) setNonce(address [32]byte, nonce uint64) error {
+	s.nonces[address] = nonce
+	s.mainDB.BatchInsertAccountNonce(s.batch, &address, nonce)
+	return nil
+}
+
+func (s *batchState) mintedSupply() (float64, error) {
+	if s.minted != nil {
+		return *s.minted, nil
+	}
+	return s.mainDB.GetMintedSupply()
+}
+
+func (s *batchState) addMintedSupply(delta float64) error {
+	minted, err := s.mintedSupply()
+	if err != nil {
+		return err
+	}
+	minted += delta
+	s.minted = &minted
+	s.mainDB.BatchInsertMintedSupply(s.batch, minted)
+	return nil
+}
+
+// stageBlock validates the block against state and queues every write applying it makes in
+// the state's batch, the database is only read
+func (bc *BlockChain) stageBlock(state *batchState, b *block.Block) error {
+	batch := state.batch
+	reward := bc.NodeConfig.BlockReward
+	miner := blockMiner(b)
+
+	addresses := [][32]byte{b.Txn.FromAddress}
+	for _, output := range b.Txn.TxOutputs() {
+		if !slices.Contains(addresses, output.ToAddress) {
+			addresses = append(addresses, output.ToAddress)
+		}
+	}
+	if (reward > 0 || b.Txn.Fee > 0) && !slices.Contains(addresses, miner) {
+		addresses = append(addresses, miner)
+	}
+
+	undo := make([]db.AccountUndo, 0, len(addresses))
+	for _, address := range addresses {
+		balance, err := state.balance(address)
+		if err != nil {
+			return err
+		}
+		nonce, err := state.nonce(address)
+		if err != nil {
+			return err
+		}
+		undo = append(undo, db.AccountUndo{Address: address, Balance: balance, Nonce: nonce})
+	}
+
+	blockHash := b.Hash()
+	stake, err := bc.parentStake(state, b)
+	if err != nil {
+		return err
+	}
+	delegations, staged := state.delegations[b.PreHash]
+	if !staged {
+		if delegations, err = bc.delegationsAt(b.PreHash); err != nil {
+			return err
+		}
+	}
+	nextStake, nextDelegations := stake.next(b, reward, delegations)
+	if err := bc.mainDB.BatchInsertStakeSnapshot(batch, &blockHash, nextStake.entries()); err != nil {
+		return err
+	}
+	if len(nextDelegations) > 0 {
+		if err := bc.mainDB.BatchInsertDelegations(batch, &blockHash, nextDelegations.entries()); err != nil {
+			return err
+		}
+	}
+	state.stakes[blockHash], state.delegations[blockHash] = nextStake, nextDelegations
+	parentWork, known := state.work[b.PreHash]
+	if !known {
+		if parentWork, err = bc.GetCumulativeDifficulty(b.PreHash); err != nil {
+			return fmt.Errorf("parent %x of block at height %d has no cumulative difficulty: %w", b.PreHash, b.Height, err)
+		}
+	}
+	work := parentWork + bc.blockDifficulty(b, stake)
+	bc.mainDB.BatchInsertCumDifficulty(batch, &blockHash, work)
+	state.work[blockHash] = work
+	if err := bc.mainDB.BatchInsertBlockUndo(batch, &blockHash, undo); err != nil {
+		return err
+	}
+	success, err := applyTxn(state, &b.Txn)
+	if err != nil {
+		return err
+	}
+	receipts := txnReceipts(&b.Txn, success)
+	if success && b.Txn.Fee > 0 {
+		if err := creditReward(state, miner, b.Txn.Fee); err != nil {
+			return err
+		}
+		receipts = append(receipts, db.Receipt{TxHash: b.Txn.Hash(), From: b.Txn.FromAddress, To: miner, Amount: b.Txn.Fee, Success: true})
+	}
+
+	if reward > 0 {
+		if err := creditReward(state, miner, reward); err != nil {
+			return err
+		}
+		if err := state.addMintedSupply(reward); err != nil {
+			return err
+		}
+		receipts = append(receipts, db.Receipt{To: miner, Amount: reward, Success: true})
+	}
+
+	if err := bc.mainDB.BatchInsertBlockReceipts(batch, &blockHash, receipts); err != nil {
+		return err
+	}
+	txHash := b.Txn.Hash()
+	bc.mainDB.BatchInsertTxnHeight(batch, &txHash, b.Height)
+	for _, address := range historyAddresses(&b.Txn) {
+		bc.mainDB.BatchInsertAccountTxn(batch, &address, b.Height, &txHash)
+	}
+	// The block settles its height, the transactions pooled for it leave the database with
+	// the block's writes so a crash in between cannot restore them
+	return bc.mainDB.BatchDeletePendingTxns(batch, b.Height)
+}
+
+// parentStake returns the stake ledger the block was mined against, its parent's. A parent
+// that was never applied has no ledger and the block cannot be applied on top of it.
+func (bc *BlockChain) parentStake(state *batchState, b *block.Block) (stakeLedger, error) {
+	if stake, ok := state.stakes[b.PreHash]; ok {
+		return stake, nil
+	}
+	stake, err := bc.stakeAt(b.PreHash)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, fmt.Errorf("parent %x of block at height %d has no stake ledger", b.PreHash, b.Height)
+	}
+	return stake, err
+}
+
+// GetCumulativeDifficulty returns the sum of the block difficulties from genesis up to the
+// block with the given hash, recorded when the block was applied
+func (bc *BlockChain) GetCumulativeDifficulty(hash [32]byte) (uint64, error) {
+	if hash == bc.GenesisBlock().Hash() {
+		return 0, nil
+	}
+	work, err := bc.mainDB.GetCumDifficulty(&hash)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, rpc.ErrBlockNotFound
+	}
+	return work, err
+}
+
+// blockMiner is the address of the account that mined the block
+func blockMiner(b *block.Block) [32]byte {
+	return sha256.Sum256(b.PublicKey[:])
+}
+
+// creditReward credits the miner's account with the block reward or a transaction fee
+func creditReward(state accountState, miner [32]byte, reward float64) error {
+	balance, err := state.balance(miner)
+	if err != nil {
+		return err
+	}
+	return state.setBalance(miner, balance+reward)
+}
+
+// stageRollback queues every write rolling the block back in the state's batch, the block must
+// be the last one applied to state
+func (bc *BlockChain) stageRollback(state *batchState, b *block.Block) error {
+	blockHash := b.Hash()
+	undo, err := bc.mainDB.GetBlockUndo(&blockHash)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return fmt.Errorf("block %x at height %d has no undo record", blockHash, b.Height)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, account := range undo {
+		if err := state.setBalance(account.Address, account.Balance); err != nil {
+			return err
+		}
+		if err := state.setNonce(account.Address, account.Nonce); err != nil {
+			return err
+		}
+	}
+	bc.mainDB.BatchDeleteBlockUndo(state.batch, &blockHash)
+
+	// The reward receipt, the one without a transaction hash, records what was minted
+	receipts, err := bc.mainDB.GetBlockReceipts(&blockHash)
+	if err != nil && !errors.Is(err, leveldb.ErrNotFound) {
+		return err
+	}
+	for _, receipt := range receipts {
+		if receipt.TxHash == ([32]byte{}) {
+			if err := state.addMintedSupply(-receipt.Amount); err != nil {
+				return err
+			}
+		}
+	}
+	bc.mainDB.BatchDeleteBlockReceipts(state.batch, &blockHash)
+	bc.mainDB.BatchDeleteStakeSnapshot(state.batch, &blockHash)
+	bc.mainDB.BatchDeleteDelegations(state.batch, &blockHash)
+	bc.unindexBlockTxn(state.batch, b)
 	return nil
 }
@@ -0,0 +1,95 @@
+package consensus
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/nanlour/da/src/block"
+)
+
+const (
+	fetchedBlockTTL  = 30 * time.Second // How long a fetched block is served without asking again
+	maxFetchedBlocks = 256
+)
+
+type blockFetch struct {
+	done  chan struct{} // Closed once block and err are set
+	block *block.Block
+	err   error
+}
+
+type fetchedBlock struct {
+	block *block.Block
+	at    time.Time
+}
+
+// blockFetcher coalesces concurrent requests for the same block into one network call and
+// keeps the blocks it fetched for a short while, so fork resolutions that share ancestors
+// fetch each of them once
+type blockFetcher struct {
+	mu       sync.Mutex
+	inflight map[[32]byte]*blockFetch
+	recent   map[[32]byte]fetchedBlock
+}
+
+// fetch returns the block with the given hash from the cache, from a request already in
+// flight, or else by calling get
+func (f *blockFetcher) fetch(hash [32]byte, now time.Time, get func() (*block.Block, error)) (*block.Block, error) {
+	f.mu.Lock()
+	if f.inflight == nil {
+		f.inflight = make(map[[32]byte]*blockFetch)
+		f.recent = make(map[[32]byte]fetchedBlock)
+	}
+	if cached, ok := f.recent[hash]; ok && now.Sub(cached.at) < fetchedBlockTTL {
+		f.mu.Unlock()
+		return cached.block, nil
+	}
+	if running, ok := f.inflight[hash]; ok {
+		f.mu.Unlock()
+		<-running.done
+		return running.block, running.err
+	}
+	running := &blockFetch{done: make(chan struct{})}
+	f.inflight[hash] = running
+	f.mu.Unlock()
+
+	running.block, running.err = get()
+	if running.err == nil && running.block == nil {
+		running.err = fmt.Errorf("peer sent no block for %x", hash)
+	} else if running.err == nil && running.block.Hash() != hash {
+		running.block, running.err = nil, fmt.Errorf("peer sent block %x instead of %x", running.block.Hash(), hash)
+	}
+
+	f.mu.Lock()
+	delete(f.inflight, hash)
+	if running.err == nil {
+		f.remember(hash, running.block, now)
+	}
+	f.mu.Unlock()
+	close(running.done)
+	return running.block, running.err
+}
+
+// remember caches a fetched block, dropping expired ones first and skipping it if the cache
+// is still full
+func (f *blockFetcher) remember(hash [32]byte, b *block.Block, now time.Time) {
+	if len(f.recent) >= maxFetchedBlocks {
+		for h, cached := range f.recent {
+			if now.Sub(cached.at) >= fetchedBlockTTL {
+				delete(f.recent, h)
+			}
+		}
+	}
+	if len(f.recent) < maxFetchedBlocks {
+		f.recent[hash] = fetchedBlock{block: b, at: now}
+	}
+}
+
+// fetchBlock gets a block by hash from a peer through the chain's fetcher
+func (bc *BlockChain) fetchBlock(hash [32]byte, peerID peer.ID) (*block.Block, error) {
+	return bc.fetcher.fetch(hash, bc.getClock().Now(), func() (*block.Block, error) {
+		return bc.P2PNode.GetBlockByHash(hash, peerID)
+	})
+}
@@ -2,14 +2,22 @@ package consensus
 
 import (
 	"crypto/ecdsa"
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
 	"sync"
+	"time"
 
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/nanlour/da/src/block"
 	"github.com/nanlour/da/src/db"
 	"github.com/nanlour/da/src/ecdsa_da"
 	"github.com/nanlour/da/src/p2p"
 	"github.com/nanlour/da/src/rpc"
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
 type Account struct {
@@ -19,119 +27,399 @@ type Account struct {
 }
 
 type Chain struct {
-	Hash    [32]byte
-	PrvHash [32]byte
+	Hash          [32]byte
+	PrvHash       [32]byte
+	CumDifficulty uint64 // Sum of block difficulties from genesis up to this block
 }
 
 type Config struct {
 	ID               Account
-	StakeMine        float64
 	MiningDifficulty uint64
+	DifficultyFloor  uint64  // VDF iterations added to every difficulty, zero uses the default
+	DifficultyCap    float64 // Cap multiplier of the stake-dependent difficulty, zero uses the default
+	MaxDifficulty    uint64  // Difficulty every block is clamped to, zero uses DefaultMaxDifficulty
 	DbPath           string
 	RPCPort          int
+	RPCBindAddr      string // Interface the RPC server listens on, empty means rpc.DefaultBindAddr
+	RPCSocket        string // Unix socket the RPC server listens on instead of TCP, when set
 	P2PListenAddr    string
+	P2PListenAddrs   []string // Further addresses to listen on
+	AnnounceAddrs    []string // Addresses advertised to peers instead of the listen addresses
 	BootstrapPeer    []string
 	InitStake        map[[32]byte]float64
-	StakeSum         float64
 	InitBank         map[[32]byte]float64
+	Genesis          GenesisConfig
+	Mining           bool // Whether this node produces blocks or only validates them
+	DBOptions        db.DBOptions
+	FaucetEnabled    bool          // Whether the Faucet RPC hands out coins, meant for testnets
+	FaucetAmount     float64       // Coins sent per faucet request
+	FaucetCooldown   time.Duration // Minimum time between grants to one address, zero uses the default
+	BlockReward      float64       // Coins minted to the miner of every block
+	CompactInterval  time.Duration // How often the database is compacted, zero disables it
+	GossipQueueSize  int           // Gossip messages buffered per topic, zero uses the p2p default
+	GossipWorkers    int           // Handlers draining each topic's queue, zero uses the p2p default
+	MaxBlockTxns     int           // Transactions a block may carry, bounding its size, zero uses the default
+	MDNSEnabled      bool          // Discover peers on the local network over mDNS
+	SyncInterval     time.Duration // How often a peer is asked for its tip, zero uses the default
+	StatusInterval   time.Duration // How often the tip is announced to peers, zero uses p2p.DefaultStatusInterval
+	SyncWindow       uint64        // How far above the tip a gossiped block may be before it is downloaded instead, zero uses the default
+	WireFormat       string        // How blocks and transactions are gossiped, binary or json, empty uses p2p.DefaultWireFormat
+	HealthPort       int           // Port serving /healthz and /readyz on every interface, zero disables them
+	MaxMempoolSize   int           // Transactions the pool holds before fees decide which stay, zero uses the default
+	TxnFee           float64       // Fee paid to the miner with every transaction this node submits
+	MinStake         float64       // Stake a miner needs in its block's parent ledger, any stake at all when zero
+	CheckInvariants  bool          // Check the supply after every block, stopping mining on a violation
+}
+
+// Network is what the chain needs from the P2P layer, Init creates a *p2p.Service unless one is set
+type Network interface {
+	Start() error
+	Stop() error
+	BroadcastBlock(block *block.Block) error
+	BroadcastTransaction(tx *block.Transaction) error
+	GetBlockByHash(hash [32]byte, peerID peer.ID) (*block.Block, error)
+	GetTip(peerID peer.ID) (*block.Block, error)
+	GetBlocksAfter(hash [32]byte, count int, peerID peer.ID) ([]*block.Block, error)
+	PeerHandshake(peerID peer.ID) (p2p.HandshakeMessage, bool)
+	PeerStatus(peerID peer.ID) (p2p.StatusMessage, bool)
+	Peers() []peer.ID
 }
 
 type BlockChain struct {
-	RPCserver  *rpc.RPCServer
-	P2PNode    *p2p.Service
-	NodeConfig *Config
-	MiningChan chan *block.Block  // Channel for newly mined blocks
-	P2PChan    chan *p2p.P2PBlock // Channel for blocks received via P2P
-	TxnPool    TransactionPool
-	mainDB     *db.DBManager
-	MyChain    []*Chain
-}
-
-var (
-	genesisTx = block.Transaction{
-		FromAddress: [32]byte{}, // No sender for genesis block
-		ToAddress:   [32]byte{}, // No receiver for genesis block
-		Amount:      0,          // No amount transferred
-	}
-
-	genesisBlock = block.Block{
-		PreHash:        [32]byte{},                                            // No previous block
-		Height:         0,                                                     // Height is 0
-		EpochBeginHash: [32]byte{'H', 'E', 'L', 'L', 'O', ',', ' ', 'D', 'A'}, // Initial epoch hash
-		Txn:            genesisTx,
-		Signature:      [64]byte{'M', 'A', 'D', 'E', ' ', 'B', 'Y', ' ', 'R', 'O', 'N', 'G', 'W', 'A', 'N', 'G'},
-		PublicKey:      [64]byte{},
-		Proof:          [516]byte{'T', 'h', 'e', 'r', 'e', ' ', 'i', 's', ' ', 'a', 'l', 'w', 'a', 'y', 's', ' ', 's', 'o', 'm', 'e', 't', 'h', 'i', 'n', 'g', ' ', 't', 'h', 'a', 't', ' ', 'y', 'o', 'u', ' ', 'c', 'a', 'n', 'n', 'o', 't', ' ', 'p', 'r', 'o', 'o', 'f'},
-	}
-)
+	RPCserver    *rpc.RPCServer
+	P2PNode      Network
+	NodeConfig   *Config
+	MiningChan   chan *block.Block  // Channel for newly mined blocks
+	P2PChan      chan *p2p.P2PBlock // Channel for blocks received via P2P
+	TxnPool      TransactionPool
+	mainDB       *db.DBManager
+	MyChain      []*Chain
+	chainMu      sync.RWMutex // Held by the tip manager while it changes MyChain, and by readers on other goroutines
+	tipMu        sync.Mutex
+	tipCh        chan struct{} // Closed and replaced whenever the tip changes
+	tipBlock     *block.Block  // Cached tip, cleared whenever the tip changes
+	tipGen       uint64        // Bumped on every tip change, so a read racing one is not cached
+	genesis      *block.Block
+	miningMu     sync.Mutex
+	miningQuit   chan struct{} // Non-nil while the miner is running, closed to stop it
+	readyOnce    sync.Once
+	ready        chan struct{}  // Closed once Init has brought every component up
+	quit         chan struct{}  // Closed by Stop
+	stopped      chan struct{}  // Closed once Stop has shut everything down
+	workers      sync.WaitGroup // Mining and tip manager loops, Stop waits for them before closing the DB
+	clock        Clock
+	orphans      orphanPool         // Blocks waiting for a parent we have not seen yet
+	syncPeers    syncPeers          // Tip request history used to pick the next peer to sync from
+	faucet       faucet             // Last grant per address, enforcing the faucet cooldown
+	sync         syncState          // Progress of the running initial block download
+	scheduler    miningScheduler    // When the mining loop starts its next VDF, used only by the loop
+	syncRequests chan peer.ID       // Peers announcing a higher tip, drained by the tip manager
+	events       eventBus           // Block, reorg and transaction events for subscribers
+	mined        miningStats        // Difficulty and blocks mined since the node started
+	fetcher      blockFetcher       // Coalesces and briefly caches fork ancestor requests
+	imports      chan importRequest // Blocks from a chain file, processed by the tip manager
+	health       *http.Server       // Liveness and readiness probes, nil unless HealthPort is set
+}
 
 func (bc *BlockChain) SetConfig(config *Config) {
 	bc.NodeConfig = new(Config)
 	*bc.NodeConfig = *config
+	bc.genesis = nil
 }
 
-func (bc *BlockChain) Init() error {
-	dbmanager, err := db.InitialDB(bc.NodeConfig.DbPath)
+// Init loads the chain, starts RPC, P2P and the background loops, and returns once the node is
+// ready. A failed Init undoes every step it started, so it can be called again. A node that
+// came up once is not initialized again.
+func (bc *BlockChain) Init() (err error) {
+	select {
+	case <-bc.readyChan():
+		return errors.New("node is already initialized")
+	default:
+	}
+	bc.quit = make(chan struct{})
+	bc.stopped = make(chan struct{})
+
+	// Steps that started are undone newest first when a later one fails
+	var undo []func()
+	defer func() {
+		if err != nil {
+			for i := len(undo) - 1; i >= 0; i-- {
+				undo[i]()
+			}
+		}
+	}()
+
+	if bc.NodeConfig.HealthPort > 0 {
+		if err := bc.startHealthServer(); err != nil {
+			return err
+		}
+		undo = append(undo, func() {
+			bc.health.Close()
+			bc.health = nil
+		})
+	}
+
+	dbmanager, err := db.InitialDB(bc.NodeConfig.DbPath, &bc.NodeConfig.DBOptions)
 	if err != nil {
 		return err
 	}
 	bc.mainDB = dbmanager
+	undo = append(undo, func() { bc.mainDB.Close() })
+	if err := bc.checkGenesis(); err != nil {
+		return err
+	}
 
-	bc.MyChain = []*Chain{
-		{
-			Hash: genesisBlock.Hash(),
-		},
+	if err := bc.loadChain(); err != nil {
+		return err
 	}
 
-	bc.TxnPool.txnMap = make(map[uint64]*block.Transaction)
+	// Restore the pool, its stale entries are judged against the stored chain
+	bc.TxnPool.txns = make(map[[32]byte]*block.Transaction)
+	bc.TxnPool.addedAt = make(map[[32]byte]time.Time)
+	bc.TxnPool.store = bc.mainDB
+	bc.TxnPool.clock = bc.getClock()
+	if err := bc.loadTxnPool(); err != nil {
+		return err
+	}
 
 	bc.P2PChan = make(chan *p2p.P2PBlock, 100)
 	bc.MiningChan = make(chan *block.Block, 10)
+	bc.syncRequests = make(chan peer.ID, 1)
+	bc.imports = make(chan importRequest)
+
+	bc.notifyTipChanged()
 
-	// initila db
-	for address, balance := range bc.NodeConfig.InitBank {
-		bc.mainDB.InsertAccountBalance(&address, balance)
+	bc.RPCserver = rpc.NewRPCServerOn(bc.NodeConfig.rpcListen())
+	if err := bc.RPCserver.Start(bc); err != nil {
+		return err
+	}
+	undo = append(undo, func() { bc.RPCserver.Stop() })
+
+	if bc.P2PNode == nil {
+		node, err := p2p.NewService(bc.NodeConfig.listenAddrs(), bc.NodeConfig.AnnounceAddrs, bc)
+		if err != nil {
+			return err
+		}
+		node.SetNetworkID(bc.NodeConfig.NetworkID())
+		node.SetGossipQueue(bc.NodeConfig.gossipQueue())
+		node.SetMaxBlockSize(bc.NodeConfig.maxBlockSize())
+		node.SetMDNS(bc.NodeConfig.MDNSEnabled)
+		if bc.NodeConfig.StatusInterval > 0 {
+			node.SetStatusInterval(bc.NodeConfig.StatusInterval)
+		}
+		if bc.NodeConfig.WireFormat != "" {
+			node.SetWireFormat(p2p.WireFormat(bc.NodeConfig.WireFormat))
+		}
+
+		for _, addr := range bc.NodeConfig.BootstrapPeer {
+			if err := node.AddBootstrapPeer(addr); err != nil {
+				log.Printf("Ignoring invalid bootstrap peer %s: %v", addr, err)
+			}
+		}
+		bc.P2PNode = node
+		// The service holds its listen addresses from creation, a retry creates a new one
+		undo = append(undo, func() {
+			node.Stop()
+			bc.P2PNode = nil
+		})
+	} else {
+		undo = append(undo, func() { bc.P2PNode.Stop() })
+	}
+	if err := bc.P2PNode.Start(); err != nil {
+		return err
 	}
 
-	gBHash := genesisBlock.Hash()
-	bc.mainDB.InsertTipHash(&gBHash)
-	bc.mainDB.InsertHashBlock(&gBHash, &genesisBlock)
+	// Start mine, validating-only nodes skip this
+	if bc.NodeConfig.Mining {
+		bc.StartMining()
+	} else {
+		log.Println("Mining disabled, running as a validating node")
+	}
 
-	bc.RPCserver = rpc.NewRPCServer(bc.NodeConfig.RPCPort)
-	bc.RPCserver.Start(bc)
+	bc.workers.Add(1)
+	go func() {
+		defer bc.workers.Done()
+		bc.TipManager()
+	}()
 
-	bc.P2PNode, err = p2p.NewService(bc.NodeConfig.P2PListenAddr, bc)
-	if err != nil {
-		return err
+	if bc.NodeConfig.CompactInterval > 0 {
+		bc.workers.Add(1)
+		go func() {
+			defer bc.workers.Done()
+			bc.compactLoop(bc.NodeConfig.CompactInterval)
+		}()
 	}
 
-	for _, addr := range bc.NodeConfig.BootstrapPeer {
-		bc.P2PNode.AddBootstrapPeer(addr)
+	close(bc.readyChan())
+	return nil
+}
+
+// loadChain rebuilds MyChain by walking back from the stored tip to genesis, so a restarted
+// node resumes with the balances, nonces and supply its database holds for that tip. A new
+// database is seeded with the genesis allocation and block.
+func (bc *BlockChain) loadChain() error {
+	genesisHash := bc.GenesisBlock().Hash()
+
+	tipHash, err := bc.mainDB.GetTipHash()
+	if errors.Is(err, leveldb.ErrNotFound) {
+		var supply float64
+		for address, balance := range bc.NodeConfig.GenesisAlloc() {
+			if err := bc.mainDB.InsertAccountBalance(&address, balance); err != nil {
+				return err
+			}
+			supply += balance
+		}
+		if err := bc.mainDB.InsertGenesisSupply(supply); err != nil {
+			return err
+		}
+		if err := bc.mainDB.InsertHashBlock(&genesisHash, bc.GenesisBlock()); err != nil {
+			return err
+		}
+		if err := bc.mainDB.InsertTipHash(&genesisHash); err != nil {
+			return err
+		}
+		tipHash = genesisHash[:]
+	} else if err != nil {
+		return fmt.Errorf("failed to read tip: %w", err)
 	}
-	bc.P2PNode.Start()
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+	// Collect the chain from the tip back
+	var chain []*Chain
+	var child uint64 // Height of the block collected last
+	var hash [32]byte
+	copy(hash[:], tipHash)
+	for hash != genesisHash {
+		b, err := bc.mainDB.GetHashBlock(hash[:])
+		if err != nil {
+			return fmt.Errorf("stored chain is broken, block %x is missing: %w", hash, err)
+		}
+		if len(chain) > 0 && b.Height+1 != child {
+			return fmt.Errorf("stored chain is broken, block %x at height %d is followed by height %d", hash, b.Height, child)
+		}
+		if b.Height == 0 {
+			return fmt.Errorf("stored chain starts at %x, not at this network's genesis %x", hash, genesisHash)
+		}
+		chain = append(chain, &Chain{Hash: hash, PrvHash: b.PreHash})
+		child = b.Height
+		hash = b.PreHash
+	}
+	if len(chain) > 0 && child != 1 {
+		return fmt.Errorf("stored chain is broken, genesis is followed by height %d", child)
+	}
+	chain = append(chain, &Chain{Hash: genesisHash})
+	slices.Reverse(chain)
+
+	for i := 1; i < len(chain); i++ {
+		work, err := bc.GetCumulativeDifficulty(chain[i].Hash)
+		if errors.Is(err, rpc.ErrBlockNotFound) {
+			return fmt.Errorf("stored block %x at height %d has no cumulative difficulty, database is corrupt", chain[i].Hash, i)
+		} else if err != nil {
+			return err
+		}
+		chain[i].CumDifficulty = work
+	}
 
-	// Start mine
-	go func() {
-		defer wg.Done()
-		bc.mine()
-	}()
+	bc.chainMu.Lock()
+	bc.MyChain = chain
+	bc.chainMu.Unlock()
+	if len(chain) > 1 {
+		log.Printf("Resuming the stored chain at height %d", len(chain)-1)
+	}
+	return nil
+}
 
-	go func() {
-		defer wg.Done()
-		bc.TipManager()
-	}()
+// readyChan lazily creates the readiness channel so Ready can be called before Init
+func (bc *BlockChain) readyChan() chan struct{} {
+	bc.readyOnce.Do(func() {
+		bc.ready = make(chan struct{})
+	})
+	return bc.ready
+}
+
+// Ready returns a channel that is closed once Init has finished bringing the node up
+func (bc *BlockChain) Ready() <-chan struct{} {
+	return bc.readyChan()
+}
 
-	wg.Wait()
+// Run initializes the node and blocks until Stop has finished shutting it down
+func (bc *BlockChain) Run() error {
+	if err := bc.Init(); err != nil {
+		return err
+	}
 
+	<-bc.stopped
 	return nil
 }
 
+// StartMining launches the mining loop if it is not already running
+func (bc *BlockChain) StartMining() {
+	bc.miningMu.Lock()
+	defer bc.miningMu.Unlock()
+	if bc.miningQuit != nil {
+		return
+	}
+
+	bc.miningQuit = make(chan struct{})
+	bc.workers.Add(1)
+	go func(quit <-chan struct{}) {
+		defer bc.workers.Done()
+		bc.mine(quit)
+	}(bc.miningQuit)
+}
+
+// StopMining stops the mining loop, cancelling any block in progress
+func (bc *BlockChain) StopMining() {
+	bc.miningMu.Lock()
+	defer bc.miningMu.Unlock()
+	if bc.miningQuit == nil {
+		return
+	}
+
+	close(bc.miningQuit)
+	bc.miningQuit = nil
+}
+
+// abandonMining marks the mining loop listening on quit as stopped, for a loop that gives up
+// on its own. A loop already stopped, or replaced by a newer one, is left alone.
+func (bc *BlockChain) abandonMining(quit <-chan struct{}) {
+	bc.miningMu.Lock()
+	defer bc.miningMu.Unlock()
+	if bc.miningQuit != quit {
+		return
+	}
+
+	close(bc.miningQuit)
+	bc.miningQuit = nil
+}
+
+// IsMining reports whether the mining loop is running
+func (bc *BlockChain) IsMining() bool {
+	bc.miningMu.Lock()
+	defer bc.miningMu.Unlock()
+	return bc.miningQuit != nil
+}
+
+// Stop shuts the node down, the background loops exit before anything they use is closed
 func (bc *BlockChain) Stop() error {
 	var lastErr error
 
+	bc.StopMining()
+
+	if bc.quit != nil {
+		select {
+		case <-bc.quit:
+		default:
+			close(bc.quit)
+		}
+	}
+	bc.workers.Wait()
+
+	if bc.health != nil {
+		if err := bc.health.Close(); err != nil {
+			lastErr = err
+		}
+	}
+
 	// Stop RPC server
 	if err := bc.RPCserver.Stop(); err != nil {
 		lastErr = err
@@ -147,9 +435,38 @@ func (bc *BlockChain) Stop() error {
 		lastErr = err
 	}
 
+	if bc.stopped != nil {
+		select {
+		case <-bc.stopped:
+		default:
+			close(bc.stopped)
+		}
+	}
 	return lastErr
 }
 
+// TipChanged returns a channel that is closed the next time the tip changes
+func (bc *BlockChain) TipChanged() <-chan struct{} {
+	bc.tipMu.Lock()
+	defer bc.tipMu.Unlock()
+	if bc.tipCh == nil {
+		bc.tipCh = make(chan struct{})
+	}
+	return bc.tipCh
+}
+
+// notifyTipChanged wakes up everyone waiting on the current tip
+func (bc *BlockChain) notifyTipChanged() {
+	bc.tipMu.Lock()
+	defer bc.tipMu.Unlock()
+	if bc.tipCh != nil {
+		close(bc.tipCh)
+	}
+	bc.tipCh = make(chan struct{})
+	bc.tipBlock = nil
+	bc.tipGen++
+}
+
 func (bc *BlockChain) AddBlock(block *p2p.P2PBlock) error {
 	select {
 	case bc.P2PChan <- block:
@@ -161,17 +478,127 @@ func (bc *BlockChain) AddBlock(block *p2p.P2PBlock) error {
 	}
 }
 
+// maxTxnLookahead is how many blocks above the tip a transaction from a peer may be signed
+// for, enough for a peer a few blocks ahead of us while keeping heights no block will reach
+// for a long time out of the pool
+const maxTxnLookahead = 3
+
+// AddTxn pools a transaction received from a peer and relays it to our peers. A transaction
+// already pending or already in the main chain returns p2p.ErrKnownTxn and is neither pooled
+// nor relayed again, so one echoed back by peers stops here.
 func (bc *BlockChain) AddTxn(txn *block.Transaction) error {
-	bc.TxnPool.AddTransaction(txn.Height, txn)
+	txHash := txn.Hash()
+	if _, pending := bc.TxnPool.GetTransactionByHash(txHash); pending {
+		return p2p.ErrKnownTxn
+	}
+	if _, err := bc.mainDB.GetTxnHeight(&txHash); err == nil {
+		return p2p.ErrKnownTxn
+	}
+
+	if err := checkPoolTxn(txn); err != nil {
+		return err
+	}
+	if err := bc.checkPeerTxn(txn); err != nil {
+		return err
+	}
+	if err := bc.TxnPool.addBounded(txn, bc.NodeConfig.maxMempoolSize()); err != nil {
+		return err
+	}
+	return bc.P2PNode.BroadcastTransaction(txn)
+}
+
+// checkPoolTxn rejects transactions no block may carry, and transfers that move nothing. The
+// node's own transactions and those received from peers both pass it before they are pooled.
+func checkPoolTxn(txn *block.Transaction) error {
+	if err := txn.CheckFee(); err != nil {
+		return err
+	}
+	if err := txn.CheckType(); err != nil {
+		return err
+	}
+	if txn.Type == block.TxTransfer && !(txn.Amount > 0) {
+		return fmt.Errorf("invalid amount %v, must be positive", txn.Amount)
+	}
+	return txn.CheckOutputs()
+}
+
+// checkPeerTxn holds a transaction from a peer to what the node's own transactions get by
+// construction: a valid signature by the sender's key, a height the next few blocks can carry
+// and a balance covering the amount and fee. Its fee decides what a full pool evicts, so an
+// unchecked one would let any peer push out every legitimate transaction.
+func (bc *BlockChain) checkPeerTxn(txn *block.Transaction) error {
+	if sha256.Sum256(txn.PublicKey[:]) != txn.FromAddress || !txn.Verify() {
+		return errors.New("transaction is not signed by its sender")
+	}
+
+	tip, err := bc.GetTipBlock()
+	if err != nil {
+		return err
+	}
+	if txn.Height <= tip.Height || txn.Height > tip.Height+maxTxnLookahead {
+		return fmt.Errorf("transaction for height %d is outside heights %d to %d", txn.Height, tip.Height+1, tip.Height+maxTxnLookahead)
+	}
+
+	balance, err := bc.mainDB.GetAccountBalanceOrZero(&txn.FromAddress)
+	if err != nil {
+		return err
+	}
+	if balance < txn.Amount+txn.Fee {
+		return fmt.Errorf("%w: balance %v, amount %v", rpc.ErrInsufficientFunds, balance, txn.Amount+txn.Fee)
+	}
 	return nil
 }
 
 func (bc *BlockChain) GetBlockByHash(hash []byte) (*block.Block, error) {
 	// Retrieve block from database using hash
-	return bc.mainDB.GetHashBlock(hash)
+	b, err := bc.mainDB.GetHashBlock(hash)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, rpc.ErrBlockNotFound
+	}
+	return b, err
+}
+
+// GetMainChain returns the main chain blocks from height from up to height to, or up to the tip
+// when to is above it. Blocks are looked up by height in MyChain, so no fork's block is returned
+// even where it is stored.
+func (bc *BlockChain) GetMainChain(from, to uint64) ([]block.Block, error) {
+	if from > to {
+		return nil, fmt.Errorf("range from height %d to %d is empty", from, to)
+	}
+
+	bc.chainMu.RLock()
+	tipHeight := uint64(len(bc.MyChain)) - 1
+	if from > tipHeight {
+		bc.chainMu.RUnlock()
+		return nil, fmt.Errorf("%w: height %d is above the tip at height %d", rpc.ErrBlockNotFound, from, tipHeight)
+	}
+	hashes := make([][32]byte, 0, min(to, tipHeight)-from+1)
+	for _, link := range bc.MyChain[from : min(to, tipHeight)+1] {
+		hashes = append(hashes, link.Hash)
+	}
+	bc.chainMu.RUnlock()
+
+	blocks := make([]block.Block, len(hashes))
+	for i, hash := range hashes {
+		b, err := bc.mainDB.GetHashBlock(hash[:])
+		if err != nil {
+			return nil, fmt.Errorf("main chain block %x at height %d: %w", hash, from+uint64(i), err)
+		}
+		blocks[i] = *b
+	}
+	return blocks, nil
 }
 
+// GetTipBlock returns a copy of the tip block, read from the database only after the tip changed
 func (bc *BlockChain) GetTipBlock() (*block.Block, error) {
+	bc.tipMu.Lock()
+	cached, gen := bc.tipBlock, bc.tipGen
+	bc.tipMu.Unlock()
+	if cached != nil {
+		tip := *cached
+		return &tip, nil
+	}
+
 	// First get the hash of the tip block
 	tipHash, err := bc.mainDB.GetTipHash()
 	if err != nil {
@@ -179,7 +606,18 @@ func (bc *BlockChain) GetTipBlock() (*block.Block, error) {
 	}
 
 	// Then retrieve the block using the tip hash
-	return bc.mainDB.GetHashBlock(tipHash)
+	tip, err := bc.mainDB.GetHashBlock(tipHash)
+	if err != nil {
+		return nil, err
+	}
+
+	bc.tipMu.Lock()
+	if bc.tipGen == gen {
+		cached := *tip
+		bc.tipBlock = &cached
+	}
+	bc.tipMu.Unlock()
+	return tip, nil
 }
 
 func (bc *BlockChain) GetAddress() ([32]byte, error) {
@@ -187,21 +625,125 @@ func (bc *BlockChain) GetAddress() ([32]byte, error) {
 }
 
 func (bc *BlockChain) SendTxn(dest [32]byte, amount float64) error {
-	tip, _ := bc.GetTipBlock()
+	_, err := bc.SubmitTxn(dest, amount)
+	return err
+}
+
+// SubmitTxn signs and broadcasts a transaction, returning its hash so callers can track confirmation
+func (bc *BlockChain) SubmitTxn(dest [32]byte, amount float64) ([32]byte, error) {
+	if err := bc.checkSpend([]block.TxOutput{{ToAddress: dest, Amount: amount}}); err != nil {
+		return [32]byte{}, err
+	}
+
+	tip, err := bc.GetTipBlock()
+	if err != nil {
+		return [32]byte{}, err
+	}
 	txn := &block.Transaction{
 		FromAddress: bc.NodeConfig.ID.Address,
 		ToAddress:   dest,
 		Amount:      amount,
-		Height:      tip.Height + 2,
+		Height:      tip.Height + 1, // The next block, the only one this transaction is valid in
+		Nonce:       bc.NextNonce(bc.NodeConfig.ID.Address),
 		PublicKey:   ecdsa_da.PublicKeyToBytes(&bc.NodeConfig.ID.PubKey),
 	}
 
+	return bc.signAndSubmit(txn)
+}
+
+// SubmitSplitTxn pays every output from the node's account in a single transaction
+func (bc *BlockChain) SubmitSplitTxn(outputs []block.TxOutput) ([32]byte, error) {
+	if err := bc.checkSpend(outputs); err != nil {
+		return [32]byte{}, err
+	}
+
+	tip, err := bc.GetTipBlock()
+	if err != nil {
+		return [32]byte{}, err
+	}
+	txn, err := block.NewSplitTransaction(bc.NodeConfig.ID.Address, outputs, tip.Height+1, bc.NextNonce(bc.NodeConfig.ID.Address))
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	return bc.signAndSubmit(txn)
+}
+
+// SubmitDelegation delegates the node's stake to validator from the next block on, naming the
+// node's own address takes its stake back. A delegation moves no funds and pays no fee.
+func (bc *BlockChain) SubmitDelegation(validator [32]byte) ([32]byte, error) {
+	tip, err := bc.GetTipBlock()
+	if err != nil {
+		return [32]byte{}, err
+	}
+	txn := block.NewDelegation(bc.NodeConfig.ID.Address, validator, tip.Height+1, bc.NextNonce(bc.NodeConfig.ID.Address))
+	txn.PublicKey = ecdsa_da.PublicKeyToBytes(&bc.NodeConfig.ID.PubKey)
+	if err := txn.CheckType(); err != nil {
+		return [32]byte{}, err
+	}
+
+	return bc.signAndSubmit(txn)
+}
+
+// checkSpend rejects payments to the node itself or beyond its balance, so they are never
+// broadcast. The amounts are checked with every pooled transaction by checkPoolTxn.
+func (bc *BlockChain) checkSpend(outputs []block.TxOutput) error {
+	from := bc.NodeConfig.ID.Address
+
+	var total float64
+	for _, output := range outputs {
+		if output.ToAddress == from {
+			return errors.New("cannot send to own address")
+		}
+		total += output.Amount
+	}
+
+	total += bc.NodeConfig.TxnFee
+
+	balance, err := bc.mainDB.GetAccountBalanceOrZero(&from)
+	if err != nil {
+		return err
+	}
+	if balance < total {
+		return fmt.Errorf("%w: balance %v, amount %v", rpc.ErrInsufficientFunds, balance, total)
+	}
+	return nil
+}
+
+// signAndSubmit signs a transaction from the node's account, pools it for the next block
+// and broadcasts it
+func (bc *BlockChain) signAndSubmit(txn *block.Transaction) ([32]byte, error) {
+	if txn.Type == block.TxTransfer {
+		txn.Fee = bc.NodeConfig.TxnFee
+	}
+	if err := checkPoolTxn(txn); err != nil {
+		return [32]byte{}, err
+	}
 	txn.Sign(&bc.NodeConfig.ID.PrvKey)
 
-	bc.TxnPool.AddTransaction(txn.Height, txn)
-	return bc.P2PNode.BroadcastTransaction(txn)
+	if err := bc.TxnPool.addBounded(txn, bc.NodeConfig.maxMempoolSize()); err != nil {
+		return [32]byte{}, err
+	}
+	return txn.Hash(), bc.P2PNode.BroadcastTransaction(txn)
 }
 
 func (bc *BlockChain) GetAccountBalance(address *[32]byte) (float64, error) {
-	return bc.mainDB.GetAccountBalance(address)
+	balance, err := bc.mainDB.GetAccountBalance(address)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, rpc.ErrAccountNotFound
+	}
+	return balance, err
+}
+
+// GetAccountBalances reads the balance of every address, accounts never written hold zero
+func (bc *BlockChain) GetAccountBalances(addresses [][32]byte) (map[[32]byte]float64, error) {
+	balances := make(map[[32]byte]float64, len(addresses))
+	for _, address := range addresses {
+		balance, err := bc.mainDB.GetAccountBalanceOrZero(&address)
+		if err != nil {
+			return nil, err
+		}
+		balances[address] = balance
+	}
+	return balances, nil
 }
@@ -1,19 +1,28 @@
 package consensus
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"errors"
+	"math"
+	"net"
 	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
 
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/nanlour/da/src/block"
 	"github.com/nanlour/da/src/db"
 	"github.com/nanlour/da/src/ecdsa_da"
 	"github.com/nanlour/da/src/p2p"
+	"github.com/nanlour/da/src/rpc"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
 // setupTestBlockchain creates a minimal blockchain for testing with just the DB component
@@ -35,16 +44,15 @@ func setupTestBlockchain(t *testing.T) (*BlockChain, func()) {
 			PubKey:  privateKey.PublicKey,
 			Address: address,
 		},
-		StakeMine:        1.0,
 		MiningDifficulty: 10,
 		DbPath:           filepath.Join(tempDir, "testdb"),
 		InitStake: map[[32]byte]float64{
 			address: 100.0,
 		},
-		StakeSum: 100.0,
 		InitBank: map[[32]byte]float64{
 			address: 1000.0,
 		},
+		CheckInvariants: true,
 	}
 
 	// Initialize blockchain and database
@@ -52,31 +60,37 @@ func setupTestBlockchain(t *testing.T) (*BlockChain, func()) {
 	bc.SetConfig(config)
 
 	// Set up database
-	dbManager, err := db.InitialDB(config.DbPath)
+	dbManager, err := db.InitialDB(config.DbPath, &config.DBOptions)
 	require.NoError(t, err)
 	bc.mainDB = dbManager
 
 	// Initialize transaction pool
 	bc.TxnPool = TransactionPool{
-		txnMap: make(map[uint64]*block.Transaction),
+		txns:    make(map[[32]byte]*block.Transaction),
+		addedAt: make(map[[32]byte]time.Time),
 	}
 
+	bc.P2PNode = offlineNetwork{}
+
 	// Initialize channels
 	bc.P2PChan = make(chan *p2p.P2PBlock, 10)
 	bc.MiningChan = make(chan *block.Block, 10)
 
 	// Set up genesis block
-	gBHash := genesisBlock.Hash()
+	gBHash := bc.GenesisBlock().Hash()
 	err = bc.mainDB.InsertTipHash(&gBHash)
 	require.NoError(t, err)
-	err = bc.mainDB.InsertHashBlock(&gBHash, &genesisBlock)
+	err = bc.mainDB.InsertHashBlock(&gBHash, bc.GenesisBlock())
 	require.NoError(t, err)
 
 	// Set up initial balances
+	var supply float64
 	for addr, balance := range config.InitBank {
 		err = bc.mainDB.InsertAccountBalance(&addr, balance)
 		require.NoError(t, err)
+		supply += balance
 	}
+	require.NoError(t, bc.mainDB.InsertGenesisSupply(supply))
 
 	// Return cleanup function
 	cleanup := func() {
@@ -87,6 +101,30 @@ func setupTestBlockchain(t *testing.T) (*BlockChain, func()) {
 	return bc, cleanup
 }
 
+// applyTestBlock stages the block against the stored state and writes it, as the tip manager
+// does for a block extending the chain
+func applyTestBlock(bc *BlockChain, b *block.Block) error {
+	state := newBatchState(bc.mainDB, new(leveldb.Batch))
+	if err := bc.stageBlock(state, b); err != nil {
+		return err
+	}
+	return bc.mainDB.BatchInsert(state.batch)
+}
+
+// rollbackTestBlock stages rolling the last applied block back and writes it
+func rollbackTestBlock(bc *BlockChain, b *block.Block) error {
+	state := newBatchState(bc.mainDB, new(leveldb.Batch))
+	if err := bc.stageRollback(state, b); err != nil {
+		return err
+	}
+	return bc.mainDB.BatchInsert(state.batch)
+}
+
+// txnBlock wraps the transaction in an unmined block on top of parent
+func txnBlock(parent *block.Block, txn *block.Transaction) *block.Block {
+	return &block.Block{PreHash: parent.Hash(), Height: parent.Height + 1, Txn: *txn}
+}
+
 // TestBlockchainDBIntegration tests the integration between blockchain and database
 func TestBlockchainDBIntegration(t *testing.T) {
 	bc, cleanup := setupTestBlockchain(t)
@@ -107,6 +145,11 @@ func TestBlockchainDBIntegration(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, 1000.0, balance)
 
+	// Test GetAccountBalances, unknown accounts hold zero
+	balances, err := bc.GetAccountBalances([][32]byte{address, {0xee}})
+	require.NoError(t, err)
+	assert.Equal(t, map[[32]byte]float64{address: 1000, {0xee}: 0}, balances)
+
 	// Test transaction handling
 	testTransaction(t, bc)
 }
@@ -131,6 +174,7 @@ func testTransaction(t *testing.T, bc *BlockChain) {
 		ToAddress:   toAddress,
 		Amount:      100.0,
 		Height:      1,
+		Nonce:       1,
 	}
 
 	// Sign the transaction
@@ -146,8 +190,8 @@ func testTransaction(t *testing.T, bc *BlockChain) {
 	assert.Equal(t, tx.Amount, pooledTx.Amount)
 
 	// Process the transaction
-	err = bc.DoTxn(tx)
-	require.NoError(t, err)
+	b := txnBlock(bc.GenesisBlock(), tx)
+	require.NoError(t, applyTestBlock(bc, b))
 
 	// Verify balances after transaction
 	fromBalance, err := bc.GetAccountBalance(&fromAddress)
@@ -159,8 +203,7 @@ func testTransaction(t *testing.T, bc *BlockChain) {
 	assert.Equal(t, 100.0, toBalance) // 0 + 100
 
 	// Test transaction rollback
-	err = bc.UNDoTxn(tx)
-	require.NoError(t, err)
+	require.NoError(t, rollbackTestBlock(bc, b))
 
 	// Verify balances after rollback
 	fromBalance, err = bc.GetAccountBalance(&fromAddress)
@@ -191,18 +234,21 @@ func TestMultipleTransactions(t *testing.T) {
 
 	// Create and process multiple transactions
 	amounts := []float64{100.0, 200.0, 300.0}
+	parent := bc.GenesisBlock()
 	for i, amount := range amounts {
 		tx := &block.Transaction{
 			FromAddress: fromAddress,
 			ToAddress:   recipients[i],
 			Amount:      amount,
 			Height:      uint64(i + 1),
+			Nonce:       uint64(i + 1),
 		}
 		tx.Sign(&bc.NodeConfig.ID.PrvKey)
 
 		// Add to pool and process
 		bc.AddTxn(tx)
-		bc.DoTxn(tx)
+		parent = txnBlock(parent, tx)
+		require.NoError(t, applyTestBlock(bc, parent))
 	}
 
 	// Verify sender balance
@@ -245,3 +291,1354 @@ func TestBlockRetrieval(t *testing.T) {
 		assert.Nil(t, nonExistentBlock, "Non-existent block should be nil")
 	}
 }
+
+// TestTransactionStatus tests pending, confirmed and reorg-orphaned transaction status
+func TestTransactionStatus(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	genesis := bc.GenesisBlock()
+	bc.MyChain = []*Chain{{Hash: genesis.Hash()}}
+	sender := testPeerID(t)
+	network := blockNetwork{peers: []peer.ID{sender}, blocks: map[[32]byte]*block.Block{}}
+	bc.P2PNode = network
+
+	fromAddress, err := bc.GetAddress()
+	require.NoError(t, err)
+
+	var toAddress [32]byte
+	copy(toAddress[:], []byte("recipient-address-12345678901234567"))
+
+	tx := &block.Transaction{
+		FromAddress: fromAddress,
+		ToAddress:   toAddress,
+		Amount:      10.0,
+		Height:      1,
+		Nonce:       1,
+	}
+	tx.Sign(&bc.NodeConfig.ID.PrvKey)
+	txHash := tx.Hash()
+
+	// Unknown before it reaches the pool
+	_, _, _, err = bc.GetTransactionStatus(txHash)
+	assert.Error(t, err)
+
+	// Pending while in the pool
+	require.NoError(t, bc.AddTxn(tx))
+	confirmed, _, _, err := bc.GetTransactionStatus(txHash)
+	require.NoError(t, err)
+	assert.False(t, confirmed)
+
+	// Confirmed once included in a block on the main chain
+	a1 := mineTestBlock(t, bc, genesis, *tx)
+	require.NoError(t, bc.processNewBlock(a1, false, ""))
+
+	confirmed, height, confirmations, err := bc.GetTransactionStatus(txHash)
+	require.NoError(t, err)
+	assert.True(t, confirmed)
+	assert.Equal(t, uint64(1), height)
+	assert.Equal(t, uint64(1), confirmations)
+
+	// Depth grows as the chain extends
+	a2 := mineTestBlock(t, bc, a1, signedTxn(bc, 2))
+	require.NoError(t, bc.processNewBlock(a2, false, ""))
+
+	_, _, confirmations, err = bc.GetTransactionStatus(txHash)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), confirmations)
+
+	// Once mined it left the pool
+	_, pending := bc.TxnPool.GetTransactionByHash(txHash)
+	assert.False(t, pending)
+	stale := signedTransfer(bc, 3)
+	bc.TxnPool.AddTransaction(&stale)
+
+	// Orphaned by a reorg to a longer fork from genesis without it, the transaction is gone,
+	// its height passed and it has to be sent again. The reorg drops the one at height 3.
+	emptyTxn := block.Transaction{Height: 1}
+	emptyTxn.Sign(&bc.NodeConfig.ID.PrvKey)
+	b1 := mineTestBlock(t, bc, genesis, emptyTxn)
+	b2 := mineTestBlock(t, bc, b1, signedTxn(bc, 2))
+	b3 := mineTestBlock(t, bc, b2, signedTxn(bc, 3))
+	network.blocks[b1.Hash()] = b1
+	network.blocks[b2.Hash()] = b2
+	require.NoError(t, bc.processNewBlock(b3, false, sender.String()))
+	require.Equal(t, b3.Hash(), bc.MyChain[len(bc.MyChain)-1].Hash, "longer fork should be adopted")
+
+	_, _, _, err = bc.GetTransactionStatus(txHash)
+	assert.Error(t, err)
+	assert.Empty(t, bc.TxnPool.txns)
+}
+
+// indexTxn records the transaction as included in the block at height, as applying that block would
+func indexTxn(t *testing.T, bc *BlockChain, hash [32]byte, height uint64) {
+	t.Helper()
+	batch := new(leveldb.Batch)
+	bc.mainDB.BatchInsertTxnHeight(batch, &hash, height)
+	require.NoError(t, bc.mainDB.BatchInsert(batch))
+}
+
+// testNodeConfig returns a config for a single fully wired node on ephemeral ports
+func testNodeConfig(t *testing.T, tempDir string) *Config {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	address := ecdsa_da.PublicKeyToAddress(&privateKey.PublicKey)
+
+	return &Config{
+		ID: Account{
+			PrvKey:  *privateKey,
+			PubKey:  privateKey.PublicKey,
+			Address: address,
+		},
+		MiningDifficulty: 10,
+		DbPath:           filepath.Join(tempDir, "testdb"),
+		RPCPort:          0,
+		P2PListenAddr:    "/ip4/127.0.0.1/tcp/0",
+		InitStake:        map[[32]byte]float64{address: 100.0},
+		InitBank:         map[[32]byte]float64{address: 1000.0},
+	}
+}
+
+// TestInitReturnsWhenReady tests that Init returns with a usable node instead of blocking
+func TestInitReturnsWhenReady(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "blockchain_init_test_")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	config := testNodeConfig(t, tempDir)
+	address := config.ID.Address
+
+	bc := &BlockChain{}
+	bc.SetConfig(config)
+
+	ready := bc.Ready()
+
+	initDone := make(chan error, 1)
+	go func() {
+		initDone <- bc.Init()
+	}()
+
+	select {
+	case err := <-initDone:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Init should return once the node is ready")
+	}
+	defer bc.Stop()
+
+	select {
+	case <-ready:
+	default:
+		t.Fatal("Ready channel should be closed after Init returns")
+	}
+
+	// The node is immediately usable
+	tip, err := bc.GetTipBlock()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), tip.Height)
+
+	balance, err := bc.GetAccountBalance(&address)
+	require.NoError(t, err)
+	assert.Equal(t, 1000.0, balance)
+}
+
+// TestStopTerminatesLoops tests that Stop waits for the miner and tip manager to exit, so
+// nothing touches the database once it is closed. Run with -race to catch late accesses.
+func TestStopTerminatesLoops(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "blockchain_stop_test_")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	config := testNodeConfig(t, tempDir)
+	config.Mining = true
+
+	bc := &BlockChain{}
+	bc.SetConfig(config)
+	require.NoError(t, bc.Init())
+
+	// Let the node mine and apply a block so both loops are busy
+	require.Eventually(t, func() bool {
+		tip, err := bc.GetTipBlock()
+		return err == nil && tip.Height >= 1
+	}, 30*time.Second, 50*time.Millisecond)
+
+	require.NoError(t, bc.Stop())
+	assert.False(t, bc.IsMining())
+
+	// Stop only returns after the loops have exited, and the VDF was not left running
+	buf := make([]byte, 1<<20)
+	stacks := string(buf[:runtime.Stack(buf, true)])
+	for _, loop := range []string{"(*BlockChain).mine", "(*BlockChain).TipManager", "vdf_go.(*VDF).Execute"} {
+		assert.NotContains(t, stacks, loop, "%s should have exited after Stop", loop)
+	}
+}
+
+// TestRunReturnsAfterStop tests that Run only returns once Stop has finished, so a caller
+// exiting right after Run does not cut the shutdown short
+func TestRunReturnsAfterStop(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "blockchain_run_test_")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	bc := &BlockChain{}
+	bc.SetConfig(testNodeConfig(t, tempDir))
+
+	runDone := make(chan error, 1)
+	go func() {
+		runDone <- bc.Run()
+	}()
+	<-bc.Ready()
+
+	stopDone := make(chan error, 1)
+	go func() {
+		stopDone <- bc.Stop()
+	}()
+
+	select {
+	case err := <-runDone:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run should return once the node is stopped")
+	}
+
+	// Stop closes the database last, so it is already closed when Run returns
+	_, err = bc.mainDB.GetTipHash()
+	assert.Error(t, err, "Run returned before Stop closed the database")
+	require.NoError(t, <-stopDone)
+}
+
+// TestPooledTxnDeletedWithBlock tests that the stored pool entries for a block's height are
+// deleted by the batch applying the block, and stay when the block is not written
+func TestPooledTxnDeletedWithBlock(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	tx := signedTransfer(bc, 1)
+	require.NoError(t, bc.mainDB.InsertPendingTxn(&tx))
+	b := mineTestBlock(t, bc, bc.GenesisBlock(), tx)
+
+	state := newBatchState(bc.mainDB, new(leveldb.Batch))
+	require.NoError(t, bc.stageBlock(state, b))
+	stored, err := bc.mainDB.GetPendingTxns()
+	require.NoError(t, err)
+	require.Len(t, stored, 1, "staging alone must not delete the entry")
+	assert.Equal(t, tx, *stored[0])
+
+	require.NoError(t, bc.mainDB.BatchInsert(state.batch))
+	stored, err = bc.mainDB.GetPendingTxns()
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+}
+
+// TestTxnPoolSurvivesRestart tests that pooled transactions are reloaded by Init, except those
+// for heights the stored chain already passed and those a block already includes
+func TestTxnPoolSurvivesRestart(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "blockchain_pool_test_")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	config := testNodeConfig(t, tempDir)
+	bc := &BlockChain{}
+	bc.SetConfig(config)
+	require.NoError(t, bc.Init())
+
+	pending := signedTransfer(bc, 50)
+	stale := signedTransfer(bc, 5)
+	confirmed := signedTransfer(bc, 60)
+	for _, txn := range []*block.Transaction{&pending, &stale, &confirmed} {
+		bc.TxnPool.AddTransaction(txn)
+	}
+
+	// A stored chain at height 10 that includes the confirmed transaction
+	tipHash := bc.GenesisBlock().Hash()
+	batch := new(leveldb.Batch)
+	for height := uint64(1); height <= 10; height++ {
+		b := &block.Block{PreHash: tipHash, Height: height}
+		tipHash = b.Hash()
+		require.NoError(t, bc.mainDB.BatchInsertHashBlock(batch, &tipHash, b))
+		bc.mainDB.BatchInsertCumDifficulty(batch, &tipHash, height)
+	}
+	bc.mainDB.BatchInsertTipHash(batch, &tipHash)
+	confirmedHash := confirmed.Hash()
+	bc.mainDB.BatchInsertTxnHeight(batch, &confirmedHash, 8)
+	require.NoError(t, bc.mainDB.BatchInsert(batch))
+	require.NoError(t, bc.Stop())
+
+	restarted := &BlockChain{}
+	restarted.SetConfig(config)
+	require.NoError(t, restarted.Init())
+	defer restarted.Stop()
+
+	txn, exists := restarted.TxnPool.GetTransaction(50)
+	require.True(t, exists, "pending transaction should survive the restart")
+	assert.Equal(t, pending, *txn)
+	_, exists = restarted.TxnPool.GetTransaction(5)
+	assert.False(t, exists, "transaction below the tip should be dropped")
+	_, exists = restarted.TxnPool.GetTransaction(60)
+	assert.False(t, exists, "confirmed transaction should be dropped")
+
+	// Dropped transactions are gone from the database too
+	stored, err := restarted.mainDB.GetPendingTxns()
+	require.NoError(t, err)
+	require.Len(t, stored, 1)
+	assert.Equal(t, pending, *stored[0])
+}
+
+// TestInitPoolErrorClosesDB tests that Init releases the database when the stored pool cannot
+// be restored, so the database can be opened again
+func TestInitPoolErrorClosesDB(t *testing.T) {
+	config := testNodeConfig(t, t.TempDir())
+	bc := &BlockChain{}
+	bc.SetConfig(config)
+	require.NoError(t, bc.Init())
+	require.NoError(t, bc.Stop())
+
+	// A pending transaction entry too short to decode
+	mainDB, err := db.InitialDB(config.DbPath, nil)
+	require.NoError(t, err)
+	require.NoError(t, mainDB.Insert(db.PrefixKey(0x0b, make([]byte, 8)), []byte{1}))
+	require.NoError(t, mainDB.Close())
+
+	restarted := &BlockChain{}
+	restarted.SetConfig(config)
+	require.Error(t, restarted.Init())
+
+	mainDB, err = db.InitialDB(config.DbPath, nil)
+	require.NoError(t, err, "database should not stay locked after a failed Init")
+	require.NoError(t, mainDB.Close())
+}
+
+// failingNetwork is a Network that cannot start
+type failingNetwork struct {
+	offlineNetwork
+	stopped *bool
+}
+
+func (n failingNetwork) Start() error { return errors.New("cannot listen") }
+func (n failingNetwork) Stop() error  { *n.stopped = true; return nil }
+
+// TestInitNetworkErrorUndoesSteps tests that Init failing to start P2P closes the database and
+// releases the RPC and health ports it already took, and that a node cannot be initialized twice
+func TestInitNetworkErrorUndoesSteps(t *testing.T) {
+	freePort := func() int {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+		return listener.Addr().(*net.TCPAddr).Port
+	}
+	config := testNodeConfig(t, t.TempDir())
+	config.RPCPort = freePort()
+	config.HealthPort = freePort()
+
+	var stopped bool
+	failed := &BlockChain{P2PNode: failingNetwork{stopped: &stopped}}
+	failed.SetConfig(config)
+	require.Error(t, failed.Init())
+	assert.True(t, stopped, "the network should be stopped")
+	assert.Nil(t, failed.health)
+
+	mainDB, err := db.InitialDB(config.DbPath, nil)
+	require.NoError(t, err, "database should not stay locked after a failed Init")
+	require.NoError(t, mainDB.Close())
+
+	bc := &BlockChain{}
+	bc.SetConfig(config)
+	require.NoError(t, bc.Init(), "the RPC and health ports should be free again")
+	defer bc.Stop()
+	assert.Error(t, bc.Init())
+}
+
+// TestRestartResumesChain tests that Init resumes from the stored tip, so blocks synced after
+// a restart continue from the stored nonces and minted supply instead of a reset genesis state
+func TestRestartResumesChain(t *testing.T) {
+	config := testNodeConfig(t, t.TempDir())
+	config.BlockReward = 1
+	config.CheckInvariants = true
+	dest := [32]byte{0xd0}
+
+	transfer := func(nonce uint64) block.Transaction {
+		txn := block.Transaction{FromAddress: config.ID.Address, ToAddress: dest, Amount: 10, Height: nonce, Nonce: nonce}
+		txn.Sign(&config.ID.PrvKey)
+		return txn
+	}
+	importBlocks := func(bc *BlockChain, blocks ...*block.Block) {
+		var buf bytes.Buffer
+		for _, b := range blocks {
+			require.NoError(t, writeBlock(&buf, b))
+		}
+		require.NoError(t, bc.ImportBlocks(&buf))
+	}
+
+	bc := &BlockChain{}
+	bc.SetConfig(config)
+	require.NoError(t, bc.Init())
+	b1 := mineTestBlock(t, bc, bc.GenesisBlock(), transfer(1))
+	importBlocks(bc, b1)
+	require.NoError(t, bc.Stop())
+
+	restarted := &BlockChain{}
+	restarted.SetConfig(config)
+	require.NoError(t, restarted.Init())
+	defer restarted.Stop()
+
+	tip, err := restarted.GetTipBlock()
+	require.NoError(t, err)
+	assert.Equal(t, b1.Hash(), tip.Hash(), "restart should resume from the stored tip")
+	work, err := restarted.GetCumulativeDifficulty(b1.Hash())
+	require.NoError(t, err)
+	restarted.chainMu.RLock()
+	assert.Equal(t, []*Chain{{Hash: restarted.GenesisBlock().Hash()}, {Hash: b1.Hash(), PrvHash: b1.PreHash, CumDifficulty: work}}, restarted.MyChain)
+	restarted.chainMu.RUnlock()
+
+	// The next block spends the next nonce on top of the stored state
+	b2 := mineTestBlock(t, restarted, b1, transfer(2))
+	importBlocks(restarted, b2)
+
+	balance, err := restarted.GetAccountBalance(&dest)
+	require.NoError(t, err)
+	assert.Equal(t, 20.0, balance)
+	minted, err := restarted.mainDB.GetMintedSupply()
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, minted)
+	problems, err := restarted.mainDB.CheckSupply()
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+}
+
+// TestRestartRefusesMissingWork tests that Init refuses a stored chain whose blocks have no
+// cumulative difficulty instead of trusting the difficulty they claim
+func TestRestartRefusesMissingWork(t *testing.T) {
+	config := testNodeConfig(t, t.TempDir())
+	mainDB, err := db.InitialDB(config.DbPath, nil)
+	require.NoError(t, err)
+	genesisHash := config.GenesisHash()
+	require.NoError(t, mainDB.InsertGenesisHash(&genesisHash))
+	require.NoError(t, mainDB.InsertHashBlock(&genesisHash, config.GenesisBlock()))
+	b1 := &block.Block{PreHash: genesisHash, Height: 1, Difficulty: 1 << 40}
+	b1Hash := b1.Hash()
+	require.NoError(t, mainDB.InsertHashBlock(&b1Hash, b1))
+	require.NoError(t, mainDB.InsertTipHash(&b1Hash))
+	require.NoError(t, mainDB.Close())
+
+	bc := &BlockChain{}
+	bc.SetConfig(config)
+	err = bc.Init()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no cumulative difficulty")
+}
+
+// TestMempoolStats tests that the pool's stats follow additions, removals and the passing of time
+func TestMempoolStats(t *testing.T) {
+	clock := &steppedClock{now: time.Unix(1700000000, 0)}
+	pool := TransactionPool{clock: clock}
+	alice, bob := [32]byte{1}, [32]byte{2}
+
+	stats := pool.Stats()
+	assert.Zero(t, stats.Pending)
+	assert.Zero(t, stats.OldestAge)
+
+	oldest := &block.Transaction{FromAddress: alice, Amount: 10, Height: 5}
+	pool.AddTransaction(oldest)
+	clock.now = clock.now.Add(time.Minute)
+	pool.AddTransaction(&block.Transaction{FromAddress: alice, Amount: 2.5, Height: 6})
+	pool.AddTransaction(&block.Transaction{FromAddress: bob, Amount: 4, Height: 7})
+	clock.now = clock.now.Add(30 * time.Second)
+
+	stats = pool.Stats()
+	assert.Equal(t, 3, stats.Pending)
+	assert.Equal(t, map[[32]byte]int{alice: 2, bob: 1}, stats.BySender)
+	assert.Equal(t, 16.5, stats.Outflow)
+	assert.Equal(t, 90*time.Second, stats.OldestAge)
+
+	// Once the oldest is mined the next oldest sets the age
+	require.NoError(t, pool.removeTransaction(oldest.Hash()))
+	stats = pool.Stats()
+	assert.Equal(t, 2, stats.Pending)
+	assert.Equal(t, map[[32]byte]int{alice: 1, bob: 1}, stats.BySender)
+	assert.Equal(t, 6.5, stats.Outflow)
+	assert.Equal(t, 30*time.Second, stats.OldestAge)
+
+	// A block applied at height 6 leaves only what is still waiting for a block
+	require.NoError(t, pool.prune(6))
+	stats = pool.Stats()
+	assert.Equal(t, 1, stats.Pending)
+	assert.Equal(t, map[[32]byte]int{bob: 1}, stats.BySender)
+	assert.Equal(t, 4.0, stats.Outflow)
+}
+
+// TestMempoolCapacity tests that a full pool rejects transactions that do not outbid its
+// lowest fee and evicts that one for those that do, zero-fee ones first
+func TestMempoolCapacity(t *testing.T) {
+	clock := &steppedClock{now: time.Unix(1700000000, 0)}
+	pool := TransactionPool{clock: clock}
+	add := func(height uint64, fee float64) error {
+		clock.now = clock.now.Add(time.Second)
+		return pool.addBounded(&block.Transaction{Amount: 1, Height: height, Fee: fee}, 3)
+	}
+
+	require.NoError(t, add(1, 1))
+	require.NoError(t, add(2, 0))
+	require.NoError(t, add(3, 2))
+
+	// A zero fee never outbids anything
+	assert.ErrorIs(t, add(4, 0), rpc.ErrMempoolFull)
+	assert.ErrorIs(t, add(4, -1), rpc.ErrMempoolFull)
+
+	// The zero-fee transaction makes way first
+	require.NoError(t, add(4, 0.5))
+	_, kept := pool.GetTransaction(2)
+	assert.False(t, kept)
+
+	// Matching the lowest fee is not enough
+	assert.ErrorIs(t, add(5, 0.5), rpc.ErrMempoolFull)
+
+	// A second transaction for a pooled height competes for room like any other, both stay
+	// and the block takes the higher fee
+	require.NoError(t, add(3, 2.5))
+	assert.Equal(t, 3, pool.Stats().Pending)
+	pooled, _ := pool.GetTransaction(3)
+	assert.Equal(t, 2.5, pooled.Fee)
+	_, kept = pool.GetTransaction(4)
+	assert.False(t, kept, "the lowest fee made way")
+
+	// Among equal fees the newest goes
+	require.NoError(t, add(7, 2))
+	_, kept = pool.GetTransaction(1)
+	assert.False(t, kept)
+	require.NoError(t, add(8, 3))
+	_, kept = pool.GetTransaction(7)
+	assert.False(t, kept)
+	for _, height := range []uint64{3, 8} {
+		_, kept = pool.GetTransaction(height)
+		assert.True(t, kept, "height %d", height)
+	}
+	assert.Equal(t, 3, pool.Stats().Pending)
+}
+
+// TestMempoolPicksHighestFee tests that several transactions wait for the same height and
+// the block takes the one paying most, the earliest among equals
+func TestMempoolPicksHighestFee(t *testing.T) {
+	clock := &steppedClock{now: time.Unix(1700000000, 0)}
+	pool := TransactionPool{clock: clock}
+	add := func(amount, fee float64) *block.Transaction {
+		clock.now = clock.now.Add(time.Second)
+		tx := &block.Transaction{Amount: amount, Height: 4, Fee: fee}
+		pool.AddTransaction(tx)
+		return tx
+	}
+
+	add(1, 1)
+	first := add(2, 3)
+	add(3, 3)
+	add(4, 2)
+	assert.Equal(t, 4, pool.Stats().Pending)
+	picked, ok := pool.GetTransaction(4)
+	require.True(t, ok)
+	assert.Equal(t, first.Hash(), picked.Hash())
+
+	// Once the height is in the chain none of them can be included
+	require.NoError(t, pool.prune(4))
+	assert.Zero(t, pool.Stats().Pending)
+}
+
+// TestMempoolPrunedAsBlocksApply tests that transactions leave the pool once a block at their
+// height is applied, so mining more blocks than the pool holds leaves room for new ones
+func TestMempoolPrunedAsBlocksApply(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+	bc.P2PNode = offlineNetwork{}
+	bc.MyChain = []*Chain{{Hash: bc.GenesisBlock().Hash()}}
+	bc.NodeConfig.MaxMempoolSize = 3
+	bc.NodeConfig.TxnFee = 0
+
+	parent := bc.GenesisBlock()
+	for height := uint64(1); height <= uint64(bc.NodeConfig.MaxMempoolSize)+2; height++ {
+		_, err := bc.SubmitTxn([32]byte{0xde, 0xad}, 1)
+		require.NoError(t, err, "height %d", height)
+
+		// One left behind for a height the chain already passed
+		stale := signedTransfer(bc, height-1)
+		bc.TxnPool.AddTransaction(&stale)
+
+		b := mineTestBlock(t, bc, parent, bc.selectTransaction(height))
+		require.NoError(t, bc.processNewBlock(b, false, ""))
+		require.Equal(t, b.Hash(), bc.MyChain[height].Hash)
+		assert.Empty(t, bc.TxnPool.txns, "height %d", height)
+		assert.Zero(t, bc.MempoolStats().Pending, "height %d", height)
+		parent = b
+	}
+
+	balance, err := bc.GetAccountBalance(&[32]byte{0xde, 0xad})
+	require.NoError(t, err)
+	assert.Equal(t, float64(bc.NodeConfig.MaxMempoolSize+2), balance)
+	_, err = bc.SubmitTxn([32]byte{0xde, 0xad}, 1)
+	assert.NoError(t, err)
+}
+
+// TestInitChecksGenesis tests that Init reopens a database created for the configured genesis
+// and refuses one created for another network
+func TestInitChecksGenesis(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "blockchain_genesis_test_")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	config := testNodeConfig(t, tempDir)
+	bc := &BlockChain{}
+	bc.SetConfig(config)
+	require.NoError(t, bc.Init())
+	require.NoError(t, bc.Stop())
+
+	// Same genesis, the database is reused
+	restarted := &BlockChain{}
+	restarted.SetConfig(config)
+	require.NoError(t, restarted.Init())
+	require.NoError(t, restarted.Stop())
+
+	// Another network on the same database
+	other := *config
+	other.Genesis.NetworkID = "other-net"
+	require.NotEqual(t, config.GenesisHash(), other.GenesisHash())
+	mismatched := &BlockChain{}
+	mismatched.SetConfig(&other)
+	err = mismatched.Init()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "wrong network or stale database")
+
+	// A database from before the genesis was recorded is checked against its blocks
+	legacyDir := filepath.Join(tempDir, "legacy")
+	legacyDB, err := db.InitialDB(legacyDir, nil)
+	require.NoError(t, err)
+	foreignGenesis := other.GenesisBlock()
+	foreignHash := foreignGenesis.Hash()
+	require.NoError(t, legacyDB.InsertHashBlock(&foreignHash, foreignGenesis))
+	require.NoError(t, legacyDB.InsertTipHash(&foreignHash))
+	require.NoError(t, legacyDB.Close())
+
+	legacyConfig := *config
+	legacyConfig.DbPath = legacyDir
+	legacy := &BlockChain{}
+	legacy.SetConfig(&legacyConfig)
+	assert.Error(t, legacy.Init(), "legacy database from another network should be refused")
+
+	// Refusing it leaves the database without our genesis marker
+	legacyDB, err = db.InitialDB(legacyDir, nil)
+	require.NoError(t, err)
+	defer legacyDB.Close()
+	_, err = legacyDB.GetGenesisHash()
+	assert.ErrorIs(t, err, leveldb.ErrNotFound, "refused database should not be marked with our genesis")
+}
+
+// TestInitMissingGenesisBlock tests that Init writes a missing genesis block again when the
+// chain holds nothing else, and refuses a chain whose genesis block is missing
+func TestInitMissingGenesisBlock(t *testing.T) {
+	tempDir := t.TempDir()
+	config := testNodeConfig(t, tempDir)
+	genesisHash := config.GenesisHash()
+
+	// Only the genesis marker, as left by a crash right after it was written
+	emptyDir := filepath.Join(tempDir, "empty")
+	emptyDB, err := db.InitialDB(emptyDir, nil)
+	require.NoError(t, err)
+	require.NoError(t, emptyDB.InsertGenesisHash(&genesisHash))
+	require.NoError(t, emptyDB.Close())
+
+	emptyConfig := *config
+	emptyConfig.DbPath = emptyDir
+	reseeded := &BlockChain{}
+	reseeded.SetConfig(&emptyConfig)
+	require.NoError(t, reseeded.Init())
+	require.NoError(t, reseeded.checkGenesisBlock(genesisHash))
+	tip, err := reseeded.GetTipBlock()
+	require.NoError(t, err)
+	assert.Equal(t, genesisHash, tip.Hash())
+	require.NoError(t, reseeded.Stop())
+
+	// A chain built on a genesis block that is gone
+	corruptDir := filepath.Join(tempDir, "corrupt")
+	corruptDB, err := db.InitialDB(corruptDir, nil)
+	require.NoError(t, err)
+	require.NoError(t, corruptDB.InsertGenesisHash(&genesisHash))
+	b1 := &block.Block{PreHash: genesisHash, Height: 1}
+	b1Hash := b1.Hash()
+	require.NoError(t, corruptDB.InsertHashBlock(&b1Hash, b1))
+	require.NoError(t, corruptDB.InsertTipHash(&b1Hash))
+	require.NoError(t, corruptDB.Close())
+
+	corruptConfig := *config
+	corruptConfig.DbPath = corruptDir
+	corrupt := &BlockChain{}
+	corrupt.SetConfig(&corruptConfig)
+	err = corrupt.Init()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "genesis block")
+	assert.Contains(t, err.Error(), "is missing")
+}
+
+// TestTransactionNonces tests replay protection through per-sender nonces
+func TestTransactionNonces(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	fromAddress, err := bc.GetAddress()
+	require.NoError(t, err)
+
+	var toAddress [32]byte
+	copy(toAddress[:], []byte("recipient-address-12345678901234567"))
+
+	newTx := func(nonce uint64) *block.Transaction {
+		tx := &block.Transaction{
+			FromAddress: fromAddress,
+			ToAddress:   toAddress,
+			Amount:      100.0,
+			Height:      nonce,
+			Nonce:       nonce,
+		}
+		tx.Sign(&bc.NodeConfig.ID.PrvKey)
+		return tx
+	}
+
+	assert.Equal(t, uint64(1), bc.NextNonce(fromAddress))
+
+	// In-order transactions are accepted
+	tx1 := newTx(1)
+	b1 := txnBlock(bc.GenesisBlock(), tx1)
+	require.NoError(t, applyTestBlock(bc, b1))
+	tx2 := newTx(2)
+	b2 := txnBlock(b1, tx2)
+	require.NoError(t, applyTestBlock(bc, b2))
+
+	balance, err := bc.GetAccountBalance(&fromAddress)
+	require.NoError(t, err)
+	assert.Equal(t, 800.0, balance)
+	assert.Equal(t, uint64(3), bc.NextNonce(fromAddress))
+
+	// Replaying an applied transaction is rejected
+	assert.Error(t, applyTestBlock(bc, txnBlock(b2, tx2)), "replayed transaction should be rejected")
+
+	// A gap in the nonce sequence is rejected
+	assert.Error(t, applyTestBlock(bc, txnBlock(b2, newTx(4))), "transaction skipping a nonce should be rejected")
+
+	balance, err = bc.GetAccountBalance(&fromAddress)
+	require.NoError(t, err)
+	assert.Equal(t, 800.0, balance, "rejected transactions must not move funds")
+
+	// Rolling back in reverse order restores the nonce
+	require.NoError(t, rollbackTestBlock(bc, b2))
+	require.NoError(t, rollbackTestBlock(bc, b1))
+
+	balance, err = bc.GetAccountBalance(&fromAddress)
+	require.NoError(t, err)
+	assert.Equal(t, 1000.0, balance)
+	assert.Equal(t, uint64(1), bc.NextNonce(fromAddress))
+
+	// After the rollback the same transactions can be applied again on another fork
+	emptyTxn := signedTxn(bc, 1)
+	fork := txnBlock(bc.GenesisBlock(), &emptyTxn)
+	require.NoError(t, applyTestBlock(bc, fork))
+	require.NoError(t, applyTestBlock(bc, txnBlock(fork, tx1)))
+}
+
+// TestBlockUndoLog tests that rolling back blocks restores accounts from the stored undo
+// records, even when the current account state no longer matches what the blocks left
+func TestBlockUndoLog(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	fromAddress, err := bc.GetAddress()
+	require.NoError(t, err)
+
+	var toAddress [32]byte
+	copy(toAddress[:], []byte("recipient-address-12345678901234567"))
+
+	blocks := make([]*block.Block, 3)
+	parent := bc.GenesisBlock().Hash()
+	for i := range blocks {
+		txn := block.Transaction{
+			FromAddress: fromAddress,
+			ToAddress:   toAddress,
+			Amount:      float64(100 * (i + 1)),
+			Height:      uint64(i + 1),
+			Nonce:       uint64(i + 1),
+		}
+		txn.Sign(&bc.NodeConfig.ID.PrvKey)
+		blocks[i] = &block.Block{PreHash: parent, Height: uint64(i + 1), Txn: txn}
+		require.NoError(t, applyTestBlock(bc, blocks[i]))
+		parent = blocks[i].Hash()
+	}
+
+	balance, err := bc.GetAccountBalance(&fromAddress)
+	require.NoError(t, err)
+	assert.Equal(t, 400.0, balance)
+	balance, err = bc.GetAccountBalance(&toAddress)
+	require.NoError(t, err)
+	assert.Equal(t, 600.0, balance)
+
+	// Knock the sender's nonce out of step, re-deriving the rollback would now fail
+	require.NoError(t, bc.mainDB.InsertAccountNonce(&fromAddress, 42))
+
+	for i := len(blocks) - 1; i >= 0; i-- {
+		require.NoError(t, rollbackTestBlock(bc, blocks[i]))
+	}
+
+	balance, err = bc.GetAccountBalance(&fromAddress)
+	require.NoError(t, err)
+	assert.Equal(t, 1000.0, balance)
+	balance, err = bc.GetAccountBalance(&toAddress)
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, balance)
+	assert.Equal(t, uint64(1), bc.NextNonce(fromAddress))
+
+	// Undo records and the transaction index are cleared with the blocks
+	for _, b := range blocks {
+		blockHash := b.Hash()
+		_, err := bc.mainDB.GetBlockUndo(&blockHash)
+		assert.Error(t, err)
+		txHash := b.Txn.Hash()
+		_, err = bc.mainDB.GetTxnHeight(&txHash)
+		assert.Error(t, err)
+	}
+
+	// Without its undo record a block cannot be rolled back
+	err = rollbackTestBlock(bc, blocks[0])
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no undo record")
+}
+
+// TestBlockReceipts tests that applying a block stores receipts for its transaction and
+// rolling it back removes them
+func TestBlockReceipts(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	fromAddress, err := bc.GetAddress()
+	require.NoError(t, err)
+	toAddress := [32]byte{0xbe, 0xef}
+
+	newTxn := func(height uint64, amount float64) block.Transaction {
+		txn := block.Transaction{
+			FromAddress: fromAddress,
+			ToAddress:   toAddress,
+			Amount:      amount,
+			Height:      height,
+			Nonce:       height,
+		}
+		txn.Sign(&bc.NodeConfig.ID.PrvKey)
+		return txn
+	}
+
+	// A payment, one the sender cannot cover and an empty block
+	blocks := []*block.Block{
+		{Height: 1, Txn: newTxn(1, 250)},
+		{Height: 2, Txn: newTxn(2, 5000)},
+		{Height: 3, Txn: signedTxn(bc, 3)},
+	}
+	parent := bc.GenesisBlock().Hash()
+	for _, b := range blocks {
+		b.PreHash = parent
+		require.NoError(t, applyTestBlock(bc, b))
+		parent = b.Hash()
+	}
+
+	receipts, err := bc.GetBlockReceipts(blocks[0].Hash())
+	require.NoError(t, err)
+	require.Len(t, receipts, 1)
+	assert.Equal(t, rpc.Receipt{
+		TxHash:  blocks[0].Txn.Hash(),
+		From:    fromAddress,
+		To:      toAddress,
+		Amount:  250,
+		Success: true,
+	}, receipts[0])
+
+	receipts, err = bc.GetBlockReceipts(blocks[1].Hash())
+	require.NoError(t, err)
+	require.Len(t, receipts, 1)
+	assert.False(t, receipts[0].Success, "an unaffordable payment should be recorded as failed")
+
+	receipts, err = bc.GetBlockReceipts(blocks[2].Hash())
+	require.NoError(t, err)
+	assert.Empty(t, receipts)
+
+	for i := len(blocks) - 1; i >= 0; i-- {
+		require.NoError(t, rollbackTestBlock(bc, blocks[i]))
+		_, err := bc.GetBlockReceipts(blocks[i].Hash())
+		assert.Error(t, err, "receipts of a rolled back block should be removed")
+	}
+}
+
+// TestBlockReward tests that applying a block credits its miner with the reward and rolling
+// it back, as a reorg does, takes the reward away again
+func TestBlockReward(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+	bc.NodeConfig.BlockReward = 5
+	require.NoError(t, bc.mainDB.InsertGenesisSupply(1000))
+
+	miner := bc.NodeConfig.ID.Address
+	toAddress := [32]byte{0xbe, 0xef}
+	txn := block.Transaction{
+		FromAddress: miner,
+		ToAddress:   toAddress,
+		Amount:      100,
+		Height:      1,
+		Nonce:       1,
+	}
+	txn.Sign(&bc.NodeConfig.ID.PrvKey)
+	b := &block.Block{
+		PreHash:   bc.GenesisBlock().Hash(),
+		Height:    1,
+		Txn:       txn,
+		PublicKey: ecdsa_da.PublicKeyToBytes(&bc.NodeConfig.ID.PubKey),
+	}
+	require.NoError(t, applyTestBlock(bc, b))
+
+	balance, err := bc.GetAccountBalance(&miner)
+	require.NoError(t, err)
+	assert.Equal(t, 905.0, balance, "the miner pays 100 and earns the reward of 5")
+
+	minted, err := bc.mainDB.GetMintedSupply()
+	require.NoError(t, err)
+	assert.Equal(t, 5.0, minted)
+	problems, err := bc.mainDB.Verify()
+	require.NoError(t, err)
+	for _, problem := range problems {
+		assert.NotContains(t, problem, "supply")
+	}
+
+	receipts, err := bc.GetBlockReceipts(b.Hash())
+	require.NoError(t, err)
+	require.Len(t, receipts, 2)
+	assert.Equal(t, rpc.Receipt{To: miner, Amount: 5, Success: true}, receipts[1])
+
+	require.NoError(t, rollbackTestBlock(bc, b))
+
+	balance, err = bc.GetAccountBalance(&miner)
+	require.NoError(t, err)
+	assert.Equal(t, 1000.0, balance)
+	minted, err = bc.mainDB.GetMintedSupply()
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, minted)
+}
+
+// TestFailedBlockChangesNothing tests that a block whose transaction fails to apply is rejected
+// without leaving any of its writes behind
+func TestFailedBlockChangesNothing(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+	bc.P2PNode = offlineNetwork{}
+	bc.MyChain = []*Chain{{Hash: bc.GenesisBlock().Hash()}}
+	bc.NodeConfig.BlockReward = 5
+
+	// The reward is credited after the transaction, which fails on its nonce
+	miner := bc.NodeConfig.ID.Address
+	txn := block.Transaction{
+		FromAddress: miner,
+		ToAddress:   [32]byte{0xbe, 0xef},
+		Amount:      100,
+		Height:      1,
+		Nonce:       2,
+	}
+	txn.Sign(&bc.NodeConfig.ID.PrvKey)
+	b := mineTestBlock(t, bc, bc.GenesisBlock(), txn)
+	require.Error(t, bc.processNewBlock(b, false, ""))
+
+	balance, err := bc.GetAccountBalance(&miner)
+	require.NoError(t, err)
+	assert.Equal(t, 1000.0, balance)
+	minted, err := bc.mainDB.GetMintedSupply()
+	require.NoError(t, err)
+	assert.Zero(t, minted)
+
+	tip, err := bc.GetTipBlock()
+	require.NoError(t, err)
+	assert.Equal(t, bc.GenesisBlock().Hash(), tip.Hash())
+	assert.Len(t, bc.MyChain, 1)
+	assert.False(t, bc.hasBlock(b.Hash()))
+
+	blockHash := b.Hash()
+	_, err = bc.mainDB.GetStakeSnapshot(&blockHash)
+	assert.ErrorIs(t, err, leveldb.ErrNotFound)
+	_, err = bc.mainDB.GetBlockUndo(&blockHash)
+	assert.ErrorIs(t, err, leveldb.ErrNotFound)
+}
+
+// TestInvalidAmountBlockRejected tests that a block moving a negative, NaN or infinite amount
+// fails validation and cannot be applied, so the sender cannot mint funds out of nothing
+func TestInvalidAmountBlockRejected(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+	bc.P2PNode = offlineNetwork{}
+	bc.MyChain = []*Chain{{Hash: bc.GenesisBlock().Hash()}}
+
+	miner := bc.NodeConfig.ID.Address
+	victim := [32]byte{0xbe, 0xef}
+	require.NoError(t, bc.mainDB.InsertAccountBalance(&victim, 100))
+
+	for _, amount := range []float64{-100, math.NaN(), math.Inf(1), math.Inf(-1)} {
+		txn := block.Transaction{
+			FromAddress: miner,
+			ToAddress:   victim,
+			Amount:      amount,
+			Height:      1,
+			Nonce:       1,
+		}
+		txn.Sign(&bc.NodeConfig.ID.PrvKey)
+		b := mineTestBlock(t, bc, bc.GenesisBlock(), txn)
+		assert.False(t, bc.checkBlock(b), "amount %v", amount)
+
+		state := newBatchState(bc.mainDB, new(leveldb.Batch))
+		assert.Error(t, bc.stageBlock(state, b), "amount %v", amount)
+
+		require.NoError(t, bc.processNewBlock(b, false, ""))
+		assert.False(t, bc.hasBlock(b.Hash()), "amount %v", amount)
+	}
+
+	balance, err := bc.GetAccountBalance(&miner)
+	require.NoError(t, err)
+	assert.Equal(t, 1000.0, balance)
+	balance, err = bc.GetAccountBalance(&victim)
+	require.NoError(t, err)
+	assert.Equal(t, 100.0, balance)
+	tip, err := bc.GetTipBlock()
+	require.NoError(t, err)
+	assert.Equal(t, bc.GenesisBlock().Hash(), tip.Hash())
+}
+
+// TestInvariantCheckFlagsSupplyMismatch tests that a balance changed outside of block
+// application is caught by the check after the next block
+func TestInvariantCheckFlagsSupplyMismatch(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+	bc.P2PNode = offlineNetwork{}
+	bc.MyChain = []*Chain{{Hash: bc.GenesisBlock().Hash()}}
+
+	b1 := mineTestBlock(t, bc, bc.GenesisBlock(), signedTxn(bc, 1))
+	require.NoError(t, bc.processNewBlock(b1, false, ""))
+
+	// Money out of nowhere
+	stray := [32]byte{0x5e}
+	require.NoError(t, bc.mainDB.InsertAccountBalance(&stray, 50))
+
+	b2 := mineTestBlock(t, bc, b1, signedTxn(bc, 2))
+	err := bc.processNewBlock(b2, false, "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invariant violation")
+
+	// Without the check the same state goes unnoticed
+	bc.NodeConfig.CheckInvariants = false
+	b3 := mineTestBlock(t, bc, b2, signedTxn(bc, 3))
+	assert.NoError(t, bc.processNewBlock(b3, false, ""))
+}
+
+// TestSubmitTxnValidation tests that transactions the chain would never apply are rejected
+// before they are broadcast
+func TestSubmitTxnValidation(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+	bc.P2PNode = offlineNetwork{}
+
+	self := bc.NodeConfig.ID.Address
+	dest := [32]byte{0xde, 0xad}
+
+	_, err := bc.SubmitTxn(dest, 5000)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "insufficient funds")
+
+	for _, amount := range []float64{0, -10} {
+		_, err = bc.SubmitTxn(dest, amount)
+		require.Error(t, err, "amount %v should be rejected", amount)
+		assert.Contains(t, err.Error(), "must be positive")
+	}
+
+	_, err = bc.SubmitTxn(self, 10)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "own address")
+
+	// Nothing rejected reaches the mempool
+	assert.Empty(t, bc.TxnPool.txns)
+
+	txHash, err := bc.SubmitTxn(dest, 1000)
+	require.NoError(t, err, "spending the whole balance should be allowed")
+	_, pending := bc.TxnPool.GetTransactionByHash(txHash)
+	assert.True(t, pending)
+}
+
+// TestSplitTransaction tests that a transaction with several outputs pays all of them at once,
+// rolls back cleanly, and pays none of them when the sender can't cover the total
+func TestSplitTransaction(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	from := bc.NodeConfig.ID.Address
+	outputs := []block.TxOutput{
+		{ToAddress: [32]byte{0xa1}, Amount: 100},
+		{ToAddress: [32]byte{0xa2}, Amount: 200},
+		{ToAddress: [32]byte{0xa3}, Amount: 300},
+	}
+	balances := func() []float64 {
+		result := []float64{}
+		for _, address := range [][32]byte{from, outputs[0].ToAddress, outputs[1].ToAddress, outputs[2].ToAddress} {
+			balance, err := bc.mainDB.GetAccountBalanceOrZero(&address)
+			require.NoError(t, err)
+			result = append(result, balance)
+		}
+		return result
+	}
+
+	txn, err := block.NewSplitTransaction(from, outputs, 1, 1)
+	require.NoError(t, err)
+	txn.Sign(&bc.NodeConfig.ID.PrvKey)
+	b := &block.Block{PreHash: bc.GenesisBlock().Hash(), Height: 1, Txn: *txn}
+
+	require.NoError(t, applyTestBlock(bc, b))
+	assert.Equal(t, []float64{400, 100, 200, 300}, balances())
+	assert.Equal(t, uint64(2), bc.NextNonce(from))
+
+	require.NoError(t, rollbackTestBlock(bc, b))
+	assert.Equal(t, []float64{1000, 0, 0, 0}, balances())
+	assert.Equal(t, uint64(1), bc.NextNonce(from))
+
+	// The total is checked before any output is paid
+	outputs[2].Amount = 800
+	expensive, err := block.NewSplitTransaction(from, outputs, 1, 1)
+	require.NoError(t, err)
+	expensive.Sign(&bc.NodeConfig.ID.PrvKey)
+	require.NoError(t, applyTestBlock(bc, txnBlock(bc.GenesisBlock(), expensive)))
+	assert.Equal(t, []float64{1000, 0, 0, 0}, balances())
+	assert.Equal(t, uint64(1), bc.NextNonce(from))
+
+	bc.P2PNode = offlineNetwork{}
+	_, err = bc.SubmitSplitTxn(outputs)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "insufficient funds")
+	assert.Empty(t, bc.TxnPool.txns)
+}
+
+// relayCountNetwork counts the transactions broadcast to peers
+type relayCountNetwork struct {
+	offlineNetwork
+	relayed int
+}
+
+func (n *relayCountNetwork) BroadcastTransaction(tx *block.Transaction) error {
+	n.relayed++
+	return nil
+}
+
+// TestGossipedTxnDeduplicated tests that a transaction received twice is pooled and relayed
+// once, and that one already in the chain is neither
+func TestGossipedTxnDeduplicated(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+	network := &relayCountNetwork{}
+	bc.P2PNode = network
+
+	tx := signedTransfer(bc, 1)
+	require.NoError(t, bc.AddTxn(&tx))
+	echo := tx
+	assert.ErrorIs(t, bc.AddTxn(&echo), p2p.ErrKnownTxn)
+	assert.Equal(t, 1, bc.MempoolStats().Pending)
+	assert.Equal(t, 1, network.relayed)
+
+	confirmed := signedTransfer(bc, 2)
+	confirmedHash := confirmed.Hash()
+	indexTxn(t, bc, confirmedHash, 2)
+	assert.ErrorIs(t, bc.AddTxn(&confirmed), p2p.ErrKnownTxn)
+	assert.Equal(t, 1, bc.MempoolStats().Pending)
+	assert.Equal(t, 1, network.relayed)
+
+	// Once mined and dropped from the pool the first is still known from the chain
+	txHash := tx.Hash()
+	indexTxn(t, bc, txHash, 1)
+	require.NoError(t, bc.TxnPool.removeTransaction(txHash))
+	_, pending := bc.TxnPool.GetTransactionByHash(txHash)
+	assert.False(t, pending)
+	assert.ErrorIs(t, bc.AddTxn(&echo), p2p.ErrKnownTxn)
+	assert.Equal(t, 1, network.relayed)
+}
+
+// TestAddTxnValidation tests that a transaction from a peer is held to the same amount checks
+// as the node's own before it is pooled or relayed
+func TestAddTxnValidation(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+	network := &relayCountNetwork{}
+	bc.P2PNode = network
+
+	for _, amount := range []float64{0, -100, math.NaN(), math.Inf(1)} {
+		txn := signedTransfer(bc, 1)
+		txn.Amount = amount
+		txn.Sign(&bc.NodeConfig.ID.PrvKey)
+		assert.Error(t, bc.AddTxn(&txn), "amount %v should be rejected", amount)
+	}
+
+	outputs := []block.TxOutput{{ToAddress: [32]byte{0xa1}, Amount: 10}, {ToAddress: [32]byte{0xa2}, Amount: -5}}
+	split, err := block.NewSplitTransaction(bc.NodeConfig.ID.Address, outputs, 1, 1)
+	require.NoError(t, err)
+	split.Sign(&bc.NodeConfig.ID.PrvKey)
+	assert.Error(t, bc.AddTxn(split), "negative output should be rejected")
+
+	assert.Empty(t, bc.TxnPool.txns)
+	assert.Zero(t, network.relayed)
+
+	txn := signedTransfer(bc, 1)
+	require.NoError(t, bc.AddTxn(&txn))
+	assert.Equal(t, 1, network.relayed)
+}
+
+// TestAddTxnChecksPeerTxn tests that a transaction from a peer is only pooled when signed by
+// its sender for one of the next few heights and covered by the sender's balance, so a forged
+// fee cannot push the node's own transactions out of a full pool
+func TestAddTxnChecksPeerTxn(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+	network := &relayCountNetwork{}
+	bc.P2PNode = network
+	bc.NodeConfig.MaxMempoolSize = 1
+
+	// Signed by another key, whether or not the sender names that key's address
+	other, err := ecdsa_da.GenerateKeyPair()
+	require.NoError(t, err)
+	forged := signedTransfer(bc, 1)
+	forged.Fee = 100
+	forged.Sign(other)
+	assert.Error(t, bc.AddTxn(&forged), "transaction signed by another key should be rejected")
+	forged.FromAddress = ecdsa_da.PublicKeyToAddress(&other.PublicKey)
+	forged.Sign(other)
+	assert.ErrorIs(t, bc.AddTxn(&forged), rpc.ErrInsufficientFunds, "unfunded sender should be rejected")
+
+	// A valid signature over altered contents
+	tampered := signedTransfer(bc, 1)
+	tampered.Fee = 100
+	assert.Error(t, bc.AddTxn(&tampered), "transaction altered after signing should be rejected")
+
+	// Heights the chain already reached or will not reach soon
+	for _, height := range []uint64{0, 1 + maxTxnLookahead, 1 << 40} {
+		txn := signedTransfer(bc, height)
+		assert.Error(t, bc.AddTxn(&txn), "transaction for height %d should be rejected", height)
+	}
+
+	// More than the sender holds, counting the fee
+	overdrawn := signedTransfer(bc, 1)
+	overdrawn.Amount, overdrawn.Fee = 999.5, 1
+	overdrawn.Sign(&bc.NodeConfig.ID.PrvKey)
+	assert.ErrorIs(t, bc.AddTxn(&overdrawn), rpc.ErrInsufficientFunds)
+
+	assert.Empty(t, bc.TxnPool.txns)
+	assert.Zero(t, network.relayed)
+
+	// A transaction at the last height in reach is pooled, and only a higher fee replaces it
+	txn := signedTransfer(bc, maxTxnLookahead)
+	txn.Fee = 1
+	txn.Sign(&bc.NodeConfig.ID.PrvKey)
+	require.NoError(t, bc.AddTxn(&txn))
+	sameFee := txn
+	sameFee.Nonce = 2
+	sameFee.Sign(&bc.NodeConfig.ID.PrvKey)
+	assert.ErrorIs(t, bc.AddTxn(&sameFee), rpc.ErrMempoolFull)
+	higherFee := sameFee
+	higherFee.Fee = 2
+	higherFee.Sign(&bc.NodeConfig.ID.PrvKey)
+	require.NoError(t, bc.AddTxn(&higherFee))
+	pooled, _ := bc.TxnPool.GetTransaction(maxTxnLookahead)
+	assert.Equal(t, higherFee.Hash(), pooled.Hash())
+	assert.Equal(t, 2, network.relayed)
+}
+
+// TestTxnFeePaidToMiner tests that a transaction's fee moves from the sender to the block's
+// miner with a receipt, is only taken along with the amount, and is refunded on rollback
+func TestTxnFeePaidToMiner(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	sender := bc.NodeConfig.ID.Address
+	bob := [32]byte{0xb0}
+	minerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	minerPub := ecdsa_da.PublicKeyToBytes(&minerKey.PublicKey)
+	miner := blockMiner(&block.Block{PublicKey: minerPub})
+
+	mine := func(parent *block.Block, amount, fee float64, nonce uint64) *block.Block {
+		txn := block.Transaction{FromAddress: sender, ToAddress: bob, Amount: amount, Fee: fee, Height: parent.Height + 1, Nonce: nonce}
+		txn.Sign(&bc.NodeConfig.ID.PrvKey)
+		return &block.Block{PreHash: parent.Hash(), Height: parent.Height + 1, Txn: txn, PublicKey: minerPub}
+	}
+	balance := func(address [32]byte) float64 {
+		b, err := bc.mainDB.GetAccountBalanceOrZero(&address)
+		require.NoError(t, err)
+		return b
+	}
+
+	paid := mine(bc.GenesisBlock(), 100, 2.5, 1)
+	require.NoError(t, applyTestBlock(bc, paid))
+	assert.Equal(t, 897.5, balance(sender))
+	assert.Equal(t, 100.0, balance(bob))
+	assert.Equal(t, 2.5, balance(miner))
+
+	receipts, err := bc.GetBlockReceipts(paid.Hash())
+	require.NoError(t, err)
+	assert.Contains(t, receipts, rpc.Receipt{TxHash: paid.Txn.Hash(), From: sender, To: miner, Amount: 2.5, Success: true})
+
+	// The amount alone is covered, with the fee it is not, so nothing moves
+	unpaid := mine(paid, 897, 1, 2)
+	require.NoError(t, applyTestBlock(bc, unpaid))
+	assert.Equal(t, 897.5, balance(sender))
+	assert.Equal(t, 2.5, balance(miner))
+
+	require.NoError(t, rollbackTestBlock(bc, unpaid))
+	require.NoError(t, rollbackTestBlock(bc, paid))
+	assert.Equal(t, 1000.0, balance(sender))
+	assert.Equal(t, 0.0, balance(miner))
+
+	// A negative fee would take coins from the miner
+	assert.Error(t, applyTestBlock(bc, mine(bc.GenesisBlock(), 10, -1, 1)))
+}
+
+// TestAccountHistoryIndex tests that applied blocks are indexed under their sender and
+// recipients and that rolling a block back removes its entries
+func TestAccountHistoryIndex(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	miner := bc.NodeConfig.ID.Address
+	alice, bob := [32]byte{0xa1}, [32]byte{0xb0}
+	parent := bc.GenesisBlock()
+	var blocks []*block.Block
+	for i, to := range [][32]byte{alice, bob} {
+		txn := block.Transaction{FromAddress: miner, ToAddress: to, Amount: 10, Height: uint64(i + 1), Nonce: uint64(i + 1)}
+		txn.Sign(&bc.NodeConfig.ID.PrvKey)
+		b := &block.Block{
+			PreHash:   parent.Hash(),
+			Height:    uint64(i + 1),
+			Txn:       txn,
+			PublicKey: ecdsa_da.PublicKeyToBytes(&bc.NodeConfig.ID.PubKey),
+		}
+		require.NoError(t, applyTestBlock(bc, b))
+		blocks = append(blocks, b)
+		parent = b
+	}
+
+	history, err := bc.GetAccountHistory(miner, 0, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []rpc.AccountTxn{
+		{Height: 2, TxHash: blocks[1].Txn.Hash()},
+		{Height: 1, TxHash: blocks[0].Txn.Hash()},
+	}, history, "outgoing transactions, newest first")
+
+	history, err = bc.GetAccountHistory(alice, 0, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []rpc.AccountTxn{{Height: 1, TxHash: blocks[0].Txn.Hash()}}, history, "incoming transaction")
+
+	history, err = bc.GetAccountHistory(miner, 1, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []rpc.AccountTxn{{Height: 1, TxHash: blocks[0].Txn.Hash()}}, history, "second page")
+
+	require.NoError(t, rollbackTestBlock(bc, blocks[1]))
+
+	history, err = bc.GetAccountHistory(miner, 0, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []rpc.AccountTxn{{Height: 1, TxHash: blocks[0].Txn.Hash()}}, history)
+	history, err = bc.GetAccountHistory(bob, 0, 10)
+	require.NoError(t, err)
+	assert.Empty(t, history)
+}
@@ -12,12 +12,18 @@ import (
 
 	"github.com/nanlour/da/src/block"
 	"github.com/nanlour/da/src/ecdsa_da"
+	"github.com/nanlour/da/src/p2p"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 // setupTestNetwork creates a network of blockchain nodes for testing
 func setupTestNetwork(t *testing.T, nodeCount int) ([]*BlockChain, func()) {
+	return setupTestNetworkWith(t, nodeCount, nil)
+}
+
+// setupTestNetworkWith creates a network of blockchain nodes, letting the caller adjust each config before Init
+func setupTestNetworkWith(t *testing.T, nodeCount int, configure func(i int, config *Config)) ([]*BlockChain, func()) {
 	// Create temp directories for each node
 	tempBaseDir, err := os.MkdirTemp("", "blockchain_network_test_")
 	require.NoError(t, err)
@@ -26,7 +32,6 @@ func setupTestNetwork(t *testing.T, nodeCount int) ([]*BlockChain, func()) {
 	nodes := make([]*BlockChain, nodeCount)
 	nodeAddrs := make([]string, nodeCount)
 
-	stakeSum := float64(nodeCount * 100)
 	initStake := map[[32]byte]float64{}
 	initBank := map[[32]byte]float64{}
 
@@ -46,12 +51,6 @@ func setupTestNetwork(t *testing.T, nodeCount int) ([]*BlockChain, func()) {
 		// Create unique address for this node
 		address := ecdsa_da.PublicKeyToAddress(&privateKey.PublicKey)
 
-		// Set up bootstrap peers (all nodes except self)
-		bootstrapPeers := make([]string, 0)
-		if i != 0 { // Don't connect to self
-			bootstrapPeers = append(bootstrapPeers, nodeAddrs[0]+"/p2p")
-		}
-
 		initStake[address] = 100
 		initBank[address] = 100
 
@@ -62,13 +61,14 @@ func setupTestNetwork(t *testing.T, nodeCount int) ([]*BlockChain, func()) {
 				PubKey:  privateKey.PublicKey,
 				Address: address,
 			},
-			StakeMine:        100,
 			MiningDifficulty: 5000,
 			DbPath:           filepath.Join(tempBaseDir, fmt.Sprintf("node%d", i)),
 			RPCPort:          9000 + i,
 			P2PListenAddr:    nodeAddrs[i],
-			BootstrapPeer:    bootstrapPeers,
-			StakeSum:         stakeSum,
+			Mining:           true,
+		}
+		if configure != nil {
+			configure(i, config)
 		}
 
 		// Initialize blockchain
@@ -79,6 +79,11 @@ func setupTestNetwork(t *testing.T, nodeCount int) ([]*BlockChain, func()) {
 	for i := range nodeCount {
 		nodes[i].NodeConfig.InitStake = initStake
 		nodes[i].NodeConfig.InitBank = initBank
+		// Every other node bootstraps from node 0, whose peer ID is only known once it started.
+		// mDNS is off by default, so this is the only way the nodes find each other.
+		if i != 0 {
+			nodes[i].NodeConfig.BootstrapPeer = []string{nodeAddrs[0] + "/p2p/" + nodes[0].P2PNode.(*p2p.Service).ID().String()}
+		}
 		err = nodes[i].Init()
 		require.NoError(t, err)
 		// Give time for ndoe initial
@@ -133,37 +138,27 @@ func TestBlockchainNetworkSync(t *testing.T) {
 	// Wait for block propagation
 	time.Sleep(200 * time.Second)
 
-	// Check that all nodes have the new block
-	maxRetries := 3
-	var tips []block.Block
-	for attempt := range maxRetries {
-		tips = make([]block.Block, len(nodes))
-		allEqual := true
-		var firstHash [32]byte
-
-		for i, node := range nodes {
+	// Stop mining so the tips can settle, then check that all nodes agree on one
+	for _, node := range nodes {
+		node.StopMining()
+	}
+	require.Eventually(t, func() bool {
+		first, err := nodes[0].GetTipBlock()
+		if err != nil {
+			return false
+		}
+		for _, node := range nodes[1:] {
 			tip, err := node.GetTipBlock()
-			require.NoError(t, err, "Failed to get tip for node %d", i)
-			tips[i] = *tip
-			if i == 0 {
-				firstHash = tip.Hash()
-			} else if tipHash := tip.Hash(); string(tipHash[:]) != string(firstHash[:]) {
-				allEqual = false
+			if err != nil || tip.Hash() != first.Hash() {
+				return false
 			}
 		}
+		return true
+	}, 60*time.Second, 500*time.Millisecond, "All nodes should have the same tip block after propagation")
 
-		if allEqual {
-			break
-		}
-		if attempt < maxRetries-1 {
-			time.Sleep(7 * time.Second)
-		}
-	}
-
-	// Final assertion
-	for i := 1; i < len(tips); i++ {
-		assert.Equal(t, tips[0].Hash(), tips[i].Hash(), "All nodes should have the same tip block after propagation")
-	}
+	tip, err := nodes[0].GetTipBlock()
+	require.NoError(t, err)
+	assert.Greater(t, tip.Height, node0TipBefore.Height, "The network should have mined blocks")
 }
 
 // TestTransactionPropagation tests that transactions propagate across the network
@@ -192,13 +187,41 @@ func TestTransactionPropagation(t *testing.T) {
 		receiverBalanceBefore = 0
 	}
 
-	// Node 0 sends transaction to Node 1
+	// Node 0 sends transaction to Node 1. It is only valid in the block after the tip, and
+	// another node may mine that block before the transaction reaches it, so it is sent again
+	// until a block includes it.
 	sendAmount := 50.0
-	err = nodes[0].SendTxn(receiverAddr, sendAmount)
-	require.NoError(t, err)
+	var confirmedHeight uint64
+	deadline := time.Now().Add(2 * time.Minute)
+	for confirmedHeight == 0 && time.Now().Before(deadline) {
+		hash, err := nodes[0].SubmitTxn(receiverAddr, sendAmount)
+		require.NoError(t, err)
+		txn, ok := nodes[0].TxnPool.GetTransactionByHash(hash)
+		require.True(t, ok)
+
+		for time.Now().Before(deadline) {
+			time.Sleep(200 * time.Millisecond)
+			confirmed, height, _, err := nodes[0].GetTransactionStatus(hash)
+			if err == nil && confirmed {
+				confirmedHeight = height
+				break
+			}
+			tip, err := nodes[0].GetTipBlock()
+			require.NoError(t, err)
+			if tip.Height >= txn.Height {
+				// Its block went by without it, drop it so the next one reuses its nonce
+				require.NoError(t, nodes[0].TxnPool.removeTransaction(txn.Hash()))
+				break
+			}
+		}
+	}
+	require.NotZero(t, confirmedHeight, "transaction was never included in a block")
 
-	// Wait for transaction to be mined in a block and propagated
-	time.Sleep(10 * time.Second)
+	// Wait for the including block to reach node 2
+	require.Eventually(t, func() bool {
+		tip, err := nodes[2].GetTipBlock()
+		return err == nil && tip.Height >= confirmedHeight
+	}, 30*time.Second, 200*time.Millisecond)
 
 	// Check that transaction was processed across all nodes
 	// In an actual network, we'd need to mine a block to confirm the transaction
@@ -239,35 +262,59 @@ func TestBlockchainConsensus(t *testing.T) {
 	initialTip2, err := nodes[1].GetTipBlock()
 	require.NoError(t, err)
 
-	// Both should start with the same genesis block
-	assert.Equal(t, initialTip1.Hash(), initialTip2.Hash(), "All nodes should start with the same genesis block")
+	// Both should start from the same genesis block, node 0 may have mined on it already
+	assert.Equal(t, nodes[0].GenesisBlock().Hash(), nodes[1].GenesisBlock().Hash(), "All nodes should start with the same genesis block")
 
-	// Let the nodes run for a while and possibly mine blocks
-	time.Sleep(20 * time.Second)
+	// Both nodes advance beyond where they started, however long mining takes under load
+	for i, initial := range []*block.Block{initialTip1, initialTip2} {
+		node := nodes[i]
+		require.Eventually(t, func() bool {
+			tip, err := node.GetTipBlock()
+			return err == nil && tip.Height > initial.Height
+		}, 2*time.Minute, 500*time.Millisecond, "Node %d should have advanced beyond height %d", i+1, initial.Height)
+	}
 
-	// Get final tip blocks
-	finalTip1, err := nodes[0].GetTipBlock()
-	require.NoError(t, err)
-	finalTip2, err := nodes[1].GetTipBlock()
+	// And settle on the same tip
+	require.Eventually(t, func() bool {
+		tip1, err := nodes[0].GetTipBlock()
+		if err != nil {
+			return false
+		}
+		tip2, err := nodes[1].GetTipBlock()
+		return err == nil && tip1.Hash() == tip2.Hash()
+	}, 60*time.Second, 500*time.Millisecond, "Both nodes should settle on the same tip")
+
+	tip, err := nodes[0].GetTipBlock()
 	require.NoError(t, err)
+	t.Logf("Nodes settled at tip height %d", tip.Height)
+}
 
-	// Check that both nodes have advanced beyond the initial block
-	assert.Greater(t, finalTip1.Height, initialTip1.Height, "Node 1 should have mined new blocks")
-	assert.Greater(t, finalTip2.Height, initialTip2.Height, "Node 2 should have mined new blocks")
+// TestNonMiningNodeSyncs tests that a validating-only node follows a mining peer without producing blocks
+func TestNonMiningNodeSyncs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping network test in short mode")
+	}
 
-	// In a real consensus, both nodes would eventually have the same tip
-	// This depends on mining rate, network conditions, etc., so we can't assert equality
-	// Instead, we check that they've both advanced and log the final state
-	t.Logf("Node 1 tip height: %d, Node 2 tip height: %d", finalTip1.Height, finalTip2.Height)
+	nodes, cleanup := setupTestNetworkWith(t, 2, func(i int, config *Config) {
+		config.Mining = i == 0
+	})
+	defer cleanup()
 
-	// Wait for potential synchronization
-	time.Sleep(5 * time.Second)
+	assert.True(t, nodes[0].IsMining(), "Node 0 should be mining")
+	assert.False(t, nodes[1].IsMining(), "Node 1 should not be mining")
 
-	// Check if both nodes have the highest block
-	tip1, _ := nodes[0].GetTipBlock()
-	tip2, _ := nodes[1].GetTipBlock()
+	// Let node 0 mine and node 1 sync
+	time.Sleep(20 * time.Second)
 
-	// Log final heights
-	t.Logf("After sync - Node 1 tip height: %d, Node 2 tip height: %d",
-		tip1.Height, tip2.Height)
+	tip, err := nodes[1].GetTipBlock()
+	require.NoError(t, err)
+	assert.Greater(t, tip.Height, uint64(0), "Non-mining node should sync blocks from its peer")
+
+	// Walk node 1's chain and check it never produced a block itself
+	myKey := ecdsa_da.PublicKeyToBytes(&nodes[1].NodeConfig.ID.PubKey)
+	for tip.Height > 0 {
+		assert.NotEqual(t, myKey, tip.PublicKey, "Non-mining node should never produce blocks")
+		tip, err = nodes[1].GetBlockByHash(tip.PreHash[:])
+		require.NoError(t, err)
+	}
 }
@@ -0,0 +1,45 @@
+package consensus
+
+import "time"
+
+// Clock is the time source of the background loops, tests swap it for one they can advance
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the part of time.Timer the loops use
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// SetClock replaces the wall clock, it must be called before Init
+func (bc *BlockChain) SetClock(clock Clock) {
+	bc.clock = clock
+}
+
+func (bc *BlockChain) getClock() Clock {
+	if bc.clock == nil {
+		return realClock{}
+	}
+	return bc.clock
+}
@@ -0,0 +1,35 @@
+package consensus
+
+import (
+	"log"
+	"time"
+)
+
+// compactLoop compacts the database every interval until the node stops, reclaiming the
+// space of entries that reorgs deleted or overwrote
+func (bc *BlockChain) compactLoop(interval time.Duration) {
+	clock := bc.getClock()
+	for {
+		timer := clock.NewTimer(interval)
+		select {
+		case <-bc.quit:
+			timer.Stop()
+			return
+
+		case <-timer.C():
+			before, _ := bc.mainDB.ApproximateSize()
+			start := clock.Now()
+			if err := bc.mainDB.Compact(); err != nil {
+				log.Printf("Database compaction failed: %v", err)
+				continue
+			}
+			after, _ := bc.mainDB.ApproximateSize()
+			log.Printf("Compacted database from %d to %d bytes in %v", before, after, clock.Now().Sub(start))
+		}
+	}
+}
+
+// GetDBSize returns the approximate bytes the node's database takes on disk
+func (bc *BlockChain) GetDBSize() (uint64, error) {
+	return bc.mainDB.ApproximateSize()
+}
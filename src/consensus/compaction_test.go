@@ -0,0 +1,49 @@
+package consensus
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/nanlour/da/src/db"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCompactLoop tests that the node's compaction loop reclaims deleted keys and stops with the node
+func TestCompactLoop(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	value := bytes.Repeat([]byte{0xab}, 1024)
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = db.PrefixKey(0xee, []byte{byte(i >> 8), byte(i)})
+		require.NoError(t, bc.mainDB.Insert(keys[i], value))
+	}
+	require.NoError(t, bc.mainDB.Compact())
+	full, err := bc.GetDBSize()
+	require.NoError(t, err)
+	require.NotZero(t, full)
+	for _, key := range keys {
+		require.NoError(t, bc.mainDB.Delete(key))
+	}
+
+	bc.quit = make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		bc.compactLoop(10 * time.Millisecond)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool {
+		size, err := bc.GetDBSize()
+		return err == nil && size < full/10
+	}, 5*time.Second, 10*time.Millisecond)
+
+	close(bc.quit)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("compaction loop did not stop")
+	}
+}
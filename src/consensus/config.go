@@ -6,7 +6,16 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"errors"
+	"math"
+	"net"
 	"os"
+	"strconv"
+	"time"
+
+	"github.com/nanlour/da/src/block"
+	"github.com/nanlour/da/src/db"
+	"github.com/nanlour/da/src/p2p"
+	"github.com/nanlour/da/src/rpc"
 )
 
 // ConfigJSON is a JSON-friendly version of Config
@@ -16,15 +25,60 @@ type ConfigJSON struct {
 		PublicKey  string `json:"public_key"`  // PEM format
 		Address    string `json:"address"`     // Hex encoded
 	} `json:"id"`
-	StakeMine        float64            `json:"stake_mine"`
 	MiningDifficulty uint64             `json:"mining_difficulty"`
+	DifficultyFloor  uint64             `json:"difficulty_floor,omitempty"`
+	DifficultyCap    float64            `json:"difficulty_cap,omitempty"`
+	MaxDifficulty    uint64             `json:"max_difficulty,omitempty"`
 	DbPath           string             `json:"db_path"`
 	RPCPort          int                `json:"rpc_port"`
+	RPCBindAddr      string             `json:"rpc_bind_addr,omitempty"`
+	RPCSocket        string             `json:"rpc_socket,omitempty"`
 	P2PListenAddr    string             `json:"p2p_listen_addr"`
+	P2PListenAddrs   []string           `json:"p2p_listen_addrs,omitempty"`
+	AnnounceAddrs    []string           `json:"announce_addrs,omitempty"`
 	BootstrapPeer    []string           `json:"bootstrap_peer"`
 	InitStake        map[string]float64 `json:"init_stake"` // Hex-encoded address -> stake
-	StakeSum         float64            `json:"stake_sum"`
-	InitBank         map[string]float64 `json:"init_bank"` // Hex-encoded address -> balance
+	InitBank         map[string]float64 `json:"init_bank"`  // Hex-encoded address -> balance
+	Genesis          GenesisJSON        `json:"genesis"`
+	Mining           *bool              `json:"mining,omitempty"` // Defaults to true when omitted
+	DB               DBOptionsJSON      `json:"db"`
+	Faucet           FaucetJSON         `json:"faucet"`
+	BlockReward      float64            `json:"block_reward,omitempty"`
+	GossipQueueSize  int                `json:"gossip_queue_size,omitempty"`
+	GossipWorkers    int                `json:"gossip_workers,omitempty"`
+	MaxBlockTxns     int                `json:"max_block_txns,omitempty"`
+	MDNSEnabled      bool               `json:"mdns_enabled,omitempty"`
+	SyncSeconds      int                `json:"sync_interval_seconds,omitempty"`
+	StatusSeconds    int                `json:"status_interval_seconds,omitempty"`
+	SyncWindow       uint64             `json:"sync_window,omitempty"`
+	WireFormat       string             `json:"wire_format,omitempty"`
+	HealthPort       int                `json:"health_port,omitempty"`
+	MaxMempoolSize   int                `json:"max_mempool_size,omitempty"`
+	TxnFee           float64            `json:"txn_fee,omitempty"`
+	MinStake         float64            `json:"min_stake,omitempty"`
+	CheckInvariants  bool               `json:"check_invariants,omitempty"`
+}
+
+// FaucetJSON is a JSON-friendly version of the faucet settings
+type FaucetJSON struct {
+	Enabled         bool    `json:"enabled,omitempty"`
+	Amount          float64 `json:"amount,omitempty"`
+	CooldownSeconds int64   `json:"cooldown_seconds,omitempty"` // Zero uses the default
+}
+
+// DBOptionsJSON is a JSON-friendly version of db.DBOptions, omitted values use the defaults
+type DBOptionsJSON struct {
+	BlockCacheSize  int `json:"block_cache_size,omitempty"` // Bytes
+	WriteBuffer     int `json:"write_buffer,omitempty"`     // Bytes
+	BloomFilterBits int `json:"bloom_filter_bits,omitempty"`
+	CompactSeconds  int `json:"compact_interval_seconds,omitempty"` // Zero disables periodic compaction
+}
+
+// GenesisJSON is a JSON-friendly version of GenesisConfig
+type GenesisJSON struct {
+	NetworkID string             `json:"network_id"`
+	EpochHash string             `json:"epoch_hash,omitempty"` // Hex encoded, empty means the default
+	Alloc     map[string]float64 `json:"alloc,omitempty"`      // Hex-encoded address -> balance
 }
 
 // LoadConfigFromFile loads configuration from a JSON file
@@ -48,13 +102,76 @@ func LoadConfigFromFile(filePath string) (*Config, error) {
 // ToConfig converts a ConfigJSON to Config
 func (cj *ConfigJSON) ToConfig() (*Config, error) {
 	config := &Config{
-		StakeMine:        cj.StakeMine,
 		MiningDifficulty: cj.MiningDifficulty,
+		DifficultyFloor:  cj.DifficultyFloor,
+		DifficultyCap:    cj.DifficultyCap,
+		MaxDifficulty:    cj.MaxDifficulty,
 		DbPath:           cj.DbPath,
 		RPCPort:          cj.RPCPort,
+		RPCBindAddr:      cj.RPCBindAddr,
+		RPCSocket:        cj.RPCSocket,
 		P2PListenAddr:    cj.P2PListenAddr,
+		P2PListenAddrs:   cj.P2PListenAddrs,
+		AnnounceAddrs:    cj.AnnounceAddrs,
 		BootstrapPeer:    cj.BootstrapPeer,
-		StakeSum:         cj.StakeSum,
+		Mining:           cj.Mining == nil || *cj.Mining,
+		DBOptions: db.DBOptions{
+			BlockCacheSize:  cj.DB.BlockCacheSize,
+			WriteBuffer:     cj.DB.WriteBuffer,
+			BloomFilterBits: cj.DB.BloomFilterBits,
+		},
+		FaucetEnabled:   cj.Faucet.Enabled,
+		FaucetAmount:    cj.Faucet.Amount,
+		FaucetCooldown:  time.Duration(cj.Faucet.CooldownSeconds) * time.Second,
+		BlockReward:     cj.BlockReward,
+		CompactInterval: time.Duration(cj.DB.CompactSeconds) * time.Second,
+		GossipQueueSize: cj.GossipQueueSize,
+		GossipWorkers:   cj.GossipWorkers,
+		MaxBlockTxns:    cj.MaxBlockTxns,
+		MDNSEnabled:     cj.MDNSEnabled,
+		SyncInterval:    time.Duration(cj.SyncSeconds) * time.Second,
+		StatusInterval:  time.Duration(cj.StatusSeconds) * time.Second,
+		SyncWindow:      cj.SyncWindow,
+		WireFormat:      cj.WireFormat,
+		HealthPort:      cj.HealthPort,
+		MaxMempoolSize:  cj.MaxMempoolSize,
+		TxnFee:          cj.TxnFee,
+		MinStake:        cj.MinStake,
+		CheckInvariants: cj.CheckInvariants,
+	}
+
+	if cj.MaxMempoolSize < 0 {
+		return nil, errors.New("max_mempool_size must not be negative")
+	}
+	if !(cj.TxnFee >= 0) || math.IsInf(cj.TxnFee, 1) {
+		return nil, errors.New("txn_fee must be a non-negative amount")
+	}
+	if cj.HealthPort < 0 || cj.HealthPort > 65535 {
+		return nil, errors.New("health_port must be between 0 and 65535")
+	}
+	if _, err := p2p.ParseWireFormat(cj.WireFormat); err != nil {
+		return nil, err
+	}
+	if cj.MaxDifficulty > DefaultMaxDifficulty {
+		return nil, errors.New("max_difficulty must fit in a 32-bit int")
+	}
+	if cj.BlockReward < 0 {
+		return nil, errors.New("block_reward must not be negative")
+	}
+	if cj.DB.CompactSeconds < 0 {
+		return nil, errors.New("compact_interval_seconds must not be negative")
+	}
+	if cj.GossipQueueSize < 0 || cj.GossipWorkers < 0 {
+		return nil, errors.New("gossip_queue_size and gossip_workers must not be negative")
+	}
+	if cj.MaxBlockTxns < 0 {
+		return nil, errors.New("max_block_txns must not be negative")
+	}
+	if cj.SyncSeconds < 0 || cj.StatusSeconds < 0 {
+		return nil, errors.New("sync_interval_seconds and status_interval_seconds must not be negative")
+	}
+	if cj.MinStake < 0 {
+		return nil, errors.New("min_stake must not be negative")
 	}
 
 	// Parse ID Account
@@ -83,19 +200,66 @@ func (cj *ConfigJSON) ToConfig() (*Config, error) {
 		config.InitBank[addrBytes] = balance
 	}
 
+	// Parse Genesis
+	config.Genesis.NetworkID = cj.Genesis.NetworkID
+	if cj.Genesis.EpochHash != "" {
+		if config.Genesis.EpochHash, err = hexTo32Bytes(cj.Genesis.EpochHash); err != nil {
+			return nil, err
+		}
+	}
+	config.Genesis.Alloc = make(map[[32]byte]float64)
+	for addrStr, balance := range cj.Genesis.Alloc {
+		var addrBytes [32]byte
+		if addrBytes, err = hexTo32Bytes(addrStr); err != nil {
+			return nil, err
+		}
+		config.Genesis.Alloc[addrBytes] = balance
+	}
+
 	return config, nil
 }
 
 // ToJSON converts a Config to ConfigJSON
 func (c *Config) ToJSON() (*ConfigJSON, error) {
 	configJSON := &ConfigJSON{
-		StakeMine:        c.StakeMine,
 		MiningDifficulty: c.MiningDifficulty,
+		DifficultyFloor:  c.DifficultyFloor,
+		DifficultyCap:    c.DifficultyCap,
+		MaxDifficulty:    c.MaxDifficulty,
 		DbPath:           c.DbPath,
 		RPCPort:          c.RPCPort,
+		RPCBindAddr:      c.RPCBindAddr,
+		RPCSocket:        c.RPCSocket,
 		P2PListenAddr:    c.P2PListenAddr,
+		P2PListenAddrs:   c.P2PListenAddrs,
+		AnnounceAddrs:    c.AnnounceAddrs,
 		BootstrapPeer:    c.BootstrapPeer,
-		StakeSum:         c.StakeSum,
+		Mining:           &c.Mining,
+		DB: DBOptionsJSON{
+			BlockCacheSize:  c.DBOptions.BlockCacheSize,
+			WriteBuffer:     c.DBOptions.WriteBuffer,
+			BloomFilterBits: c.DBOptions.BloomFilterBits,
+			CompactSeconds:  int(c.CompactInterval / time.Second),
+		},
+		Faucet: FaucetJSON{
+			Enabled:         c.FaucetEnabled,
+			Amount:          c.FaucetAmount,
+			CooldownSeconds: int64(c.FaucetCooldown / time.Second),
+		},
+		BlockReward:     c.BlockReward,
+		GossipQueueSize: c.GossipQueueSize,
+		GossipWorkers:   c.GossipWorkers,
+		MaxBlockTxns:    c.MaxBlockTxns,
+		MDNSEnabled:     c.MDNSEnabled,
+		SyncSeconds:     int(c.SyncInterval / time.Second),
+		StatusSeconds:   int(c.StatusInterval / time.Second),
+		SyncWindow:      c.SyncWindow,
+		WireFormat:      c.WireFormat,
+		HealthPort:      c.HealthPort,
+		MaxMempoolSize:  c.MaxMempoolSize,
+		TxnFee:          c.TxnFee,
+		MinStake:        c.MinStake,
+		CheckInvariants: c.CheckInvariants,
 	}
 
 	// Convert ID Account
@@ -131,6 +295,18 @@ func (c *Config) ToJSON() (*ConfigJSON, error) {
 		configJSON.InitBank[hex.EncodeToString(addr[:])] = balance
 	}
 
+	// Convert Genesis
+	configJSON.Genesis.NetworkID = c.Genesis.NetworkID
+	if c.Genesis.EpochHash != ([32]byte{}) {
+		configJSON.Genesis.EpochHash = hex.EncodeToString(c.Genesis.EpochHash[:])
+	}
+	if len(c.Genesis.Alloc) > 0 {
+		configJSON.Genesis.Alloc = make(map[string]float64)
+		for addr, balance := range c.Genesis.Alloc {
+			configJSON.Genesis.Alloc[hex.EncodeToString(addr[:])] = balance
+		}
+	}
+
 	return configJSON, nil
 }
 
@@ -190,3 +366,82 @@ func hexTo32Bytes(hexStr string) ([32]byte, error) {
 	copy(result[:], bytes)
 	return result, nil
 }
+
+// rpcListen returns the network and address the RPC server listens on, the Unix socket when
+// one is set and otherwise RPCPort on the bind address
+func (c *Config) rpcListen() (string, string) {
+	if c.RPCSocket != "" {
+		return "unix", c.RPCSocket
+	}
+	bindAddr := c.RPCBindAddr
+	if bindAddr == "" {
+		bindAddr = rpc.DefaultBindAddr
+	}
+	return "tcp", net.JoinHostPort(bindAddr, strconv.Itoa(c.RPCPort))
+}
+
+// listenAddrs returns every P2P address to listen on, P2PListenAddr first
+func (c *Config) listenAddrs() []string {
+	var addrs []string
+	if c.P2PListenAddr != "" {
+		addrs = append(addrs, c.P2PListenAddr)
+	}
+	return append(addrs, c.P2PListenAddrs...)
+}
+
+// gossipQueue returns the gossip queue size and worker count, zero values fall back to the p2p defaults
+func (c *Config) gossipQueue() (int, int) {
+	size := c.GossipQueueSize
+	if size == 0 {
+		size = p2p.DefaultGossipQueueSize
+	}
+	workers := c.GossipWorkers
+	if workers == 0 {
+		workers = p2p.DefaultGossipWorkers
+	}
+	return size, workers
+}
+
+// defaultMaxBlockTxns is how many transactions a block may carry unless configured, blocks
+// carry exactly one today
+const defaultMaxBlockTxns = 1
+
+// maxBlockSize returns the longest encoding a valid block can have, derived from MaxBlockTxns
+func (c *Config) maxBlockSize() int {
+	txns := c.MaxBlockTxns
+	if txns == 0 {
+		txns = defaultMaxBlockTxns
+	}
+	return block.MaxBlockSize(txns)
+}
+
+// defaultMaxMempoolSize is how many transactions the pool holds unless configured
+const defaultMaxMempoolSize = 4096
+
+// maxMempoolSize returns how many transactions the pool holds before fees decide which stay
+func (c *Config) maxMempoolSize() int {
+	if c.MaxMempoolSize == 0 {
+		return defaultMaxMempoolSize
+	}
+	return c.MaxMempoolSize
+}
+
+// defaultSyncInterval is how often the tip manager asks a peer for its tip unless configured
+const defaultSyncInterval = 5 * time.Second
+
+// syncInterval returns how often the tip manager asks a peer for its tip
+func (c *Config) syncInterval() time.Duration {
+	if c.SyncInterval == 0 {
+		return defaultSyncInterval
+	}
+	return c.SyncInterval
+}
+
+// syncWindow returns how many blocks above the tip a block may be and still be resolved
+// like a fork, blocks further ahead are left to initial block download
+func (c *Config) syncWindow() uint64 {
+	if c.SyncWindow == 0 {
+		return syncBatchSize
+	}
+	return c.SyncWindow
+}
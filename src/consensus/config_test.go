@@ -1,13 +1,20 @@
 package consensus
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/nanlour/da/src/db"
+	"github.com/nanlour/da/src/ecdsa_da"
+	"github.com/nanlour/da/src/p2p"
 )
 
 func TestConfigConversion(t *testing.T) {
@@ -29,21 +36,49 @@ func TestConfigConversion(t *testing.T) {
 			PubKey:  privateKey.PublicKey,
 			Address: address,
 		},
-		StakeMine:        1.5,
 		MiningDifficulty: 10,
+		DifficultyFloor:  20,
+		DifficultyCap:    4,
+		MaxDifficulty:    1 << 20,
 		DbPath:           "/test/path",
 		RPCPort:          8000,
 		P2PListenAddr:    "localhost:9000",
+		P2PListenAddrs:   []string{"localhost:9001"},
+		AnnounceAddrs:    []string{"external:9000"},
 		BootstrapPeer:    []string{"peer1:9001", "peer2:9002"},
 		InitStake: map[[32]byte]float64{
 			address:  100.0,
 			address2: 200.0,
 		},
-		StakeSum: 300.0,
 		InitBank: map[[32]byte]float64{
 			address:  1000.0,
 			address2: 2000.0,
 		},
+		DBOptions: db.DBOptions{
+			BlockCacheSize:  8 << 20,
+			WriteBuffer:     4 << 20,
+			BloomFilterBits: -1,
+		},
+		FaucetEnabled:   true,
+		FaucetAmount:    12.5,
+		FaucetCooldown:  90 * time.Second,
+		BlockReward:     2.5,
+		CompactInterval: time.Hour,
+		GossipQueueSize: 64,
+		GossipWorkers:   2,
+		MaxBlockTxns:    4,
+		MDNSEnabled:     true,
+		SyncInterval:    2 * time.Second,
+		StatusInterval:  30 * time.Second,
+		SyncWindow:      500,
+		WireFormat:      string(p2p.WireJSON),
+		HealthPort:      8081,
+		MaxMempoolSize:  100,
+		TxnFee:          0.25,
+		MinStake:        10,
+		CheckInvariants: true,
+		RPCBindAddr:     "0.0.0.0",
+		RPCSocket:       "/run/da/rpc.sock",
 	}
 
 	// Convert to JSON and back
@@ -58,14 +93,18 @@ func TestConfigConversion(t *testing.T) {
 	}
 
 	// Verify that the values are preserved
-	if newConfig.StakeMine != config.StakeMine {
-		t.Errorf("StakeMine doesn't match: got %v, want %v", newConfig.StakeMine, config.StakeMine)
-	}
 
 	if newConfig.MiningDifficulty != config.MiningDifficulty {
 		t.Errorf("MiningDifficulty doesn't match: got %v, want %v", newConfig.MiningDifficulty, config.MiningDifficulty)
 	}
 
+	if newConfig.DifficultyFloor != config.DifficultyFloor || newConfig.DifficultyCap != config.DifficultyCap {
+		t.Errorf("Difficulty bounds don't match: got %v/%v, want %v/%v", newConfig.DifficultyFloor, newConfig.DifficultyCap, config.DifficultyFloor, config.DifficultyCap)
+	}
+	if newConfig.MaxDifficulty != config.MaxDifficulty {
+		t.Errorf("MaxDifficulty doesn't match: got %v, want %v", newConfig.MaxDifficulty, config.MaxDifficulty)
+	}
+
 	if newConfig.DbPath != config.DbPath {
 		t.Errorf("DbPath doesn't match: got %v, want %v", newConfig.DbPath, config.DbPath)
 	}
@@ -78,12 +117,146 @@ func TestConfigConversion(t *testing.T) {
 		t.Errorf("P2PListenAddr doesn't match: got %v, want %v", newConfig.P2PListenAddr, config.P2PListenAddr)
 	}
 
+	if !reflect.DeepEqual(newConfig.listenAddrs(), []string{"localhost:9000", "localhost:9001"}) {
+		t.Errorf("Listen addresses don't match: got %v", newConfig.listenAddrs())
+	}
+
+	if !reflect.DeepEqual(newConfig.AnnounceAddrs, config.AnnounceAddrs) {
+		t.Errorf("AnnounceAddrs doesn't match: got %v, want %v", newConfig.AnnounceAddrs, config.AnnounceAddrs)
+	}
+
 	if !reflect.DeepEqual(newConfig.BootstrapPeer, config.BootstrapPeer) {
 		t.Errorf("BootstrapPeer doesn't match: got %v, want %v", newConfig.BootstrapPeer, config.BootstrapPeer)
 	}
 
-	if newConfig.StakeSum != config.StakeSum {
-		t.Errorf("StakeSum doesn't match: got %v, want %v", newConfig.StakeSum, config.StakeSum)
+	if newConfig.DBOptions != config.DBOptions {
+		t.Errorf("DBOptions doesn't match: got %v, want %v", newConfig.DBOptions, config.DBOptions)
+	}
+
+	if newConfig.FaucetEnabled != config.FaucetEnabled || newConfig.FaucetAmount != config.FaucetAmount || newConfig.FaucetCooldown != config.FaucetCooldown {
+		t.Errorf("Faucet settings don't match: got %v/%v/%v, want %v/%v/%v", newConfig.FaucetEnabled, newConfig.FaucetAmount, newConfig.FaucetCooldown, config.FaucetEnabled, config.FaucetAmount, config.FaucetCooldown)
+	}
+
+	if newConfig.BlockReward != config.BlockReward {
+		t.Errorf("BlockReward doesn't match: got %v, want %v", newConfig.BlockReward, config.BlockReward)
+	}
+
+	if newConfig.CompactInterval != config.CompactInterval {
+		t.Errorf("CompactInterval doesn't match: got %v, want %v", newConfig.CompactInterval, config.CompactInterval)
+	}
+
+	if newConfig.GossipQueueSize != config.GossipQueueSize || newConfig.GossipWorkers != config.GossipWorkers {
+		t.Errorf("Gossip queue doesn't match: got %v/%v, want %v/%v", newConfig.GossipQueueSize, newConfig.GossipWorkers, config.GossipQueueSize, config.GossipWorkers)
+	}
+
+	if newConfig.MDNSEnabled != config.MDNSEnabled {
+		t.Errorf("MDNSEnabled doesn't match: got %v, want %v", newConfig.MDNSEnabled, config.MDNSEnabled)
+	}
+
+	if newConfig.SyncInterval != config.SyncInterval {
+		t.Errorf("SyncInterval doesn't match: got %v, want %v", newConfig.SyncInterval, config.SyncInterval)
+	}
+	if newConfig.StatusInterval != config.StatusInterval {
+		t.Errorf("StatusInterval doesn't match: got %v, want %v", newConfig.StatusInterval, config.StatusInterval)
+	}
+	if newConfig.SyncWindow != config.SyncWindow {
+		t.Errorf("SyncWindow doesn't match: got %v, want %v", newConfig.SyncWindow, config.SyncWindow)
+	}
+	if newConfig.WireFormat != config.WireFormat {
+		t.Errorf("WireFormat doesn't match: got %v, want %v", newConfig.WireFormat, config.WireFormat)
+	}
+	if newConfig.HealthPort != config.HealthPort {
+		t.Errorf("HealthPort doesn't match: got %v, want %v", newConfig.HealthPort, config.HealthPort)
+	}
+	if newConfig.MaxMempoolSize != config.MaxMempoolSize || newConfig.TxnFee != config.TxnFee {
+		t.Errorf("Mempool settings don't match: got %v/%v, want %v/%v", newConfig.MaxMempoolSize, newConfig.TxnFee, config.MaxMempoolSize, config.TxnFee)
+	}
+
+	if newConfig.CheckInvariants != config.CheckInvariants {
+		t.Errorf("CheckInvariants doesn't match: got %v, want %v", newConfig.CheckInvariants, config.CheckInvariants)
+	}
+
+	if newConfig.RPCBindAddr != config.RPCBindAddr || newConfig.RPCSocket != config.RPCSocket {
+		t.Errorf("RPC listen address doesn't match: got %q %q, want %q %q", newConfig.RPCBindAddr, newConfig.RPCSocket, config.RPCBindAddr, config.RPCSocket)
+	}
+
+	if newConfig.MinStake != config.MinStake {
+		t.Errorf("MinStake doesn't match: got %v, want %v", newConfig.MinStake, config.MinStake)
+	}
+
+	if newConfig.MaxBlockTxns != config.MaxBlockTxns {
+		t.Errorf("MaxBlockTxns doesn't match: got %v, want %v", newConfig.MaxBlockTxns, config.MaxBlockTxns)
+	}
+
+	configJSON.MaxMempoolSize = -1
+	if _, err := configJSON.ToConfig(); err == nil {
+		t.Errorf("Expected a negative mempool size to be rejected")
+	}
+	configJSON.MaxMempoolSize = 0
+
+	configJSON.TxnFee = -0.5
+	if _, err := configJSON.ToConfig(); err == nil {
+		t.Errorf("Expected a negative transaction fee to be rejected")
+	}
+	configJSON.TxnFee = 0
+
+	configJSON.HealthPort = 70000
+	if _, err := configJSON.ToConfig(); err == nil {
+		t.Errorf("Expected a health port out of range to be rejected")
+	}
+	configJSON.HealthPort = 0
+
+	configJSON.WireFormat = "protobuf"
+	if _, err := configJSON.ToConfig(); err == nil {
+		t.Errorf("Expected an unknown wire format to be rejected")
+	}
+	configJSON.WireFormat = ""
+
+	configJSON.MaxDifficulty = DefaultMaxDifficulty + 1
+	if _, err := configJSON.ToConfig(); err == nil {
+		t.Errorf("Expected a maximum difficulty above the int32 range to be rejected")
+	}
+	configJSON.MaxDifficulty = 0
+
+	configJSON.BlockReward = -1
+	if _, err := configJSON.ToConfig(); err == nil {
+		t.Errorf("Expected a negative block reward to be rejected")
+	}
+	configJSON.BlockReward = 0
+
+	configJSON.DB.CompactSeconds = -1
+	if _, err := configJSON.ToConfig(); err == nil {
+		t.Errorf("Expected a negative compaction interval to be rejected")
+	}
+	configJSON.DB.CompactSeconds = 0
+
+	configJSON.GossipWorkers = -1
+	if _, err := configJSON.ToConfig(); err == nil {
+		t.Errorf("Expected a negative gossip worker count to be rejected")
+	}
+	configJSON.GossipWorkers = 0
+
+	configJSON.MaxBlockTxns = -1
+	if _, err := configJSON.ToConfig(); err == nil {
+		t.Errorf("Expected a negative block transaction limit to be rejected")
+	}
+	configJSON.MaxBlockTxns = 0
+
+	configJSON.SyncSeconds = -1
+	if _, err := configJSON.ToConfig(); err == nil {
+		t.Errorf("Expected a negative sync interval to be rejected")
+	}
+	configJSON.SyncSeconds = 0
+
+	configJSON.StatusSeconds = -1
+	if _, err := configJSON.ToConfig(); err == nil {
+		t.Errorf("Expected a negative status interval to be rejected")
+	}
+	configJSON.StatusSeconds = 0
+
+	configJSON.MinStake = -1
+	if _, err := configJSON.ToConfig(); err == nil {
+		t.Errorf("Expected a negative minimum stake to be rejected")
 	}
 
 	// Check that InitStake and InitBank were correctly converted
@@ -116,7 +289,6 @@ func TestSaveAndLoadConfig(t *testing.T) {
 			PubKey:  privateKey.PublicKey,
 			Address: address,
 		},
-		StakeMine:        2.5,
 		MiningDifficulty: 12,
 		DbPath:           "/test/db/path",
 		RPCPort:          8080,
@@ -125,7 +297,6 @@ func TestSaveAndLoadConfig(t *testing.T) {
 		InitStake: map[[32]byte]float64{
 			address: 150.0,
 		},
-		StakeSum: 150.0,
 		InitBank: map[[32]byte]float64{
 			address: 1500.0,
 		},
@@ -152,9 +323,6 @@ func TestSaveAndLoadConfig(t *testing.T) {
 	}
 
 	// Verify that the values are preserved
-	if loadedConfig.StakeMine != config.StakeMine {
-		t.Errorf("StakeMine doesn't match: got %v, want %v", loadedConfig.StakeMine, config.StakeMine)
-	}
 
 	if loadedConfig.MiningDifficulty != config.MiningDifficulty {
 		t.Errorf("MiningDifficulty doesn't match: got %v, want %v", loadedConfig.MiningDifficulty, config.MiningDifficulty)
@@ -176,10 +344,6 @@ func TestSaveAndLoadConfig(t *testing.T) {
 		t.Errorf("BootstrapPeer doesn't match: got %v, want %v", loadedConfig.BootstrapPeer, config.BootstrapPeer)
 	}
 
-	if loadedConfig.StakeSum != config.StakeSum {
-		t.Errorf("StakeSum doesn't match: got %v, want %v", loadedConfig.StakeSum, config.StakeSum)
-	}
-
 	// Check InitStake and InitBank values
 	for addr, stake := range config.InitStake {
 		if loadedConfig.InitStake[addr] != stake {
@@ -193,3 +357,136 @@ func TestSaveAndLoadConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestGenesisNetworkID(t *testing.T) {
+	var address [32]byte
+	copy(address[:], []byte("test-address-12345678901234567890"))
+
+	configA := &Config{
+		InitBank: map[[32]byte]float64{address: 100.0},
+		Genesis:  GenesisConfig{NetworkID: "testnet-a"},
+	}
+	configB := &Config{
+		InitBank: map[[32]byte]float64{address: 100.0},
+		Genesis:  GenesisConfig{NetworkID: "testnet-b"},
+	}
+
+	if configA.GenesisBlock().Hash() == configB.GenesisBlock().Hash() {
+		t.Errorf("Different network IDs should produce different genesis hashes")
+	}
+
+	// Same configuration must always give the same genesis
+	if configA.GenesisBlock().Hash() != configA.GenesisBlock().Hash() {
+		t.Errorf("Genesis hash should be deterministic")
+	}
+
+	// Allocations are part of the genesis
+	configC := &Config{
+		InitBank: map[[32]byte]float64{address: 200.0},
+		Genesis:  GenesisConfig{NetworkID: "testnet-a"},
+	}
+	if configA.GenesisBlock().Hash() == configC.GenesisBlock().Hash() {
+		t.Errorf("Different allocations should produce different genesis hashes")
+	}
+
+	// So are the initial stake and every parameter blocks are validated with
+	for name, change := range map[string]func(c *Config){
+		"init stake":        func(c *Config) { c.InitStake = map[[32]byte]float64{address: 10} },
+		"mining difficulty": func(c *Config) { c.MiningDifficulty = 1000 },
+		"difficulty floor":  func(c *Config) { c.DifficultyFloor = 7 },
+		"difficulty cap":    func(c *Config) { c.DifficultyCap = 3 },
+		"max difficulty":    func(c *Config) { c.MaxDifficulty = 1 << 20 },
+		"block reward":      func(c *Config) { c.BlockReward = 1 },
+		"min stake":         func(c *Config) { c.MinStake = 5 },
+	} {
+		changed := *configA
+		change(&changed)
+		if changed.GenesisHash() == configA.GenesisHash() {
+			t.Errorf("Different %s should produce a different genesis hash", name)
+		}
+	}
+
+	// Spelling out a default gives the same genesis as leaving it out
+	explicit := *configA
+	explicit.DifficultyFloor = ecdsa_da.DefaultDifficultyFloor
+	explicit.MaxDifficulty = DefaultMaxDifficulty
+	if explicit.GenesisHash() != configA.GenesisHash() {
+		t.Errorf("Explicit defaults should not change the genesis hash")
+	}
+
+	// The allocation and the stake cannot stand in for each other
+	stakeOnly := &Config{InitStake: configA.InitBank, Genesis: configA.Genesis}
+	if stakeOnly.GenesisHash() == (&Config{InitBank: configA.InitBank, Genesis: configA.Genesis}).GenesisHash() {
+		t.Errorf("Balances moved from the allocation to the stake should change the genesis hash")
+	}
+}
+
+func TestGenesisBytesCanonical(t *testing.T) {
+	addresses := [][32]byte{{3}, {1}, {2}, {0xff}, {0x80}}
+	forward := &Config{InitBank: map[[32]byte]float64{}, Genesis: GenesisConfig{NetworkID: "testnet"}}
+	for i, addr := range addresses {
+		forward.InitBank[addr] = float64(i) + 0.5
+	}
+	backward := &Config{InitBank: map[[32]byte]float64{}, Genesis: GenesisConfig{NetworkID: "testnet"}}
+	for i := len(addresses) - 1; i >= 0; i-- {
+		backward.InitBank[addresses[i]] = float64(i) + 0.5
+	}
+
+	for range 10 {
+		if !bytes.Equal(forward.GenesisBytes(), backward.GenesisBytes()) {
+			t.Fatalf("Configs with the same allocations should have the same canonical bytes")
+		}
+	}
+
+	backward.InitBank[[32]byte{1}] = 7
+	if bytes.Equal(forward.GenesisBytes(), backward.GenesisBytes()) {
+		t.Errorf("Different allocations should have different canonical bytes")
+	}
+
+	// The genesis hash only changes along with chainFormat or what genesis commits to
+	existing := &Config{InitBank: map[[32]byte]float64{{1}: 100, {2}: 50.5}}
+	if got := fmt.Sprintf("%x", existing.GenesisBlock().Hash()); got != "be7470c7c1d037272cc5468355ecfcf60a1c27d94032961fa6c53fe56ba53b66" {
+		t.Errorf("Genesis hash changed to %s", got)
+	}
+}
+
+func TestGenesisConversion(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate private key: %v", err)
+	}
+
+	var address [32]byte
+	copy(address[:], []byte("test-address-12345678901234567890"))
+
+	config := &Config{
+		ID: Account{
+			PrvKey:  *privateKey,
+			PubKey:  privateKey.PublicKey,
+			Address: address,
+		},
+		Genesis: GenesisConfig{
+			NetworkID: "testnet-a",
+			EpochHash: [32]byte{'E', 'P', 'O', 'C', 'H'},
+			Alloc:     map[[32]byte]float64{address: 500.0},
+		},
+	}
+
+	configJSON, err := config.ToJSON()
+	if err != nil {
+		t.Fatalf("Failed to convert Config to ConfigJSON: %v", err)
+	}
+
+	newConfig, err := configJSON.ToConfig()
+	if err != nil {
+		t.Fatalf("Failed to convert ConfigJSON to Config: %v", err)
+	}
+
+	if !reflect.DeepEqual(newConfig.Genesis, config.Genesis) {
+		t.Errorf("Genesis doesn't match: got %v, want %v", newConfig.Genesis, config.Genesis)
+	}
+
+	if newConfig.GenesisBlock().Hash() != config.GenesisBlock().Hash() {
+		t.Errorf("Genesis hash should survive a JSON round trip")
+	}
+}
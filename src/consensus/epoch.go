@@ -0,0 +1,28 @@
+package consensus
+
+import (
+	"github.com/nanlour/da/src/rpc"
+)
+
+// GetEpochInfo reports the epoch the tip is in and the difficulty it is mined at. Blocks all
+// commit to the genesis hash as their epoch hash and difficulty is not retargeted yet, so
+// the whole chain is one epoch that starts at genesis. The effective difficulty is the one the
+// miner last drew for the node's key from its stake, each attempt draws a new one.
+func (bc *BlockChain) GetEpochInfo() (rpc.EpochInfo, error) {
+	tip, err := bc.GetTipBlock()
+	if err != nil {
+		return rpc.EpochInfo{}, err
+	}
+
+	genesis := bc.GenesisBlock()
+	floor, capMultiplier := bc.NodeConfig.difficultyBounds()
+	return rpc.EpochInfo{
+		EpochBeginHash:   genesis.Hash(),
+		StartHeight:      genesis.Height,
+		TipHeight:        tip.Height,
+		Difficulty:       bc.MiningStats().Difficulty,
+		MiningDifficulty: bc.NodeConfig.MiningDifficulty,
+		DifficultyFloor:  floor,
+		DifficultyCap:    capMultiplier,
+	}, nil
+}
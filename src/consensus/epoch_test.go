@@ -0,0 +1,49 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/nanlour/da/src/ecdsa_da"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestGetEpochInfo tests that the epoch info follows the tip as the chain advances
+func TestGetEpochInfo(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	bc.P2PNode = offlineNetwork{}
+	bc.MyChain = []*Chain{{Hash: bc.GenesisBlock().Hash()}}
+
+	info, err := bc.GetEpochInfo()
+	require.NoError(t, err)
+	assert.Equal(t, bc.GenesisBlock().Hash(), info.EpochBeginHash)
+	assert.Equal(t, bc.GenesisBlock().Height, info.StartHeight)
+	assert.Equal(t, bc.GenesisBlock().Height, info.TipHeight)
+	assert.Equal(t, bc.NodeConfig.MiningDifficulty, info.MiningDifficulty)
+	assert.Zero(t, info.Difficulty, "no difficulty is drawn before mining")
+	assert.Equal(t, ecdsa_da.DefaultDifficultyFloor, info.DifficultyFloor)
+	assert.Equal(t, ecdsa_da.DefaultDifficultyCapMultiplier, info.DifficultyCap)
+
+	parent := bc.GenesisBlock()
+	for range 2 {
+		b := mineTestBlock(t, bc, parent, signedTxn(bc, parent.Height+1))
+		require.NoError(t, bc.processNewBlock(b, false, ""))
+		parent = b
+	}
+
+	// Every block commits to the genesis epoch, so only the tip moves
+	info, err = bc.GetEpochInfo()
+	require.NoError(t, err)
+	assert.Equal(t, parent.Height, info.TipHeight)
+	assert.Equal(t, parent.EpochBeginHash, info.EpochBeginHash)
+	assert.Equal(t, bc.GenesisBlock().Height, info.StartHeight)
+
+	// The effective difficulty is the one the node drew for the block it mined last
+	mined, err := bc.MineBlock()
+	require.NoError(t, err)
+	info, err = bc.GetEpochInfo()
+	require.NoError(t, err)
+	assert.Equal(t, mined.Difficulty, info.Difficulty)
+}
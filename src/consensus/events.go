@@ -0,0 +1,88 @@
+package consensus
+
+import (
+	"sync"
+
+	"github.com/nanlour/da/src/block"
+)
+
+// Event is published on the chain's event bus, it is one of BlockApplied, ChainReorged or
+// TxnConfirmed
+type Event interface {
+	isEvent()
+}
+
+// BlockApplied is published for every block added to the main chain
+type BlockApplied struct {
+	Hash   [32]byte
+	Height uint64
+}
+
+// ChainReorged is published when the main chain switches to a fork, the blocks of the new
+// branch follow as BlockApplied events
+type ChainReorged struct {
+	From uint64 // Tip height before the reorg
+	To   uint64 // Tip height after the reorg
+	Fork uint64 // Height of the last block both branches share
+}
+
+// TxnConfirmed is published when a block carrying a transaction joins the main chain
+type TxnConfirmed struct {
+	TxHash    [32]byte
+	BlockHash [32]byte
+	Height    uint64
+}
+
+func (BlockApplied) isEvent() {}
+func (ChainReorged) isEvent() {}
+func (TxnConfirmed) isEvent() {}
+
+// eventBus fans events out to its subscribers without blocking, a subscriber whose channel
+// is full misses the event
+type eventBus struct {
+	mu     sync.Mutex
+	nextID int
+	subs   map[int]chan<- Event
+}
+
+func (e *eventBus) subscribe(ch chan<- Event) func() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.subs == nil {
+		e.subs = make(map[int]chan<- Event)
+	}
+	id := e.nextID
+	e.nextID++
+	e.subs[id] = ch
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(e.subs, id)
+	}
+}
+
+func (e *eventBus) publish(event Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, ch := range e.subs {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe delivers the chain's events to ch until the returned function is called. Events
+// are dropped for a subscriber that is not keeping up, so ch should be buffered.
+func (bc *BlockChain) Subscribe(ch chan<- Event) (unsubscribe func()) {
+	return bc.events.subscribe(ch)
+}
+
+// publishApplied announces a block that joined the main chain and the transaction it carries
+func (bc *BlockChain) publishApplied(b *block.Block) {
+	blockHash := b.Hash()
+	bc.events.publish(BlockApplied{Hash: blockHash, Height: b.Height})
+	if b.Txn.FromAddress != ([32]byte{}) {
+		bc.events.publish(TxnConfirmed{TxHash: b.Txn.Hash(), BlockHash: blockHash, Height: b.Height})
+	}
+}
@@ -0,0 +1,85 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/nanlour/da/src/block"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// drainEvents returns the events waiting on ch
+func drainEvents(ch chan Event) []Event {
+	var events []Event
+	for {
+		select {
+		case event := <-ch:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// TestEventsOnApplyAndReorg tests that extending the chain and switching to a heavier fork
+// are published to subscribers
+func TestEventsOnApplyAndReorg(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	genesis := bc.GenesisBlock()
+	bc.MyChain = []*Chain{{Hash: genesis.Hash()}}
+	sender := testPeerID(t)
+	network := blockNetwork{peers: []peer.ID{sender}, blocks: map[[32]byte]*block.Block{}}
+	bc.P2PNode = network
+
+	events := make(chan Event, 16)
+	unsubscribe := bc.Subscribe(events)
+	defer unsubscribe()
+
+	// Extending the tip applies the block and confirms its transaction
+	a1 := mineTestBlock(t, bc, genesis, signedTxn(bc, 1))
+	require.NoError(t, bc.processNewBlock(a1, false, ""))
+	assert.Equal(t, []Event{
+		BlockApplied{Hash: a1.Hash(), Height: 1},
+		TxnConfirmed{TxHash: a1.Txn.Hash(), BlockHash: a1.Hash(), Height: 1},
+	}, drainEvents(events))
+
+	// A longer fork from genesis, its first block carries an empty transaction
+	emptyTxn := block.Transaction{Height: 1}
+	emptyTxn.Sign(&bc.NodeConfig.ID.PrvKey)
+	b1 := mineTestBlock(t, bc, genesis, emptyTxn)
+	b2 := mineTestBlock(t, bc, b1, signedTxn(bc, 2))
+	network.blocks[b1.Hash()] = b1
+
+	require.NoError(t, bc.processNewBlock(b2, false, sender.String()))
+	require.Equal(t, b2.Hash(), bc.MyChain[len(bc.MyChain)-1].Hash, "heavier fork should be adopted")
+	assert.Equal(t, []Event{
+		ChainReorged{From: 1, To: 2, Fork: 0},
+		BlockApplied{Hash: b1.Hash(), Height: 1},
+		BlockApplied{Hash: b2.Hash(), Height: 2},
+		TxnConfirmed{TxHash: b2.Txn.Hash(), BlockHash: b2.Hash(), Height: 2},
+	}, drainEvents(events))
+
+	// Once unsubscribed nothing more is delivered
+	unsubscribe()
+	b3 := mineTestBlock(t, bc, b2, signedTxn(bc, 3))
+	require.NoError(t, bc.processNewBlock(b3, false, ""))
+	assert.Empty(t, drainEvents(events))
+}
+
+// TestEventBusDropsForSlowSubscriber tests that a full subscriber does not block publishing
+func TestEventBusDropsForSlowSubscriber(t *testing.T) {
+	var bus eventBus
+	slow, fast := make(chan Event), make(chan Event, 2)
+	bus.subscribe(slow)
+	bus.subscribe(fast)
+
+	bus.publish(BlockApplied{Height: 1})
+	bus.publish(BlockApplied{Height: 2})
+	bus.publish(BlockApplied{Height: 3})
+
+	assert.Equal(t, []Event{BlockApplied{Height: 1}, BlockApplied{Height: 2}}, drainEvents(fast))
+	assert.Empty(t, drainEvents(slow))
+}
@@ -0,0 +1,48 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultFaucetCooldown is how long an address waits between faucet grants unless configured
+const defaultFaucetCooldown = time.Hour
+
+// faucet remembers when each address was last paid
+type faucet struct {
+	mu        sync.Mutex
+	lastGrant map[[32]byte]time.Time
+}
+
+// Faucet sends the configured amount from the node's account to address, at most once per
+// cooldown per address
+func (bc *BlockChain) Faucet(address [32]byte) error {
+	if !bc.NodeConfig.FaucetEnabled {
+		return errors.New("faucet is disabled on this node")
+	}
+
+	cooldown := bc.NodeConfig.FaucetCooldown
+	if cooldown == 0 {
+		cooldown = defaultFaucetCooldown
+	}
+
+	bc.faucet.mu.Lock()
+	defer bc.faucet.mu.Unlock()
+
+	now := bc.getClock().Now()
+	if last, ok := bc.faucet.lastGrant[address]; ok && now.Sub(last) < cooldown {
+		return fmt.Errorf("address %x already received coins, try again in %v", address, (cooldown - now.Sub(last)).Round(time.Second))
+	}
+
+	if _, err := bc.SubmitTxn(address, bc.NodeConfig.FaucetAmount); err != nil {
+		return err
+	}
+
+	if bc.faucet.lastGrant == nil {
+		bc.faucet.lastGrant = make(map[[32]byte]time.Time)
+	}
+	bc.faucet.lastGrant[address] = now
+	return nil
+}
@@ -0,0 +1,83 @@
+package consensus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// steppedClock is a clock whose time only moves when the test says so
+type steppedClock struct {
+	now time.Time
+}
+
+func (c *steppedClock) Now() time.Time {
+	return c.now
+}
+
+func (c *steppedClock) NewTimer(d time.Duration) Timer {
+	return realClock{}.NewTimer(d)
+}
+
+// setupFaucet returns a test chain with the faucet enabled and a controllable clock
+func setupFaucet(t *testing.T) (*BlockChain, *steppedClock, func()) {
+	bc, cleanup := setupTestBlockchain(t)
+	bc.P2PNode = offlineNetwork{}
+	bc.NodeConfig.FaucetEnabled = true
+	bc.NodeConfig.FaucetAmount = 25
+	bc.NodeConfig.FaucetCooldown = time.Minute
+
+	clock := &steppedClock{now: time.Unix(1700000000, 0)}
+	bc.SetClock(clock)
+	return bc, clock, cleanup
+}
+
+// TestFaucetGrant tests that a faucet request sends the configured amount
+func TestFaucetGrant(t *testing.T) {
+	bc, _, cleanup := setupFaucet(t)
+	defer cleanup()
+
+	address := [32]byte{0xfa}
+	require.NoError(t, bc.Faucet(address))
+
+	require.Len(t, bc.TxnPool.txns, 1)
+	for _, txn := range bc.TxnPool.txns {
+		assert.Equal(t, address, txn.ToAddress)
+		assert.Equal(t, 25.0, txn.Amount)
+		assert.Equal(t, bc.NodeConfig.ID.Address, txn.FromAddress)
+	}
+}
+
+// TestFaucetCooldown tests that an address has to wait out the cooldown between grants
+func TestFaucetCooldown(t *testing.T) {
+	bc, clock, cleanup := setupFaucet(t)
+	defer cleanup()
+
+	address := [32]byte{0xfa}
+	require.NoError(t, bc.Faucet(address))
+
+	clock.now = clock.now.Add(30 * time.Second)
+	err := bc.Faucet(address)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "try again in 30s")
+
+	// Other addresses are not held up
+	assert.NoError(t, bc.Faucet([32]byte{0xfb}))
+
+	clock.now = clock.now.Add(30 * time.Second)
+	assert.NoError(t, bc.Faucet(address))
+}
+
+// TestFaucetDisabled tests that nothing is sent when the faucet is off
+func TestFaucetDisabled(t *testing.T) {
+	bc, _, cleanup := setupFaucet(t)
+	defer cleanup()
+	bc.NodeConfig.FaucetEnabled = false
+
+	err := bc.Faucet([32]byte{0xfa})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "disabled")
+	assert.Empty(t, bc.TxnPool.txns)
+}
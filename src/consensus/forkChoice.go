@@ -0,0 +1,69 @@
+package consensus
+
+import (
+	"bytes"
+
+	"github.com/nanlour/da/src/block"
+)
+
+// candidateTip returns the highest block of a candidate chain segment
+func candidateTip(candidate map[uint64]*block.Block) *block.Block {
+	var tip *block.Block
+	for height, b := range candidate {
+		if b != nil && (tip == nil || height > tip.Height) {
+			tip = b
+		}
+	}
+	return tip
+}
+
+// candidateForkHeight returns the lowest height of a candidate chain segment
+func candidateForkHeight(candidate map[uint64]*block.Block) uint64 {
+	first := true
+	var fork uint64
+	for height := range candidate {
+		if first || height < fork {
+			fork = height
+			first = false
+		}
+	}
+	return fork
+}
+
+// shouldAdopt decides whether a candidate chain segment should replace the current main chain.
+// It performs no DB or network access so fork choice can be tested in isolation.
+// The candidate is keyed by height starting at the fork point, and difficulty gives the work of
+// each candidate block. The chain with the greatest cumulative difficulty wins, ties are broken
+// by height and then by the lowest tip hash.
+func shouldAdopt(current []*Chain, candidate map[uint64]*block.Block, difficulty func(*block.Block) uint64) bool {
+	tip := candidateTip(candidate)
+	if tip == nil {
+		return false
+	}
+
+	if len(current) == 0 {
+		return true
+	}
+	currentTip := current[len(current)-1]
+	currentHeight := uint64(len(current) - 1)
+
+	// Work of the candidate is the work of our chain up to the fork point plus its own blocks
+	var work uint64
+	if fork := candidateForkHeight(candidate); fork > 0 && int(fork-1) < len(current) {
+		work = current[fork-1].CumDifficulty
+	}
+	for _, b := range candidate {
+		work += difficulty(b)
+	}
+
+	if work != currentTip.CumDifficulty {
+		return work > currentTip.CumDifficulty
+	}
+
+	if tip.Height != currentHeight {
+		return tip.Height > currentHeight
+	}
+
+	tipHash := tip.Hash()
+	return bytes.Compare(tipHash[:], currentTip.Hash[:]) < 0
+}
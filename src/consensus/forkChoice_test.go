@@ -0,0 +1,227 @@
+package consensus
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/nanlour/da/src/block"
+	"github.com/nanlour/da/src/rpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildChain creates a main chain of the given tip height where every block has the given difficulty
+func buildChain(tipHeight uint64, difficulty uint64) []*Chain {
+	chain := make([]*Chain, tipHeight+1)
+	for i := range chain {
+		chain[i] = &Chain{Hash: [32]byte{byte(i)}, CumDifficulty: uint64(i) * difficulty}
+	}
+	return chain
+}
+
+// buildCandidate creates a candidate segment covering heights from..to
+func buildCandidate(from, to uint64) map[uint64]*block.Block {
+	candidate := make(map[uint64]*block.Block)
+	for h := from; h <= to; h++ {
+		candidate[h] = &block.Block{Height: h, Txn: block.Transaction{Height: h}}
+	}
+	return candidate
+}
+
+// fixedDifficulty gives every block the same difficulty
+func fixedDifficulty(diff uint64) func(*block.Block) uint64 {
+	return func(*block.Block) uint64 {
+		return diff
+	}
+}
+
+func TestShouldAdoptLongerCandidate(t *testing.T) {
+	current := buildChain(5, 10)
+	assert.True(t, shouldAdopt(current, buildCandidate(3, 6), fixedDifficulty(10)), "strictly longer candidate with equal block work should be adopted")
+}
+
+func TestShouldAdoptEqualHeightTie(t *testing.T) {
+	current := buildChain(5, 10)
+	candidate := buildCandidate(3, 5)
+
+	// Equal work and height, the lowest tip hash wins
+	tipHash := candidate[5].Hash()
+	expected := bytes.Compare(tipHash[:], current[5].Hash[:]) < 0
+	assert.Equal(t, expected, shouldAdopt(current, candidate, fixedDifficulty(10)))
+
+	// Adopting the same tip must never happen
+	current[5].Hash = tipHash
+	assert.False(t, shouldAdopt(current, candidate, fixedDifficulty(10)), "identical tip should not be adopted")
+}
+
+func TestShouldAdoptShorterCandidate(t *testing.T) {
+	current := buildChain(5, 10)
+	assert.False(t, shouldAdopt(current, buildCandidate(2, 4), fixedDifficulty(10)), "shorter and lighter candidate should be rejected")
+}
+
+func TestShouldAdoptShorterHeavierCandidate(t *testing.T) {
+	current := buildChain(5, 10)
+	assert.True(t, shouldAdopt(current, buildCandidate(3, 4), fixedDifficulty(40)), "shorter but heavier candidate should be adopted")
+}
+
+func TestShouldAdoptLongerLighterCandidate(t *testing.T) {
+	current := buildChain(5, 10)
+	assert.False(t, shouldAdopt(current, buildCandidate(3, 8), fixedDifficulty(2)), "longer but lighter candidate should be rejected")
+}
+
+func TestShouldAdoptEmptyCandidate(t *testing.T) {
+	current := buildChain(5, 10)
+	assert.False(t, shouldAdopt(current, map[uint64]*block.Block{}, fixedDifficulty(10)), "empty candidate should be rejected")
+}
+
+// requireStoredWork checks the stored cumulative difficulty of every main chain block grows
+// by the block's difficulty and matches the in-memory chain
+func requireStoredWork(t *testing.T, bc *BlockChain) {
+	var prev uint64
+	for i, link := range bc.MyChain {
+		work, err := bc.GetCumulativeDifficulty(link.Hash)
+		require.NoError(t, err, "height %d", i)
+		assert.Equal(t, link.CumDifficulty, work, "height %d", i)
+		if i > 0 {
+			b, err := bc.GetBlockByHash(link.Hash[:])
+			require.NoError(t, err)
+			stake, err := bc.stakeAt(b.PreHash)
+			require.NoError(t, err)
+			assert.Equal(t, prev+bc.blockDifficulty(b, stake), work, "height %d", i)
+			assert.Greater(t, work, prev, "height %d", i)
+		}
+		prev = work
+	}
+}
+
+// TestCumulativeDifficultyStored tests that applying a block records its cumulative
+// difficulty, along the main chain and along a fork it reorganizes to
+func TestCumulativeDifficultyStored(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	genesis := bc.GenesisBlock()
+	bc.MyChain = []*Chain{{Hash: genesis.Hash()}}
+	sender := testPeerID(t)
+	network := blockNetwork{peers: []peer.ID{sender}, blocks: map[[32]byte]*block.Block{}}
+	bc.P2PNode = network
+
+	a1 := mineTestBlock(t, bc, genesis, signedTxn(bc, 1))
+	require.NoError(t, bc.processNewBlock(a1, false, ""))
+	requireStoredWork(t, bc)
+
+	// A longer fork from genesis replaces a1
+	emptyTxn := block.Transaction{Height: 1}
+	emptyTxn.Sign(&bc.NodeConfig.ID.PrvKey)
+	b1 := mineTestBlock(t, bc, genesis, emptyTxn)
+	b2 := mineTestBlock(t, bc, b1, signedTxn(bc, 2))
+	network.blocks[b1.Hash()] = b1
+	require.NoError(t, bc.processNewBlock(b2, false, sender.String()))
+	require.Equal(t, b2.Hash(), bc.MyChain[len(bc.MyChain)-1].Hash, "heavier fork should be adopted")
+	requireStoredWork(t, bc)
+
+	b3 := mineTestBlock(t, bc, b2, signedTxn(bc, 3))
+	require.NoError(t, bc.processNewBlock(b3, false, ""))
+	require.Len(t, bc.MyChain, 4)
+	requireStoredWork(t, bc)
+
+	_, err := bc.GetCumulativeDifficulty([32]byte{0xff})
+	assert.ErrorIs(t, err, rpc.ErrBlockNotFound)
+}
+
+// TestGetMainChainAfterFork tests that after a reorg the blocks by height come from the
+// adopted fork, never from the stored block it replaced
+func TestGetMainChainAfterFork(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	genesis := bc.GenesisBlock()
+	bc.MyChain = []*Chain{{Hash: genesis.Hash()}}
+	sender := testPeerID(t)
+	network := blockNetwork{peers: []peer.ID{sender}, blocks: map[[32]byte]*block.Block{}}
+	bc.P2PNode = network
+
+	a1 := mineTestBlock(t, bc, genesis, signedTxn(bc, 1))
+	require.NoError(t, bc.processNewBlock(a1, false, ""))
+
+	emptyTxn := block.Transaction{Height: 1}
+	emptyTxn.Sign(&bc.NodeConfig.ID.PrvKey)
+	b1 := mineTestBlock(t, bc, genesis, emptyTxn)
+	b2 := mineTestBlock(t, bc, b1, signedTxn(bc, 2))
+	network.blocks[b1.Hash()] = b1
+	require.NoError(t, bc.processNewBlock(b2, false, sender.String()))
+	b3 := mineTestBlock(t, bc, b2, signedTxn(bc, 3))
+	require.NoError(t, bc.processNewBlock(b3, false, ""))
+
+	// The replaced block is still stored
+	a1Hash := a1.Hash()
+	stored, err := bc.GetBlockByHash(a1Hash[:])
+	require.NoError(t, err)
+	require.Equal(t, a1.Hash(), stored.Hash())
+
+	blocks, err := bc.GetMainChain(1, 10)
+	require.NoError(t, err)
+	var hashes [][32]byte
+	for _, b := range blocks {
+		hashes = append(hashes, b.Hash())
+	}
+	assert.Equal(t, [][32]byte{b1.Hash(), b2.Hash(), b3.Hash()}, hashes, "range should end at the tip")
+
+	blocks, err = bc.GetMainChain(2, 2)
+	require.NoError(t, err)
+	require.Len(t, blocks, 1)
+	assert.Equal(t, b2.Hash(), blocks[0].Hash())
+
+	_, err = bc.GetMainChain(4, 5)
+	assert.ErrorIs(t, err, rpc.ErrBlockNotFound)
+	_, err = bc.GetMainChain(2, 1)
+	assert.Error(t, err)
+}
+
+// TestEqualHeightSiblingTieBreak tests that of two blocks competing at the tip's height the
+// heavier one, or on equal work the one with the lower hash, ends up as the tip whichever
+// arrives first, with no peer to ask
+func TestEqualHeightSiblingTieBreak(t *testing.T) {
+	for _, winnerFirst := range []bool{true, false} {
+		bc, cleanup := setupTestBlockchain(t)
+
+		genesis := bc.GenesisBlock()
+		bc.MyChain = []*Chain{{Hash: genesis.Hash()}}
+		bc.P2PNode = offlineNetwork{}
+
+		emptyTxn := block.Transaction{Height: 1}
+		emptyTxn.Sign(&bc.NodeConfig.ID.PrvKey)
+		a1 := mineTestBlock(t, bc, genesis, signedTxn(bc, 1))
+		b1 := mineTestBlock(t, bc, genesis, emptyTxn)
+		stake, err := bc.stakeAt(genesis.Hash())
+		require.NoError(t, err)
+		winner, loser := a1, b1
+		if beats(bc.blockDifficulty(b1, stake), b1, bc.blockDifficulty(a1, stake), a1) {
+			winner, loser = b1, a1
+		}
+		first, second := loser, winner
+		if winnerFirst {
+			first, second = winner, loser
+		}
+
+		require.NoError(t, bc.processNewBlock(first, false, ""))
+		require.NoError(t, bc.processNewBlock(second, false, ""))
+		require.Len(t, bc.MyChain, 2)
+		assert.Equal(t, winner.Hash(), bc.MyChain[1].Hash, "winner first: %v", winnerFirst)
+		tip, err := bc.GetTipBlock()
+		require.NoError(t, err)
+		assert.Equal(t, winner.Hash(), tip.Hash(), "winner first: %v", winnerFirst)
+		requireStoredWork(t, bc)
+		cleanup()
+	}
+}
+
+// beats reports whether a sibling block with work aWork wins fork choice over one with bWork
+func beats(aWork uint64, a *block.Block, bWork uint64, b *block.Block) bool {
+	if aWork != bWork {
+		return aWork > bWork
+	}
+	aHash, bHash := a.Hash(), b.Hash()
+	return bytes.Compare(aHash[:], bHash[:]) < 0
+}
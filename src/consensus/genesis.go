@@ -0,0 +1,182 @@
+package consensus
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/nanlour/da/src/block"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// GenesisConfig describes the first block of a network
+type GenesisConfig struct {
+	NetworkID string               // Networks with different IDs never share a chain
+	EpochHash [32]byte             // Epoch hash of the genesis block, zero means the default one
+	Alloc     map[[32]byte]float64 // Initial balances, falls back to InitBank when empty
+}
+
+const DefaultNetworkID = "da-mainnet"
+
+// chainFormat is committed into the genesis hash and raised whenever the encoding hashed into
+// blocks and transactions changes, so a database or export file of an older format belongs to
+// another genesis. Format 2 hashes integers as big-endian bytes and amounts as their float bits.
+const chainFormat = 2
+
+var (
+	defaultEpochHash = [32]byte{'H', 'E', 'L', 'L', 'O', ',', ' ', 'D', 'A'}
+
+	genesisTx = block.Transaction{
+		FromAddress: [32]byte{}, // No sender for genesis block
+		ToAddress:   [32]byte{}, // No receiver for genesis block
+		Amount:      0,          // No amount transferred
+	}
+
+	genesisSignature = [64]byte{'M', 'A', 'D', 'E', ' ', 'B', 'Y', ' ', 'R', 'O', 'N', 'G', 'W', 'A', 'N', 'G'}
+	genesisProof     = [516]byte{'T', 'h', 'e', 'r', 'e', ' ', 'i', 's', ' ', 'a', 'l', 'w', 'a', 'y', 's', ' ', 's', 'o', 'm', 'e', 't', 'h', 'i', 'n', 'g', ' ', 't', 'h', 'a', 't', ' ', 'y', 'o', 'u', ' ', 'c', 'a', 'n', 'n', 'o', 't', ' ', 'p', 'r', 'o', 'o', 'f'}
+)
+
+// NetworkID returns the configured network ID or the default one
+func (c *Config) NetworkID() string {
+	if c.Genesis.NetworkID == "" {
+		return DefaultNetworkID
+	}
+	return c.Genesis.NetworkID
+}
+
+// GenesisAlloc returns the initial balances written at genesis
+func (c *Config) GenesisAlloc() map[[32]byte]float64 {
+	if len(c.Genesis.Alloc) > 0 {
+		return c.Genesis.Alloc
+	}
+	return c.InitBank
+}
+
+// GenesisBlock deterministically builds the genesis block of the configured network.
+// Genesis has no parent, so its PreHash commits to the network's configuration instead,
+// which makes differently configured networks end up with different genesis hashes.
+func (c *Config) GenesisBlock() *block.Block {
+	epochHash := c.Genesis.EpochHash
+	if epochHash == ([32]byte{}) {
+		epochHash = defaultEpochHash
+	}
+
+	return &block.Block{
+		PreHash:        sha256.Sum256(c.GenesisBytes()),
+		Height:         0,
+		EpochBeginHash: epochHash,
+		Txn:            genesisTx,
+		Signature:      genesisSignature,
+		PublicKey:      [64]byte{},
+		Proof:          genesisProof,
+	}
+}
+
+// GenesisHash is the hash of the genesis block every node on the configured network shares
+func (c *Config) GenesisHash() [32]byte {
+	return c.GenesisBlock().Hash()
+}
+
+// GenesisBytes is the canonical encoding of what the genesis block commits to: the network
+// ID, the chain format, every parameter blocks are validated with, the allocations and the
+// initial stake. Nodes whose configs disagree on any of them end up on different networks
+// instead of rejecting each other's blocks. Configs with equal content give equal bytes
+// whatever order their maps were filled in, defaults encode as their effective values.
+func (c *Config) GenesisBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(c.NetworkID())
+	buf.Write(block.EncodeUint64(chainFormat))
+
+	floor, capMultiplier := c.difficultyBounds()
+	for _, param := range []uint64{
+		c.MiningDifficulty,
+		floor,
+		math.Float64bits(capMultiplier),
+		c.maxDifficulty(),
+		math.Float64bits(c.BlockReward),
+		math.Float64bits(c.MinStake),
+	} {
+		buf.Write(block.EncodeUint64(param))
+	}
+
+	buf.Write(canonicalBalances(c.GenesisAlloc()))
+	buf.Write(canonicalBalances(c.InitStake))
+	return buf.Bytes()
+}
+
+// canonicalBalances encodes the number of addresses, then each address with the big-endian
+// bits of its balance in address order
+func canonicalBalances(balances map[[32]byte]float64) []byte {
+	var buf bytes.Buffer
+	buf.Write(block.EncodeUint64(uint64(len(balances))))
+	for _, addr := range stakeLedger(balances).addresses() {
+		buf.Write(addr[:])
+		balanceBytes := make([]byte, 8)
+		binary.BigEndian.PutUint64(balanceBytes, math.Float64bits(balances[addr]))
+		buf.Write(balanceBytes)
+	}
+	return buf.Bytes()
+}
+
+// GenesisBlock returns the genesis block of the network this node is configured for
+func (bc *BlockChain) GenesisBlock() *block.Block {
+	if bc.genesis == nil {
+		bc.genesis = bc.NodeConfig.GenesisBlock()
+	}
+	return bc.genesis
+}
+
+// checkGenesis refuses a database created for another genesis, from another network or an
+// outdated genesis configuration, and records the genesis in a new database
+func (bc *BlockChain) checkGenesis() error {
+	want := bc.NodeConfig.GenesisHash()
+	stored, err := bc.mainDB.GetGenesisHash()
+	if err == nil {
+		if stored != want {
+			return fmt.Errorf("database was created for genesis %x but the config gives genesis %x, wrong network or stale database", stored, want)
+		}
+		return bc.checkGenesisBlock(want)
+	}
+	if !errors.Is(err, leveldb.ErrNotFound) {
+		return fmt.Errorf("failed to read genesis hash: %w", err)
+	}
+
+	// Databases from before the genesis hash was recorded hold a chain but no marker, their
+	// genesis block has to be ours
+	if _, err := bc.mainDB.GetTipHash(); err == nil {
+		if _, err := bc.mainDB.GetHashBlock(want[:]); err != nil {
+			return fmt.Errorf("database holds a chain without genesis %x, wrong network or stale database", want)
+		}
+	}
+	return bc.mainDB.InsertGenesisHash(&want)
+}
+
+// checkGenesisBlock checks the genesis block is stored intact. A missing one is written again
+// when the chain holds nothing else, a chain built on top of it is corrupt and refused, as
+// walks back from its tip would fail.
+func (bc *BlockChain) checkGenesisBlock(want [32]byte) error {
+	stored, err := bc.mainDB.GetHashBlock(want[:])
+	if err == nil {
+		if stored.Hash() != want {
+			return fmt.Errorf("stored genesis block hashes to %x instead of %x, database is corrupt", stored.Hash(), want)
+		}
+		return nil
+	}
+	if !errors.Is(err, leveldb.ErrNotFound) {
+		return fmt.Errorf("failed to read genesis block: %w", err)
+	}
+
+	tip, err := bc.mainDB.GetTipHash()
+	if err == nil && !bytes.Equal(tip, want[:]) {
+		return fmt.Errorf("database holds a chain with tip %x but its genesis block %x is missing, database is corrupt", tip, want)
+	}
+	if err != nil && !errors.Is(err, leveldb.ErrNotFound) {
+		return fmt.Errorf("failed to read tip: %w", err)
+	}
+	log.Printf("Genesis block %x is missing from an empty chain, writing it again", want)
+	return bc.mainDB.InsertHashBlock(&want, bc.GenesisBlock())
+}
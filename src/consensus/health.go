@@ -0,0 +1,67 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// healthTimeout bounds how long a probe connection may take to send its request
+const healthTimeout = 5 * time.Second
+
+// startHealthServer serves the liveness and readiness probes on HealthPort, it is started first
+// so probes see the node as not ready while it loads instead of finding nothing listening
+func (bc *BlockChain) startHealthServer() error {
+	listener, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(bc.NodeConfig.HealthPort)))
+	if err != nil {
+		return fmt.Errorf("failed to start health server: %w", err)
+	}
+	bc.health = &http.Server{Handler: bc.healthHandler(), ReadHeaderTimeout: healthTimeout}
+	go func(server *http.Server) {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Health server stopped: %v", err)
+		}
+	}(bc.health)
+	log.Printf("Health checks listening on %s", listener.Addr())
+	return nil
+}
+
+// healthHandler answers /healthz while the process runs and /readyz with 200 once the node
+// can serve, 503 with the reason otherwise
+func (bc *BlockChain) healthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := bc.readiness(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	})
+	return mux
+}
+
+// readiness returns why the node is not ready, or nil once Init has loaded the chain and
+// started P2P and the node either has a peer or is mining on its own
+func (bc *BlockChain) readiness() error {
+	select {
+	case <-bc.Ready():
+	default:
+		return errors.New("starting")
+	}
+	select {
+	case <-bc.quit:
+		return errors.New("stopping")
+	default:
+	}
+	if len(bc.P2PNode.Peers()) == 0 && !bc.IsMining() {
+		return errors.New("no peers and not mining")
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package consensus
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHealthEndpoints tests that /readyz reports 503 until Init has finished and the node
+// mines or has a peer, and 200 from then on, while /healthz always answers
+func TestHealthEndpoints(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "blockchain_health_test_")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	require.NoError(t, listener.Close())
+
+	config := testNodeConfig(t, tempDir)
+	config.HealthPort = port
+	bc := &BlockChain{}
+	bc.SetConfig(config)
+
+	// Before Init nothing listens yet, the handler already refuses
+	probe := httptest.NewRecorder()
+	bc.healthHandler().ServeHTTP(probe, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, probe.Code)
+	assert.Contains(t, probe.Body.String(), "starting")
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get("http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(port)) + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	require.NoError(t, bc.Init())
+	defer bc.Stop()
+
+	code, _ := get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+
+	// Alone and not mining the node has nothing to offer yet
+	code, body := get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "no peers and not mining")
+
+	bc.StartMining()
+	code, _ = get("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	bc.StopMining()
+}
+
+// TestHealthServerReleasedOnInitError tests that a failed Init frees the health port, so Init
+// can be retried on it
+func TestHealthServerReleasedOnInitError(t *testing.T) {
+	tempDir := t.TempDir()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	require.NoError(t, listener.Close())
+
+	// A database created for another network fails Init after the health server started
+	other := testNodeConfig(t, tempDir)
+	other.Genesis.NetworkID = "other-net"
+	bc := &BlockChain{}
+	bc.SetConfig(other)
+	require.NoError(t, bc.Init())
+	require.NoError(t, bc.Stop())
+
+	config := testNodeConfig(t, tempDir)
+	config.HealthPort = port
+	failed := &BlockChain{}
+	failed.SetConfig(config)
+	require.Error(t, failed.Init())
+	assert.Nil(t, failed.health)
+
+	config.DbPath = filepath.Join(tempDir, "retry")
+	retried := &BlockChain{}
+	retried.SetConfig(config)
+	require.NoError(t, retried.Init(), "the health port should be free again")
+	require.NoError(t, retried.Stop())
+}
@@ -0,0 +1,147 @@
+package consensus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+
+	"github.com/nanlour/da/src/block"
+	"github.com/nanlour/da/src/db"
+)
+
+// errNodeStopped is returned to callers waiting on the tip manager after the node stopped
+var errNodeStopped = errors.New("node stopped")
+
+// importRequest hands one block from a chain file to the tip manager
+type importRequest struct {
+	block *block.Block
+	done  chan error
+}
+
+// ExportBlocks writes the main chain from genesis to the stored tip, each block as its
+// length in 4 little-endian bytes followed by its JSON encoding
+func (bc *BlockChain) ExportBlocks(w io.Writer) error {
+	tipHash, err := bc.mainDB.GetTipHash()
+	if err != nil {
+		return fmt.Errorf("failed to read tip: %v", err)
+	}
+
+	var chain []*block.Block
+	var hash [32]byte
+	copy(hash[:], tipHash)
+	for {
+		b, err := bc.mainDB.GetHashBlock(hash[:])
+		if err != nil {
+			return fmt.Errorf("block %x is missing: %v", hash, err)
+		}
+		chain = append(chain, b)
+		if b.Height == 0 {
+			break
+		}
+		hash = b.PreHash
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, b := range slices.Backward(chain) {
+		if err := writeBlock(bw, b); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ExportStoredChain writes the main chain stored in mainDB, for use while the node is not running
+func ExportStoredChain(config *Config, mainDB *db.DBManager, w io.Writer) error {
+	bc := &BlockChain{}
+	bc.SetConfig(config)
+	bc.mainDB = mainDB
+	return bc.ExportBlocks(w)
+}
+
+// ImportBlocks reads blocks written by ExportBlocks and hands them to the tip manager in
+// order, each goes through the same verification and application as a block from a peer.
+// Blocks already in the chain are skipped, the import stops at the first block that does
+// not become part of the main chain. The node must be running.
+func (bc *BlockChain) ImportBlocks(r io.Reader) error {
+	if bc.imports == nil {
+		return errors.New("node is not running")
+	}
+
+	br := bufio.NewReader(r)
+	for count := 0; ; count++ {
+		b, err := readBlock(br, bc.NodeConfig.maxBlockSize())
+		if errors.Is(err, io.EOF) {
+			log.Printf("Imported %d blocks", count)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read block %d: %w", count, err)
+		}
+
+		req := importRequest{block: b, done: make(chan error, 1)}
+		select {
+		case bc.imports <- req:
+		case <-bc.quit:
+			return errNodeStopped
+		}
+		select {
+		case err = <-req.done:
+		case <-bc.quit:
+			return errNodeStopped
+		}
+		if err != nil {
+			return fmt.Errorf("failed to import block at height %d: %w", b.Height, err)
+		}
+	}
+}
+
+// importBlock processes an imported block on the tip manager and checks it joined the main chain
+func (bc *BlockChain) importBlock(b *block.Block) error {
+	if err := bc.processNewBlock(b, false, ""); err != nil {
+		return err
+	}
+	blockHash := b.Hash()
+	if b.Height >= uint64(len(bc.MyChain)) || bc.MyChain[b.Height].Hash != blockHash {
+		return fmt.Errorf("block %x was not added to the main chain", blockHash)
+	}
+	return nil
+}
+
+func writeBlock(w io.Writer, b *block.Block) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// readBlock reads one block written by writeBlock, io.EOF means the input ended cleanly
+// between blocks
+func readBlock(r io.Reader, maxSize int) (*block.Block, error) {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if int64(size) > int64(maxSize) {
+		return nil, fmt.Errorf("block of %d bytes is above the %d byte limit", size, maxSize)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := &block.Block{}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
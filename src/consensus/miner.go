@@ -1,71 +1,121 @@
 package consensus
 
 import (
-	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/nanlour/da/src/block"
 	"github.com/nanlour/da/src/ecdsa_da"
+	"github.com/nanlour/da/src/rpc"
 	"github.com/nanlour/da/src/vdf_go"
 )
 
-func (bc *BlockChain) mine() {
+// errInsufficientStake is returned when the node's stake is too low for its blocks to be accepted
+var errInsufficientStake = errors.New("not enough stake to mine")
+
+func (bc *BlockChain) mine(quit <-chan struct{}) {
 	log.Println("Starting mining process...")
 
-	// Run the mining loop indefinitely
+	// Run the mining loop until asked to quit
 	for {
-		tipBlock, err := bc.GetTipBlock()
+		select {
+		case <-quit:
+			log.Println("Mining process stopped")
+			return
+		default:
+		}
 
-		tipHash := tipBlock.Hash()
+		// Blocks mined while catching up would build on a stale tip
+		if done, syncing := bc.sync.running(); syncing {
+			select {
+			case <-done:
+			case <-quit:
+				log.Println("Mining process stopped")
+				return
+			}
+		}
 
-		// Create a new block to mine
-		newBlock := &block.Block{
-			PreHash:        tipHash,
-			Height:         tipBlock.Height + 1,
-			EpochBeginHash: genesisBlock.Hash(), // Use genesisBlock for now
-			Txn:            bc.selectTransaction(tipBlock.Height + 1),
-			PublicKey:      ecdsa_da.PublicKeyToBytes(&bc.NodeConfig.ID.PubKey),
+		// Subscribe before reading the tip and the pool so no change can slip in between
+		tipChanged := bc.TipChanged()
+		txnAdded := bc.TxnPool.Added()
+		tipBlock, err := bc.GetTipBlock()
+		if err != nil {
+			log.Printf("Failed to get tip block: %v", err)
+			time.Sleep(50 * time.Millisecond)
+			continue
 		}
 
-		// Sign the difficulty using the node's private key
-		seed := ecdsa_da.DifficultySeed(&newBlock.EpochBeginHash, newBlock.Height)
-		signature, err := ecdsa_da.Sign(&bc.NodeConfig.ID.PrvKey, seed[:])
+		bc.scheduler.observe(tipBlock, blockMiner(tipBlock) == bc.NodeConfig.ID.Address, bc.getClock().Now())
+
+		newBlock, difficulty, err := bc.newBlockTemplate(tipBlock)
+		if errors.Is(err, errInsufficientStake) {
+			// Only a new block can change the stake
+			log.Printf("Not mining at height %d: %v", tipBlock.Height+1, err)
+			select {
+			case <-tipChanged:
+			case <-quit:
+				log.Println("Mining process stopped")
+				return
+			}
+			continue
+		}
 		if err != nil {
 			log.Printf("Failed to sign block: %v", err)
 			continue
 		}
-		copy(newBlock.Signature[:], signature)
-		difficulty := ecdsa_da.Difficulty(signature, bc.NodeConfig.StakeSum, bc.NodeConfig.StakeMine, bc.NodeConfig.MiningDifficulty)
+
+		// Wait out the part of the slot another node is likely to win, a block arriving
+		// meanwhile saves the VDF altogether
+		if wait := bc.scheduler.delay(difficulty, bc.NodeConfig.expectedDifficulty()); wait > 0 {
+			log.Printf("Difficulty %d is above the expected %d, waiting %s before mining at height %d",
+				difficulty, bc.NodeConfig.expectedDifficulty(), wait, newBlock.Height)
+			timer := bc.getClock().NewTimer(wait)
+			select {
+			case <-timer.C():
+			case <-tipChanged:
+				timer.Stop()
+				log.Printf("Tip changed while waiting to mine at height %d", newBlock.Height)
+				continue
+			case <-quit:
+				timer.Stop()
+				log.Println("Mining process stopped")
+				return
+			}
+		}
 
 		// Create context for VDF that can be cancelled
 		ctx, cancel := context.WithCancel(context.Background())
 		stopChan := make(chan struct{})
 
-		// Set up goroutine to monitor for tip changes
-		go func(currentTipHash []byte, stopMining func()) {
-			ticker := time.NewTicker(100 * time.Millisecond)
-			defer ticker.Stop()
-
+		// Set up goroutine to stop mining as soon as the tip manager signals a tip change, or when
+		// a transaction arrives for the height of an empty block, it is valid in no other block
+		height, empty := newBlock.Height, newBlock.Txn.FromAddress == [32]byte{}
+		go func(tipChanged, txnAdded <-chan struct{}, stopMining func()) {
 			for {
 				select {
-				case <-ticker.C:
-					latestTipHash, err := bc.mainDB.GetTipHash()
-					if err != nil {
-						log.Printf("Error checking tip hash: %v", err)
-						continue
-					}
-
-					// If tip has changed, stop mining
-					if !bytes.Equal(currentTipHash, latestTipHash) {
-						log.Println("Tip has changed, stopping current mining operation")
+				case <-tipChanged:
+					log.Println("Tip has changed, stopping current mining operation")
+					stopMining()
+					return
+				case <-txnAdded:
+					txnAdded = bc.TxnPool.Added()
+					if _, exists := bc.TxnPool.GetTransaction(height); exists && empty {
+						log.Println("Transaction arrived for the block being mined, restarting")
 						stopMining()
 						return
 					}
+				case <-quit:
+					stopMining()
+					return
+				case <-ctx.Done():
+					return
 				}
 			}
-		}(tipHash[:], func() {
+		}(tipChanged, txnAdded, func() {
 			close(stopChan)
 			cancel()
 		})
@@ -79,20 +129,25 @@ func (bc *BlockChain) mine() {
 		// Start VDF computation in a separate goroutine
 		go vdf.Execute(stopChan)
 
-		// Wait for VDF completion or cancellation
-		select {
-		case proof := <-vdf.GetOutputChannel():
+		// Wait for the VDF even when cancelled, it returns early with an empty output
+		// and would otherwise be left running after the loop exits
+		proof := <-vdf.GetOutputChannel()
+		if ctx.Err() != nil {
+			log.Println("Mining operation cancelled")
+		} else if err := vdf.Err(); err != nil {
+			// The output holds no proof, and retrying would run into the same failure
+			cancel()
+			log.Printf("VDF failed at height %d, stopping mining: %v", newBlock.Height, err)
+			bc.abandonMining(quit)
+			return
+		} else {
 			// Mining completed, copy proof to block
 			copy(newBlock.Proof[:], proof[:])
 
 			log.Printf("Successfully mined block at height %d", newBlock.Height)
 
 			// Send the mined block to the channel
-			bc.MiningChan <- newBlock
-
-		case <-ctx.Done():
-			// Mining was cancelled, clean up
-			log.Println("Mining operation cancelled")
+			bc.submitMinedBlock(newBlock)
 		}
 
 		// Cancel context if not already done
@@ -103,6 +158,117 @@ func (bc *BlockChain) mine() {
 	}
 }
 
+// newBlockTemplate builds and signs the next block on top of tipBlock, returning it with the
+// VDF difficulty it has to be mined at
+func (bc *BlockChain) newBlockTemplate(tipBlock *block.Block) (*block.Block, uint64, error) {
+	newBlock := &block.Block{
+		PreHash:        tipBlock.Hash(),
+		Height:         tipBlock.Height + 1,
+		EpochBeginHash: bc.GenesisBlock().Hash(), // Use genesisBlock for now
+		Txn:            bc.selectTransaction(tipBlock.Height + 1),
+		PublicKey:      ecdsa_da.PublicKeyToBytes(&bc.NodeConfig.ID.PubKey),
+	}
+
+	// Sign the difficulty using the node's private key
+	seed := ecdsa_da.DifficultySeed(&newBlock.EpochBeginHash, newBlock.Height)
+	signature, err := ecdsa_da.Sign(&bc.NodeConfig.ID.PrvKey, seed[:])
+	if err != nil {
+		return nil, 0, err
+	}
+	copy(newBlock.Signature[:], signature)
+
+	stake, err := bc.stakeAt(newBlock.PreHash)
+	if err != nil {
+		return nil, 0, err
+	}
+	if own := stake[bc.NodeConfig.ID.Address]; !bc.NodeConfig.canMine(own) {
+		return nil, 0, fmt.Errorf("%w: %v staked, %v required", errInsufficientStake, own, bc.NodeConfig.MinStake)
+	}
+
+	difficulty := bc.blockDifficulty(newBlock, stake)
+	newBlock.Difficulty = difficulty
+	bc.mined.setDifficulty(difficulty)
+	return newBlock, difficulty, nil
+}
+
+// MineBlock mines a single block on the current tip and hands it to the tip manager, so a
+// node with the mining loop off can be driven one block at a time
+func (bc *BlockChain) MineBlock() (*block.Block, error) {
+	tipBlock, err := bc.GetTipBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	newBlock, difficulty, err := bc.newBlockTemplate(tipBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	vdf := vdf_go.New(int(difficulty), newBlock.HashwithoutProof())
+	go vdf.Execute(nil)
+	proof := <-vdf.GetOutputChannel()
+	if err := vdf.Err(); err != nil {
+		return nil, fmt.Errorf("VDF failed at height %d: %w", newBlock.Height, err)
+	}
+	copy(newBlock.Proof[:], proof[:])
+
+	if !bc.submitMinedBlock(newBlock) {
+		return nil, errors.New("tip changed while mining")
+	}
+	return newBlock, nil
+}
+
+// submitMinedBlock hands a mined block to the tip manager, unless the tip moved while mining
+func (bc *BlockChain) submitMinedBlock(newBlock *block.Block) bool {
+	latestTip, err := bc.GetTipBlock()
+	if err != nil {
+		log.Printf("Error checking tip hash: %v", err)
+		return false
+	}
+
+	if newBlock.PreHash != latestTip.Hash() {
+		log.Printf("Tip changed while mining block at height %d, discarding stale block", newBlock.Height)
+		return false
+	}
+
+	bc.MiningChan <- newBlock
+	bc.mined.blockMined(bc.getClock().Now())
+	return true
+}
+
+// miningStats is what the miner has done since the node started
+type miningStats struct {
+	mu          sync.Mutex
+	difficulty  uint64
+	blocksMined uint64
+	lastBlock   time.Time
+}
+
+func (m *miningStats) setDifficulty(difficulty uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.difficulty = difficulty
+}
+
+func (m *miningStats) blockMined(at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blocksMined++
+	m.lastBlock = at
+}
+
+// MiningStats reports the current mining difficulty and the blocks mined since the node started
+func (bc *BlockChain) MiningStats() rpc.MiningStats {
+	bc.mined.mu.Lock()
+	defer bc.mined.mu.Unlock()
+	return rpc.MiningStats{
+		Mining:        bc.IsMining(),
+		Difficulty:    bc.mined.difficulty,
+		BlocksMined:   bc.mined.blocksMined,
+		LastBlockTime: bc.mined.lastBlock,
+	}
+}
+
 // Helper function to convert byte slice to [32]byte
 func bytesToHash32(data []byte) [32]byte {
 	var result [32]byte
@@ -0,0 +1,148 @@
+package consensus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nanlour/da/src/block"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStaleMinedBlockDiscarded tests that a block mined on an old tip is not handed to the tip manager
+func TestStaleMinedBlockDiscarded(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	genesisHash := bc.GenesisBlock().Hash()
+	minedBlock := &block.Block{PreHash: genesisHash, Height: 1}
+
+	// Tip changes while the miner is working
+	tipChanged := bc.TipChanged()
+	otherBlock := &block.Block{PreHash: genesisHash, Height: 1, Txn: block.Transaction{Height: 1, Amount: 1}}
+	otherHash := otherBlock.Hash()
+	require.NoError(t, bc.mainDB.InsertTipHash(&otherHash))
+	bc.notifyTipChanged()
+
+	select {
+	case <-tipChanged:
+	default:
+		t.Fatal("miner should be signalled when the tip changes")
+	}
+
+	assert.False(t, bc.submitMinedBlock(minedBlock), "stale block should be discarded")
+	assert.Empty(t, bc.MiningChan, "stale block should not reach the tip manager")
+}
+
+// TestFreshMinedBlockSubmitted tests that a block mined on the current tip is handed to the tip manager
+func TestFreshMinedBlockSubmitted(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	minedBlock := &block.Block{PreHash: bc.GenesisBlock().Hash(), Height: 1}
+
+	assert.True(t, bc.submitMinedBlock(minedBlock))
+	require.Len(t, bc.MiningChan, 1)
+	assert.Equal(t, minedBlock, <-bc.MiningChan)
+}
+
+// TestStartStopMining tests toggling the miner at runtime
+func TestStartStopMining(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	assert.False(t, bc.IsMining(), "Miner should not run before being started")
+
+	bc.StartMining()
+	assert.True(t, bc.IsMining())
+
+	// Starting twice is a no-op
+	bc.StartMining()
+	assert.True(t, bc.IsMining())
+
+	bc.StopMining()
+	assert.False(t, bc.IsMining())
+
+	// Stopping twice is a no-op
+	bc.StopMining()
+	assert.False(t, bc.IsMining())
+
+	// A loop giving up on its own is stopped, a newer one is left running
+	bc.StartMining()
+	stale := bc.miningQuit
+	bc.abandonMining(stale)
+	assert.False(t, bc.IsMining())
+	bc.StartMining()
+	bc.abandonMining(stale)
+	assert.True(t, bc.IsMining())
+	bc.StopMining()
+}
+
+// TestSentTxnInNextBlock tests that a sent transaction is included in the very next block
+func TestSentTxnInNextBlock(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+	bc.P2PNode = offlineNetwork{}
+
+	tip, err := bc.GetTipBlock()
+	require.NoError(t, err)
+
+	txHash, err := bc.SubmitTxn([32]byte{0xbe, 0xef}, 10)
+	require.NoError(t, err)
+
+	minedBlock, err := bc.MineBlock()
+	require.NoError(t, err)
+	assert.Equal(t, tip.Height+1, minedBlock.Height)
+	assert.Equal(t, txHash, minedBlock.Txn.Hash())
+	assert.True(t, bc.VerifyBlock(minedBlock))
+}
+
+// TestMiningStatsAfterMinedBlock tests that mining stats count a mined block and report the
+// difficulty it was mined at
+func TestMiningStatsAfterMinedBlock(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+	bc.P2PNode = offlineNetwork{}
+
+	stats := bc.MiningStats()
+	assert.False(t, stats.Mining)
+	assert.Zero(t, stats.BlocksMined)
+	assert.True(t, stats.LastBlockTime.IsZero())
+
+	before := time.Now()
+	minedBlock, err := bc.MineBlock()
+	require.NoError(t, err)
+	stake, err := bc.stakeAt(minedBlock.PreHash)
+	require.NoError(t, err)
+
+	stats = bc.MiningStats()
+	assert.Equal(t, uint64(1), stats.BlocksMined)
+	assert.Equal(t, bc.blockDifficulty(minedBlock, stake), stats.Difficulty)
+	assert.False(t, stats.LastBlockTime.Before(before))
+}
+
+// TestMinerRestartsForArrivingTxn tests that a transaction arriving while an empty block is
+// being mined still makes it into that block
+func TestMinerRestartsForArrivingTxn(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+	bc.P2PNode = offlineNetwork{}
+	// Slow enough that the empty block is still being mined when the transaction arrives
+	bc.NodeConfig.MiningDifficulty = 1000
+
+	bc.StartMining()
+	defer bc.StopMining()
+
+	// Let the miner start on an empty block first
+	time.Sleep(200 * time.Millisecond)
+	txHash, err := bc.SubmitTxn([32]byte{0xbe, 0xef}, 10)
+	require.NoError(t, err)
+
+	select {
+	case minedBlock := <-bc.MiningChan:
+		assert.Equal(t, uint64(1), minedBlock.Height)
+		assert.Equal(t, txHash, minedBlock.Txn.Hash())
+	case <-time.After(30 * time.Second):
+		t.Fatal("no block mined")
+	}
+}
@@ -0,0 +1,98 @@
+package consensus
+
+import (
+	"sync"
+
+	"github.com/nanlour/da/src/block"
+)
+
+// maxOrphanBlocks bounds how many blocks with unknown parents are kept, the oldest go first
+const maxOrphanBlocks = 100
+
+type orphanBlock struct {
+	block  *block.Block
+	hash   [32]byte
+	sender string
+	seq    uint64 // Arrival order, used to evict the oldest orphan
+}
+
+// orphanPool holds blocks received before their parent, keyed by the parent hash
+type orphanPool struct {
+	mu       sync.Mutex
+	byParent map[[32]byte][]*orphanBlock
+	byHash   map[[32]byte]*orphanBlock
+	nextSeq  uint64
+}
+
+// add stores a block until its parent arrives, returning false if it is already held
+func (op *orphanPool) add(b *block.Block, sender string) bool {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	if op.byHash == nil {
+		op.byParent = make(map[[32]byte][]*orphanBlock)
+		op.byHash = make(map[[32]byte]*orphanBlock)
+	}
+
+	hash := b.Hash()
+	if _, exists := op.byHash[hash]; exists {
+		return false
+	}
+
+	if len(op.byHash) >= maxOrphanBlocks {
+		op.evictOldest()
+	}
+
+	orphan := &orphanBlock{block: b, hash: hash, sender: sender, seq: op.nextSeq}
+	op.nextSeq++
+	op.byHash[hash] = orphan
+	op.byParent[b.PreHash] = append(op.byParent[b.PreHash], orphan)
+	return true
+}
+
+// takeChildren removes and returns the orphans waiting on the given parent, oldest first
+func (op *orphanPool) takeChildren(parent [32]byte) []*orphanBlock {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	children := op.byParent[parent]
+	delete(op.byParent, parent)
+	for _, child := range children {
+		delete(op.byHash, child.hash)
+	}
+	return children
+}
+
+// len returns the number of orphans held
+func (op *orphanPool) len() int {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return len(op.byHash)
+}
+
+// evictOldest drops the earliest arrived orphan, the caller must hold mu
+func (op *orphanPool) evictOldest() {
+	var oldest *orphanBlock
+	for _, orphan := range op.byHash {
+		if oldest == nil || orphan.seq < oldest.seq {
+			oldest = orphan
+		}
+	}
+	if oldest == nil {
+		return
+	}
+
+	delete(op.byHash, oldest.hash)
+	siblings := op.byParent[oldest.block.PreHash]
+	for i, sibling := range siblings {
+		if sibling == oldest {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(op.byParent, oldest.block.PreHash)
+	} else {
+		op.byParent[oldest.block.PreHash] = siblings
+	}
+}
@@ -0,0 +1,96 @@
+package consensus
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/nanlour/da/src/block"
+	"github.com/nanlour/da/src/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// offlineNetwork is a Network with no peers, every fetch fails
+type offlineNetwork struct{}
+
+func (offlineNetwork) Start() error                                     { return nil }
+func (offlineNetwork) Stop() error                                      { return nil }
+func (offlineNetwork) BroadcastBlock(block *block.Block) error          { return nil }
+func (offlineNetwork) BroadcastTransaction(tx *block.Transaction) error { return nil }
+func (offlineNetwork) Peers() []peer.ID                                 { return nil }
+
+func (offlineNetwork) GetBlockByHash(hash [32]byte, peerID peer.ID) (*block.Block, error) {
+	return nil, errors.New("offline")
+}
+
+func (offlineNetwork) GetTip(peerID peer.ID) (*block.Block, error) {
+	return nil, errors.New("offline")
+}
+
+func (offlineNetwork) GetBlocksAfter(hash [32]byte, count int, peerID peer.ID) ([]*block.Block, error) {
+	return nil, errors.New("offline")
+}
+
+func (offlineNetwork) PeerHandshake(peerID peer.ID) (p2p.HandshakeMessage, bool) {
+	return p2p.HandshakeMessage{}, false
+}
+
+func (offlineNetwork) PeerStatus(peerID peer.ID) (p2p.StatusMessage, bool) {
+	return p2p.StatusMessage{}, false
+}
+
+// TestOrphanPoolEvictsOldest tests that a full pool drops the earliest orphan
+func TestOrphanPoolEvictsOldest(t *testing.T) {
+	var pool orphanPool
+
+	blocks := make([]*block.Block, maxOrphanBlocks+1)
+	for i := range blocks {
+		blocks[i] = &block.Block{Height: uint64(i + 2), PreHash: [32]byte{byte(i), byte(i >> 8)}}
+		assert.True(t, pool.add(blocks[i], ""))
+	}
+	assert.False(t, pool.add(blocks[1], ""), "duplicate orphan should not be stored twice")
+	assert.Equal(t, maxOrphanBlocks, pool.len())
+
+	assert.Empty(t, pool.takeChildren(blocks[0].PreHash), "oldest orphan should have been evicted")
+	children := pool.takeChildren(blocks[1].PreHash)
+	require.Len(t, children, 1)
+	assert.Equal(t, blocks[1], children[0].block)
+	assert.Equal(t, maxOrphanBlocks-1, pool.len())
+}
+
+// TestOrphanBlocksReverseOrder tests that blocks received newest first are connected once
+// the missing parent arrives
+func TestOrphanBlocksReverseOrder(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	bc.P2PNode = offlineNetwork{}
+	bc.MyChain = []*Chain{{Hash: bc.GenesisBlock().Hash()}}
+
+	blocks := make([]*block.Block, 3)
+	parent := bc.GenesisBlock()
+	for i := range blocks {
+		blocks[i] = mineTestBlock(t, bc, parent, signedTxn(bc, parent.Height+1))
+		parent = blocks[i]
+	}
+
+	// Without the parents the later blocks can only be held as orphans
+	for i := len(blocks) - 1; i >= 1; i-- {
+		require.NoError(t, bc.processNewBlock(blocks[i], false, ""))
+	}
+	assert.Equal(t, 2, bc.orphans.len())
+	assert.Len(t, bc.MyChain, 1)
+
+	require.NoError(t, bc.processNewBlock(blocks[0], false, ""))
+
+	require.Len(t, bc.MyChain, 4)
+	for i, b := range blocks {
+		assert.Equal(t, b.Hash(), bc.MyChain[i+1].Hash)
+	}
+	tipHash, err := bc.mainDB.GetTipHash()
+	require.NoError(t, err)
+	expected := blocks[2].Hash()
+	assert.Equal(t, expected[:], tipHash)
+	assert.Zero(t, bc.orphans.len())
+}
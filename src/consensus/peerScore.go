@@ -0,0 +1,131 @@
+package consensus
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	fetchBackoffBase = 5 * time.Second // Wait after a peer's first failed tip request
+	fetchBackoffMax  = 5 * time.Minute
+)
+
+type peerHealth struct {
+	failures int       // Consecutive failed or useless tip requests
+	retryAt  time.Time // The peer is skipped until then
+}
+
+// syncPeers tracks how peers answered tip requests so the heartbeat prefers responsive ones
+type syncPeers struct {
+	mu     sync.Mutex
+	health map[peer.ID]*peerHealth
+}
+
+// choose picks the peer with the fewest recent failures among those not backing off,
+// breaking ties at random, and returns false if every peer is backing off
+func (sp *syncPeers) choose(peers []peer.ID, now time.Time) (peer.ID, bool) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	// Forget peers that have disconnected
+	connected := make(map[peer.ID]bool, len(peers))
+	for _, id := range peers {
+		connected[id] = true
+	}
+	for id := range sp.health {
+		if !connected[id] {
+			delete(sp.health, id)
+		}
+	}
+
+	var candidates []peer.ID
+	fewest := -1
+	for _, id := range peers {
+		failures := 0
+		if health, ok := sp.health[id]; ok {
+			if now.Before(health.retryAt) {
+				continue
+			}
+			failures = health.failures
+		}
+
+		switch {
+		case fewest < 0 || failures < fewest:
+			fewest = failures
+			candidates = append(candidates[:0], id)
+		case failures == fewest:
+			candidates = append(candidates, id)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return "", false
+	}
+	return selectRandomPeer(candidates), true
+}
+
+// chooseAhead picks the peer that announced the highest tip above height among those not
+// backing off, breaking ties at random, and returns false if no such peer announced one
+func (sp *syncPeers) chooseAhead(peers []peer.ID, announced func(peer.ID) (uint64, bool), height uint64, now time.Time) (peer.ID, bool) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	var candidates []peer.ID
+	best := height
+	for _, id := range peers {
+		if health, ok := sp.health[id]; ok && now.Before(health.retryAt) {
+			continue
+		}
+		peerHeight, ok := announced(id)
+		if !ok || peerHeight <= height || peerHeight < best {
+			continue
+		}
+		if peerHeight > best {
+			best = peerHeight
+			candidates = candidates[:0]
+		}
+		candidates = append(candidates, id)
+	}
+
+	if len(candidates) == 0 {
+		return "", false
+	}
+	return selectRandomPeer(candidates), true
+}
+
+// selectRandomPeer picks a peer uniformly at random, or the zero ID if there are none
+func selectRandomPeer(peers []peer.ID) peer.ID {
+	if len(peers) == 0 {
+		return ""
+	}
+	return peers[rand.IntN(len(peers))]
+}
+
+// recordFailure backs a peer off, doubling the wait with every consecutive failure
+func (sp *syncPeers) recordFailure(id peer.ID, now time.Time) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if sp.health == nil {
+		sp.health = make(map[peer.ID]*peerHealth)
+	}
+	health, ok := sp.health[id]
+	if !ok {
+		health = &peerHealth{}
+		sp.health[id] = health
+	}
+
+	health.failures++
+	shift := min(health.failures-1, 6) // Six doublings already pass the cap
+	health.retryAt = now.Add(min(fetchBackoffBase<<shift, fetchBackoffMax))
+}
+
+// recordSuccess clears a peer's failures
+func (sp *syncPeers) recordSuccess(id peer.ID) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	delete(sp.health, id)
+}
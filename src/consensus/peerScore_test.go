@@ -0,0 +1,195 @@
+package consensus
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/nanlour/da/src/block"
+	"github.com/nanlour/da/src/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tipNetwork answers tip requests only from the peers it has tips for
+type tipNetwork struct {
+	offlineNetwork
+	tips map[peer.ID]*block.Block
+}
+
+func (n tipNetwork) GetTip(peerID peer.ID) (*block.Block, error) {
+	if tip, ok := n.tips[peerID]; ok {
+		return tip, nil
+	}
+	return nil, errors.New("peer unavailable")
+}
+
+// TestFailingPeerDeprioritized tests that a peer whose tip requests fail is skipped in
+// favour of a responsive one, even after its backoff expires
+func TestFailingPeerDeprioritized(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	badPeer, goodPeer := peer.ID("bad"), peer.ID("good")
+	bc.P2PNode = tipNetwork{tips: map[peer.ID]*block.Block{goodPeer: {Height: 5}}}
+	peers := []peer.ID{badPeer, goodPeer}
+
+	for range 3 {
+		bc.idealFetch(badPeer)
+	}
+	bc.idealFetch(goodPeer)
+	require.NotEmpty(t, bc.P2PChan, "responsive peer's tip should be processed")
+
+	now := time.Now()
+	for range 20 {
+		selected, ok := bc.syncPeers.choose(peers, now)
+		require.True(t, ok)
+		assert.Equal(t, goodPeer, selected)
+	}
+
+	// Once the backoff has passed the failing peer is eligible but still ranked lower
+	later := now.Add(fetchBackoffMax)
+	selected, ok := bc.syncPeers.choose(peers, later)
+	require.True(t, ok)
+	assert.Equal(t, goodPeer, selected)
+
+	selected, ok = bc.syncPeers.choose([]peer.ID{badPeer}, later)
+	require.True(t, ok)
+	assert.Equal(t, badPeer, selected)
+
+	_, ok = bc.syncPeers.choose([]peer.ID{badPeer}, now)
+	assert.False(t, ok, "peer should be backing off")
+}
+
+// TestIdealFetchSkipsLowerTips tests that only a peer tip above ours or competing with ours at
+// our height is handed to fork resolution
+func TestIdealFetchSkipsLowerTips(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+	bc.P2PNode = offlineNetwork{}
+	bc.MyChain = []*Chain{{Hash: bc.GenesisBlock().Hash()}}
+
+	b1 := mineTestBlock(t, bc, bc.GenesisBlock(), signedTxn(bc, 1))
+	require.NoError(t, bc.processNewBlock(b1, false, ""))
+
+	samePeer, equalPeer, lowerPeer, higherPeer := peer.ID("same"), peer.ID("equal"), peer.ID("lower"), peer.ID("higher")
+	bc.P2PNode = tipNetwork{tips: map[peer.ID]*block.Block{
+		samePeer:   b1,
+		equalPeer:  {PreHash: bc.GenesisBlock().Hash(), Height: 1, Txn: block.Transaction{Nonce: 7}},
+		lowerPeer:  bc.GenesisBlock(),
+		higherPeer: {PreHash: b1.Hash(), Height: 2},
+	}}
+
+	for _, id := range []peer.ID{samePeer, lowerPeer} {
+		bc.idealFetch(id)
+		assert.Empty(t, bc.P2PChan, "tip from peer %s should be skipped", id)
+	}
+
+	bc.idealFetch(equalPeer)
+	require.Len(t, bc.P2PChan, 1)
+	assert.Equal(t, uint64(7), (<-bc.P2PChan).Block.Txn.Nonce)
+
+	bc.idealFetch(higherPeer)
+	require.Len(t, bc.P2PChan, 1)
+	assert.Equal(t, uint64(2), (<-bc.P2PChan).Block.Height)
+}
+
+// statusNetwork connects to the peers it has statuses for and reports each one's announced tip
+type statusNetwork struct {
+	tipNetwork
+	statuses map[peer.ID]uint64
+}
+
+func (n statusNetwork) Peers() []peer.ID {
+	var peers []peer.ID
+	for id := range n.statuses {
+		peers = append(peers, id)
+	}
+	return peers
+}
+
+func (n statusNetwork) PeerStatus(peerID peer.ID) (p2p.StatusMessage, bool) {
+	height, ok := n.statuses[peerID]
+	return p2p.StatusMessage{TipHeight: height}, ok
+}
+
+// TestLaggingNodeAsksHighestAnnouncedPeer tests that the heartbeat asks the peer announcing the
+// highest tip, skipping it while it backs off, and falls back to any peer once none is ahead
+func TestLaggingNodeAsksHighestAnnouncedPeer(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+	bc.MyChain = []*Chain{{Hash: bc.GenesisBlock().Hash()}}
+
+	nearPeer, farPeer, stalePeer := peer.ID("near"), peer.ID("far"), peer.ID("stale")
+	network := statusNetwork{
+		tipNetwork: tipNetwork{tips: map[peer.ID]*block.Block{
+			nearPeer:  {PreHash: bc.GenesisBlock().Hash(), Height: 3},
+			farPeer:   {PreHash: bc.GenesisBlock().Hash(), Height: 8},
+			stalePeer: {PreHash: bc.GenesisBlock().Hash(), Height: 1},
+		}},
+		statuses: map[peer.ID]uint64{nearPeer: 3, farPeer: 8, stalePeer: 0},
+	}
+	bc.P2PNode = network
+	now := time.Now()
+
+	for range 20 {
+		selected, ok := bc.syncPeers.chooseAhead(network.Peers(), bc.announcedHeight, 0, now)
+		require.True(t, ok)
+		assert.Equal(t, farPeer, selected)
+	}
+	bc.requestPeerTip(realClock{})
+	select {
+	case received := <-bc.P2PChan:
+		assert.Equal(t, uint64(8), received.Block.Height)
+	case <-time.After(5 * time.Second):
+		t.Fatal("tip of the highest peer was not requested")
+	}
+
+	// While the highest peer backs off the next highest is asked
+	bc.syncPeers.recordFailure(farPeer, now)
+	selected, ok := bc.syncPeers.chooseAhead(network.Peers(), bc.announcedHeight, 0, now)
+	require.True(t, ok)
+	assert.Equal(t, nearPeer, selected)
+
+	// No peer announced a tip above ours
+	_, ok = bc.syncPeers.chooseAhead(network.Peers(), bc.announcedHeight, 8, now)
+	assert.False(t, ok)
+}
+
+// TestPeerBackoffDoubles tests that each consecutive failure doubles the wait up to the cap
+func TestPeerBackoffDoubles(t *testing.T) {
+	var sp syncPeers
+	id := peer.ID("peer")
+	now := time.Now()
+
+	expected := fetchBackoffBase
+	for range 10 {
+		sp.recordFailure(id, now)
+		assert.Equal(t, now.Add(expected), sp.health[id].retryAt)
+		expected = min(expected*2, fetchBackoffMax)
+	}
+
+	sp.recordSuccess(id)
+	selected, ok := sp.choose([]peer.ID{id}, now)
+	require.True(t, ok)
+	assert.Equal(t, id, selected)
+}
+
+// TestSelectRandomPeerUniform tests that every peer is picked roughly equally often
+func TestSelectRandomPeerUniform(t *testing.T) {
+	assert.Equal(t, peer.ID(""), selectRandomPeer(nil))
+
+	peers := []peer.ID{"a", "b", "c", "d", "e"}
+	const draws = 50000
+	counts := make(map[peer.ID]int)
+	for range draws {
+		counts[selectRandomPeer(peers)]++
+	}
+
+	// Each count has a standard deviation of about 90, so 10% is far outside chance
+	expected := draws / len(peers)
+	for _, id := range peers {
+		assert.InDelta(t, expected, counts[id], float64(expected)/10, "peer %s", id)
+	}
+}
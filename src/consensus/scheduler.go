@@ -0,0 +1,57 @@
+package consensus
+
+import (
+	"time"
+
+	"github.com/nanlour/da/src/block"
+)
+
+const (
+	maxSchedulerBackoff = 4               // Doublings of the wait after consecutive lost slots
+	maxMiningDelay      = 5 * time.Minute // Longest wait, so a node left on its own keeps producing
+)
+
+// miningScheduler delays the miner when its difficulty makes winning the slot unlikely. Every
+// slot some miner's difficulty is drawn below the expected one, so a node far above it would
+// almost always be beaten and its VDF wasted. It waits part of a slot first, longer after each
+// slot another node won, and skips the slot if a block arrives meanwhile.
+type miningScheduler struct {
+	tip     [32]byte      // Tip the last template was built on
+	tipSeen time.Time     // When that tip was first seen
+	slot    time.Duration // Smoothed time between tips, zero until two were seen
+	losses  int           // Consecutive slots won by another node
+}
+
+// observe records the tip the miner is about to build on, mined tells whether this node mined it
+func (s *miningScheduler) observe(tip *block.Block, mined bool, now time.Time) {
+	hash := tip.Hash()
+	if hash == s.tip {
+		return
+	}
+	if !s.tipSeen.IsZero() {
+		elapsed := now.Sub(s.tipSeen)
+		if s.slot == 0 {
+			s.slot = elapsed
+		} else {
+			s.slot = (3*s.slot + elapsed) / 4
+		}
+		if mined {
+			s.losses = 0
+		} else {
+			s.losses++
+		}
+	}
+	s.tip, s.tipSeen = hash, now
+}
+
+// delay returns how long to wait before mining a block at difficulty. A node at or below the
+// expected difficulty starts at once, one above it waits the share of a slot it is unlikely to
+// win in, doubled for each slot lost in a row.
+func (s *miningScheduler) delay(difficulty, expected uint64) time.Duration {
+	if difficulty <= expected || s.slot == 0 {
+		return 0
+	}
+	wait := float64(s.slot) * (1 - float64(expected)/float64(difficulty))
+	wait *= float64(uint64(1) << min(s.losses, maxSchedulerBackoff))
+	return min(time.Duration(wait), maxMiningDelay)
+}
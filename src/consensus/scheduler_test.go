@@ -0,0 +1,67 @@
+package consensus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nanlour/da/src/block"
+	"github.com/stretchr/testify/assert"
+)
+
+// attemptsInWindow runs a scheduler through slots won by another node every slotTime and
+// counts the slots in which it would have started a VDF at difficulty before the next block
+func attemptsInWindow(difficulty, expected uint64, slots int, slotTime time.Duration) int {
+	var s miningScheduler
+	now := time.Now()
+	attempts := 0
+	for i := range slots {
+		s.observe(&block.Block{Height: uint64(i)}, false, now)
+		if s.delay(difficulty, expected) < slotTime {
+			attempts++
+		}
+		now = now.Add(slotTime)
+	}
+	return attempts
+}
+
+// TestSchedulerLowStakeAttemptsLess tests that over the same window a node drawing difficulties
+// far above the expected one starts fewer VDFs than a node at or below it
+func TestSchedulerLowStakeAttemptsLess(t *testing.T) {
+	const slots = 100
+	expected := (&Config{MiningDifficulty: 100}).expectedDifficulty()
+
+	high := attemptsInWindow(expected/2, expected, slots, 10*time.Second)
+	low := attemptsInWindow(expected*10, expected, slots, 10*time.Second)
+	assert.Equal(t, slots, high, "a competitive node mines every slot")
+	assert.Less(t, low, high/10)
+}
+
+// TestSchedulerBackoff tests that the wait doubles with every lost slot up to the caps, and
+// that a slot the node won resets it
+func TestSchedulerBackoff(t *testing.T) {
+	var s miningScheduler
+	now := time.Now()
+	assert.Zero(t, s.delay(1000, 100), "no wait before a slot was measured")
+
+	s.observe(&block.Block{Height: 0}, false, now)
+	now = now.Add(10 * time.Second)
+	s.observe(&block.Block{Height: 1}, false, now)
+	assert.Equal(t, 18*time.Second, s.delay(1000, 100))
+	assert.Zero(t, s.delay(100, 100))
+
+	// Seeing the same tip again is not another slot
+	s.observe(&block.Block{Height: 1}, false, now.Add(time.Second))
+	assert.Equal(t, 1, s.losses)
+
+	for i := uint64(2); i < 10; i++ {
+		now = now.Add(10 * time.Second)
+		s.observe(&block.Block{Height: i}, false, now)
+	}
+	assert.Equal(t, time.Duration(float64(10*time.Second)*0.9)<<maxSchedulerBackoff, s.delay(1000, 100))
+	slow := miningScheduler{slot: time.Hour}
+	assert.Equal(t, maxMiningDelay, slow.delay(1000, 100))
+
+	now = now.Add(10 * time.Second)
+	s.observe(&block.Block{Height: 10}, true, now)
+	assert.Equal(t, 9*time.Second, s.delay(1000, 100))
+}
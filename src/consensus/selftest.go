@@ -0,0 +1,113 @@
+package consensus
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/nanlour/da/src/ecdsa_da"
+)
+
+const (
+	selfTestBlocks  = 3
+	selfTestBalance = 1000.0
+	selfTestTimeout = time.Minute // How long a mined block may take to become the tip
+)
+
+// SelfTest runs a single node with its database under dir through its lifecycle: it starts the
+// node with a throwaway key and low difficulty, mines a few blocks, pays a generated address,
+// checks the balances moved, and stops the node
+func SelfTest(dir string) error {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	self := ecdsa_da.PublicKeyToAddress(&privateKey.PublicKey)
+
+	bc := &BlockChain{}
+	bc.SetConfig(&Config{
+		ID:               Account{PrvKey: *privateKey, PubKey: privateKey.PublicKey, Address: self},
+		MiningDifficulty: 4,
+		DifficultyFloor:  5,
+		DifficultyCap:    0.5,
+		DbPath:           filepath.Join(dir, "db"),
+		P2PListenAddr:    "/ip4/127.0.0.1/tcp/0",
+		InitStake:        map[[32]byte]float64{self: 100},
+		InitBank:         map[[32]byte]float64{self: selfTestBalance},
+		Genesis:          GenesisConfig{NetworkID: "selftest"},
+	})
+
+	log.Printf("selftest: starting node")
+	if err := bc.Init(); err != nil {
+		return fmt.Errorf("failed to start node: %v", err)
+	}
+	defer bc.Stop()
+
+	for i := 0; i < selfTestBlocks; i++ {
+		if err := bc.selfTestMine(); err != nil {
+			return err
+		}
+	}
+
+	var other [32]byte
+	if _, err := rand.Read(other[:]); err != nil {
+		return err
+	}
+	txHash, err := bc.SubmitTxn(other, 25)
+	if err != nil {
+		return fmt.Errorf("failed to send transaction: %v", err)
+	}
+	if err := bc.selfTestMine(); err != nil {
+		return err
+	}
+
+	confirmed, height, _, err := bc.GetTransactionStatus(txHash)
+	if err != nil || !confirmed {
+		return fmt.Errorf("transaction %x not confirmed: %v", txHash, err)
+	}
+	log.Printf("selftest: transaction confirmed at height %d", height)
+
+	balances, err := bc.GetAccountBalances([][32]byte{self, other})
+	if err != nil {
+		return err
+	}
+	if want := selfTestBalance - 25; balances[self] != want {
+		return fmt.Errorf("own balance is %v, expected %v", balances[self], want)
+	}
+	if balances[other] != 25 {
+		return fmt.Errorf("balance of %x is %v, expected 25", other, balances[other])
+	}
+
+	log.Printf("selftest: passed")
+	return nil
+}
+
+// selfTestMine mines a block and waits until the tip manager made it the tip
+func (bc *BlockChain) selfTestMine() error {
+	timeout := time.After(selfTestTimeout)
+	tipChanged := bc.TipChanged()
+	b, err := bc.MineBlock()
+	if err != nil {
+		return fmt.Errorf("failed to mine: %v", err)
+	}
+	for {
+		tip, err := bc.GetTipBlock()
+		if err != nil {
+			return err
+		}
+		if tip.Hash() == b.Hash() {
+			log.Printf("selftest: mined block at height %d", b.Height)
+			return nil
+		}
+		select {
+		case <-tipChanged:
+			tipChanged = bc.TipChanged()
+		case <-timeout:
+			return fmt.Errorf("block at height %d did not become the tip within %s", b.Height, selfTestTimeout)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestSelfTest tests that the self-test passes on a healthy build
+func TestSelfTest(t *testing.T) {
+	require.NoError(t, SelfTest(t.TempDir()))
+}
@@ -1,26 +1,112 @@
 package consensus
 
 import (
-	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"math"
 
 	"github.com/nanlour/da/src/block"
 	"github.com/nanlour/da/src/ecdsa_da"
 	"github.com/nanlour/da/src/vdf_go"
 )
 
+var (
+	errDifficultyMismatch = errors.New("claimed difficulty does not match")
+	errInvalidProof       = errors.New("invalid VDF proof")
+)
+
+// VerifyBlock checks a block against the stake ledger of its parent, which has to be on the main chain
 func (bc *BlockChain) VerifyBlock(block *block.Block) bool {
+	if block.Height == 0 {
+		return bc.isGenesis(block)
+	}
+	stake, err := bc.stakeAt(block.PreHash)
+	if err != nil {
+		return false
+	}
+	return bc.verifyBlockWithStake(block, stake)
+}
+
+// verifyBlockWithStake checks a block, that its miner holds enough stake in the stake ledger
+// and its work, the claimed difficulty and the VDF proof at it
+func (bc *BlockChain) verifyBlockWithStake(block *block.Block, stake stakeLedger) bool {
+	if !bc.checkBlock(block) {
+		return false
+	}
+	if block.Height == 0 {
+		return true
+	}
+	if !bc.NodeConfig.canMine(stake[blockMiner(block)]) {
+		return false
+	}
+	return bc.verifyWork(block, stake) == nil
+}
+
+// VerifyWork checks a block's work against the stake ledger of its parent, which has to be on
+// the main chain: the difficulty it claims has to be the one its signature and its miner's stake
+// give, and its VDF proof has to take exactly that many iterations
+func (bc *BlockChain) VerifyWork(b *block.Block) error {
+	stake, err := bc.stakeAt(b.PreHash)
+	if err != nil {
+		return err
+	}
+	return bc.verifyWork(b, stake)
+}
+
+// verifyWork checks a block's claimed difficulty and its VDF proof at that difficulty. A proof
+// computed with fewer iterations than claimed does not verify, so a miner can neither forge a
+// difficulty nor skip work.
+func (bc *BlockChain) verifyWork(b *block.Block, stake stakeLedger) error {
+	if expected := bc.blockDifficulty(b, stake); b.Difficulty != expected {
+		return fmt.Errorf("%w: claims %d, stake gives %d", errDifficultyMismatch, b.Difficulty, expected)
+	}
+	return verifyProof(b)
+}
+
+// checkWork checks the work of a block whose parent's stake ledger is unknown: the claimed
+// difficulty has to lie within the configured bounds and the VDF proof has to take that many
+// iterations, so a forged block costs at least the difficulty floor in work
+func (bc *BlockChain) checkWork(b *block.Block) error {
+	floor, _ := bc.NodeConfig.difficultyBounds()
+	if b.Difficulty < floor || b.Difficulty > bc.NodeConfig.maxDifficulty() {
+		return fmt.Errorf("%w: claims %d, outside %d to %d", errDifficultyMismatch, b.Difficulty, floor, bc.NodeConfig.maxDifficulty())
+	}
+	return verifyProof(b)
+}
+
+// verifyProof checks a block's VDF proof at the difficulty it claims
+func verifyProof(b *block.Block) error {
+	// Only genesis may carry its placeholder proof, and genesis is never verified this way
+	var zeroProof [516]byte
+	if b.Proof == zeroProof || b.Proof == genesisProof {
+		return errInvalidProof
+	}
+
+	if !vdf_go.New(int(b.Difficulty), b.HashwithoutProof()).Verify(b.Proof) {
+		return fmt.Errorf("%w at difficulty %d", errInvalidProof, b.Difficulty)
+	}
+	return nil
+}
+
+// checkBlock runs the checks that need no chain state, everything but the VDF proof
+func (bc *BlockChain) checkBlock(block *block.Block) bool {
+	if block.Height == 0 {
+		return bc.isGenesis(block)
+	}
 	seed := ecdsa_da.DifficultySeed(&block.EpochBeginHash, block.Height)
 	publicKey, err := ecdsa_da.BytesToPublicKey(block.PublicKey)
 	if err != nil {
 		return false
 	}
 
-	// Check epoch begin hash
-	if block.EpochBeginHash != genesisBlock.Hash() {
+	// Check epoch begin hash, genesis commits to the network ID so this also rejects foreign lineages
+	if block.EpochBeginHash != bc.GenesisBlock().Hash() {
 		return false
 	}
 
-	// Check transaction height matches block height
+	// Check transaction height matches block height, a transaction signed for one height
+	// can never be replayed in a block at another height
 	if block.Txn.Height != block.Height {
 		return false
 	}
@@ -30,19 +116,80 @@ func (bc *BlockChain) VerifyBlock(block *block.Block) bool {
 		return false
 	}
 
-	// Verify signature
-	if !ecdsa_da.Verify(publicKey, seed[:], block.Signature[:]) {
+	// Split transaction outputs must add up to the amount the sender is charged
+	if block.Txn.CheckOutputs() != nil {
+		return false
+	}
+
+	// A delegation moves no funds and names its validator
+	if block.Txn.CheckType() != nil {
 		return false
 	}
 
-	diff := ecdsa_da.Difficulty(block.Signature[:], bc.NodeConfig.StakeSum, bc.NodeConfig.InitStake[sha256.Sum256(block.PublicKey[:])], bc.NodeConfig.MiningDifficulty)
+	// Verify signature
+	return ecdsa_da.Verify(publicKey, seed[:], block.Signature[:])
+}
 
-	vdf := vdf_go.New(int(diff), block.HashwithoutProof())
+// isGenesis reports whether the block is this network's genesis. Genesis is built from the
+// config rather than mined, it has no miner and its proof is a placeholder no VDF verifies,
+// so it passes verification by matching the genesis hash and no other height 0 block does.
+func (bc *BlockChain) isGenesis(block *block.Block) bool {
+	return block.Height == 0 && block.Hash() == bc.GenesisBlock().Hash()
+}
 
-	var zeroProof [516]byte
-	if block.Proof == zeroProof {
-		return false
+// blockDifficulty recomputes the VDF difficulty a block was mined at from its signature and
+// its miner's share of the stake in the ledger of the block's parent
+func (bc *BlockChain) blockDifficulty(block *block.Block, stake stakeLedger) uint64 {
+	return bc.NodeConfig.Difficulty(block.Signature[:], stake[blockMiner(block)], stake.sum())
+}
+
+// DefaultMaxDifficulty is the largest difficulty of a block, the VDF counts iterations in an
+// int and nodes on 32-bit platforms have to agree with the others
+const DefaultMaxDifficulty = math.MaxInt32
+
+// Difficulty maps a miner's seed signature and stake to a VDF difficulty using the
+// configured bounds, zero bounds fall back to the ecdsa_da defaults. The result is clamped to
+// the maximum difficulty so it always converts to an int.
+func (c *Config) Difficulty(signature []byte, stake float64, stakeSum float64) uint64 {
+	floor, capMultiplier := c.difficultyBounds()
+	diff := ecdsa_da.DifficultyWithBounds(signature, stakeSum, stake, c.MiningDifficulty, floor, capMultiplier)
+	if limit := c.maxDifficulty(); diff > limit {
+		log.Printf("Clamping difficulty %d to %d, stake %g of %g", diff, limit, stake, stakeSum)
+		return limit
 	}
+	return diff
+}
+
+// maxDifficulty returns the effective difficulty limit
+func (c *Config) maxDifficulty() uint64 {
+	if c.MaxDifficulty == 0 || c.MaxDifficulty > DefaultMaxDifficulty {
+		return DefaultMaxDifficulty
+	}
+	return c.MaxDifficulty
+}
 
-	return vdf.Verify(block.Proof)
+// expectedDifficulty is the difficulty the next block is expected to be mined at across the
+// network, the lowest stake-dependent part drawn by all miners together averages MiningDifficulty
+func (c *Config) expectedDifficulty() uint64 {
+	floor, _ := c.difficultyBounds()
+	return floor + c.MiningDifficulty
+}
+
+// canMine reports whether an account with the given stake may produce blocks, it needs at
+// least MinStake and more than nothing
+func (c *Config) canMine(stake float64) bool {
+	return stake > 0 && stake >= c.MinStake
+}
+
+// difficultyBounds returns the effective difficulty floor and cap multiplier
+func (c *Config) difficultyBounds() (uint64, float64) {
+	floor := c.DifficultyFloor
+	if floor == 0 {
+		floor = ecdsa_da.DefaultDifficultyFloor
+	}
+	capMultiplier := c.DifficultyCap
+	if capMultiplier == 0 {
+		capMultiplier = ecdsa_da.DefaultDifficultyCapMultiplier
+	}
+	return floor, capMultiplier
 }
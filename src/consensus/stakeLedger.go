@@ -0,0 +1,152 @@
+package consensus
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"github.com/nanlour/da/src/block"
+	"github.com/nanlour/da/src/db"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// stakeLedger is the stake of every account as of some block
+type stakeLedger map[[32]byte]float64
+
+// addresses returns the accounts in the ledger in address order
+func (l stakeLedger) addresses() [][32]byte {
+	addresses := make([][32]byte, 0, len(l))
+	for address := range l {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return bytes.Compare(addresses[i][:], addresses[j][:]) < 0
+	})
+	return addresses
+}
+
+// sum is the total stake, added in address order so every node gets the same float
+func (l stakeLedger) sum() float64 {
+	var total float64
+	for _, address := range l.addresses() {
+		total += l[address]
+	}
+	return total
+}
+
+// next returns the ledgers after block b, whose miner's stake grows by the block reward and
+// whose delegation, if it carries one, moves the sender's stake
+func (l stakeLedger) next(b *block.Block, reward float64, delegations delegationLedger) (stakeLedger, delegationLedger) {
+	next := make(stakeLedger, len(l)+1)
+	for address, stake := range l {
+		next[address] = stake
+	}
+	nextDelegations := make(delegationLedger, len(delegations)+1)
+	for delegator, delegation := range delegations {
+		nextDelegations[delegator] = delegation
+	}
+
+	if b.Txn.Type == block.TxDelegate {
+		next.delegate(nextDelegations, &b.Txn)
+	}
+	if reward > 0 {
+		next[blockMiner(b)] += reward
+	}
+	return next, nextDelegations
+}
+
+// delegate returns the stake the sender delegated before, then moves the sender's own stake to
+// the validator the transaction names. Stake delegated to the sender stays where it is, and a
+// sender naming itself only takes its stake back.
+func (l stakeLedger) delegate(delegations delegationLedger, txn *block.Transaction) {
+	from := txn.FromAddress
+	if previous, ok := delegations[from]; ok {
+		l[previous.Validator] -= previous.Stake
+		l[from] += previous.Stake
+		delete(delegations, from)
+	}
+	if txn.ToAddress == from {
+		return
+	}
+
+	own := l[from]
+	for _, delegation := range delegations.entries() {
+		if delegation.Validator == from {
+			own -= delegation.Stake
+		}
+	}
+	if !(own > 0) {
+		return
+	}
+	l[from] -= own
+	l[txn.ToAddress] += own
+	delegations[from] = db.Delegation{Delegator: from, Validator: txn.ToAddress, Stake: own}
+}
+
+// entries converts the ledger to its stored form
+func (l stakeLedger) entries() []db.StakeEntry {
+	entries := make([]db.StakeEntry, 0, len(l))
+	for _, address := range l.addresses() {
+		entries = append(entries, db.StakeEntry{Address: address, Stake: l[address]})
+	}
+	return entries
+}
+
+// delegationLedger is the stake every delegator has delegated as of some block
+type delegationLedger map[[32]byte]db.Delegation
+
+// entries converts the ledger to its stored form, in delegator order
+func (d delegationLedger) entries() []db.Delegation {
+	entries := make([]db.Delegation, 0, len(d))
+	for delegator := range d {
+		entries = append(entries, d[delegator])
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].Delegator[:], entries[j].Delegator[:]) < 0
+	})
+	return entries
+}
+
+// genesisStake is the ledger before the first block, the configured initial stake
+func (bc *BlockChain) genesisStake() stakeLedger {
+	ledger := make(stakeLedger, len(bc.NodeConfig.InitStake))
+	for address, stake := range bc.NodeConfig.InitStake {
+		ledger[address] = stake
+	}
+	return ledger
+}
+
+// stakeAt returns the ledger as of the block with the given hash. Only blocks applied to
+// the main chain have one stored, others return leveldb.ErrNotFound.
+func (bc *BlockChain) stakeAt(hash [32]byte) (stakeLedger, error) {
+	if hash == bc.GenesisBlock().Hash() {
+		return bc.genesisStake(), nil
+	}
+
+	entries, err := bc.mainDB.GetStakeSnapshot(&hash)
+	if err != nil {
+		return nil, err
+	}
+	ledger := make(stakeLedger, len(entries))
+	for _, entry := range entries {
+		ledger[entry.Address] = entry.Stake
+	}
+	return ledger, nil
+}
+
+// delegationsAt returns the delegations in force as of the block with the given hash, none when
+// nothing is stored for it
+func (bc *BlockChain) delegationsAt(hash [32]byte) (delegationLedger, error) {
+	entries, err := bc.mainDB.GetDelegations(&hash)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return delegationLedger{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	delegations := make(delegationLedger, len(entries))
+	for _, entry := range entries {
+		delegations[entry.Delegator] = entry
+	}
+	return delegations, nil
+}
@@ -0,0 +1,387 @@
+package consensus
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/nanlour/da/src/block"
+	"github.com/nanlour/da/src/ecdsa_da"
+	"github.com/nanlour/da/src/vdf_go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// mineTestBlock builds a fully mined block on top of parent carrying txn, signed by the node's key
+func mineTestBlock(t *testing.T, bc *BlockChain, parent *block.Block, txn block.Transaction) *block.Block {
+	newBlock := &block.Block{
+		PreHash:        parent.Hash(),
+		Height:         parent.Height + 1,
+		EpochBeginHash: bc.GenesisBlock().Hash(),
+		Txn:            txn,
+		PublicKey:      ecdsa_da.PublicKeyToBytes(&bc.NodeConfig.ID.PubKey),
+	}
+
+	seed := ecdsa_da.DifficultySeed(&newBlock.EpochBeginHash, newBlock.Height)
+	signature, err := ecdsa_da.Sign(&bc.NodeConfig.ID.PrvKey, seed[:])
+	require.NoError(t, err)
+	copy(newBlock.Signature[:], signature)
+
+	stake, err := bc.stakeAt(parent.Hash())
+	if err != nil {
+		// Mining ahead of the applied chain, the stake only stays at genesis without rewards
+		require.Zero(t, bc.NodeConfig.BlockReward, "parent %x has no stake ledger", parent.Hash())
+		stake = bc.genesisStake()
+	}
+	newBlock.Difficulty = bc.blockDifficulty(newBlock, stake)
+	vdf := vdf_go.New(int(newBlock.Difficulty), newBlock.HashwithoutProof())
+	go vdf.Execute(nil)
+	newBlock.Proof = <-vdf.GetOutputChannel()
+
+	return newBlock
+}
+
+// signedTxn creates a transaction from the node's account signed for the given height
+func signedTxn(bc *BlockChain, height uint64) block.Transaction {
+	txn := block.Transaction{
+		FromAddress: bc.NodeConfig.ID.Address,
+		Amount:      0,
+		Height:      height,
+	}
+	txn.Sign(&bc.NodeConfig.ID.PrvKey)
+	return txn
+}
+
+// signedTransfer creates a payment from the node's account signed for the given height, the
+// pool only accepts transactions that move funds
+func signedTransfer(bc *BlockChain, height uint64) block.Transaction {
+	txn := block.Transaction{
+		FromAddress: bc.NodeConfig.ID.Address,
+		ToAddress:   [32]byte{0xfe},
+		Amount:      1,
+		Height:      height,
+		Nonce:       1,
+	}
+	txn.Sign(&bc.NodeConfig.ID.PrvKey)
+	return txn
+}
+
+// TestVerifyBlockValid tests that a properly mined block passes verification
+func TestVerifyBlockValid(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	b := mineTestBlock(t, bc, bc.GenesisBlock(), signedTxn(bc, 1))
+	assert.True(t, bc.VerifyBlock(b))
+}
+
+// TestVerifyGenesis tests that genesis passes verification on its hash alone, while another
+// height 0 block and a mined block carrying the genesis placeholder proof are rejected
+func TestVerifyGenesis(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	genesis := bc.GenesisBlock()
+	assert.True(t, bc.VerifyBlock(genesis))
+	assert.True(t, bc.checkBlock(genesis))
+	assert.True(t, bc.verifyBlockWithStake(genesis, bc.genesisStake()))
+
+	// Another network's genesis
+	other := *bc.NodeConfig
+	other.Genesis.NetworkID = "other-net"
+	assert.False(t, bc.VerifyBlock(other.GenesisBlock()))
+	assert.False(t, bc.checkBlock(other.GenesisBlock()))
+
+	b := mineTestBlock(t, bc, genesis, signedTxn(bc, 1))
+	require.True(t, bc.VerifyBlock(b))
+	b.Proof = genesisProof
+	assert.False(t, bc.VerifyBlock(b), "only genesis may carry the placeholder proof")
+	assert.ErrorIs(t, bc.verifyWork(b, bc.genesisStake()), errInvalidProof)
+
+	// Renumbering a mined block to height 0 does not make it genesis
+	b = mineTestBlock(t, bc, genesis, signedTxn(bc, 1))
+	b.Height, b.Txn.Height = 0, 0
+	assert.False(t, bc.VerifyBlock(b))
+}
+
+// prove recomputes a block's proof with the given number of VDF iterations
+func prove(b *block.Block, iterations uint64) {
+	vdf := vdf_go.New(int(iterations), b.HashwithoutProof())
+	go vdf.Execute(nil)
+	b.Proof = <-vdf.GetOutputChannel()
+}
+
+// TestVerifyWork tests that a block's claimed difficulty has to match the one its stake gives,
+// and that its proof has to take as many iterations as it claims
+func TestVerifyWork(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	genesis := bc.GenesisBlock()
+	b := mineTestBlock(t, bc, genesis, signedTxn(bc, 1))
+	require.NotZero(t, b.Difficulty)
+	assert.NoError(t, bc.VerifyWork(b))
+	assert.True(t, bc.VerifyBlock(b))
+
+	// Claiming less work and proving only that much
+	forged := *b
+	forged.Difficulty = b.Difficulty - 1
+	prove(&forged, forged.Difficulty)
+	assert.ErrorIs(t, bc.VerifyWork(&forged), errDifficultyMismatch)
+	assert.False(t, bc.VerifyBlock(&forged))
+
+	// Claiming the right difficulty with a proof of fewer iterations
+	short := *b
+	prove(&short, b.Difficulty-1)
+	assert.ErrorIs(t, bc.VerifyWork(&short), errInvalidProof)
+	assert.False(t, bc.VerifyBlock(&short))
+
+	// A block without a claim is not accepted either
+	unclaimed := *b
+	unclaimed.Difficulty = 0
+	prove(&unclaimed, b.Difficulty)
+	assert.ErrorIs(t, bc.VerifyWork(&unclaimed), errDifficultyMismatch)
+}
+
+// TestVerifyBlockTxnHeightMismatch tests that a transaction signed for another height is rejected
+func TestVerifyBlockTxnHeightMismatch(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	// Everything else about the block is valid, including its VDF proof
+	b := mineTestBlock(t, bc, bc.GenesisBlock(), signedTxn(bc, 5))
+	assert.False(t, bc.VerifyBlock(b), "block carrying a transaction for another height should be rejected")
+}
+
+// TestVerifyBlockMinStake tests that only blocks from a producer holding enough stake in the
+// parent's ledger are accepted, and that the node does not mine without it
+func TestVerifyBlockMinStake(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	staked := mineTestBlock(t, bc, bc.GenesisBlock(), signedTxn(bc, 1))
+	assert.True(t, bc.VerifyBlock(staked))
+
+	bc.NodeConfig.MinStake = 150
+	assert.False(t, bc.VerifyBlock(staked), "100 staked is below the minimum")
+	_, _, err := bc.newBlockTemplate(bc.GenesisBlock())
+	assert.ErrorIs(t, err, errInsufficientStake)
+	bc.NodeConfig.MinStake = 0
+
+	// A key that is not in the stake ledger at all, its difficulty is too large to mine at so
+	// the block reuses the staked block's proof
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	bc.NodeConfig.ID = Account{
+		PrvKey:  *privateKey,
+		PubKey:  privateKey.PublicKey,
+		Address: ecdsa_da.PublicKeyToAddress(&privateKey.PublicKey),
+	}
+	unstaked := *staked
+	unstaked.PublicKey = ecdsa_da.PublicKeyToBytes(&privateKey.PublicKey)
+	seed := ecdsa_da.DifficultySeed(&unstaked.EpochBeginHash, unstaked.Height)
+	signature, err := ecdsa_da.Sign(privateKey, seed[:])
+	require.NoError(t, err)
+	copy(unstaked.Signature[:], signature)
+	require.True(t, bc.checkBlock(&unstaked))
+	assert.False(t, bc.VerifyBlock(&unstaked), "a producer without stake should be rejected")
+	_, _, err = bc.newBlockTemplate(bc.GenesisBlock())
+	assert.ErrorIs(t, err, errInsufficientStake)
+}
+
+// TestDelegation tests that a delegation moves the delegator's stake to the validator and
+// taking it back returns it, and that a reorg dropping the delegation restores the ledger
+func TestDelegation(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	genesis := bc.GenesisBlock()
+	bc.MyChain = []*Chain{{Hash: genesis.Hash()}}
+	sender := testPeerID(t)
+	network := blockNetwork{peers: []peer.ID{sender}, blocks: map[[32]byte]*block.Block{}}
+	bc.P2PNode = network
+	// Difficulties stay near the floor, so the longer fork below is always the heavier one
+	bc.NodeConfig.DifficultyCap = 0.1
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	delegator := ecdsa_da.PublicKeyToAddress(&privateKey.PublicKey)
+	bc.NodeConfig.InitStake[delegator] = 50
+	validator := bc.NodeConfig.ID.Address
+	delegate := func(to [32]byte, height, nonce uint64) block.Transaction {
+		txn := block.NewDelegation(delegator, to, height, nonce)
+		txn.Sign(privateKey)
+		return *txn
+	}
+
+	b1 := mineTestBlock(t, bc, genesis, delegate(validator, 1, 1))
+	require.NoError(t, bc.processNewBlock(b1, false, ""))
+	require.Len(t, bc.MyChain, 2)
+	stake, err := bc.stakeAt(b1.Hash())
+	require.NoError(t, err)
+	assert.Equal(t, 150.0, stake[validator])
+	assert.Zero(t, stake[delegator])
+	assert.Equal(t, 150.0, stake.sum())
+
+	// The validator mines at its larger share
+	b2 := mineTestBlock(t, bc, b1, delegate(delegator, 2, 2))
+	assert.LessOrEqual(t, bc.blockDifficulty(b2, stake), bc.blockDifficulty(b2, bc.genesisStake()))
+
+	// Naming itself the delegator takes its stake back
+	require.NoError(t, bc.processNewBlock(b2, false, ""))
+	require.Len(t, bc.MyChain, 3)
+	stake, err = bc.stakeAt(b2.Hash())
+	require.NoError(t, err)
+	assert.Equal(t, 100.0, stake[validator])
+	assert.Equal(t, 50.0, stake[delegator])
+	delegations, err := bc.delegationsAt(b2.Hash())
+	require.NoError(t, err)
+	assert.Empty(t, delegations)
+
+	// A longer fork from genesis without the delegation replaces both blocks
+	fork := genesis
+	for height := uint64(1); height <= 3; height++ {
+		emptyTxn := block.Transaction{Height: height}
+		emptyTxn.Sign(&bc.NodeConfig.ID.PrvKey)
+		fork = mineTestBlock(t, bc, fork, emptyTxn)
+		network.blocks[fork.Hash()] = fork
+	}
+	require.NoError(t, bc.processNewBlock(fork, false, sender.String()))
+	require.Equal(t, fork.Hash(), bc.MyChain[len(bc.MyChain)-1].Hash, "longer fork should be adopted")
+
+	stake, err = bc.stakeAt(fork.Hash())
+	require.NoError(t, err)
+	assert.Equal(t, 100.0, stake[validator])
+	assert.Equal(t, 50.0, stake[delegator])
+	b1Hash := b1.Hash()
+	_, err = bc.mainDB.GetDelegations(&b1Hash)
+	assert.ErrorIs(t, err, leveldb.ErrNotFound, "rolling back the block drops its delegations")
+	nonce, err := bc.mainDB.GetAccountNonceOrZero(&delegator)
+	require.NoError(t, err)
+	assert.Zero(t, nonce)
+	require.NoError(t, bc.ValidateChain())
+
+	// The node's own delegations are pooled for the next block without a fee
+	bc.NodeConfig.TxnFee = 0.5
+	hash, err := bc.SubmitDelegation(delegator)
+	require.NoError(t, err)
+	pooled, ok := bc.TxnPool.GetTransactionByHash(hash)
+	require.True(t, ok)
+	assert.Equal(t, block.TxDelegate, pooled.Type)
+	assert.Zero(t, pooled.Fee)
+	assert.Equal(t, fork.Height+1, pooled.Height)
+	assert.True(t, pooled.Verify())
+}
+
+// TestConfigDifficultyBounds tests that the configured floor and cap are applied, and that
+// leaving them unset keeps the default difficulty
+func TestConfigDifficultyBounds(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	config := *bc.NodeConfig
+	stake := config.InitStake[config.ID.Address]
+	stakeSum := bc.genesisStake().sum()
+	maxDiff := uint64(1) + uint64(float64(config.MiningDifficulty)*0.5*stakeSum/stake)
+	epochHash := bc.GenesisBlock().Hash()
+
+	for height := uint64(1); height <= 200; height++ {
+		seed := ecdsa_da.DifficultySeed(&epochHash, height)
+		signature, err := ecdsa_da.Sign(&config.ID.PrvKey, seed[:])
+		require.NoError(t, err)
+
+		config.DifficultyFloor, config.DifficultyCap = 0, 0
+		assert.Equal(t, ecdsa_da.Difficulty(signature, stakeSum, stake, config.MiningDifficulty), config.Difficulty(signature, stake, stakeSum))
+
+		config.DifficultyFloor, config.DifficultyCap = 1, 0.5
+		diff := config.Difficulty(signature, stake, stakeSum)
+		assert.GreaterOrEqual(t, diff, uint64(1))
+		assert.LessOrEqual(t, diff, maxDiff)
+	}
+}
+
+// TestConfigDifficultyClamped tests that a difficulty too large for an int, as a vanishing
+// stake share gives, is clamped to the configured maximum instead of overflowing
+func TestConfigDifficultyClamped(t *testing.T) {
+	config := Config{MiningDifficulty: 1000}
+	signature := []byte("huge difficulty")
+
+	for _, stake := range []float64{0, 1e-300, 1e-9} {
+		diff := config.Difficulty(signature, stake, 100)
+		assert.Equal(t, uint64(DefaultMaxDifficulty), diff, "stake %g", stake)
+		assert.Positive(t, int(diff))
+	}
+
+	config.MaxDifficulty = 5000
+	assert.Equal(t, uint64(5000), config.Difficulty(signature, 1e-9, 100))
+
+	// A difficulty under the limit is left alone
+	floor, capMultiplier := config.difficultyBounds()
+	assert.Equal(t, ecdsa_da.DifficultyWithBounds(signature, 100, 50, 1000, floor, capMultiplier), config.Difficulty(signature, 50, 100))
+}
+
+// TestBlockRewardGrowsStake tests that mining rewards add to the miner's stake and that the
+// larger share lowers the difficulty of the miner's later blocks
+func TestBlockRewardGrowsStake(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+	bc.P2PNode = offlineNetwork{}
+	bc.MyChain = []*Chain{{Hash: bc.GenesisBlock().Hash()}}
+	bc.NodeConfig.BlockReward = 100
+	bc.NodeConfig.InitStake[[32]byte{0xee}] = 100
+
+	miner := bc.NodeConfig.ID.Address
+	b1 := mineTestBlock(t, bc, bc.GenesisBlock(), signedTxn(bc, 1))
+	require.NoError(t, bc.processNewBlock(b1, false, ""))
+	require.Len(t, bc.MyChain, 2)
+
+	genesisStake := bc.genesisStake()
+	stake, err := bc.stakeAt(b1.Hash())
+	require.NoError(t, err)
+	assert.Equal(t, 200.0, stake[miner])
+	assert.Equal(t, 300.0, stake.sum())
+
+	// The same signatures map to no higher a difficulty with the larger share, and lower on the whole
+	epochHash := bc.GenesisBlock().Hash()
+	var before, after uint64
+	for height := uint64(2); height <= 100; height++ {
+		seed := ecdsa_da.DifficultySeed(&epochHash, height)
+		signature, err := ecdsa_da.Sign(&bc.NodeConfig.ID.PrvKey, seed[:])
+		require.NoError(t, err)
+
+		old := bc.NodeConfig.Difficulty(signature, genesisStake[miner], genesisStake.sum())
+		current := bc.NodeConfig.Difficulty(signature, stake[miner], stake.sum())
+		assert.LessOrEqual(t, current, old)
+		before += old
+		after += current
+	}
+	assert.Less(t, after, before)
+
+	// The miner builds on the new ledger and other nodes verify against it
+	template, difficulty, err := bc.newBlockTemplate(b1)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, difficulty, bc.blockDifficulty(template, genesisStake))
+	b2 := mineTestBlock(t, bc, b1, signedTxn(bc, 2))
+	assert.True(t, bc.VerifyBlock(b2))
+
+	// Rolling the block back drops its ledger
+	require.NoError(t, rollbackTestBlock(bc, b1))
+	_, err = bc.stakeAt(b1.Hash())
+	assert.Error(t, err)
+}
+
+// TestStageBlockNeedsParentStake tests that a block whose parent was never applied has no
+// stake ledger to be applied against and is refused
+func TestStageBlockNeedsParentStake(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	orphan := &block.Block{PreHash: [32]byte{0x0f}, Height: 2, Txn: signedTxn(bc, 2)}
+	state := newBatchState(bc.mainDB, new(leveldb.Batch))
+	err := bc.stageBlock(state, orphan)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no stake ledger")
+}
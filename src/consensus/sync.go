@@ -0,0 +1,228 @@
+package consensus
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/nanlour/da/src/block"
+	"github.com/nanlour/da/src/p2p"
+	"github.com/nanlour/da/src/rpc"
+)
+
+// syncBatchSize is how many blocks initial block download asks a peer for at once
+const syncBatchSize = p2p.MaxBlocksPerRequest
+
+// syncRunBlocks bounds the blocks one initial block download run applies
+const syncRunBlocks = 16 * syncBatchSize
+
+// syncState tracks the initial block download, mining waits while one is running
+type syncState struct {
+	mu     sync.Mutex
+	active bool
+	target uint64        // Height being synced to, kept after the download ends
+	done   chan struct{} // Closed when the running download ends
+}
+
+func (s *syncState) start(target uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active = true
+	s.target = target
+	s.done = make(chan struct{})
+}
+
+func (s *syncState) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active = false
+	close(s.done)
+}
+
+// running returns whether a download is running and a channel closed when it ends
+func (s *syncState) running() (<-chan struct{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done, s.active
+}
+
+func (s *syncState) status() (bool, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active, s.target
+}
+
+// SyncFromPeer asks the tip manager to download the chain of a peer that announced a
+// higher tip than ours, requests arriving while one is queued are dropped
+func (bc *BlockChain) SyncFromPeer(peerID peer.ID) {
+	select {
+	case bc.syncRequests <- peerID:
+	default:
+	}
+}
+
+// TipAnnounced fetches a tip a peer announced in its status when we don't have it, so a block
+// whose gossip we missed still reaches us. A tip more than one block ahead is downloaded
+// like a sync, tips below ours are left to gossip and the periodic tip request.
+func (bc *BlockChain) TipAnnounced(peerID peer.ID, tip p2p.StatusMessage) {
+	go bc.fetchAnnouncedTip(peerID, tip)
+}
+
+func (bc *BlockChain) fetchAnnouncedTip(peerID peer.ID, announced p2p.StatusMessage) {
+	if bc.hasBlock(announced.TipHash) {
+		return
+	}
+	tip, err := bc.GetTipBlock()
+	if err != nil || announced.TipHeight < tip.Height {
+		return
+	}
+	if announced.TipHeight > tip.Height+1 {
+		bc.SyncFromPeer(peerID)
+		return
+	}
+
+	b, err := bc.P2PNode.GetBlockByHash(announced.TipHash, peerID)
+	if err != nil || b == nil || b.Hash() != announced.TipHash {
+		log.Printf("Failed to fetch tip %x announced by %s: %v", announced.TipHash, peerID, err)
+		return
+	}
+	log.Printf("Fetched tip at height %d announced by %s", b.Height, peerID)
+	select {
+	case bc.P2PChan <- &p2p.P2PBlock{Block: *b, Sender: peerID.String()}:
+	case <-bc.quit:
+	}
+}
+
+// SyncStatus reports how far the node is towards the height it is syncing to
+func (bc *BlockChain) SyncStatus() rpc.SyncStatus {
+	var status rpc.SyncStatus
+	if tip, err := bc.GetTipBlock(); err == nil {
+		status.CurrentHeight = tip.Height
+	}
+	status.Syncing, status.TargetHeight = bc.sync.status()
+	status.TargetHeight = max(status.TargetHeight, status.CurrentHeight)
+
+	status.Progress = 100
+	if status.TargetHeight > 0 {
+		status.Progress = 100 * float64(status.CurrentHeight) / float64(status.TargetHeight)
+	}
+	return status
+}
+
+// syncFromBestPeer downloads from the connected peer whose handshake announced the highest tip
+func (bc *BlockChain) syncFromBestPeer() {
+	var best peer.ID
+	var bestHeight uint64
+	for _, peerID := range bc.P2PNode.Peers() {
+		if handshake, ok := bc.P2PNode.PeerHandshake(peerID); ok && handshake.TipHeight > bestHeight {
+			best, bestHeight = peerID, handshake.TipHeight
+		}
+	}
+	if bestHeight > 0 {
+		bc.downloadFrom(best)
+	}
+}
+
+// downloadFrom runs an initial block download from the peer if its tip is above ours
+func (bc *BlockChain) downloadFrom(peerID peer.ID) {
+	target, err := bc.P2PNode.GetTip(peerID)
+	if err != nil || target == nil {
+		log.Printf("Failed to get tip from peer %s: %v", peerID, err)
+		return
+	}
+	tip, err := bc.GetTipBlock()
+	if err != nil {
+		log.Printf("Failed to get tip block: %v", err)
+		return
+	}
+	if target.Height <= tip.Height {
+		return
+	}
+
+	if err := bc.initialBlockDownload(peerID, target); err != nil {
+		log.Printf("Initial block download from %s failed: %v", peerID, err)
+	}
+}
+
+// initialBlockDownload fetches the peer's chain forward from the newest block we share with it,
+// one batch at a time, and processes each batch before asking for the next. The newest
+// shared block is our tip unless the peer's chain forks below it, then the download starts
+// syncWindow blocks below the tip. A run applies at most syncRunBlocks blocks and asks the
+// tip manager for another run when the peer is still ahead, so a peer claiming a far higher
+// tip than it can serve costs one batch.
+func (bc *BlockChain) initialBlockDownload(peerID peer.ID, target *block.Block) error {
+	tip, err := bc.GetTipBlock()
+	if err != nil {
+		return err
+	}
+	if target.Height <= tip.Height {
+		return fmt.Errorf("target height %d is not above our tip at height %d", target.Height, tip.Height)
+	}
+
+	bc.sync.start(target.Height)
+	defer bc.sync.finish()
+	log.Printf("Starting initial block download from %s to height %d", peerID, target.Height)
+
+	from := tip.Hash()
+	retried := false
+	for fetched := 0; tip.Height < target.Height; {
+		if fetched >= syncRunBlocks {
+			log.Printf("Pausing the download from %s at height %d", peerID, tip.Height)
+			bc.SyncFromPeer(peerID)
+			return nil
+		}
+		select {
+		case <-bc.quit:
+			return errNodeStopped
+		default:
+		}
+
+		blocks, err := bc.P2PNode.GetBlocksAfter(from, syncBatchSize, peerID)
+		if err != nil && !retried && tip.Height > 0 {
+			log.Printf("Peer %s has no blocks after %x, trying %d blocks below our tip: %v", peerID, from, bc.NodeConfig.syncWindow(), err)
+			retried = true
+			from = bc.MyChain[tip.Height-min(tip.Height, bc.NodeConfig.syncWindow())].Hash
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(blocks) == 0 {
+			return fmt.Errorf("peer sent no blocks after %x", from)
+		}
+
+		// Each block is verified and applied by processNewBlock against the one before it
+		for _, b := range blocks {
+			if b == nil {
+				return fmt.Errorf("peer sent a missing block after %x", from)
+			}
+			if b.PreHash != from {
+				return fmt.Errorf("peer sent block %x, expected a child of %x", b.Hash(), from)
+			}
+			if !bc.hasBlock(b.Hash()) {
+				if err := bc.processNewBlock(b, false, peerID.String()); err != nil {
+					return err
+				}
+			}
+			from = b.Hash()
+		}
+		if !bc.hasBlock(from) {
+			return fmt.Errorf("block %x from the peer was not accepted", from)
+		}
+		fetched += len(blocks)
+
+		if tip, err = bc.GetTipBlock(); err != nil {
+			return err
+		}
+		log.Printf("Downloaded %d blocks, now at height %d", fetched, tip.Height)
+	}
+	log.Printf("Initial block download from %s finished", peerID)
+	return nil
+}
+
+// hasBlock reports whether a block is stored, on the main chain or not
+func (bc *BlockChain) hasBlock(hash [32]byte) bool {
+	b, err := bc.mainDB.GetHashBlock(hash[:])
+	return err == nil && b != nil
+}
@@ -0,0 +1,103 @@
+package testharness
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nanlour/da/src/consensus"
+)
+
+// FakeClock is a consensus.Clock that only moves when advanced
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  map[*fakeTimer]struct{}
+	changed chan struct{} // Closed and replaced whenever a timer is added or removed
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	deadline time.Time
+	c        chan time.Time
+}
+
+// NewFakeClock returns a clock stopped at start
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{
+		now:     start,
+		timers:  make(map[*fakeTimer]struct{}),
+		changed: make(chan struct{}),
+	}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) consensus.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{clock: c, deadline: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers[t] = struct{}{}
+	c.notify()
+	return t
+}
+
+// Advance moves the clock forward and fires every timer that became due
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	for t := range c.timers {
+		if !t.deadline.After(c.now) {
+			t.c <- c.now
+			delete(c.timers, t)
+		}
+	}
+	c.notify()
+}
+
+// BlockUntil waits until at least n timers are pending, that is until n loops are idle
+func (c *FakeClock) BlockUntil(ctx context.Context, n int) error {
+	for {
+		c.mu.Lock()
+		pending, changed := len(c.timers), c.changed
+		c.mu.Unlock()
+
+		if pending >= n {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// notify wakes BlockUntil, the caller holds mu
+func (c *FakeClock) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	if _, pending := t.clock.timers[t]; !pending {
+		return false
+	}
+	delete(t.clock.timers, t)
+	t.clock.notify()
+	return true
+}
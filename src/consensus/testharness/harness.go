@@ -0,0 +1,345 @@
+// Package testharness runs several fully wired nodes in one process over an in-memory
+// network and a fake clock, so tests can drive mining and sync step by step
+package testharness
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/nanlour/da/src/block"
+	"github.com/nanlour/da/src/consensus"
+	"github.com/nanlour/da/src/ecdsa_da"
+)
+
+const (
+	// Heartbeat is how far Advance has to move the clock to trigger a tip fetch
+	Heartbeat = 5 * time.Second
+
+	// InitialBalance is the genesis balance of every node's account
+	InitialBalance = 1000.0
+
+	stakePerNode = 100.0
+	waitTimeout  = 60 * time.Second
+)
+
+// Harness owns N nodes sharing a genesis, a memory network and a fake clock
+type Harness struct {
+	Nodes []*consensus.BlockChain
+	Clock *FakeClock
+
+	tb      testing.TB
+	net     *memNetwork
+	peerIDs []peer.ID
+	running []bool
+}
+
+// New starts n nodes that are all connected to each other, they are stopped when the test ends
+func New(tb testing.TB, n int) *Harness {
+	tb.Helper()
+
+	h := &Harness{
+		Nodes:   make([]*consensus.BlockChain, n),
+		Clock:   NewFakeClock(time.Unix(0, 0)),
+		tb:      tb,
+		net:     newMemNetwork(),
+		peerIDs: make([]peer.ID, n),
+		running: make([]bool, n),
+	}
+
+	// Every node stakes and owns the same amount, genesis is shared
+	accounts := make([]consensus.Account, n)
+	initStake := make(map[[32]byte]float64)
+	initBank := make(map[[32]byte]float64)
+	for i := range accounts {
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+		if err != nil {
+			tb.Fatalf("Failed to generate key for node %d: %v", i, err)
+		}
+		address := ecdsa_da.PublicKeyToAddress(&privateKey.PublicKey)
+		accounts[i] = consensus.Account{PrvKey: *privateKey, PubKey: privateKey.PublicKey, Address: address}
+		initStake[address] = stakePerNode
+		initBank[address] = InitialBalance
+	}
+
+	// Peer IDs are derived from the node index so logs are stable between runs
+	for i := range h.peerIDs {
+		key, _, err := crypto.GenerateEd25519Key(rand.New(rand.NewSource(int64(i))))
+		if err != nil {
+			tb.Fatalf("Failed to generate peer key for node %d: %v", i, err)
+		}
+		if h.peerIDs[i], err = peer.IDFromPrivateKey(key); err != nil {
+			tb.Fatalf("Failed to derive peer ID for node %d: %v", i, err)
+		}
+	}
+
+	for i := range h.Nodes {
+		bc := &consensus.BlockChain{}
+		bc.SetConfig(&consensus.Config{
+			ID:               accounts[i],
+			MiningDifficulty: 4,
+			DifficultyFloor:  5,
+			DifficultyCap:    0.5,
+			DbPath:           filepath.Join(tb.TempDir(), "db"),
+			RPCPort:          0,
+			InitStake:        initStake,
+			InitBank:         initBank,
+			Genesis:          consensus.GenesisConfig{NetworkID: "harness"},
+			CheckInvariants:  true,
+		})
+		bc.SetClock(h.Clock)
+		bc.P2PNode = h.net.join(h.peerIDs[i], bc)
+		h.Nodes[i] = bc
+	}
+	h.Heal()
+
+	tb.Cleanup(h.Stop)
+	for i, bc := range h.Nodes {
+		if err := bc.Init(); err != nil {
+			tb.Fatalf("Failed to start node %d: %v", i, err)
+		}
+		h.running[i] = true
+	}
+
+	return h
+}
+
+// Stop shuts every running node down
+func (h *Harness) Stop() {
+	for i := range h.Nodes {
+		h.StopNode(i)
+	}
+}
+
+// StopNode shuts one node down, it stays unreachable for the rest of the test
+func (h *Harness) StopNode(node int) {
+	if !h.running[node] {
+		return
+	}
+	h.running[node] = false
+	if err := h.Nodes[node].Stop(); err != nil {
+		h.tb.Logf("Stopping node %d: %v", node, err)
+	}
+}
+
+// Partition splits the network so nodes only reach the others in their own group
+func (h *Harness) Partition(groups ...[]int) {
+	group := make(map[int]int)
+	for g, nodes := range groups {
+		for _, node := range nodes {
+			group[node] = g
+		}
+	}
+	for a := range h.Nodes {
+		for b := a + 1; b < len(h.Nodes); b++ {
+			ga, okA := group[a]
+			gb, okB := group[b]
+			h.net.setLink(h.peerIDs[a], h.peerIDs[b], okA && okB && ga == gb)
+		}
+	}
+}
+
+// Heal reconnects every pair of nodes
+func (h *Harness) Heal() {
+	for a := range h.Nodes {
+		for b := a + 1; b < len(h.Nodes); b++ {
+			h.net.setLink(h.peerIDs[a], h.peerIDs[b], true)
+		}
+	}
+}
+
+// MineBlock mines a block on the node's tip and waits until the node has adopted it
+func (h *Harness) MineBlock(node int) *block.Block {
+	h.tb.Helper()
+
+	newBlock, err := h.Nodes[node].MineBlock()
+	if err != nil {
+		h.tb.Fatalf("Node %d failed to mine: %v", node, err)
+	}
+
+	blockHash := newBlock.Hash()
+	err = h.waitFor(func() bool {
+		return h.Tip(node).Hash() == blockHash
+	})
+	if err != nil {
+		h.tb.Fatalf("Node %d did not adopt its block at height %d: %v", node, newBlock.Height, err)
+	}
+	return newBlock
+}
+
+// SendTxn submits a transfer from the node's account and returns its hash
+func (h *Harness) SendTxn(node int, to [32]byte, amount float64) [32]byte {
+	h.tb.Helper()
+
+	hash, err := h.Nodes[node].SubmitTxn(to, amount)
+	if err != nil {
+		h.tb.Fatalf("Node %d failed to submit transaction: %v", node, err)
+	}
+	return hash
+}
+
+// AnnounceTips makes every running node announce its tip to the peers it reaches, as the
+// periodic status announcement does
+func (h *Harness) AnnounceTips() {
+	for i, bc := range h.Nodes {
+		if h.running[i] {
+			bc.P2PNode.(*memNode).announceStatus()
+		}
+	}
+}
+
+// Advance moves the fake clock once every running tip manager is idle
+func (h *Harness) Advance(d time.Duration) {
+	h.tb.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	if err := h.Clock.BlockUntil(ctx, h.runningCount()); err != nil {
+		h.tb.Fatalf("Tip managers did not go idle: %v", err)
+	}
+	h.Clock.Advance(d)
+}
+
+// WaitConverged fires heartbeats until every running node has the same tip
+func (h *Harness) WaitConverged() {
+	h.tb.Helper()
+
+	deadline := time.Now().Add(waitTimeout)
+	for !h.converged() {
+		if time.Now().After(deadline) {
+			h.tb.Fatalf("Nodes did not converge: %s", h.describeTips())
+		}
+
+		// A heartbeat makes every node fetch a peer's tip, give the fetches time to land
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		changed := h.anyTipChanged(ctx)
+		h.Advance(Heartbeat)
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+		cancel()
+	}
+}
+
+// Tip returns the node's current tip block
+func (h *Harness) Tip(node int) *block.Block {
+	h.tb.Helper()
+
+	tip, err := h.Nodes[node].GetTipBlock()
+	if err != nil {
+		h.tb.Fatalf("Node %d has no tip: %v", node, err)
+	}
+	return tip
+}
+
+// Address returns the account address of a node
+func (h *Harness) Address(node int) [32]byte {
+	return h.Nodes[node].NodeConfig.ID.Address
+}
+
+// PeerID returns the ID other nodes know a node by
+func (h *Harness) PeerID(node int) peer.ID {
+	return h.peerIDs[node]
+}
+
+// Balance returns the balance of address as seen by node, accounts never written hold zero
+func (h *Harness) Balance(node int, address [32]byte) float64 {
+	h.tb.Helper()
+
+	balance, err := h.Nodes[node].GetAccountBalance(&address)
+	if err != nil {
+		return 0
+	}
+	return balance
+}
+
+func (h *Harness) runningCount() int {
+	count := 0
+	for _, running := range h.running {
+		if running {
+			count++
+		}
+	}
+	return count
+}
+
+func (h *Harness) converged() bool {
+	var first [32]byte
+	seen := false
+	for i, bc := range h.Nodes {
+		if !h.running[i] {
+			continue
+		}
+		tip, err := bc.GetTipBlock()
+		if err != nil {
+			return false
+		}
+		if !seen {
+			first, seen = tip.Hash(), true
+		} else if tip.Hash() != first {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Harness) describeTips() string {
+	desc := ""
+	for i, bc := range h.Nodes {
+		if !h.running[i] {
+			continue
+		}
+		if tip, err := bc.GetTipBlock(); err == nil {
+			desc += fmt.Sprintf(" node %d at %d (%x)", i, tip.Height, tip.Hash())
+		}
+	}
+	return desc
+}
+
+// anyTipChanged returns a channel closed as soon as one running node changes its tip,
+// watching stops when ctx is done
+func (h *Harness) anyTipChanged(ctx context.Context) <-chan struct{} {
+	changed := make(chan struct{})
+	var once sync.Once
+	for i, bc := range h.Nodes {
+		if !h.running[i] {
+			continue
+		}
+		go func(tipChanged <-chan struct{}) {
+			select {
+			case <-tipChanged:
+				once.Do(func() { close(changed) })
+			case <-ctx.Done():
+			}
+		}(bc.TipChanged())
+	}
+	return changed
+}
+
+// waitFor blocks until cond holds, re-checking whenever a tip changes
+func (h *Harness) waitFor(cond func() bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+
+	for {
+		changed := h.anyTipChanged(ctx)
+		if cond() {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fmt.Errorf("timed out after %s", waitTimeout)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package testharness
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mineConfirming mines one block on node and checks it confirms the transaction, which
+// targets the block right after the tip it was sent at
+func mineConfirming(t *testing.T, h *Harness, node int, txHash [32]byte) {
+	h.MineBlock(node)
+	confirmed, _, _, err := h.Nodes[node].GetTransactionStatus(txHash)
+	require.NoError(t, err)
+	require.True(t, confirmed, "transaction %x should be in node %d's next block", txHash, node)
+}
+
+// TestBlocksPropagate tests that mined blocks reach every node
+func TestBlocksPropagate(t *testing.T) {
+	h := New(t, 3)
+
+	h.MineBlock(0)
+	h.MineBlock(0)
+	h.WaitConverged()
+
+	for i := range h.Nodes {
+		assert.Equal(t, uint64(2), h.Tip(i).Height, "node %d", i)
+	}
+}
+
+// TestForkConvergence tests that a partitioned minority switches to the heavier majority chain once healed
+func TestForkConvergence(t *testing.T) {
+	h := New(t, 3)
+
+	h.Partition([]int{0}, []int{1, 2})
+	h.MineBlock(0)
+	for i := 0; i < 3; i++ {
+		h.MineBlock(1)
+	}
+
+	// Three blocks always outweigh one, each block's difficulty is bounded by the harness config
+	h.Heal()
+	h.WaitConverged()
+
+	majorityTip := h.Tip(1)
+	assert.Equal(t, uint64(3), majorityTip.Height)
+	for i := range h.Nodes {
+		assert.Equal(t, majorityTip.Hash(), h.Tip(i).Hash(), "node %d", i)
+	}
+}
+
+// TestForkConvergenceWithRewards tests that nodes converge when block rewards change the
+// stake, and so the difficulty, along the competing chains
+func TestForkConvergenceWithRewards(t *testing.T) {
+	h := New(t, 3)
+	for _, bc := range h.Nodes {
+		bc.NodeConfig.BlockReward = 50
+	}
+
+	h.Partition([]int{0}, []int{1, 2})
+	h.MineBlock(0)
+	for i := 0; i < 3; i++ {
+		h.MineBlock(1)
+	}
+	h.Heal()
+	h.WaitConverged()
+
+	majorityTip := h.Tip(1)
+	assert.Equal(t, uint64(3), majorityTip.Height)
+	for i := range h.Nodes {
+		assert.Equal(t, majorityTip.Hash(), h.Tip(i).Hash(), "node %d", i)
+		assert.Equal(t, InitialBalance, h.Balance(i, h.Address(0)), "node %d keeps the abandoned reward", i)
+		assert.Equal(t, InitialBalance+150, h.Balance(i, h.Address(1)), "node %d", i)
+	}
+}
+
+// TestReorgRevertsBalances tests that a transfer mined only on the losing side of a partition is rolled back
+func TestReorgRevertsBalances(t *testing.T) {
+	h := New(t, 3)
+
+	h.Partition([]int{0}, []int{1, 2})
+	txHash := h.SendTxn(0, h.Address(1), 100)
+	mineConfirming(t, h, 0, txHash)
+	assert.Equal(t, InitialBalance-100, h.Balance(0, h.Address(0)))
+
+	// Five blocks always outweigh the single block mined on the minority side
+	for i := 0; i < 5; i++ {
+		h.MineBlock(1)
+	}
+	h.Heal()
+	h.WaitConverged()
+
+	for i := range h.Nodes {
+		assert.Equal(t, InitialBalance, h.Balance(i, h.Address(0)), "node %d", i)
+		assert.Equal(t, InitialBalance, h.Balance(i, h.Address(1)), "node %d", i)
+	}
+	confirmed, _, _, _ := h.Nodes[0].GetTransactionStatus(txHash)
+	assert.False(t, confirmed, "transfer from the abandoned chain should not be confirmed")
+}
+
+// TestTransferOnConvergedNetwork tests that every node applies a transfer the same way
+func TestTransferOnConvergedNetwork(t *testing.T) {
+	h := New(t, 3)
+
+	txHash := h.SendTxn(2, h.Address(0), 50)
+	mineConfirming(t, h, 1, txHash)
+	h.WaitConverged()
+
+	for i := range h.Nodes {
+		require.Equal(t, InitialBalance+50, h.Balance(i, h.Address(0)), "node %d", i)
+		require.Equal(t, InitialBalance-50, h.Balance(i, h.Address(2)), "node %d", i)
+	}
+}
+
+// TestInitialBlockDownload tests that a node left at genesis downloads a peer's 50 block
+// chain in batches once told the peer is ahead, without waiting for a heartbeat
+func TestInitialBlockDownload(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping 50 block sync in short mode")
+	}
+	h := New(t, 2)
+
+	h.Partition([]int{0}, []int{1})
+	for range 50 {
+		h.MineBlock(0)
+	}
+	require.Equal(t, uint64(0), h.Tip(1).Height)
+
+	h.Heal()
+	h.Nodes[1].SyncFromPeer(h.PeerID(0))
+	target := h.Tip(0).Hash()
+	require.NoError(t, h.waitFor(func() bool {
+		return h.Tip(1).Hash() == target
+	}), "node 1 did not sync:%s", h.describeTips())
+
+	status := h.Nodes[1].SyncStatus()
+	assert.False(t, status.Syncing)
+	assert.Equal(t, uint64(50), status.CurrentHeight)
+	assert.Equal(t, uint64(50), status.TargetHeight)
+	assert.Equal(t, 100.0, status.Progress)
+}
+
+// TestStragglerCatchesUpFromAnnouncement tests that a node that missed a block's broadcast
+// fetches it once the miner announces its tip, without waiting for a tip request
+func TestStragglerCatchesUpFromAnnouncement(t *testing.T) {
+	h := New(t, 2)
+
+	h.Partition([]int{0}, []int{1})
+	mined := h.MineBlock(0)
+	h.Heal()
+	require.Equal(t, uint64(0), h.Tip(1).Height, "node 1 should have missed the broadcast")
+
+	h.AnnounceTips()
+	require.NoError(t, h.waitFor(func() bool {
+		return h.Tip(1).Hash() == mined.Hash()
+	}), "node 1 did not fetch the announced tip:%s", h.describeTips())
+}
+
+// TestExportImport tests that a chain exported from one node and imported into a fresh one
+// reproduces the same tip and balances
+func TestExportImport(t *testing.T) {
+	h := New(t, 2)
+	h.Partition([]int{0}, []int{1})
+
+	h.MineBlock(0)
+	txHash := h.SendTxn(0, h.Address(1), 25)
+	mineConfirming(t, h, 0, txHash)
+	h.MineBlock(0)
+	require.Equal(t, uint64(0), h.Tip(1).Height)
+
+	var chain bytes.Buffer
+	require.NoError(t, h.Nodes[0].ExportBlocks(&chain))
+	require.NoError(t, h.Nodes[1].ImportBlocks(&chain))
+
+	assert.Equal(t, h.Tip(0).Hash(), h.Tip(1).Hash())
+	assert.Equal(t, h.Balance(0, h.Address(1)), h.Balance(1, h.Address(1)))
+	assert.Equal(t, InitialBalance+25, h.Balance(1, h.Address(1)))
+}
+
+// TestEqualHeightForkConvergence tests that nodes that mined competing blocks at the same
+// height all settle on the heavier one, or the one with the lower hash, once healed
+func TestEqualHeightForkConvergence(t *testing.T) {
+	h := New(t, 3)
+
+	h.Partition([]int{0}, []int{1, 2})
+	a := h.MineBlock(0)
+	b := h.MineBlock(1)
+	require.Equal(t, a.Height, b.Height)
+
+	// The heavier block wins, on equal work the lower hash does
+	config := h.Nodes[0].NodeConfig
+	aWork := config.Difficulty(a.Signature[:], stakePerNode, stakePerNode*3)
+	bWork := config.Difficulty(b.Signature[:], stakePerNode, stakePerNode*3)
+	aHash, bHash := a.Hash(), b.Hash()
+	winner := aHash
+	if bWork > aWork || (bWork == aWork && bytes.Compare(bHash[:], aHash[:]) < 0) {
+		winner = bHash
+	}
+
+	h.Heal()
+	h.WaitConverged()
+	for i := range h.Nodes {
+		assert.Equal(t, winner, h.Tip(i).Hash(), "node %d", i)
+	}
+}
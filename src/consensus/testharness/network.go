@@ -0,0 +1,188 @@
+package testharness
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/nanlour/da/src/block"
+	"github.com/nanlour/da/src/p2p"
+)
+
+// memNetwork connects nodes in the same process, delivering broadcasts synchronously
+type memNetwork struct {
+	mu    sync.Mutex
+	nodes map[peer.ID]*memNode
+	links map[peer.ID]map[peer.ID]bool
+}
+
+// memNode is one node's view of the network, it implements consensus.Network
+type memNode struct {
+	net     *memNetwork
+	id      peer.ID
+	chain   p2p.BlockchainInterface
+	running bool
+}
+
+func newMemNetwork() *memNetwork {
+	return &memNetwork{
+		nodes: make(map[peer.ID]*memNode),
+		links: make(map[peer.ID]map[peer.ID]bool),
+	}
+}
+
+func (n *memNetwork) join(id peer.ID, chain p2p.BlockchainInterface) *memNode {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	node := &memNode{net: n, id: id, chain: chain}
+	n.nodes[id] = node
+	n.links[id] = make(map[peer.ID]bool)
+	return node
+}
+
+func (n *memNetwork) setLink(a, b peer.ID, up bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.links[a][b] = up
+	n.links[b][a] = up
+}
+
+// reachable returns the running nodes linked to from
+func (n *memNetwork) reachable(from peer.ID) []*memNode {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var nodes []*memNode
+	for id, up := range n.links[from] {
+		if node := n.nodes[id]; up && node.running {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+func (n *memNetwork) lookup(from, to peer.ID) (*memNode, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	node, ok := n.nodes[to]
+	if !ok || !n.links[from][to] || !node.running {
+		return nil, errors.New("peer not reachable")
+	}
+	return node, nil
+}
+
+func (m *memNode) Start() error {
+	m.net.mu.Lock()
+	defer m.net.mu.Unlock()
+	m.running = true
+	return nil
+}
+
+func (m *memNode) Stop() error {
+	m.net.mu.Lock()
+	defer m.net.mu.Unlock()
+	m.running = false
+	return nil
+}
+
+func (m *memNode) BroadcastBlock(b *block.Block) error {
+	for _, node := range m.net.reachable(m.id) {
+		node.chain.AddBlock(&p2p.P2PBlock{Block: *b, Sender: m.id.String()})
+	}
+	return nil
+}
+
+func (m *memNode) BroadcastTransaction(tx *block.Transaction) error {
+	for _, node := range m.net.reachable(m.id) {
+		txCopy := *tx
+		node.chain.AddTxn(&txCopy)
+	}
+	return nil
+}
+
+func (m *memNode) GetBlockByHash(hash [32]byte, peerID peer.ID) (*block.Block, error) {
+	node, err := m.net.lookup(m.id, peerID)
+	if err != nil {
+		return nil, err
+	}
+	return node.chain.GetBlockByHash(hash[:])
+}
+
+func (m *memNode) GetTip(peerID peer.ID) (*block.Block, error) {
+	node, err := m.net.lookup(m.id, peerID)
+	if err != nil {
+		return nil, err
+	}
+	return node.chain.GetTipBlock()
+}
+
+// GetBlocksAfter returns the peer's main chain following hash like the p2p getblocksafter protocol
+func (m *memNode) GetBlocksAfter(hash [32]byte, count int, peerID peer.ID) ([]*block.Block, error) {
+	node, err := m.net.lookup(m.id, peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	from, err := node.chain.GetBlockByHash(hash[:])
+	if err != nil || from == nil {
+		return nil, errors.New("block not found")
+	}
+	chain, err := node.chain.GetMainChain(from.Height+1, from.Height+uint64(min(count, p2p.MaxBlocksPerRequest)))
+	if err != nil {
+		return nil, err
+	}
+	if chain[0].PreHash != hash {
+		return nil, errors.New("block is not on the main chain")
+	}
+	blocks := make([]*block.Block, len(chain))
+	for i := range chain {
+		blocks[i] = &chain[i]
+	}
+	return blocks, nil
+}
+
+// PeerHandshake reports the peer's current tip, there is no connection time snapshot in memory
+func (m *memNode) PeerHandshake(peerID peer.ID) (p2p.HandshakeMessage, bool) {
+	node, err := m.net.lookup(m.id, peerID)
+	if err != nil {
+		return p2p.HandshakeMessage{}, false
+	}
+	tip, err := node.chain.GetTipBlock()
+	if err != nil {
+		return p2p.HandshakeMessage{}, false
+	}
+	return p2p.HandshakeMessage{Version: p2p.ProtocolVersion, TipHeight: tip.Height, TipHash: tip.Hash()}, true
+}
+
+// PeerStatus reports the peer's current tip, as if it had just announced it
+func (m *memNode) PeerStatus(peerID peer.ID) (p2p.StatusMessage, bool) {
+	handshake, ok := m.PeerHandshake(peerID)
+	if !ok {
+		return p2p.StatusMessage{}, false
+	}
+	return p2p.StatusMessage{TipHeight: handshake.TipHeight, TipHash: handshake.TipHash}, true
+}
+
+// announceStatus hands the node's tip to every peer it reaches, like one round of the p2p
+// status announcement
+func (m *memNode) announceStatus() {
+	tip, err := m.chain.GetTipBlock()
+	if err != nil {
+		return
+	}
+	status := p2p.StatusMessage{TipHeight: tip.Height, TipHash: tip.Hash()}
+	for _, node := range m.net.reachable(m.id) {
+		node.chain.TipAnnounced(m.id, status)
+	}
+}
+
+func (m *memNode) Peers() []peer.ID {
+	var peers []peer.ID
+	for _, node := range m.net.reachable(m.id) {
+		peers = append(peers, node.id)
+	}
+	return peers
+}
@@ -0,0 +1,75 @@
+package consensus
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/nanlour/da/src/block"
+	"github.com/nanlour/da/src/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTipCacheInvalidatedOnTipChange tests that the tip is served from memory until a tip change
+// is signalled, and that callers can't modify the cached block
+func TestTipCacheInvalidatedOnTipChange(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+	genesisHash := bc.GenesisBlock().Hash()
+
+	tip, err := bc.GetTipBlock()
+	require.NoError(t, err)
+	assert.Equal(t, genesisHash, tip.Hash())
+	tip.Height = 99
+
+	// Written without a notification the stored tip is not read again
+	b1 := &block.Block{PreHash: genesisHash, Height: 1}
+	b1Hash := b1.Hash()
+	require.NoError(t, bc.mainDB.InsertHashBlock(&b1Hash, b1))
+	require.NoError(t, bc.mainDB.InsertTipHash(&b1Hash))
+	tip, err = bc.GetTipBlock()
+	require.NoError(t, err)
+	assert.Equal(t, genesisHash, tip.Hash(), "cached tip should be unchanged by the caller")
+
+	bc.notifyTipChanged()
+	tip, err = bc.GetTipBlock()
+	require.NoError(t, err)
+	assert.Equal(t, b1Hash, tip.Hash())
+}
+
+// BenchmarkGetTipBlock compares the miner's tip read served from the cache with one that has
+// to go to the database after every tip change
+func BenchmarkGetTipBlock(b *testing.B) {
+	bc := &BlockChain{}
+	bc.SetConfig(&Config{})
+	mainDB, err := db.InitialDB(filepath.Join(b.TempDir(), "db"), nil)
+	if err != nil {
+		b.Fatalf("Failed to open db: %v", err)
+	}
+	defer mainDB.Close()
+	bc.mainDB = mainDB
+
+	genesisHash := bc.GenesisBlock().Hash()
+	if err := mainDB.InsertHashBlock(&genesisHash, bc.GenesisBlock()); err != nil {
+		b.Fatal(err)
+	}
+	if err := mainDB.InsertTipHash(&genesisHash); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("cached", func(b *testing.B) {
+		for range b.N {
+			if _, err := bc.GetTipBlock(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("changed", func(b *testing.B) {
+		for range b.N {
+			bc.notifyTipChanged()
+			if _, err := bc.GetTipBlock(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -5,24 +5,56 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"slices"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/nanlour/da/src/block"
 	"github.com/nanlour/da/src/p2p"
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
+// idleCheckInterval is how long without a new block before the tip manager reports the chain as idle
+const idleCheckInterval = time.Minute
+
+// TipManager processes mined and received blocks, and asks a peer for its tip every sync
+// interval whether or not blocks are arriving
 func (bc *BlockChain) TipManager() {
 	log.Println("Starting blockchain tip manager...")
 
+	bc.syncFromBestPeer()
+
+	clock := bc.getClock()
+	interval := bc.NodeConfig.syncInterval()
+	syncTimer := clock.NewTimer(interval)
+	idleTimer := clock.NewTimer(idleCheckInterval)
+	defer func() {
+		syncTimer.Stop()
+		idleTimer.Stop()
+	}()
+
+	// Only new blocks push the idle check back, the sync timer keeps its cadence
+	blockArrived := func() {
+		idleTimer.Stop()
+		idleTimer = clock.NewTimer(idleCheckInterval)
+	}
+
 	for {
 		select {
+		case <-bc.quit:
+			log.Println("Tip manager stopped")
+			return
+
+		case peerID := <-bc.syncRequests:
+			bc.downloadFrom(peerID)
+
 		case block := <-bc.MiningChan:
 			// Process blocks from mining
 			log.Printf("Received locally mined block at height %d\n", block.Height)
 			if err := bc.processNewBlock(block, true, ""); err != nil {
 				log.Printf("Error processing mined block: %v\n", err)
 			}
+			blockArrived()
 
 		case p2pblock := <-bc.P2PChan:
 			// Process blocks from P2P network
@@ -30,25 +62,47 @@ func (bc *BlockChain) TipManager() {
 			if err := bc.processNewBlock(&p2pblock.Block, false, p2pblock.Sender); err != nil {
 				log.Printf("Error processing P2P block: %v\n", err)
 			}
-		case <-time.After(5 * time.Second):
-			// Timeout case - useful for periodic health checks or preventing deadlocks
-			log.Printf("TipManager heartbeat - no new blocks in the last 5 seconds, trying to fetch from peers")
-			peers := bc.P2PNode.Peers()
-
-			if len(peers) > 0 {
-				// Random peer selection
-				randomIndex := time.Now().UnixNano() % int64(len(peers))
-				selectedPeer := peers[randomIndex]
-				go bc.idealFetch(selectedPeer)
-				log.Printf("Requesting tip from peer: %s", selectedPeer)
-
-			} else {
-				log.Printf("No peers available for tip synchronization")
-			}
+			blockArrived()
+
+		case req := <-bc.imports:
+			req.done <- bc.importBlock(req.block)
+			blockArrived()
+
+		case <-syncTimer.C():
+			syncTimer = clock.NewTimer(interval)
+			bc.requestPeerTip(clock)
+
+		case <-idleTimer.C():
+			idleTimer = clock.NewTimer(idleCheckInterval)
+			log.Printf("TipManager health check - no new blocks in the last %v", idleCheckInterval)
 		}
 	}
 }
 
+// requestPeerTip asks the peer that announced the highest tip for it in the background, or the
+// most responsive peer when none announced a tip above ours
+func (bc *BlockChain) requestPeerTip(clock Clock) {
+	peers := bc.P2PNode.Peers()
+	tipHeight := uint64(len(bc.MyChain) - 1)
+	if len(peers) == 0 {
+		log.Printf("No peers available for tip synchronization")
+	} else if selectedPeer, ok := bc.syncPeers.chooseAhead(peers, bc.announcedHeight, tipHeight, clock.Now()); ok {
+		go bc.idealFetch(selectedPeer)
+		log.Printf("Requesting tip from peer %s, which is ahead of height %d", selectedPeer, tipHeight)
+	} else if selectedPeer, ok := bc.syncPeers.choose(peers, clock.Now()); ok {
+		go bc.idealFetch(selectedPeer)
+		log.Printf("Requesting tip from peer: %s", selectedPeer)
+	} else {
+		log.Printf("All %d peers are backing off, skipping tip synchronization", len(peers))
+	}
+}
+
+// announcedHeight returns the tip height a peer last announced
+func (bc *BlockChain) announcedHeight(peerID peer.ID) (uint64, bool) {
+	status, ok := bc.P2PNode.PeerStatus(peerID)
+	return status.TipHeight, ok
+}
+
 // processNewBlock handles a new block and resolves any forks
 // isLocal indicates if the block was mined locally or received from network
 func (bc *BlockChain) processNewBlock(newBlock *block.Block, isLocal bool, sender string) error {
@@ -63,12 +117,42 @@ func (bc *BlockChain) processNewBlock(newBlock *block.Block, isLocal bool, sende
 	// Calculate block hash
 	blockHash := newBlock.Hash()
 
-	if newBlock.Height <= tipBlock.Height {
-		log.Printf("Potential fork height too low, current Tip at %d\n", tipBlock.Height)
+	// A shorter chain may still carry more work, so only skip blocks we already have
+	if known, err := bc.mainDB.GetHashBlock(blockHash[:]); err == nil && known != nil {
+		log.Printf("Block %x already known, current Tip at %d\n", blockHash, tipBlock.Height)
 		return nil
 	}
 
-	if !bc.VerifyBlock(newBlock) {
+	// A block far above our tip would be walked back one fetch per block, the batched
+	// download fetches the same chain far cheaper. Its parent's stake is unknown, so only the
+	// work it can prove on its own is checked before a download is started for it, the
+	// download verifies whatever the peer serves.
+	if !isLocal && newBlock.Height > tipBlock.Height+bc.NodeConfig.syncWindow() {
+		if !bc.checkBlock(newBlock) {
+			log.Printf("Invalid Block %x\n", blockHash)
+			return nil
+		}
+		if err := bc.checkWork(newBlock); err != nil {
+			log.Printf("Block %x at height %d fails its work check: %v\n", blockHash, newBlock.Height, err)
+			return nil
+		}
+		log.Printf("Block %x at height %d is too far above our tip at %d, downloading instead\n", blockHash, newBlock.Height, tipBlock.Height)
+		if peerID, ok := bc.forkPeer(sender); ok {
+			bc.SyncFromPeer(peerID)
+		}
+		return nil
+	}
+
+	// The VDF proof is checked against the stake ledger of the block's parent. When the parent
+	// is not on the main chain the ledger is unknown, checkFork verifies the proof instead.
+	var valid bool
+	stake, err := bc.stakeAt(newBlock.PreHash)
+	if err == nil {
+		valid = bc.verifyBlockWithStake(newBlock, stake)
+	} else {
+		valid = bc.checkBlock(newBlock)
+	}
+	if !valid {
 		log.Printf("Invalid Block %x\n", blockHash)
 		return nil
 	}
@@ -77,14 +161,45 @@ func (bc *BlockChain) processNewBlock(newBlock *block.Block, isLocal bool, sende
 	if bytes.Equal(newBlock.PreHash[:], tipHash[:]) {
 		// This block extends our current main chain
 		log.Printf("Block %x extends the main chain to height %d\n", blockHash, newBlock.Height)
-		bc.DoTxn(&newBlock.Txn)
-
-		err := bc.mainDB.InsertHashBlock(&blockHash, newBlock)
-		err = bc.mainDB.InsertTipHash(&blockHash)
+		// The block, its state changes and the new tip are written together once the
+		// block is fully validated, so a block failing half way changes nothing
+		state := newBatchState(bc.mainDB, new(leveldb.Batch))
+		if err := bc.stageBlock(state, newBlock); err != nil {
+			log.Printf("Rejecting block %x, it fails to apply: %v\n", blockHash, err)
+			if isLocal {
+				// Mining the same transaction again would fail the same way
+				if err := bc.TxnPool.removeTransaction(newBlock.Txn.Hash()); err != nil {
+					log.Printf("Failed to drop transaction %x: %v\n", newBlock.Txn.Hash(), err)
+				}
+			}
+			return fmt.Errorf("failed to apply block %x: %w", blockHash, err)
+		}
+		if err := bc.mainDB.BatchInsertHashBlock(state.batch, &blockHash, newBlock); err != nil {
+			return fmt.Errorf("failed to store block %x: %w", blockHash, err)
+		}
+		bc.mainDB.BatchInsertTipHash(state.batch, &blockHash)
+		if err := bc.mainDB.BatchInsert(state.batch); err != nil {
+			return fmt.Errorf("failed to store block %x: %w", blockHash, err)
+		}
+		if err := bc.TxnPool.prune(newBlock.Height); err != nil {
+			log.Printf("Failed to drop transactions up to height %d: %v\n", newBlock.Height, err)
+		}
+		bc.notifyTipChanged()
+		bc.publishApplied(newBlock)
 
 		bc.P2PNode.BroadcastBlock(newBlock)
-		bc.MyChain = append(bc.MyChain, &Chain{Hash: blockHash, PrvHash: newBlock.PreHash})
-		return err
+		bc.chainMu.Lock()
+		bc.MyChain = append(bc.MyChain, &Chain{
+			Hash:          blockHash,
+			PrvHash:       newBlock.PreHash,
+			CumDifficulty: bc.MyChain[len(bc.MyChain)-1].CumDifficulty + bc.blockDifficulty(newBlock, stake),
+		})
+		bc.chainMu.Unlock()
+		if err := bc.checkInvariants(newBlock); err != nil {
+			return err
+		}
+		bc.processOrphans(blockHash)
+		return nil
 	} else if isLocal { // Ignore self mined block
 		return nil
 	}
@@ -94,9 +209,29 @@ func (bc *BlockChain) processNewBlock(newBlock *block.Block, isLocal bool, sende
 
 	bc.checkFork(newBlock, sender)
 
+	// Keep blocks that could not be connected because their parent is still missing,
+	// they are retried once the parent arrives
+	if known, err := bc.mainDB.GetHashBlock(blockHash[:]); err != nil || known == nil {
+		if parent, err := bc.mainDB.GetHashBlock(newBlock.PreHash[:]); err != nil || parent == nil {
+			if bc.orphans.add(newBlock, sender) {
+				log.Printf("Stored orphan block %x at height %d, %d orphans waiting\n", blockHash, newBlock.Height, bc.orphans.len())
+			}
+		}
+	}
+
 	return nil
 }
 
+// processOrphans retries the orphans that were waiting on a block that is now in the chain
+func (bc *BlockChain) processOrphans(parent [32]byte) {
+	for _, orphan := range bc.orphans.takeChildren(parent) {
+		log.Printf("Processing orphan block %x at height %d\n", orphan.hash, orphan.block.Height)
+		if err := bc.processNewBlock(orphan.block, false, orphan.sender); err != nil {
+			log.Printf("Error processing orphan block: %v\n", err)
+		}
+	}
+}
+
 func (bc *BlockChain) checkFork(newBlock *block.Block, sender string) {
 	blockHash := newBlock.Hash()
 	log.Printf("Starting fork resolution for block %x at height %d from sender %s",
@@ -107,13 +242,24 @@ func (bc *BlockChain) checkFork(newBlock *block.Block, sender string) {
 	}
 	height := newBlock.Height
 
-	for {
-		log.Printf("Fetching previous block at height %d with hash %x", height-1, newchain[height].PreHash)
-		peerID, err := peer.Decode(sender)
-		if err != nil {
-			log.Printf("Fail to restore peerid")
+	// Walk back until the candidate joins our main chain, ancestors we do not have are
+	// fetched from a peer. A block competing with our tip joins it right away.
+	var peerID peer.ID
+	for !bc.onMainChain(newchain[height].PreHash, height) {
+		if height <= 1 {
+			log.Printf("Reached genesis block height without finding fork point")
+			return
 		}
-		block, err := bc.P2PNode.GetBlockByHash(newchain[height].PreHash, peerID)
+		if peerID == "" {
+			var ok bool
+			if peerID, ok = bc.forkPeer(sender); !ok {
+				log.Printf("No connected peer to resolve the fork at height %d from", newBlock.Height)
+				return
+			}
+		}
+
+		log.Printf("Fetching previous block at height %d with hash %x", height-1, newchain[height].PreHash)
+		block, err := bc.fetchBlock(newchain[height].PreHash, peerID)
 		if err != nil {
 			log.Printf("Failed to get block at height %d: %v", height-1, err)
 			return
@@ -125,71 +271,142 @@ func (bc *BlockChain) checkFork(newBlock *block.Block, sender string) {
 			return
 		}
 
-		if !bc.VerifyBlock(block) {
+		if !bc.checkBlock(block) {
 			log.Printf("Block verification failed when check fork at height %d", height)
 			return
 		}
 
 		log.Printf("Adding block %x at height %d to potential new chain", block.Hash(), height)
 		newchain[height] = block
+	}
+	log.Printf("Found fork point at height %d", height)
+
+	// Each block's proof depends on the stake its ancestors left, so the proofs are
+	// verified from the fork point forward
+	difficulties, ok := bc.verifyCandidate(newchain, height, newBlock.Height)
+	if !ok {
+		log.Printf("Candidate chain at height %d fails verification", newBlock.Height)
+		return
+	}
 
-		if len(bc.MyChain) >= int(height) && bytes.Equal(block.PreHash[:], bc.MyChain[height-1].Hash[:]) { // Find it in our chain
-			log.Printf("Found fork point at height %d - reorganizing chain", height)
-
-			// Rollback transactions from our current chain
-			log.Printf("Rolling back transactions from height %d to %d", height, len(bc.MyChain)-1)
-			for i := height; i < uint64(len(bc.MyChain)); i++ {
-				oldblock, err := bc.mainDB.GetHashBlock(bc.MyChain[i].Hash[:])
-				if err != nil {
-					log.Printf("Failed to get old block at height %d: %v", i, err)
-					return
-				}
-				bc.UNDoTxn(&oldblock.Txn)
-				log.Printf("Rolled back transaction at height %d", i)
-			}
-
-			// Resize MyChain to the fork point (height)
-			bc.MyChain = bc.MyChain[:height]
-			log.Printf("Resized chain to fork point at height %d", height)
-
-			// Add new blocks to our chain and process their transactions
-			log.Printf("Adding %d new blocks to chain", newBlock.Height-height+1)
-			for i := height; i <= newBlock.Height; i++ {
-				if block, exists := newchain[i]; exists {
-					// Add block to our chain
-					bc.MyChain = append(bc.MyChain, &Chain{Hash: block.Hash(), PrvHash: block.PreHash})
-
-					// Process transactions
-					bc.DoTxn(&block.Txn)
-
-					// Update database
-					blockHash := block.Hash()
-					err := bc.mainDB.InsertHashBlock(&blockHash, block)
-					if err != nil {
-						log.Printf("Failed to insert block %x at height %d: %v",
-							blockHash, block.Height, err)
-						return
-					}
-					log.Printf("Added block %x at height %d to chain", blockHash, i)
-				}
-			}
-
-			// Update tip in database
-			tipHash := newBlock.Hash()
-			err := bc.mainDB.InsertTipHash(&tipHash)
-			if err != nil {
-				log.Printf("Failed to update tip hash: %v", err)
-				return
-			}
-			log.Printf("Chain tip changed to %x at height %d", tipHash, newBlock.Height)
+	if !shouldAdopt(bc.MyChain, newchain, difficulties.of) {
+		log.Printf("Candidate chain at height %d does not beat current chain, keeping current tip", newBlock.Height)
+		return
+	}
+	log.Printf("Reorganizing chain from fork point at height %d", height)
+
+	// Roll back our blocks above the fork point and apply the candidate's in one batch, newest
+	// first so each undo record is applied to the state its block left behind. Nothing is
+	// written unless every block rolls back and applies, a candidate failing half way leaves
+	// the chain, the tip and the state as they were.
+	oldTipHeight := uint64(len(bc.MyChain)) - 1
+	state := newBatchState(bc.mainDB, new(leveldb.Batch))
+	log.Printf("Rolling back blocks from height %d to %d", oldTipHeight, height)
+	for i := oldTipHeight; i >= height; i-- {
+		oldblock, err := bc.mainDB.GetHashBlock(bc.MyChain[i].Hash[:])
+		if err != nil {
+			log.Printf("Failed to get old block at height %d: %v", i, err)
+			return
+		}
+		if err := bc.stageRollback(state, oldblock); err != nil {
+			log.Printf("Failed to roll back block at height %d, keeping current tip: %v", i, err)
 			return
 		}
+	}
 
-		if height <= 1 {
-			log.Printf("Reached genesis block height without finding fork point")
+	log.Printf("Adding %d new blocks to chain", newBlock.Height-height+1)
+	newChain := slices.Clone(bc.MyChain[:height])
+	for i := height; i <= newBlock.Height; i++ {
+		block := newchain[i]
+		blockHash := block.Hash()
+		if err := bc.stageBlock(state, block); err != nil {
+			log.Printf("Candidate block %x at height %d fails to apply, keeping current tip: %v", blockHash, i, err)
 			return
 		}
+		if err := bc.mainDB.BatchInsertHashBlock(state.batch, &blockHash, block); err != nil {
+			log.Printf("Failed to store block %x at height %d: %v", blockHash, i, err)
+			return
+		}
+		newChain = append(newChain, &Chain{
+			Hash:          blockHash,
+			PrvHash:       block.PreHash,
+			CumDifficulty: newChain[len(newChain)-1].CumDifficulty + difficulties[i],
+		})
+	}
+
+	tipHash := newBlock.Hash()
+	bc.mainDB.BatchInsertTipHash(state.batch, &tipHash)
+	if err := bc.mainDB.BatchInsert(state.batch); err != nil {
+		log.Printf("Failed to write the reorganization to height %d: %v", newBlock.Height, err)
+		return
+	}
+	bc.chainMu.Lock()
+	bc.MyChain = newChain
+	bc.chainMu.Unlock()
+	if err := bc.TxnPool.prune(newBlock.Height); err != nil {
+		log.Printf("Failed to drop transactions up to height %d: %v", newBlock.Height, err)
+	}
+	bc.notifyTipChanged()
+	log.Printf("Chain tip changed to %x at height %d", tipHash, newBlock.Height)
+	bc.events.publish(ChainReorged{From: oldTipHeight, To: newBlock.Height, Fork: height - 1})
+	for i := height; i <= newBlock.Height; i++ {
+		bc.publishApplied(newchain[i])
+	}
+	if err := bc.checkInvariants(newBlock); err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	bc.processOrphans(tipHash)
+}
+
+// onMainChain reports whether hash is the main chain block below height
+func (bc *BlockChain) onMainChain(hash [32]byte, height uint64) bool {
+	return height > 0 && height <= uint64(len(bc.MyChain)) && bc.MyChain[height-1].Hash == hash
+}
+
+// forkPeer picks the peer to fetch a fork's ancestors from, the sender while it is still
+// connected and otherwise another connected peer
+func (bc *BlockChain) forkPeer(sender string) (peer.ID, bool) {
+	peers := bc.P2PNode.Peers()
+	if peerID, err := peer.Decode(sender); err == nil && slices.Contains(peers, peerID) {
+		return peerID, true
+	}
+	log.Printf("Sender %q is not a connected peer, fetching the fork from another peer", sender)
+	return bc.syncPeers.choose(peers, bc.getClock().Now())
+}
+
+// candidateDifficulties maps the height of each candidate block to its difficulty
+type candidateDifficulties map[uint64]uint64
+
+func (d candidateDifficulties) of(b *block.Block) uint64 {
+	return d[b.Height]
+}
+
+// verifyCandidate verifies the candidate blocks from height from to height to, starting from
+// the stake ledger of the main chain block the first one builds on
+func (bc *BlockChain) verifyCandidate(candidate map[uint64]*block.Block, from, to uint64) (candidateDifficulties, bool) {
+	stake, err := bc.stakeAt(candidate[from].PreHash)
+	if err != nil {
+		log.Printf("No stake ledger for fork point %x: %v", candidate[from].PreHash, err)
+		return nil, false
+	}
+	delegations, err := bc.delegationsAt(candidate[from].PreHash)
+	if err != nil {
+		log.Printf("No delegations for fork point %x: %v", candidate[from].PreHash, err)
+		return nil, false
+	}
+
+	difficulties := make(candidateDifficulties, to-from+1)
+	for height := from; height <= to; height++ {
+		b := candidate[height]
+		if !bc.verifyBlockWithStake(b, stake) {
+			log.Printf("Block verification failed when check fork at height %d", height)
+			return nil, false
+		}
+		difficulties[height] = bc.blockDifficulty(b, stake)
+		stake, delegations = stake.next(b, bc.NodeConfig.BlockReward, delegations)
 	}
+	return difficulties, true
 }
 
 // Request tip block from selected peer
@@ -198,35 +415,57 @@ func (bc *BlockChain) idealFetch(selectedPeer peer.ID) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	// Create a channel to receive the result
+	// Create a channel to receive the result, buffered so a late reply doesn't block the sender
 	resultCh := make(chan struct {
 		block *block.Block
 		err   error
-	})
+	}, 1)
 
-	tipBlock, err := bc.P2PNode.GetTip(selectedPeer)
-	resultCh <- struct {
-		block *block.Block
-		err   error
-	}{tipBlock, err}
+	go func() {
+		tipBlock, err := bc.P2PNode.GetTip(selectedPeer)
+		resultCh <- struct {
+			block *block.Block
+			err   error
+		}{tipBlock, err}
+	}()
 
 	// Wait for either result or timeout
 	select {
 	case result := <-resultCh:
-		if result.err != nil {
+		if result.err != nil || result.block == nil {
 			log.Printf("Failed to get tip from peer %s: %v", selectedPeer, result.err)
+			bc.syncPeers.recordFailure(selectedPeer, bc.getClock().Now())
 			return
 		}
 
-		// Process the received tip block
-		if result.block != nil {
-			log.Printf("Received tip block at height %d from peer %s",
-				result.block.Height, selectedPeer)
+		tip, err := bc.GetTipBlock()
+		if err != nil {
+			log.Printf("Failed to get tip block: %v", err)
+			return
+		}
 
-			// Process through the regular block handling channel
-			bc.P2PChan <- &p2p.P2PBlock{Block: *result.block, Sender: selectedPeer.String()}
+		// A peer behind us has nothing to offer, ask others first
+		if result.block.Height < tip.Height {
+			bc.syncPeers.recordFailure(selectedPeer, bc.getClock().Now())
+		} else {
+			bc.syncPeers.recordSuccess(selectedPeer)
+		}
+
+		// A higher tip is worth resolving, and so is a competing tip at our height since
+		// fork choice may prefer it. Lower forks still reach us through gossip.
+		if result.block.Height < tip.Height || result.block.Hash() == tip.Hash() {
+			return
+		}
+		log.Printf("Received tip block at height %d from peer %s",
+			result.block.Height, selectedPeer)
+
+		// Process through the regular block handling channel
+		select {
+		case bc.P2PChan <- &p2p.P2PBlock{Block: *result.block, Sender: selectedPeer.String()}:
+		case <-bc.quit:
 		}
 	case <-ctx.Done():
 		log.Printf("Timeout waiting for tip from peer %s", selectedPeer)
+		bc.syncPeers.recordFailure(selectedPeer, bc.getClock().Now())
 	}
 }
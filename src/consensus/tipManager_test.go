@@ -0,0 +1,477 @@
+package consensus
+
+import (
+	"crypto/rand"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/nanlour/da/src/block"
+	"github.com/nanlour/da/src/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockNetwork serves the blocks it holds by hash to requests for its connected peers
+type blockNetwork struct {
+	offlineNetwork
+	peers  []peer.ID
+	blocks map[[32]byte]*block.Block
+}
+
+func (n blockNetwork) Peers() []peer.ID {
+	return n.peers
+}
+
+func (n blockNetwork) GetBlockByHash(hash [32]byte, peerID peer.ID) (*block.Block, error) {
+	if !slices.Contains(n.peers, peerID) {
+		return nil, errors.New("peer not connected")
+	}
+	if b, ok := n.blocks[hash]; ok {
+		return b, nil
+	}
+	return nil, errors.New("block unavailable")
+}
+
+// testPeerID returns a valid peer ID that decodes from its string form
+func testPeerID(t *testing.T) peer.ID {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(key)
+	require.NoError(t, err)
+	return id
+}
+
+// TestForkFromInvalidSender tests that a fork whose sender cannot be decoded or has
+// disconnected is fetched from another connected peer, and dropped when there is none
+func TestForkFromInvalidSender(t *testing.T) {
+	for _, sender := range []string{"", "not a peer id", testPeerID(t).String()} {
+		bc, cleanup := setupTestBlockchain(t)
+
+		genesis := bc.GenesisBlock()
+		bc.MyChain = []*Chain{{Hash: genesis.Hash()}}
+		network := blockNetwork{blocks: map[[32]byte]*block.Block{}}
+		bc.P2PNode = network
+
+		a1 := mineTestBlock(t, bc, genesis, signedTxn(bc, 1))
+		require.NoError(t, bc.processNewBlock(a1, false, ""))
+
+		emptyTxn := block.Transaction{Height: 1}
+		emptyTxn.Sign(&bc.NodeConfig.ID.PrvKey)
+		b1 := mineTestBlock(t, bc, genesis, emptyTxn)
+		b2 := mineTestBlock(t, bc, b1, signedTxn(bc, 2))
+		network.blocks[b1.Hash()] = b1
+
+		// Nobody to ask, the fork is dropped
+		bc.checkFork(b2, sender)
+		assert.Equal(t, a1.Hash(), bc.MyChain[len(bc.MyChain)-1].Hash, "sender %q", sender)
+
+		network.peers = []peer.ID{testPeerID(t)}
+		bc.P2PNode = network
+		bc.checkFork(b2, sender)
+		assert.Equal(t, b2.Hash(), bc.MyChain[len(bc.MyChain)-1].Hash, "fork from sender %q should be fetched from the connected peer", sender)
+		cleanup()
+	}
+}
+
+// countingNetwork counts block requests by hash, holding requests for the gated hash until
+// release is closed
+type countingNetwork struct {
+	blockNetwork
+	gated   [32]byte
+	release chan struct{}
+	mu      sync.Mutex
+	counts  map[[32]byte]int
+}
+
+func (n *countingNetwork) GetBlockByHash(hash [32]byte, peerID peer.ID) (*block.Block, error) {
+	n.mu.Lock()
+	n.counts[hash]++
+	n.mu.Unlock()
+	if hash == n.gated {
+		<-n.release
+	}
+	return n.blockNetwork.GetBlockByHash(hash, peerID)
+}
+
+func (n *countingNetwork) count(hash [32]byte) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.counts[hash]
+}
+
+// TestForkAncestorsFetchedOnce tests that fork resolutions running at the same time over
+// shared ancestors request each ancestor once
+func TestForkAncestorsFetchedOnce(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	genesis := bc.GenesisBlock()
+	bc.MyChain = []*Chain{{Hash: genesis.Hash()}}
+	bc.P2PNode = offlineNetwork{}
+	parent := genesis
+	for i := uint64(1); i <= 4; i++ {
+		b := mineTestBlock(t, bc, parent, signedTxn(bc, i))
+		require.NoError(t, bc.processNewBlock(b, false, ""))
+		parent = b
+	}
+	mainTip := parent.Hash()
+
+	// Two forks of height 3 sharing b1 and b2, neither outweighs the main chain
+	emptyTxn := block.Transaction{Height: 1}
+	emptyTxn.Sign(&bc.NodeConfig.ID.PrvKey)
+	b1 := mineTestBlock(t, bc, genesis, emptyTxn)
+	b2 := mineTestBlock(t, bc, b1, signedTxn(bc, 2))
+	c3 := mineTestBlock(t, bc, b2, signedTxn(bc, 3))
+	emptyTxn = block.Transaction{Height: 3}
+	emptyTxn.Sign(&bc.NodeConfig.ID.PrvKey)
+	d3 := mineTestBlock(t, bc, b2, emptyTxn)
+
+	sender := testPeerID(t)
+	network := &countingNetwork{
+		blockNetwork: blockNetwork{
+			peers:  []peer.ID{sender},
+			blocks: map[[32]byte]*block.Block{b1.Hash(): b1, b2.Hash(): b2},
+		},
+		gated:   b2.Hash(),
+		release: make(chan struct{}),
+		counts:  make(map[[32]byte]int),
+	}
+	bc.P2PNode = network
+
+	var wg sync.WaitGroup
+	for _, fork := range []*block.Block{c3, d3} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bc.checkFork(fork, sender.String())
+		}()
+	}
+
+	// Let the second resolution catch up with the first's request before answering it
+	require.Eventually(t, func() bool { return network.count(b2.Hash()) > 0 }, 5*time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	close(network.release)
+	wg.Wait()
+
+	assert.Equal(t, 1, network.count(b2.Hash()))
+	assert.Equal(t, 1, network.count(b1.Hash()))
+	assert.Equal(t, mainTip, bc.MyChain[len(bc.MyChain)-1].Hash)
+}
+
+// nullNetwork answers every block request without error and without a block
+type nullNetwork struct {
+	blockNetwork
+}
+
+func (n nullNetwork) GetBlockByHash(hash [32]byte, peerID peer.ID) (*block.Block, error) {
+	return nil, nil
+}
+
+// TestForkMissingAncestor tests that an ancestor request answered with no block fails the
+// fork resolution instead of the tip manager
+func TestForkMissingAncestor(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	genesis := bc.GenesisBlock()
+	bc.MyChain = []*Chain{{Hash: genesis.Hash()}}
+	sender := testPeerID(t)
+	bc.P2PNode = nullNetwork{blockNetwork{peers: []peer.ID{sender}}}
+
+	_, err := bc.fetchBlock([32]byte{0xaa}, sender)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no block")
+
+	b1 := mineTestBlock(t, bc, genesis, signedTxn(bc, 1))
+	b2 := mineTestBlock(t, bc, b1, signedTxn(bc, 2))
+	require.NotPanics(t, func() { bc.checkFork(b2, sender.String()) })
+	assert.Equal(t, genesis.Hash(), bc.MyChain[len(bc.MyChain)-1].Hash)
+}
+
+// TestReorgFailingBlockChangesNothing tests that a heavier fork whose second block fails to
+// apply is dropped as a whole, the rollback of our chain and its first block included
+func TestReorgFailingBlockChangesNothing(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	genesis := bc.GenesisBlock()
+	bc.MyChain = []*Chain{{Hash: genesis.Hash()}}
+	sender := testPeerID(t)
+	network := blockNetwork{peers: []peer.ID{sender}, blocks: map[[32]byte]*block.Block{}}
+	bc.P2PNode = network
+
+	from := bc.NodeConfig.ID.Address
+	dest := [32]byte{0xd0}
+	transfer := func(height, nonce uint64) block.Transaction {
+		txn := block.Transaction{FromAddress: from, ToAddress: dest, Amount: 10, Height: height, Nonce: nonce}
+		txn.Sign(&bc.NodeConfig.ID.PrvKey)
+		return txn
+	}
+
+	a1 := mineTestBlock(t, bc, genesis, transfer(1, 1))
+	require.NoError(t, bc.processNewBlock(a1, false, ""))
+	chainBefore := slices.Clone(bc.MyChain)
+	balances, err := bc.GetAccountBalances([][32]byte{from, dest})
+	require.NoError(t, err)
+	nonce := bc.NextNonce(from)
+
+	events := make(chan Event, 16)
+	unsubscribe := bc.Subscribe(events)
+	defer unsubscribe()
+
+	// A longer fork from genesis whose second block skips a nonce
+	emptyTxn := block.Transaction{Height: 1}
+	emptyTxn.Sign(&bc.NodeConfig.ID.PrvKey)
+	b1 := mineTestBlock(t, bc, genesis, emptyTxn)
+	b2 := mineTestBlock(t, bc, b1, transfer(2, 3))
+	network.blocks[b1.Hash()] = b1
+	require.NoError(t, bc.processNewBlock(b2, false, sender.String()))
+
+	tip, err := bc.GetTipBlock()
+	require.NoError(t, err)
+	assert.Equal(t, a1.Hash(), tip.Hash(), "the old tip should stay")
+	assert.Equal(t, chainBefore, bc.MyChain)
+	after, err := bc.GetAccountBalances([][32]byte{from, dest})
+	require.NoError(t, err)
+	assert.Equal(t, balances, after)
+	assert.Equal(t, nonce, bc.NextNonce(from))
+	confirmed, height, _, err := bc.GetTransactionStatus(a1.Txn.Hash())
+	require.NoError(t, err)
+	assert.True(t, confirmed)
+	assert.Equal(t, uint64(1), height)
+	b1Hash := b1.Hash()
+	_, err = bc.GetBlockByHash(b1Hash[:])
+	assert.Error(t, err, "no block of the failed fork should be stored")
+	assert.Empty(t, drainEvents(events))
+	requireStoredWork(t, bc)
+}
+
+// TestFarAheadBlockDownloaded tests that a block far above the tip is handed to the batched
+// download rather than walked back one ancestor fetch at a time
+func TestFarAheadBlockDownloaded(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	genesis := bc.GenesisBlock()
+	bc.MyChain = []*Chain{{Hash: genesis.Hash()}}
+	bc.syncRequests = make(chan peer.ID, 1)
+	sender := testPeerID(t)
+	network := &countingNetwork{
+		blockNetwork: blockNetwork{peers: []peer.ID{sender}, blocks: map[[32]byte]*block.Block{}},
+		counts:       make(map[[32]byte]int),
+	}
+	bc.P2PNode = network
+
+	far := mineTestBlock(t, bc, &block.Block{PreHash: [32]byte{1}, Height: 999_999}, signedTxn(bc, 1_000_000))
+	require.NoError(t, bc.processNewBlock(far, false, sender.String()))
+
+	assert.Empty(t, network.counts, "no ancestor may be fetched one by one")
+	assert.Equal(t, 0, bc.orphans.len())
+	select {
+	case peerID := <-bc.syncRequests:
+		assert.Equal(t, sender, peerID)
+	default:
+		t.Fatal("expected a download from the sender")
+	}
+}
+
+// TestForgedFarAheadBlockIgnored tests that a block far above the tip starts no download
+// unless it carries a valid signature and the work it claims
+func TestForgedFarAheadBlockIgnored(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	genesis := bc.GenesisBlock()
+	bc.MyChain = []*Chain{{Hash: genesis.Hash()}}
+	bc.syncRequests = make(chan peer.ID, 1)
+	sender := testPeerID(t)
+	bc.P2PNode = blockNetwork{peers: []peer.ID{sender}}
+
+	far := mineTestBlock(t, bc, &block.Block{PreHash: [32]byte{1}, Height: 999_999}, signedTxn(bc, 1_000_000))
+	unsigned := &block.Block{PreHash: [32]byte{1}, Height: 1_000_000, Txn: far.Txn, EpochBeginHash: far.EpochBeginHash}
+	badProof := *far
+	badProof.Proof[0] ^= 1
+	cheaper := *far
+	cheaper.Difficulty = 0
+	richer := *far
+	richer.Difficulty = bc.NodeConfig.maxDifficulty() + 1
+
+	for name, forged := range map[string]*block.Block{"unsigned": unsigned, "bad proof": &badProof, "below the floor": &cheaper, "above the limit": &richer} {
+		require.NoError(t, bc.processNewBlock(forged, false, sender.String()))
+		assert.Empty(t, bc.syncRequests, name)
+	}
+}
+
+// batchNetwork answers every batch request with the same blocks and counts the requests
+type batchNetwork struct {
+	offlineNetwork
+	batch    []*block.Block
+	requests atomic.Int32
+}
+
+func (n *batchNetwork) GetBlocksAfter(hash [32]byte, count int, peerID peer.ID) ([]*block.Block, error) {
+	n.requests.Add(1)
+	return n.batch, nil
+}
+
+// chainNetwork serves the blocks following genesis in chain, a batch at a time, and counts
+// the requests
+type chainNetwork struct {
+	offlineNetwork
+	chain    []*block.Block // Blocks from height 1 up
+	requests atomic.Int32
+}
+
+func (n *chainNetwork) GetBlocksAfter(hash [32]byte, count int, peerID peer.ID) ([]*block.Block, error) {
+	n.requests.Add(1)
+	for i, b := range n.chain {
+		if b.PreHash == hash {
+			return n.chain[i:min(i+count, len(n.chain))], nil
+		}
+	}
+	return nil, errors.New("block not found")
+}
+
+// TestInitialBlockDownloadChecksBatches tests that the download gives up on a peer serving
+// nothing, missing blocks or blocks that do not follow ours, and stops with the node
+func TestInitialBlockDownloadChecksBatches(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+	bc.quit = make(chan struct{})
+	genesis := bc.GenesisBlock()
+	bc.MyChain = []*Chain{{Hash: genesis.Hash()}}
+	sender := testPeerID(t)
+	target := &block.Block{PreHash: [32]byte{7}, Height: 3}
+
+	// An empty answer would otherwise be asked again forever
+	network := &batchNetwork{}
+	bc.P2PNode = network
+	err := bc.initialBlockDownload(sender, target)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no blocks")
+	assert.Equal(t, int32(1), network.requests.Load())
+
+	// A block that is not a child of our tip
+	bc.P2PNode = &batchNetwork{batch: []*block.Block{{PreHash: [32]byte{7}, Height: 1}}}
+	err = bc.initialBlockDownload(sender, target)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "expected a child")
+
+	// A null entry in the answer
+	bc.P2PNode = &batchNetwork{batch: []*block.Block{nil}}
+	err = bc.initialBlockDownload(sender, target)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "missing block")
+
+	// Blocks are applied batch by batch up to the target
+	chain := []*block.Block{mineTestBlock(t, bc, genesis, signedTxn(bc, 1))}
+	for height := uint64(2); height <= 3; height++ {
+		chain = append(chain, mineTestBlock(t, bc, chain[len(chain)-1], signedTxn(bc, height)))
+	}
+	valid := &chainNetwork{chain: chain}
+	bc.P2PNode = valid
+	require.NoError(t, bc.initialBlockDownload(sender, chain[2]))
+	tip, err := bc.GetTipBlock()
+	require.NoError(t, err)
+	assert.Equal(t, chain[2].Hash(), tip.Hash())
+	assert.Equal(t, int32(1), valid.requests.Load())
+
+	// A stopped node does not ask for more
+	close(bc.quit)
+	network = &batchNetwork{batch: []*block.Block{chain[0]}}
+	bc.P2PNode = network
+	assert.ErrorIs(t, bc.initialBlockDownload(sender, &block.Block{Height: 10}), errNodeStopped)
+	assert.Zero(t, network.requests.Load())
+}
+
+// TestInitialBlockDownloadFakeTip tests that a peer claiming a tip far above what it can serve
+// gets one batch asked for and nothing of it applied
+func TestInitialBlockDownloadFakeTip(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+	bc.quit = make(chan struct{})
+	genesis := bc.GenesisBlock()
+	bc.MyChain = []*Chain{{Hash: genesis.Hash()}}
+	bc.syncRequests = make(chan peer.ID, 1)
+
+	// A long chain of blocks linked by hash but without any work
+	chain := make([]*block.Block, 4*syncBatchSize)
+	parent := genesis
+	for i := range chain {
+		chain[i] = &block.Block{PreHash: parent.Hash(), Height: parent.Height + 1, EpochBeginHash: genesis.Hash()}
+		parent = chain[i]
+	}
+	network := &chainNetwork{chain: chain}
+	bc.P2PNode = network
+
+	err := bc.initialBlockDownload(testPeerID(t), &block.Block{Height: 1_000_000_000})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not accepted")
+	assert.Equal(t, int32(1), network.requests.Load())
+	tip, err := bc.GetTipBlock()
+	require.NoError(t, err)
+	assert.Equal(t, genesis.Hash(), tip.Hash())
+	assert.Equal(t, 0, bc.orphans.len(), "no block may be kept")
+	assert.Empty(t, bc.syncRequests)
+}
+
+// tipCountNetwork answers every tip request with the same block and counts the requests
+type tipCountNetwork struct {
+	offlineNetwork
+	peers    []peer.ID
+	tip      *block.Block
+	requests atomic.Int32
+}
+
+func (n *tipCountNetwork) Peers() []peer.ID {
+	return n.peers
+}
+
+func (n *tipCountNetwork) GetTip(peerID peer.ID) (*block.Block, error) {
+	n.requests.Add(1)
+	return n.tip, nil
+}
+
+// TestSyncIntervalCadence tests that the tip manager asks for tips at the configured interval,
+// also while blocks arrive more often than that
+func TestSyncIntervalCadence(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	const interval = 50 * time.Millisecond
+	bc.NodeConfig.SyncInterval = interval
+	genesis := bc.GenesisBlock()
+	bc.MyChain = []*Chain{{Hash: genesis.Hash()}}
+	network := &tipCountNetwork{peers: []peer.ID{testPeerID(t)}, tip: genesis}
+	bc.P2PNode = network
+	bc.quit = make(chan struct{})
+	bc.P2PChan = make(chan *p2p.P2PBlock, 100)
+	bc.MiningChan = make(chan *block.Block, 10)
+	bc.syncRequests = make(chan peer.ID, 1)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bc.TipManager()
+	}()
+
+	// An already known block every few milliseconds
+	start := time.Now()
+	for time.Since(start) < 10*interval {
+		bc.P2PChan <- &p2p.P2PBlock{Block: *genesis}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(bc.quit)
+	<-done
+
+	expected := int32(time.Since(start) / interval)
+	requests := network.requests.Load()
+	assert.GreaterOrEqual(t, requests, expected/2, "tip requests should not be starved by arriving blocks")
+	assert.LessOrEqual(t, requests, expected+1, "tip requests should not exceed the configured rate")
+}
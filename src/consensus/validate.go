@@ -0,0 +1,202 @@
+package consensus
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/nanlour/da/src/block"
+	"github.com/nanlour/da/src/db"
+)
+
+// memState is an in-memory account state, used to replay the chain without touching the database
+type memState struct {
+	balances map[[32]byte]float64
+	nonces   map[[32]byte]uint64
+}
+
+func (s *memState) balance(address [32]byte) (float64, error) {
+	return s.balances[address], nil
+}
+
+func (s *memState) setBalance(address [32]byte, balance float64) error {
+	s.balances[address] = balance
+	return nil
+}
+
+func (s *memState) nonce(address [32]byte) (uint64, error) {
+	return s.nonces[address], nil
+}
+
+func (s *memState) setNonce(address [32]byte, nonce uint64) error {
+	s.nonces[address] = nonce
+	return nil
+}
+
+// ValidateChain replays the stored main chain from genesis to the tip. It checks every
+// block is stored under its own hash, links to its parent at the next height, passes
+// VerifyBlock, and carries a transaction that applies to the balances rebuilt from the
+// genesis allocation and block rewards. The first inconsistency found is returned. The stored
+// balances and nonces of every account, and the tip's stake ledger and delegations, must match
+// the replay at the end. An account the replay never touched must hold nothing.
+func (bc *BlockChain) ValidateChain() error {
+	tipHash, err := bc.mainDB.GetTipHash()
+	if err != nil {
+		return fmt.Errorf("failed to read tip: %v", err)
+	}
+
+	// Collect the chain tip first, then check it in order from genesis
+	type storedBlock struct {
+		hash  [32]byte
+		block *block.Block
+	}
+	var chain []storedBlock
+	var hash [32]byte
+	copy(hash[:], tipHash)
+	for {
+		b, err := bc.mainDB.GetHashBlock(hash[:])
+		if err != nil {
+			if len(chain) == 0 {
+				return fmt.Errorf("tip block %x is missing: %v", hash, err)
+			}
+			return fmt.Errorf("parent %x of block at height %d is missing: %v", hash, chain[len(chain)-1].block.Height, err)
+		}
+		chain = append(chain, storedBlock{hash: hash, block: b})
+		if b.Height == 0 || hash == bc.GenesisBlock().Hash() {
+			break
+		}
+		hash = b.PreHash
+	}
+
+	state := &memState{
+		balances: make(map[[32]byte]float64),
+		nonces:   make(map[[32]byte]uint64),
+	}
+	for address, balance := range bc.NodeConfig.GenesisAlloc() {
+		state.balances[address] = balance
+	}
+	stake, delegations := bc.genesisStake(), delegationLedger{}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		stored := chain[i]
+		b := stored.block
+		if b.Hash() != stored.hash {
+			return fmt.Errorf("block at height %d is stored under %x but hashes to %x", b.Height, stored.hash, b.Hash())
+		}
+
+		if i == len(chain)-1 {
+			if stored.hash != bc.GenesisBlock().Hash() {
+				return fmt.Errorf("chain starts at %x at height %d, not at this network's genesis", stored.hash, b.Height)
+			}
+			continue
+		}
+
+		parent := chain[i+1]
+		if b.PreHash != parent.hash {
+			return fmt.Errorf("block at height %d does not link to its parent %x", b.Height, parent.hash)
+		}
+		if b.Height != parent.block.Height+1 {
+			return fmt.Errorf("block at height %d follows a block at height %d", b.Height, parent.block.Height)
+		}
+		if !bc.verifyBlockWithStake(b, stake) {
+			return fmt.Errorf("block at height %d fails verification", b.Height)
+		}
+		success, err := applyTxn(state, &b.Txn)
+		if err != nil {
+			return fmt.Errorf("transaction in block at height %d: %v", b.Height, err)
+		}
+		if success && b.Txn.Fee > 0 {
+			if err := creditReward(state, blockMiner(b), b.Txn.Fee); err != nil {
+				return fmt.Errorf("fee of block at height %d: %v", b.Height, err)
+			}
+		}
+		if reward := bc.NodeConfig.BlockReward; reward > 0 {
+			if err := creditReward(state, blockMiner(b), reward); err != nil {
+				return fmt.Errorf("reward of block at height %d: %v", b.Height, err)
+			}
+		}
+		stake, delegations = stake.next(b, bc.NodeConfig.BlockReward, delegations)
+	}
+
+	storedBalances, err := bc.mainDB.GetAllAccountBalances()
+	if err != nil {
+		return fmt.Errorf("failed to read balances: %v", err)
+	}
+	if err := compareAccounts("balance", storedBalances, state.balances); err != nil {
+		return err
+	}
+	storedNonces, err := bc.mainDB.GetAllAccountNonces()
+	if err != nil {
+		return fmt.Errorf("failed to read nonces: %v", err)
+	}
+	if err := compareAccounts("nonce", storedNonces, state.nonces); err != nil {
+		return err
+	}
+
+	tip := chain[0].hash
+	storedStake, err := bc.stakeAt(tip)
+	if err != nil {
+		return fmt.Errorf("failed to read the stake ledger of tip %x: %v", tip, err)
+	}
+	if err := compareAccounts("stake", storedStake, stake); err != nil {
+		return err
+	}
+	storedDelegations, err := bc.delegationsAt(tip)
+	if err != nil {
+		return fmt.Errorf("failed to read the delegations of tip %x: %v", tip, err)
+	}
+	return compareAccounts("delegation", storedDelegations, delegations)
+}
+
+// compareAccounts checks the stored value of every account against the replayed one. An
+// account missing from either side holds the zero value there, so accounts written only to be
+// rolled back compare equal and accounts the replay never produced are still caught.
+func compareAccounts[V comparable](kind string, stored, replayed map[[32]byte]V) error {
+	var zero V
+	for address, value := range stored {
+		replayedValue, produced := replayed[address]
+		if value == replayedValue {
+			continue
+		}
+		if !produced {
+			return fmt.Errorf("stored %s of %x is %v, replaying the chain never touches the account", kind, address, value)
+		}
+		return fmt.Errorf("stored %s of %x is %v, replaying the chain gives %v", kind, address, value, replayedValue)
+	}
+	for address, value := range replayed {
+		if _, ok := stored[address]; !ok && value != zero {
+			return fmt.Errorf("no %s stored for %x, replaying the chain gives %v", kind, address, value)
+		}
+	}
+	return nil
+}
+
+// ValidateStoredChain runs ValidateChain on a database without starting the node
+func ValidateStoredChain(config *Config, mainDB *db.DBManager) error {
+	bc := &BlockChain{}
+	bc.SetConfig(config)
+	bc.mainDB = mainDB
+	return bc.ValidateChain()
+}
+
+// checkInvariants checks that the balances still add up after the block was applied, when
+// CheckInvariants is set. A violation stops mining, blocks built on a state that created or
+// destroyed money would spread the damage.
+func (bc *BlockChain) checkInvariants(b *block.Block) error {
+	if !bc.NodeConfig.CheckInvariants {
+		return nil
+	}
+	problems, err := bc.mainDB.CheckSupply()
+	if err != nil {
+		return fmt.Errorf("failed to check invariants: %w", err)
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	blockHash := b.Hash()
+	for _, problem := range problems {
+		log.Printf("Invariant violated after block %x at height %d: %s", blockHash, b.Height, problem)
+	}
+	bc.StopMining()
+	return fmt.Errorf("%d invariant violation(s) after block %x at height %d, mining stopped", len(problems), blockHash, b.Height)
+}
@@ -0,0 +1,106 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/nanlour/da/src/block"
+	"github.com/nanlour/da/src/db"
+	"github.com/nanlour/da/src/ecdsa_da"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// buildValidatedChain mines and applies four blocks, the second paying 10 coins away
+func buildValidatedChain(t *testing.T, bc *BlockChain) []*block.Block {
+	bc.P2PNode = offlineNetwork{}
+	bc.MyChain = []*Chain{{Hash: bc.GenesisBlock().Hash()}}
+
+	blocks := make([]*block.Block, 4)
+	parent := bc.GenesisBlock()
+	for i := range blocks {
+		txn := signedTxn(bc, parent.Height+1)
+		if i == 1 {
+			txn = block.Transaction{
+				FromAddress: bc.NodeConfig.ID.Address,
+				ToAddress:   [32]byte{0xb0},
+				Amount:      10,
+				Height:      parent.Height + 1,
+				Nonce:       1,
+				PublicKey:   ecdsa_da.PublicKeyToBytes(&bc.NodeConfig.ID.PubKey),
+			}
+			txn.Sign(&bc.NodeConfig.ID.PrvKey)
+		}
+		blocks[i] = mineTestBlock(t, bc, parent, txn)
+		require.NoError(t, bc.processNewBlock(blocks[i], false, ""))
+		parent = blocks[i]
+	}
+	require.Len(t, bc.MyChain, 5)
+	return blocks
+}
+
+func TestValidateChain(t *testing.T) {
+	bc, cleanup := setupTestBlockchain(t)
+	defer cleanup()
+
+	// Rewards must be replayed as well as transactions
+	bc.NodeConfig.BlockReward = 2
+	blocks := buildValidatedChain(t, bc)
+	require.NoError(t, bc.ValidateChain())
+
+	// A stored balance that disagrees with the replay
+	payee := [32]byte{0xb0}
+	require.NoError(t, bc.mainDB.InsertAccountBalance(&payee, 1000))
+	err := bc.ValidateChain()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "stored balance")
+	require.NoError(t, bc.mainDB.InsertAccountBalance(&payee, 10))
+	require.NoError(t, bc.ValidateChain())
+
+	// A balance for an account the chain never touched, an empty one is harmless
+	stranger := [32]byte{0xb1}
+	require.NoError(t, bc.mainDB.InsertAccountBalance(&stranger, 0))
+	require.NoError(t, bc.ValidateChain())
+	require.NoError(t, bc.mainDB.InsertAccountBalance(&stranger, 5))
+	err = bc.ValidateChain()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "never touches")
+	require.NoError(t, bc.mainDB.InsertAccountBalance(&stranger, 0))
+
+	// A stored nonce that disagrees with the replay
+	sender := bc.NodeConfig.ID.Address
+	require.NoError(t, bc.mainDB.InsertAccountNonce(&sender, 2))
+	err = bc.ValidateChain()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "stored nonce")
+	require.NoError(t, bc.mainDB.InsertAccountNonce(&sender, 1))
+	require.NoError(t, bc.ValidateChain())
+
+	// A stake ledger at the tip that disagrees with the replay
+	tipHash := blocks[len(blocks)-1].Hash()
+	entries, err := bc.mainDB.GetStakeSnapshot(&tipHash)
+	require.NoError(t, err)
+	inflated := append([]db.StakeEntry(nil), entries...)
+	inflated[0].Stake += 100
+	writeSnapshot := func(entries []db.StakeEntry) {
+		batch := new(leveldb.Batch)
+		require.NoError(t, bc.mainDB.BatchInsertStakeSnapshot(batch, &tipHash, entries))
+		require.NoError(t, bc.mainDB.BatchInsert(batch))
+	}
+	writeSnapshot(inflated)
+	err = bc.ValidateChain()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "stored stake")
+	writeSnapshot(entries)
+	require.NoError(t, bc.ValidateChain())
+
+	// Rewrite the payment block in place with a larger amount
+	tampered := *blocks[1]
+	tampered.Txn.Amount = 500
+	hash := blocks[1].Hash()
+	require.NoError(t, bc.mainDB.InsertHashBlock(&hash, &tampered))
+
+	err = bc.ValidateChain()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "height 2")
+}
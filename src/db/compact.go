@@ -0,0 +1,28 @@
+package db
+
+import (
+	"bytes"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// sizeLimit sorts after every key the DBManager writes, all of them are a prefix byte and at most 32 bytes
+var sizeLimit = bytes.Repeat([]byte{0xff}, 64)
+
+// Compact rewrites the whole key space, dropping entries that were deleted or overwritten
+func (manager *DBManager) Compact() error {
+	if manager.readOnly {
+		return ErrReadOnly
+	}
+	return manager.db.CompactRange(util.Range{})
+}
+
+// ApproximateSize returns the bytes the database's tables take on disk, including deleted
+// entries not yet compacted away. Recent writes still in the memtable are not counted.
+func (manager *DBManager) ApproximateSize() (uint64, error) {
+	sizes, err := manager.db.SizeOf([]util.Range{{Limit: sizeLimit}})
+	if err != nil {
+		return 0, err
+	}
+	return uint64(sizes.Sum()), nil
+}
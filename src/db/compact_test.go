@@ -0,0 +1,67 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// TestCompact tests that deleted keys keep taking space until the database is compacted
+func TestCompact(t *testing.T) {
+	manager, tempDir := createTempDB(t)
+	defer os.RemoveAll(tempDir)
+	defer manager.Close()
+
+	empty, err := manager.ApproximateSize()
+	if err != nil {
+		t.Fatalf("Failed to get size: %v", err)
+	}
+	if empty != 0 {
+		t.Fatalf("Expected an empty database to have size 0, got %d", empty)
+	}
+
+	value := bytes.Repeat([]byte{0xab}, 1024)
+	keys := make([][]byte, 2000)
+	for i := range keys {
+		keys[i] = PrefixKey(hashBlockPerfix, []byte(fmt.Sprintf("block-%d", i)))
+		if err := manager.Insert(keys[i], value); err != nil {
+			t.Fatalf("Failed to insert data: %v", err)
+		}
+	}
+	// Flushes the memtable, so the tables hold every key
+	if err := manager.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	full, err := manager.ApproximateSize()
+	if err != nil {
+		t.Fatalf("Failed to get size: %v", err)
+	}
+	if full == 0 {
+		t.Fatalf("Expected a non-zero size after inserting %d keys", len(keys))
+	}
+
+	for _, key := range keys {
+		if err := manager.Delete(key); err != nil {
+			t.Fatalf("Failed to delete data: %v", err)
+		}
+	}
+	deleted, err := manager.ApproximateSize()
+	if err != nil {
+		t.Fatalf("Failed to get size: %v", err)
+	}
+	if deleted < full {
+		t.Fatalf("Expected deleted keys to keep their space until compaction, size went from %d to %d", full, deleted)
+	}
+
+	if err := manager.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	compacted, err := manager.ApproximateSize()
+	if err != nil {
+		t.Fatalf("Failed to get size: %v", err)
+	}
+	if compacted >= full/10 {
+		t.Fatalf("Expected compaction to reclaim the deleted keys, size went from %d to %d", full, compacted)
+	}
+}
@@ -3,15 +3,18 @@ package db
 import (
 	"bytes"
 	"encoding/binary"
-	"log"
+	"errors"
 	"math"
+	"slices"
 
 	"github.com/nanlour/da/src/block"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 type DBManager struct {
-	db *leveldb.DB
+	db       *leveldb.DB
+	readOnly bool
 }
 
 // TODO: move const define to delicate file
@@ -19,6 +22,18 @@ const (
 	accountBalancePrefix byte = 0x01 // Prefix for user-related data
 	hashBlockPerfix      byte = 0x02
 	tipHash              byte = 0x03
+	txnHeightPrefix      byte = 0x04
+	accountNoncePrefix   byte = 0x05
+	genesisSupply        byte = 0x06
+	blockUndoPrefix      byte = 0x07
+	blockReceiptPrefix   byte = 0x08
+	mintedSupply         byte = 0x09
+	stakeSnapshotPrefix  byte = 0x0a
+	pendingTxnPrefix     byte = 0x0b
+	genesisHash          byte = 0x0c
+	cumDifficultyPrefix  byte = 0x0d
+	accountTxnPrefix     byte = 0x0e
+	delegationPrefix     byte = 0x0f
 )
 
 func PrefixKey(prefix byte, data []byte) []byte {
@@ -28,14 +43,16 @@ func PrefixKey(prefix byte, data []byte) []byte {
 	return result
 }
 
-// InitialDB initializes and returns a new DBManager instance
-func InitialDB(path string) (*DBManager, error) {
-	db, err := leveldb.OpenFile(path, nil) // Open the database
+// ErrReadOnly is returned by writes to a database opened with DBOptions.ReadOnly
+var ErrReadOnly = errors.New("database is opened read-only")
+
+// InitialDB initializes and returns a new DBManager instance, nil options use DefaultDBOptions
+func InitialDB(path string, options *DBOptions) (*DBManager, error) {
+	db, err := leveldb.OpenFile(path, options.leveldbOptions()) // Open the database
 	if err != nil {
-		log.Fatalf("Failed to open db: %v", err)
 		return nil, err
 	}
-	mainDB := &DBManager{db: db}
+	mainDB := &DBManager{db: db, readOnly: options != nil && options.ReadOnly}
 	return mainDB, nil
 }
 
@@ -49,6 +66,9 @@ func (manager *DBManager) Close() error {
 
 // Insert adds a key-value pair to the database
 func (manager *DBManager) Insert(key, value []byte) error {
+	if manager.readOnly {
+		return ErrReadOnly
+	}
 	return manager.db.Put(key, value, nil)
 }
 
@@ -57,6 +77,22 @@ func (manager *DBManager) Get(key []byte) ([]byte, error) {
 	return manager.db.Get(key, nil)
 }
 
+// BatchInsert atomically writes every operation queued in the batch
+func (manager *DBManager) BatchInsert(batch *leveldb.Batch) error {
+	if manager.readOnly {
+		return ErrReadOnly
+	}
+	return manager.db.Write(batch, nil)
+}
+
+// Delete removes a key from the database
+func (manager *DBManager) Delete(key []byte) error {
+	if manager.readOnly {
+		return ErrReadOnly
+	}
+	return manager.db.Delete(key, nil)
+}
+
 // Account Balance functions (float64)
 func (manager *DBManager) GetAccountBalance(address *[32]byte) (float64, error) {
 	key := PrefixKey(accountBalancePrefix, address[:])
@@ -69,6 +105,21 @@ func (manager *DBManager) GetAccountBalance(address *[32]byte) (float64, error)
 	return math.Float64frombits(bits), nil
 }
 
+// GetAccountBalanceOrZero treats an account that was never written as holding nothing,
+// while still reporting real read failures
+func (manager *DBManager) GetAccountBalanceOrZero(address *[32]byte) (float64, error) {
+	balance, err := manager.GetAccountBalance(address)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, nil
+	}
+	return balance, err
+}
+
+// HasAccount reports whether a balance was ever written for the address
+func (manager *DBManager) HasAccount(address *[32]byte) (bool, error) {
+	return manager.db.Has(PrefixKey(accountBalancePrefix, address[:]), nil)
+}
+
 func (manager *DBManager) InsertAccountBalance(address *[32]byte, balance float64) error {
 	key := PrefixKey(accountBalancePrefix, address[:])
 
@@ -78,6 +129,82 @@ func (manager *DBManager) InsertAccountBalance(address *[32]byte, balance float6
 	return manager.Insert(key, buf)
 }
 
+// GetAllAccountBalances returns every stored balance by address
+func (manager *DBManager) GetAllAccountBalances() (map[[32]byte]float64, error) {
+	balances := make(map[[32]byte]float64)
+	iter := manager.db.NewIterator(util.BytesPrefix([]byte{accountBalancePrefix}), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var address [32]byte
+		copy(address[:], iter.Key()[1:])
+		balances[address] = math.Float64frombits(binary.LittleEndian.Uint64(iter.Value()))
+	}
+	return balances, iter.Error()
+}
+
+// Account Nonce functions, the nonce of the last transaction applied for an address
+func (manager *DBManager) GetAccountNonce(address *[32]byte) (uint64, error) {
+	key := PrefixKey(accountNoncePrefix, address[:])
+	data, err := manager.Get(key)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint64(data), nil
+}
+
+// GetAccountNonceOrZero treats an account without transactions as having nonce 0,
+// while still reporting real read failures
+func (manager *DBManager) GetAccountNonceOrZero(address *[32]byte) (uint64, error) {
+	nonce, err := manager.GetAccountNonce(address)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, nil
+	}
+	return nonce, err
+}
+
+// GetAllAccountNonces returns every stored nonce by address
+func (manager *DBManager) GetAllAccountNonces() (map[[32]byte]uint64, error) {
+	nonces := make(map[[32]byte]uint64)
+	iter := manager.db.NewIterator(util.BytesPrefix([]byte{accountNoncePrefix}), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var address [32]byte
+		copy(address[:], iter.Key()[1:])
+		nonces[address] = binary.LittleEndian.Uint64(iter.Value())
+	}
+	return nonces, iter.Error()
+}
+
+func (manager *DBManager) InsertAccountNonce(address *[32]byte, nonce uint64) error {
+	key := PrefixKey(accountNoncePrefix, address[:])
+
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, nonce)
+
+	return manager.Insert(key, buf)
+}
+
+// BatchInsertAccountNonce queues a nonce update in the batch instead of writing it immediately
+func (manager *DBManager) BatchInsertAccountNonce(batch *leveldb.Batch, address *[32]byte, nonce uint64) {
+	key := PrefixKey(accountNoncePrefix, address[:])
+
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, nonce)
+
+	batch.Put(key, buf)
+}
+
+// BatchInsertAccountBalance queues a balance update in the batch instead of writing it immediately
+func (manager *DBManager) BatchInsertAccountBalance(batch *leveldb.Batch, address *[32]byte, balance float64) {
+	key := PrefixKey(accountBalancePrefix, address[:])
+
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, math.Float64bits(balance))
+
+	batch.Put(key, buf)
+}
+
 // GetHashBlockretrieves a Block for a given block hash
 func (manager *DBManager) GetHashBlock(hash []byte) (*block.Block, error) {
 	// Create prefixed key
@@ -116,6 +243,19 @@ func (manager *DBManager) InsertHashBlock(hash *[32]byte, block *block.Block) er
 	return manager.Insert(key, buf.Bytes())
 }
 
+// BatchInsertHashBlock queues a block write in the batch instead of writing it immediately
+func (manager *DBManager) BatchInsertHashBlock(batch *leveldb.Batch, hash *[32]byte, block *block.Block) error {
+	key := PrefixKey(hashBlockPerfix, hash[:])
+
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, block); err != nil {
+		return err
+	}
+
+	batch.Put(key, buf.Bytes())
+	return nil
+}
+
 // Tip Hash functions
 func (manager *DBManager) GetTipHash() ([]byte, error) {
 	return manager.Get([]byte{tipHash})
@@ -124,3 +264,346 @@ func (manager *DBManager) GetTipHash() ([]byte, error) {
 func (manager *DBManager) InsertTipHash(hash *[32]byte) error {
 	return manager.Insert([]byte{tipHash}, hash[:])
 }
+
+func (manager *DBManager) BatchInsertTipHash(batch *leveldb.Batch, hash *[32]byte) {
+	batch.Put([]byte{tipHash}, hash[:])
+}
+
+// AccountUndo is the state of an account before a block touched it
+type AccountUndo struct {
+	Address [32]byte
+	Balance float64
+	Nonce   uint64
+}
+
+// Block undo functions, map a block hash to the account pre-images needed to roll it back
+func (manager *DBManager) GetBlockUndo(hash *[32]byte) ([]AccountUndo, error) {
+	data, err := manager.Get(PrefixKey(blockUndoPrefix, hash[:]))
+	if err != nil {
+		return nil, err
+	}
+
+	undo := make([]AccountUndo, len(data)/binary.Size(AccountUndo{}))
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, undo); err != nil {
+		return nil, err
+	}
+
+	return undo, nil
+}
+
+func (manager *DBManager) BatchInsertBlockUndo(batch *leveldb.Batch, hash *[32]byte, undo []AccountUndo) error {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, undo); err != nil {
+		return err
+	}
+
+	batch.Put(PrefixKey(blockUndoPrefix, hash[:]), buf.Bytes())
+	return nil
+}
+
+func (manager *DBManager) BatchDeleteBlockUndo(batch *leveldb.Batch, hash *[32]byte) {
+	batch.Delete(PrefixKey(blockUndoPrefix, hash[:]))
+}
+
+// Receipt records one payment of a transaction applied in a block, a split transaction
+// has one receipt per output. The block reward is a receipt with zero TxHash and From.
+type Receipt struct {
+	TxHash  [32]byte
+	From    [32]byte
+	To      [32]byte
+	Amount  float64
+	Success bool // False when the sender could not cover the transaction and nothing moved
+}
+
+// Block receipt functions, map a block hash to the receipts of the transaction it applied
+func (manager *DBManager) GetBlockReceipts(hash *[32]byte) ([]Receipt, error) {
+	data, err := manager.Get(PrefixKey(blockReceiptPrefix, hash[:]))
+	if err != nil {
+		return nil, err
+	}
+
+	receipts := make([]Receipt, len(data)/binary.Size(Receipt{}))
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, receipts); err != nil {
+		return nil, err
+	}
+
+	return receipts, nil
+}
+
+func (manager *DBManager) BatchInsertBlockReceipts(batch *leveldb.Batch, hash *[32]byte, receipts []Receipt) error {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, receipts); err != nil {
+		return err
+	}
+
+	batch.Put(PrefixKey(blockReceiptPrefix, hash[:]), buf.Bytes())
+	return nil
+}
+
+func (manager *DBManager) BatchDeleteBlockReceipts(batch *leveldb.Batch, hash *[32]byte) {
+	batch.Delete(PrefixKey(blockReceiptPrefix, hash[:]))
+}
+
+// StakeEntry is one account's stake in a stake snapshot
+type StakeEntry struct {
+	Address [32]byte
+	Stake   float64
+}
+
+// Stake snapshot functions, map a block hash to the stake of every account after the block
+func (manager *DBManager) GetStakeSnapshot(hash *[32]byte) ([]StakeEntry, error) {
+	data, err := manager.Get(PrefixKey(stakeSnapshotPrefix, hash[:]))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]StakeEntry, len(data)/binary.Size(StakeEntry{}))
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (manager *DBManager) BatchInsertStakeSnapshot(batch *leveldb.Batch, hash *[32]byte, entries []StakeEntry) error {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, entries); err != nil {
+		return err
+	}
+
+	batch.Put(PrefixKey(stakeSnapshotPrefix, hash[:]), buf.Bytes())
+	return nil
+}
+
+func (manager *DBManager) BatchDeleteStakeSnapshot(batch *leveldb.Batch, hash *[32]byte) {
+	batch.Delete(PrefixKey(stakeSnapshotPrefix, hash[:]))
+}
+
+// Delegation is stake an account delegated to a validator, one entry of a delegation snapshot
+type Delegation struct {
+	Delegator [32]byte
+	Validator [32]byte
+	Stake     float64 // Moved from the delegator to the validator in the stake snapshot
+}
+
+// Delegation snapshot functions, map a block hash to the delegations in force after the block.
+// Blocks after which nothing is delegated have none stored.
+func (manager *DBManager) GetDelegations(hash *[32]byte) ([]Delegation, error) {
+	data, err := manager.Get(PrefixKey(delegationPrefix, hash[:]))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Delegation, len(data)/binary.Size(Delegation{}))
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (manager *DBManager) BatchInsertDelegations(batch *leveldb.Batch, hash *[32]byte, entries []Delegation) error {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, entries); err != nil {
+		return err
+	}
+
+	batch.Put(PrefixKey(delegationPrefix, hash[:]), buf.Bytes())
+	return nil
+}
+
+func (manager *DBManager) BatchDeleteDelegations(batch *leveldb.Batch, hash *[32]byte) {
+	batch.Delete(PrefixKey(delegationPrefix, hash[:]))
+}
+
+// Genesis supply functions, the total minted at genesis that balances must always sum to
+func (manager *DBManager) GetGenesisSupply() (float64, error) {
+	data, err := manager.Get([]byte{genesisSupply})
+	if err != nil {
+		return 0, err
+	}
+
+	return math.Float64frombits(binary.LittleEndian.Uint64(data)), nil
+}
+
+func (manager *DBManager) InsertGenesisSupply(supply float64) error {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, math.Float64bits(supply))
+
+	return manager.Insert([]byte{genesisSupply}, buf)
+}
+
+// Genesis hash functions, the genesis of the network the database was created for
+func (manager *DBManager) GetGenesisHash() ([32]byte, error) {
+	var hash [32]byte
+	data, err := manager.Get([]byte{genesisHash})
+	if err != nil {
+		return hash, err
+	}
+	if len(data) != len(hash) {
+		return hash, errors.New("stored genesis hash is malformed")
+	}
+	copy(hash[:], data)
+	return hash, nil
+}
+
+func (manager *DBManager) InsertGenesisHash(hash *[32]byte) error {
+	return manager.Insert([]byte{genesisHash}, hash[:])
+}
+
+// Minted supply functions, the total block rewards credited on top of the genesis supply
+func (manager *DBManager) GetMintedSupply() (float64, error) {
+	data, err := manager.Get([]byte{mintedSupply})
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return math.Float64frombits(binary.LittleEndian.Uint64(data)), nil
+}
+
+func (manager *DBManager) BatchInsertMintedSupply(batch *leveldb.Batch, supply float64) {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, math.Float64bits(supply))
+
+	batch.Put([]byte{mintedSupply}, buf)
+}
+
+// Transaction index functions, map a transaction hash to the height of the block including it
+func (manager *DBManager) GetTxnHeight(hash *[32]byte) (uint64, error) {
+	key := PrefixKey(txnHeightPrefix, hash[:])
+	data, err := manager.Get(key)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint64(data), nil
+}
+
+func (manager *DBManager) BatchInsertTxnHeight(batch *leveldb.Batch, hash *[32]byte, height uint64) {
+	key := PrefixKey(txnHeightPrefix, hash[:])
+
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, height)
+
+	batch.Put(key, buf)
+}
+
+func (manager *DBManager) BatchDeleteTxnHeight(batch *leveldb.Batch, hash *[32]byte) {
+	batch.Delete(PrefixKey(txnHeightPrefix, hash[:]))
+}
+
+// AccountTxn is one entry of an account's history, a transaction sending from or paying the
+// account in the block at Height
+type AccountTxn struct {
+	Height uint64
+	TxHash [32]byte
+}
+
+// Account history functions, index the transactions of the main chain by the addresses they
+// touch. Keys are address, big-endian height and hash so an account's entries are stored in
+// height order and the value is empty.
+func (manager *DBManager) GetAccountHistory(address *[32]byte, offset, limit int) ([]AccountTxn, error) {
+	iter := manager.db.NewIterator(util.BytesPrefix(PrefixKey(accountTxnPrefix, address[:])), nil)
+	defer iter.Release()
+
+	// Newest first
+	var history []AccountTxn
+	for ok := iter.Last(); ok && len(history) < limit; ok = iter.Prev() {
+		if offset > 0 {
+			offset--
+			continue
+		}
+		key := iter.Key()[1+32:]
+		entry := AccountTxn{Height: binary.BigEndian.Uint64(key)}
+		copy(entry.TxHash[:], key[8:])
+		history = append(history, entry)
+	}
+	return history, iter.Error()
+}
+
+func (manager *DBManager) BatchInsertAccountTxn(batch *leveldb.Batch, address *[32]byte, height uint64, txHash *[32]byte) {
+	batch.Put(accountTxnKey(address, height, txHash), nil)
+}
+
+func (manager *DBManager) BatchDeleteAccountTxn(batch *leveldb.Batch, address *[32]byte, height uint64, txHash *[32]byte) {
+	batch.Delete(accountTxnKey(address, height, txHash))
+}
+
+func accountTxnKey(address *[32]byte, height uint64, txHash *[32]byte) []byte {
+	key := make([]byte, 32+8+32)
+	copy(key, address[:])
+	binary.BigEndian.PutUint64(key[32:], height)
+	copy(key[40:], txHash[:])
+	return PrefixKey(accountTxnPrefix, key)
+}
+
+// Cumulative difficulty functions, map a block hash to the sum of the difficulties from genesis up to the block
+func (manager *DBManager) GetCumDifficulty(hash *[32]byte) (uint64, error) {
+	data, err := manager.Get(PrefixKey(cumDifficultyPrefix, hash[:]))
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint64(data), nil
+}
+
+func (manager *DBManager) BatchInsertCumDifficulty(batch *leveldb.Batch, hash *[32]byte, work uint64) {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, work)
+
+	batch.Put(PrefixKey(cumDifficultyPrefix, hash[:]), buf)
+}
+
+// Pending transaction functions, the transactions waiting in the pool keyed by the height of the
+// block that may include them and their hash
+func (manager *DBManager) GetPendingTxns() ([]*block.Transaction, error) {
+	var txns []*block.Transaction
+	iter := manager.db.NewIterator(util.BytesPrefix([]byte{pendingTxnPrefix}), nil)
+	defer iter.Release()
+	for iter.Next() {
+		txn := &block.Transaction{}
+		if err := binary.Read(bytes.NewReader(iter.Value()), binary.LittleEndian, txn); err != nil {
+			return nil, err
+		}
+		txns = append(txns, txn)
+	}
+	return txns, iter.Error()
+}
+
+func (manager *DBManager) InsertPendingTxn(txn *block.Transaction) error {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, txn); err != nil {
+		return err
+	}
+	hash := txn.Hash()
+	return manager.Insert(pendingTxnKey(txn.Height, &hash), buf.Bytes())
+}
+
+func (manager *DBManager) DeletePendingTxn(txn *block.Transaction) error {
+	hash := txn.Hash()
+	return manager.Delete(pendingTxnKey(txn.Height, &hash))
+}
+
+// BatchDeletePendingTxns queues the removal of every pending transaction for height in the batch
+func (manager *DBManager) BatchDeletePendingTxns(batch *leveldb.Batch, height uint64) error {
+	iter := manager.db.NewIterator(util.BytesPrefix(pendingTxnKey(height, nil)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		batch.Delete(slices.Clone(iter.Key()))
+	}
+	return iter.Error()
+}
+
+// pendingTxnKey is big-endian so pending transactions are iterated in height order, without a
+// hash it is the prefix of every transaction pending for height
+func pendingTxnKey(height uint64, hash *[32]byte) []byte {
+	key := make([]byte, 8, 40)
+	binary.BigEndian.PutUint64(key, height)
+	if hash != nil {
+		key = append(key, hash[:]...)
+	}
+	return PrefixKey(pendingTxnPrefix, key)
+}
@@ -5,12 +5,15 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"errors"
 	"math"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/nanlour/da/src/block"
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
 // createTempDB creates a temporary database for testing
@@ -21,7 +24,7 @@ func createTempDB(t *testing.T) (*DBManager, string) {
 	}
 
 	dbPath := filepath.Join(tempDir, "testdb")
-	manager, err := InitialDB(dbPath)
+	manager, err := InitialDB(dbPath, nil)
 	if err != nil {
 		os.RemoveAll(tempDir)
 		t.Fatalf("Failed to initialize database: %v", err)
@@ -30,6 +33,19 @@ func createTempDB(t *testing.T) (*DBManager, string) {
 	return manager, tempDir
 }
 
+// writeBatch writes whatever queue adds to a fresh batch, the way the records only written
+// alongside a block are stored
+func writeBatch(t *testing.T, manager *DBManager, queue func(batch *leveldb.Batch) error) {
+	t.Helper()
+	batch := new(leveldb.Batch)
+	if err := queue(batch); err != nil {
+		t.Fatalf("Failed to queue batch: %v", err)
+	}
+	if err := manager.BatchInsert(batch); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+}
+
 // TestInitialDBAndClose tests database initialization and closing
 func TestInitialDBAndClose(t *testing.T) {
 	manager, tempDir := createTempDB(t)
@@ -40,6 +56,51 @@ func TestInitialDBAndClose(t *testing.T) {
 	}
 }
 
+// TestReadOnly checks a read-only database serves reads, rejects writes and is never created
+func TestReadOnly(t *testing.T) {
+	manager, tempDir := createTempDB(t)
+	defer os.RemoveAll(tempDir)
+
+	testBlock := createTestBlock(t)
+	hash := testBlock.Hash()
+	if err := manager.InsertHashBlock(&hash, testBlock); err != nil {
+		t.Fatalf("Failed to insert block: %v", err)
+	}
+	manager.Close()
+
+	readOnly, err := InitialDB(filepath.Join(tempDir, "testdb"), &DBOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open database read-only: %v", err)
+	}
+	defer readOnly.Close()
+
+	retrieved, err := readOnly.GetHashBlock(hash[:])
+	if err != nil {
+		t.Fatalf("Failed to read block: %v", err)
+	}
+	if !compareBlocks(testBlock, retrieved) {
+		t.Fatalf("Retrieved block doesn't match original")
+	}
+
+	if err := readOnly.InsertHashBlock(&hash, testBlock); err != ErrReadOnly {
+		t.Fatalf("Expected ErrReadOnly inserting a block, got %v", err)
+	}
+	if err := readOnly.Delete(hash[:]); err != ErrReadOnly {
+		t.Fatalf("Expected ErrReadOnly deleting, got %v", err)
+	}
+	if err := readOnly.BatchInsert(new(leveldb.Batch)); err != ErrReadOnly {
+		t.Fatalf("Expected ErrReadOnly writing a batch, got %v", err)
+	}
+
+	missing := filepath.Join(tempDir, "missing")
+	if _, err := InitialDB(missing, &DBOptions{ReadOnly: true}); err == nil {
+		t.Fatalf("Expected opening a missing database read-only to fail")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatalf("Expected no database to be created at %s", missing)
+	}
+}
+
 // TestInsertAndGet tests the basic insert and get operations
 func TestInsertAndGet(t *testing.T) {
 	manager, tempDir := createTempDB(t)
@@ -112,6 +173,127 @@ func TestAccountBalance(t *testing.T) {
 	}
 }
 
+// TestAccountBalanceOrZero tests that a missing account reads as zero while I/O failures are reported
+func TestAccountBalanceOrZero(t *testing.T) {
+	manager, tempDir := createTempDB(t)
+	defer os.RemoveAll(tempDir)
+
+	var address [32]byte
+	_, err := rand.Read(address[:])
+	if err != nil {
+		t.Fatalf("Failed to generate random address: %v", err)
+	}
+
+	// Missing account is zero without error
+	exists, err := manager.HasAccount(&address)
+	if err != nil {
+		t.Fatalf("Failed to check account existence: %v", err)
+	}
+	if exists {
+		t.Fatalf("Account should not exist before being written")
+	}
+
+	balance, err := manager.GetAccountBalanceOrZero(&address)
+	if err != nil {
+		t.Fatalf("Missing account should not return an error: %v", err)
+	}
+	if balance != 0 {
+		t.Fatalf("Missing account should have zero balance, got %v", balance)
+	}
+
+	// Existing account returns its balance
+	if err := manager.InsertAccountBalance(&address, 12.5); err != nil {
+		t.Fatalf("Failed to insert account balance: %v", err)
+	}
+	exists, err = manager.HasAccount(&address)
+	if err != nil || !exists {
+		t.Fatalf("Account should exist after being written: %v", err)
+	}
+	balance, err = manager.GetAccountBalanceOrZero(&address)
+	if err != nil || balance != 12.5 {
+		t.Fatalf("Expected balance 12.5, got %v (%v)", balance, err)
+	}
+
+	// Simulate an I/O failure by closing the database, it must not read as zero
+	manager.Close()
+	if _, err := manager.GetAccountBalanceOrZero(&address); err == nil {
+		t.Fatalf("Expected error when the database cannot be read")
+	}
+	if _, err := manager.HasAccount(&address); err == nil {
+		t.Fatalf("Expected error when the database cannot be read")
+	}
+}
+
+// TestAccountNonce tests account nonce operations
+func TestAccountNonce(t *testing.T) {
+	manager, tempDir := createTempDB(t)
+	defer os.RemoveAll(tempDir)
+	defer manager.Close()
+
+	var address [32]byte
+	_, err := rand.Read(address[:])
+	if err != nil {
+		t.Fatalf("Failed to generate random address: %v", err)
+	}
+
+	// Test non-existent account nonce
+	_, err = manager.GetAccountNonce(&address)
+	if err == nil {
+		t.Fatalf("Expected error when getting nonce of non-existent account")
+	}
+
+	// Test nonce insertion and retrieval
+	if err := manager.InsertAccountNonce(&address, 7); err != nil {
+		t.Fatalf("Failed to insert account nonce: %v", err)
+	}
+
+	nonce, err := manager.GetAccountNonce(&address)
+	if err != nil {
+		t.Fatalf("Failed to retrieve account nonce: %v", err)
+	}
+	if nonce != 7 {
+		t.Fatalf("Retrieved nonce does not match. Got %d, expected 7", nonce)
+	}
+}
+
+// TestAllAccounts tests that every stored balance and nonce is listed by address, and nothing
+// stored under other prefixes
+func TestAllAccounts(t *testing.T) {
+	manager, tempDir := createTempDB(t)
+	defer os.RemoveAll(tempDir)
+	defer manager.Close()
+
+	a, b := [32]byte{0xa}, [32]byte{0xb}
+	for address, balance := range map[[32]byte]float64{a: 1.5, b: 0} {
+		if err := manager.InsertAccountBalance(&address, balance); err != nil {
+			t.Fatalf("Failed to insert account balance: %v", err)
+		}
+	}
+	if err := manager.InsertAccountNonce(&b, 3); err != nil {
+		t.Fatalf("Failed to insert account nonce: %v", err)
+	}
+	writeBatch(t, manager, func(batch *leveldb.Batch) error {
+		manager.BatchInsertTxnHeight(batch, &a, 9)
+		return nil
+	})
+
+	balances, err := manager.GetAllAccountBalances()
+	if err != nil {
+		t.Fatalf("Failed to list balances: %v", err)
+	}
+	if want := map[[32]byte]float64{a: 1.5, b: 0}; !reflect.DeepEqual(balances, want) {
+		t.Errorf("Listed balances %v, expected %v", balances, want)
+	}
+
+	nonces, err := manager.GetAllAccountNonces()
+	if err != nil {
+		t.Fatalf("Failed to list nonces: %v", err)
+	}
+	if want := map[[32]byte]uint64{b: 3}; !reflect.DeepEqual(nonces, want) {
+		t.Errorf("Listed nonces %v, expected %v", nonces, want)
+	}
+}
+
 // TestHashBlock tests block storage and retrieval by hash
 func TestHashBlock(t *testing.T) {
 	manager, tempDir := createTempDB(t)
@@ -191,8 +373,544 @@ func TestTipHash(t *testing.T) {
 	}
 }
 
+func TestGenesisHash(t *testing.T) {
+	manager, tempDir := createTempDB(t)
+	defer os.RemoveAll(tempDir)
+	defer manager.Close()
+
+	if _, err := manager.GetGenesisHash(); !errors.Is(err, leveldb.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound for a new database, got %v", err)
+	}
+
+	hash := [32]byte{0xde, 0xad}
+	if err := manager.InsertGenesisHash(&hash); err != nil {
+		t.Fatalf("Failed to insert genesis hash: %v", err)
+	}
+	retrieved, err := manager.GetGenesisHash()
+	if err != nil {
+		t.Fatalf("Failed to retrieve genesis hash: %v", err)
+	}
+	if retrieved != hash {
+		t.Fatalf("Retrieved genesis hash %x does not match %x", retrieved, hash)
+	}
+}
+
+// TestTxnHeight tests the transaction hash to block height index
+func TestTxnHeight(t *testing.T) {
+	manager, tempDir := createTempDB(t)
+	defer os.RemoveAll(tempDir)
+	defer manager.Close()
+
+	// Create test hash
+	var hash [32]byte
+	_, err := rand.Read(hash[:])
+	if err != nil {
+		t.Fatalf("Failed to generate random hash: %v", err)
+	}
+
+	// Test retrieval of non-indexed transaction
+	_, err = manager.GetTxnHeight(&hash)
+	if err == nil {
+		t.Fatalf("Expected error when getting height of non-indexed transaction")
+	}
+
+	// Test insertion
+	writeBatch(t, manager, func(batch *leveldb.Batch) error {
+		manager.BatchInsertTxnHeight(batch, &hash, 42)
+		return nil
+	})
+
+	// Test retrieval
+	height, err := manager.GetTxnHeight(&hash)
+	if err != nil {
+		t.Fatalf("Failed to retrieve transaction height: %v", err)
+	}
+	if height != 42 {
+		t.Fatalf("Retrieved height does not match. Got %d, expected 42", height)
+	}
+
+	// Test deletion
+	writeBatch(t, manager, func(batch *leveldb.Batch) error {
+		manager.BatchDeleteTxnHeight(batch, &hash)
+		return nil
+	})
+	_, err = manager.GetTxnHeight(&hash)
+	if err == nil {
+		t.Fatalf("Expected error when getting height of deleted transaction")
+	}
+}
+
+// TestAccountHistory tests paging an account's transactions newest first
+func TestAccountHistory(t *testing.T) {
+	manager, tempDir := createTempDB(t)
+	defer os.RemoveAll(tempDir)
+	defer manager.Close()
+
+	alice, bob := [32]byte{1}, [32]byte{2}
+	hashes := make([][32]byte, 5)
+	writeBatch(t, manager, func(batch *leveldb.Batch) error {
+		for i := range hashes {
+			hashes[i] = [32]byte{0xaa, byte(i)}
+			manager.BatchInsertAccountTxn(batch, &alice, uint64(i+1), &hashes[i])
+		}
+		manager.BatchInsertAccountTxn(batch, &bob, 3, &hashes[2])
+		return nil
+	})
+
+	history, err := manager.GetAccountHistory(&alice, 1, 2)
+	if err != nil {
+		t.Fatalf("Failed to read history: %v", err)
+	}
+	want := []AccountTxn{{Height: 4, TxHash: hashes[3]}, {Height: 3, TxHash: hashes[2]}}
+	if !reflect.DeepEqual(history, want) {
+		t.Fatalf("History page = %v, expected %v", history, want)
+	}
+
+	history, err = manager.GetAccountHistory(&bob, 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to read history: %v", err)
+	}
+	if len(history) != 1 || history[0].TxHash != hashes[2] {
+		t.Fatalf("Bob's history = %v, expected only the transaction at height 3", history)
+	}
+
+	writeBatch(t, manager, func(batch *leveldb.Batch) error {
+		manager.BatchDeleteAccountTxn(batch, &alice, 5, &hashes[4])
+		return nil
+	})
+	history, err = manager.GetAccountHistory(&alice, 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to read history: %v", err)
+	}
+	if len(history) != 4 || history[0].Height != 4 {
+		t.Fatalf("History after delete = %v, expected 4 entries starting at height 4", history)
+	}
+}
+
+// TestCumDifficulty tests storing a block's cumulative difficulty
+func TestCumDifficulty(t *testing.T) {
+	manager, tempDir := createTempDB(t)
+	defer os.RemoveAll(tempDir)
+	defer manager.Close()
+
+	hash := [32]byte{0x01}
+	if _, err := manager.GetCumDifficulty(&hash); !errors.Is(err, leveldb.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound for a block without cumulative difficulty, got %v", err)
+	}
+
+	highest := [32]byte{0x02}
+	writeBatch(t, manager, func(batch *leveldb.Batch) error {
+		manager.BatchInsertCumDifficulty(batch, &hash, 1000)
+		manager.BatchInsertCumDifficulty(batch, &highest, math.MaxUint64)
+		return nil
+	})
+	work, err := manager.GetCumDifficulty(&hash)
+	if err != nil {
+		t.Fatalf("Failed to retrieve cumulative difficulty: %v", err)
+	}
+	if work != 1000 {
+		t.Fatalf("Retrieved cumulative difficulty does not match. Got %d, expected 1000", work)
+	}
+	if work, err := manager.GetCumDifficulty(&highest); err != nil || work != math.MaxUint64 {
+		t.Fatalf("Cumulative difficulty does not match. Got %d (%v), expected %d", work, err, uint64(math.MaxUint64))
+	}
+}
+
+// TestPendingTxns tests storing, listing and deleting pooled transactions
+func TestPendingTxns(t *testing.T) {
+	manager, tempDir := createTempDB(t)
+	defer os.RemoveAll(tempDir)
+	defer manager.Close()
+
+	txns, err := manager.GetPendingTxns()
+	if err != nil || len(txns) != 0 {
+		t.Fatalf("Expected no pending transactions, got %v: %v", txns, err)
+	}
+
+	first := block.Transaction{FromAddress: [32]byte{1}, ToAddress: [32]byte{2}, Amount: 5, Height: 3, Nonce: 1}
+	rival := block.Transaction{FromAddress: [32]byte{4}, ToAddress: [32]byte{2}, Amount: 6, Height: 3, Nonce: 1}
+	second := block.Transaction{FromAddress: [32]byte{1}, ToAddress: [32]byte{3}, Amount: 7, Height: 300, Nonce: 2}
+	for _, txn := range []*block.Transaction{&second, &first, &rival} {
+		if err := manager.InsertPendingTxn(txn); err != nil {
+			t.Fatalf("Failed to insert pending transaction: %v", err)
+		}
+	}
+
+	txns, err = manager.GetPendingTxns()
+	if err != nil {
+		t.Fatalf("Failed to get pending transactions: %v", err)
+	}
+	if len(txns) != 3 || txns[0].Height != 3 || txns[1].Height != 3 || *txns[2] != second {
+		t.Fatalf("Pending transactions don't match or are out of height order: %v", txns)
+	}
+
+	if err := manager.DeletePendingTxn(&first); err != nil {
+		t.Fatalf("Failed to delete pending transaction: %v", err)
+	}
+	txns, err = manager.GetPendingTxns()
+	if err != nil {
+		t.Fatalf("Failed to get pending transactions: %v", err)
+	}
+	if len(txns) != 2 || *txns[0] != rival || *txns[1] != second {
+		t.Fatalf("Expected the rival at height 3 and the transaction at height 300 left, got %v", txns)
+	}
+}
+
+// TestBlockUndo tests block undo record operations
+func TestBlockUndo(t *testing.T) {
+	manager, tempDir := createTempDB(t)
+	defer os.RemoveAll(tempDir)
+	defer manager.Close()
+
+	var hash [32]byte
+	_, err := rand.Read(hash[:])
+	if err != nil {
+		t.Fatalf("Failed to generate random hash: %v", err)
+	}
+
+	if _, err := manager.GetBlockUndo(&hash); err != leveldb.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound for missing undo record, got %v", err)
+	}
+
+	undo := make([]AccountUndo, 3)
+	for i := range undo {
+		undo[i].Address[0] = byte(i + 1)
+		undo[i].Balance = float64(i) * 10.5
+		undo[i].Nonce = uint64(i * 7)
+	}
+	writeBatch(t, manager, func(batch *leveldb.Batch) error {
+		return manager.BatchInsertBlockUndo(batch, &hash, undo)
+	})
+
+	retrieved, err := manager.GetBlockUndo(&hash)
+	if err != nil {
+		t.Fatalf("Failed to get undo record: %v", err)
+	}
+	if len(retrieved) != len(undo) {
+		t.Fatalf("Undo record length mismatch: got %d, want %d", len(retrieved), len(undo))
+	}
+	for i := range undo {
+		if retrieved[i] != undo[i] {
+			t.Fatalf("Undo entry %d mismatch: got %v, want %v", i, retrieved[i], undo[i])
+		}
+	}
+
+	writeBatch(t, manager, func(batch *leveldb.Batch) error {
+		manager.BatchDeleteBlockUndo(batch, &hash)
+		return nil
+	})
+	if _, err := manager.GetBlockUndo(&hash); err != leveldb.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+// TestBlockReceipts tests block receipt record operations
+func TestBlockReceipts(t *testing.T) {
+	manager, tempDir := createTempDB(t)
+	defer os.RemoveAll(tempDir)
+	defer manager.Close()
+
+	hash := [32]byte{0x42}
+	if _, err := manager.GetBlockReceipts(&hash); err != leveldb.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound for missing receipts, got %v", err)
+	}
+
+	receipts := []Receipt{
+		{TxHash: [32]byte{1}, From: [32]byte{2}, To: [32]byte{3}, Amount: 1.5, Success: true},
+		{TxHash: [32]byte{1}, From: [32]byte{2}, To: [32]byte{4}, Amount: 2.5, Success: true},
+	}
+	writeBatch(t, manager, func(batch *leveldb.Batch) error {
+		return manager.BatchInsertBlockReceipts(batch, &hash, receipts)
+	})
+
+	retrieved, err := manager.GetBlockReceipts(&hash)
+	if err != nil {
+		t.Fatalf("Failed to get receipts: %v", err)
+	}
+	if len(retrieved) != len(receipts) {
+		t.Fatalf("Receipt count mismatch: got %d, want %d", len(retrieved), len(receipts))
+	}
+	for i := range receipts {
+		if retrieved[i] != receipts[i] {
+			t.Fatalf("Receipt %d mismatch: got %v, want %v", i, retrieved[i], receipts[i])
+		}
+	}
+
+	writeBatch(t, manager, func(batch *leveldb.Batch) error {
+		manager.BatchDeleteBlockReceipts(batch, &hash)
+		return nil
+	})
+	if _, err := manager.GetBlockReceipts(&hash); err != leveldb.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+// TestStakeSnapshot tests stake snapshot record operations
+func TestStakeSnapshot(t *testing.T) {
+	manager, tempDir := createTempDB(t)
+	defer os.RemoveAll(tempDir)
+	defer manager.Close()
+
+	hash := [32]byte{0x51}
+	if _, err := manager.GetStakeSnapshot(&hash); err != leveldb.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound for missing snapshot, got %v", err)
+	}
+
+	entries := []StakeEntry{
+		{Address: [32]byte{1}, Stake: 100},
+		{Address: [32]byte{2}, Stake: 42.5},
+	}
+	writeBatch(t, manager, func(batch *leveldb.Batch) error {
+		return manager.BatchInsertStakeSnapshot(batch, &hash, entries)
+	})
+
+	retrieved, err := manager.GetStakeSnapshot(&hash)
+	if err != nil {
+		t.Fatalf("Failed to get snapshot: %v", err)
+	}
+	if len(retrieved) != len(entries) {
+		t.Fatalf("Snapshot length mismatch: got %d, want %d", len(retrieved), len(entries))
+	}
+	for i := range entries {
+		if retrieved[i] != entries[i] {
+			t.Fatalf("Snapshot entry %d mismatch: got %v, want %v", i, retrieved[i], entries[i])
+		}
+	}
+
+	writeBatch(t, manager, func(batch *leveldb.Batch) error {
+		manager.BatchDeleteStakeSnapshot(batch, &hash)
+		return nil
+	})
+	if _, err := manager.GetStakeSnapshot(&hash); err != leveldb.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+// TestDelegations tests delegation snapshot record operations
+func TestDelegations(t *testing.T) {
+	manager, tempDir := createTempDB(t)
+	defer os.RemoveAll(tempDir)
+	defer manager.Close()
+
+	hash := [32]byte{0x52}
+	if _, err := manager.GetDelegations(&hash); err != leveldb.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound for missing snapshot, got %v", err)
+	}
+
+	entries := []Delegation{
+		{Delegator: [32]byte{1}, Validator: [32]byte{3}, Stake: 100},
+		{Delegator: [32]byte{2}, Validator: [32]byte{3}, Stake: 42.5},
+	}
+	writeBatch(t, manager, func(batch *leveldb.Batch) error {
+		return manager.BatchInsertDelegations(batch, &hash, entries)
+	})
+
+	retrieved, err := manager.GetDelegations(&hash)
+	if err != nil {
+		t.Fatalf("Failed to get snapshot: %v", err)
+	}
+	if len(retrieved) != len(entries) {
+		t.Fatalf("Snapshot length mismatch: got %d, want %d", len(retrieved), len(entries))
+	}
+	for i := range entries {
+		if retrieved[i] != entries[i] {
+			t.Fatalf("Snapshot entry %d mismatch: got %v, want %v", i, retrieved[i], entries[i])
+		}
+	}
+
+	writeBatch(t, manager, func(batch *leveldb.Batch) error {
+		manager.BatchDeleteDelegations(batch, &hash)
+		return nil
+	})
+	if _, err := manager.GetDelegations(&hash); err != leveldb.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+// TestBatchInsert tests that a batch of related writes applies all-or-nothing
+func TestBatchInsert(t *testing.T) {
+	manager, tempDir := createTempDB(t)
+	defer os.RemoveAll(tempDir)
+
+	addresses := make([][32]byte, 3)
+	for i := range addresses {
+		if _, err := rand.Read(addresses[i][:]); err != nil {
+			t.Fatalf("Failed to generate random address: %v", err)
+		}
+	}
+
+	testBlock := createTestBlock(t)
+	blockHash := testBlock.Hash()
+
+	// Queue several updates, nothing is visible until the batch is written
+	batch := new(leveldb.Batch)
+	for i := range addresses {
+		manager.BatchInsertAccountBalance(batch, &addresses[i], float64(100*(i+1)))
+	}
+	if err := manager.BatchInsertHashBlock(batch, &blockHash, testBlock); err != nil {
+		t.Fatalf("Failed to queue block: %v", err)
+	}
+
+	for i := range addresses {
+		if _, err := manager.GetAccountBalance(&addresses[i]); err == nil {
+			t.Fatalf("Balance should not be visible before the batch is written")
+		}
+	}
+
+	if err := manager.BatchInsert(batch); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+
+	// Every update is visible after the batch is written
+	for i := range addresses {
+		balance, err := manager.GetAccountBalance(&addresses[i])
+		if err != nil {
+			t.Fatalf("Failed to retrieve account balance: %v", err)
+		}
+		if balance != float64(100*(i+1)) {
+			t.Fatalf("Balance does not match. Got %v, expected %v", balance, float64(100*(i+1)))
+		}
+	}
+	if _, err := manager.GetHashBlock(blockHash[:]); err != nil {
+		t.Fatalf("Failed to retrieve block written in batch: %v", err)
+	}
+
+	// A batch that fails to write leaves nothing behind
+	failedBatch := new(leveldb.Batch)
+	for i := range addresses {
+		manager.BatchInsertAccountBalance(failedBatch, &addresses[i], 0)
+	}
+	manager.Close()
+	if err := manager.BatchInsert(failedBatch); err == nil {
+		t.Fatalf("Expected error when writing a batch to a closed database")
+	}
+
+	reopened, err := InitialDB(filepath.Join(tempDir, "testdb"), nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer reopened.Close()
+
+	for i := range addresses {
+		balance, err := reopened.GetAccountBalance(&addresses[i])
+		if err != nil {
+			t.Fatalf("Failed to retrieve account balance: %v", err)
+		}
+		if balance != float64(100*(i+1)) {
+			t.Fatalf("Failed batch should not change balances. Got %v, expected %v", balance, float64(100*(i+1)))
+		}
+	}
+}
+
+// TestBatchDelete tests that the per-block records queued for deletion in a batch are only
+// gone once the batch is written
+func TestBatchDelete(t *testing.T) {
+	manager, tempDir := createTempDB(t)
+	defer os.RemoveAll(tempDir)
+	defer manager.Close()
+
+	hash, txHash, address := [32]byte{0x61}, [32]byte{0x62}, [32]byte{0x63}
+	writeBatch(t, manager, func(batch *leveldb.Batch) error {
+		manager.BatchInsertTxnHeight(batch, &txHash, 4)
+		manager.BatchInsertAccountTxn(batch, &address, 4, &txHash)
+		return manager.BatchInsertBlockUndo(batch, &hash, []AccountUndo{{Address: address, Balance: 1}})
+	})
+	for _, txn := range []*block.Transaction{{Height: 4}, {Height: 4, Nonce: 1}} {
+		if err := manager.InsertPendingTxn(txn); err != nil {
+			t.Fatalf("Failed to insert pending txn: %v", err)
+		}
+	}
+
+	batch := new(leveldb.Batch)
+	manager.BatchDeleteBlockUndo(batch, &hash)
+	manager.BatchDeleteTxnHeight(batch, &txHash)
+	manager.BatchDeleteAccountTxn(batch, &address, 4, &txHash)
+	if err := manager.BatchDeletePendingTxns(batch, 4); err != nil {
+		t.Fatalf("Failed to queue the pending txns: %v", err)
+	}
+	if _, err := manager.GetBlockUndo(&hash); err != nil {
+		t.Fatalf("Undo record should stay until the batch is written: %v", err)
+	}
+
+	if err := manager.BatchInsert(batch); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+	if _, err := manager.GetBlockUndo(&hash); err != leveldb.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound for the deleted undo record, got %v", err)
+	}
+	if _, err := manager.GetTxnHeight(&txHash); err != leveldb.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound for the deleted txn height, got %v", err)
+	}
+	history, err := manager.GetAccountHistory(&address, 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to get account history: %v", err)
+	}
+	if len(history) != 0 {
+		t.Fatalf("Expected an empty history, got %v", history)
+	}
+	pending, err := manager.GetPendingTxns()
+	if err != nil {
+		t.Fatalf("Failed to get pending txns: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("Expected no pending txns, got %v", pending)
+	}
+}
+
+// BenchmarkBlockInsertAndRead compares LevelDB's stock options against DefaultDBOptions
+// on 10k blocks, written and then looked up by hash
+func BenchmarkBlockInsertAndRead(b *testing.B) {
+	const blockCount = 10000
+
+	blocks := make([]*block.Block, blockCount)
+	hashes := make([][32]byte, blockCount)
+	for i := range blocks {
+		blocks[i] = createTestBlock(b)
+		hashes[i] = blocks[i].Hash()
+	}
+
+	stock := &DBOptions{BlockCacheSize: 8 << 20, WriteBuffer: 4 << 20, BloomFilterBits: -1}
+	tuned := DefaultDBOptions()
+	for _, bc := range []struct {
+		name    string
+		options *DBOptions
+	}{
+		{"default", stock},
+		{"tuned", &tuned},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				tempDir := b.TempDir()
+				manager, err := InitialDB(filepath.Join(tempDir, "benchdb"), bc.options)
+				if err != nil {
+					b.Fatalf("Failed to initialize database: %v", err)
+				}
+
+				for i := range blocks {
+					if err := manager.InsertHashBlock(&hashes[i], blocks[i]); err != nil {
+						b.Fatalf("Failed to insert block: %v", err)
+					}
+				}
+				for i := range blocks {
+					if _, err := manager.GetHashBlock(hashes[i][:]); err != nil {
+						b.Fatalf("Failed to read block: %v", err)
+					}
+				}
+				// Misses are where the bloom filter helps
+				for i := range blocks {
+					missing := hashes[i]
+					missing[0] ^= 0xff
+					manager.GetHashBlock(missing[:])
+				}
+
+				manager.Close()
+			}
+		})
+	}
+}
+
 // Helper function to create a test block
-func createTestBlock(t *testing.T) *block.Block {
+func createTestBlock(t testing.TB) *block.Block {
 	// Generate a test private key
 	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
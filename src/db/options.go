@@ -0,0 +1,56 @@
+package db
+
+import (
+	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// DBOptions tunes the LevelDB instance behind a DBManager, zero values fall back to DefaultDBOptions
+type DBOptions struct {
+	BlockCacheSize  int // Bytes of decoded blocks kept in memory for reads
+	WriteBuffer     int // Bytes buffered in the memtable before flushing to disk
+	BloomFilterBits int // Bits per key of the bloom filter, negative disables it
+
+	// ReadOnly opens an existing database without creating or changing any file. LevelDB
+	// still locks it, shared with other readers but not with a running node, so read-only
+	// tools only work offline and fail to open the database while its node runs.
+	ReadOnly bool
+}
+
+// DefaultDBOptions favours the chain workload: blocks and balances are written on every
+// new tip and looked up by hash, so a larger write buffer and a bloom filter pay off
+func DefaultDBOptions() DBOptions {
+	return DBOptions{
+		BlockCacheSize:  32 * opt.MiB,
+		WriteBuffer:     16 * opt.MiB,
+		BloomFilterBits: 10,
+	}
+}
+
+func (o *DBOptions) leveldbOptions() *opt.Options {
+	defaults := DefaultDBOptions()
+	var options DBOptions
+	if o != nil {
+		options = *o
+	}
+	if options.BlockCacheSize == 0 {
+		options.BlockCacheSize = defaults.BlockCacheSize
+	}
+	if options.WriteBuffer == 0 {
+		options.WriteBuffer = defaults.WriteBuffer
+	}
+	if options.BloomFilterBits == 0 {
+		options.BloomFilterBits = defaults.BloomFilterBits
+	}
+
+	ldbOptions := &opt.Options{
+		BlockCacheCapacity: options.BlockCacheSize,
+		WriteBuffer:        options.WriteBuffer,
+		ReadOnly:           options.ReadOnly,
+		ErrorIfMissing:     options.ReadOnly,
+	}
+	if options.BloomFilterBits > 0 {
+		ldbOptions.Filter = filter.NewBloomFilter(options.BloomFilterBits)
+	}
+	return ldbOptions
+}
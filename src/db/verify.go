@@ -0,0 +1,117 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/nanlour/da/src/block"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Verify checks the database for inconsistencies left behind by a crash and returns
+// one message per problem found. It only reads, the returned error is for failed reads.
+func (manager *DBManager) Verify() ([]string, error) {
+	var problems []string
+
+	// The tip must point at a stored block
+	tip, err := manager.GetTipHash()
+	switch {
+	case errors.Is(err, leveldb.ErrNotFound):
+		problems = append(problems, "no tip hash recorded")
+	case err != nil:
+		return nil, err
+	default:
+		if _, err := manager.GetHashBlock(tip); errors.Is(err, leveldb.ErrNotFound) {
+			problems = append(problems, fmt.Sprintf("tip %x has no stored block", tip))
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	// Every block must link to a stored parent one height below, down to genesis
+	genesisCount := 0
+	iter := manager.db.NewIterator(util.BytesPrefix([]byte{hashBlockPerfix}), nil)
+	for iter.Next() {
+		hash := iter.Key()[1:]
+		b := &block.Block{}
+		if err := binary.Read(bytes.NewReader(iter.Value()), binary.LittleEndian, b); err != nil {
+			problems = append(problems, fmt.Sprintf("block %x cannot be decoded: %v", hash, err))
+			continue
+		}
+		if actual := b.Hash(); !bytes.Equal(actual[:], hash) {
+			problems = append(problems, fmt.Sprintf("block stored under %x hashes to %x", hash, actual))
+		}
+		if b.Height == 0 {
+			genesisCount++
+			continue
+		}
+
+		parent, err := manager.GetHashBlock(b.PreHash[:])
+		if errors.Is(err, leveldb.ErrNotFound) {
+			problems = append(problems, fmt.Sprintf("block %x at height %d links to missing parent %x", hash, b.Height, b.PreHash))
+			continue
+		}
+		if err != nil {
+			iter.Release()
+			return nil, err
+		}
+		if parent.Height+1 != b.Height {
+			problems = append(problems, fmt.Sprintf("block %x at height %d has parent %x at height %d", hash, b.Height, b.PreHash, parent.Height))
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	if genesisCount != 1 {
+		problems = append(problems, fmt.Sprintf("expected one genesis block, found %d", genesisCount))
+	}
+
+	supplyProblems, err := manager.CheckSupply()
+	if err != nil {
+		return nil, err
+	}
+	problems = append(problems, supplyProblems...)
+
+	return problems, nil
+}
+
+// CheckSupply checks that no balance is negative and that the balances sum to the genesis
+// supply plus the minted rewards, transfers only move funds. It returns one message per problem.
+func (manager *DBManager) CheckSupply() ([]string, error) {
+	var problems []string
+
+	var total float64
+	iter := manager.db.NewIterator(util.BytesPrefix([]byte{accountBalancePrefix}), nil)
+	for iter.Next() {
+		balance := math.Float64frombits(binary.LittleEndian.Uint64(iter.Value()))
+		if balance < 0 {
+			problems = append(problems, fmt.Sprintf("balance of %x is negative: %v", iter.Key()[1:], balance))
+		}
+		total += balance
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	minted, err := manager.GetMintedSupply()
+	if err != nil {
+		return nil, err
+	}
+	supply, err := manager.GetGenesisSupply()
+	switch {
+	case errors.Is(err, leveldb.ErrNotFound):
+		problems = append(problems, "genesis supply not recorded")
+	case err != nil:
+		return nil, err
+	case math.Abs(total-supply-minted) > 1e-6*math.Max(1, math.Abs(supply+minted)):
+		problems = append(problems, fmt.Sprintf("balances sum to %v, genesis supply is %v plus %v minted", total, supply, minted))
+	}
+
+	return problems, nil
+}
@@ -0,0 +1,172 @@
+package db
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// createConsistentDB stores a genesis block, one child as the tip and balances matching the supply
+func createConsistentDB(t *testing.T) (*DBManager, string, [32]byte) {
+	manager, tempDir := createTempDB(t)
+
+	genesis := createTestBlock(t)
+	genesis.Height = 0
+	genesisHash := genesis.Hash()
+	if err := manager.InsertHashBlock(&genesisHash, genesis); err != nil {
+		t.Fatalf("Failed to insert genesis block: %v", err)
+	}
+
+	child := createTestBlock(t)
+	child.PreHash = genesisHash
+	childHash := child.Hash()
+	if err := manager.InsertHashBlock(&childHash, child); err != nil {
+		t.Fatalf("Failed to insert block: %v", err)
+	}
+	if err := manager.InsertTipHash(&childHash); err != nil {
+		t.Fatalf("Failed to insert tip hash: %v", err)
+	}
+
+	var a, b [32]byte
+	a[0], b[0] = 1, 2
+	manager.InsertAccountBalance(&a, 60)
+	manager.InsertAccountBalance(&b, 40)
+	if err := manager.InsertGenesisSupply(100); err != nil {
+		t.Fatalf("Failed to insert genesis supply: %v", err)
+	}
+
+	return manager, tempDir, childHash
+}
+
+func hasProblem(problems []string, substr string) bool {
+	for _, problem := range problems {
+		if strings.Contains(problem, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// TestVerifyConsistent tests that a healthy database reports no problems
+func TestVerifyConsistent(t *testing.T) {
+	manager, tempDir, _ := createConsistentDB(t)
+	defer os.RemoveAll(tempDir)
+	defer manager.Close()
+
+	problems, err := manager.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Expected no problems, got %v", problems)
+	}
+}
+
+// TestVerifyDanglingTip tests that a tip without a stored block is reported
+func TestVerifyDanglingTip(t *testing.T) {
+	manager, tempDir, _ := createConsistentDB(t)
+	defer os.RemoveAll(tempDir)
+	defer manager.Close()
+
+	var dangling [32]byte
+	dangling[0] = 0xaa
+	manager.InsertTipHash(&dangling)
+
+	problems, err := manager.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if !hasProblem(problems, "has no stored block") {
+		t.Fatalf("Expected dangling tip to be reported, got %v", problems)
+	}
+}
+
+// TestVerifyBrokenLink tests that a block whose PreHash is not stored is reported
+func TestVerifyBrokenLink(t *testing.T) {
+	manager, tempDir, tip := createConsistentDB(t)
+	defer os.RemoveAll(tempDir)
+	defer manager.Close()
+
+	orphan := createTestBlock(t)
+	orphan.Height = 2
+	orphanHash := orphan.Hash()
+	manager.InsertHashBlock(&orphanHash, orphan)
+
+	problems, err := manager.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if !hasProblem(problems, "links to missing parent") {
+		t.Fatalf("Expected broken PreHash link to be reported, got %v", problems)
+	}
+
+	// The healthy tip itself is fine
+	if hasProblem(problems, "tip") {
+		t.Fatalf("Tip %x should not be reported, got %v", tip, problems)
+	}
+}
+
+// TestVerifySupplyMismatch tests that balances not summing to the genesis supply are reported
+func TestVerifySupplyMismatch(t *testing.T) {
+	manager, tempDir, _ := createConsistentDB(t)
+	defer os.RemoveAll(tempDir)
+	defer manager.Close()
+
+	var minted [32]byte
+	minted[0] = 3
+	manager.InsertAccountBalance(&minted, 5)
+
+	problems, err := manager.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if !hasProblem(problems, "genesis supply") {
+		t.Fatalf("Expected supply mismatch to be reported, got %v", problems)
+	}
+}
+
+// TestVerifyMintedSupply tests that recorded block rewards are counted towards the supply
+func TestVerifyMintedSupply(t *testing.T) {
+	manager, tempDir, _ := createConsistentDB(t)
+	defer os.RemoveAll(tempDir)
+	defer manager.Close()
+
+	var miner [32]byte
+	miner[0] = 3
+	manager.InsertAccountBalance(&miner, 5)
+	writeBatch(t, manager, func(batch *leveldb.Batch) error {
+		manager.BatchInsertMintedSupply(batch, 5)
+		return nil
+	})
+
+	problems, err := manager.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Expected no problems, got %v", problems)
+	}
+}
+
+// TestCheckSupplyNegativeBalance tests that a negative balance is reported even when the
+// balances still sum to the supply
+func TestCheckSupplyNegativeBalance(t *testing.T) {
+	manager, tempDir, _ := createConsistentDB(t)
+	defer os.RemoveAll(tempDir)
+	defer manager.Close()
+
+	var a, b [32]byte
+	a[0], b[0] = 1, 2
+	manager.InsertAccountBalance(&a, 110)
+	manager.InsertAccountBalance(&b, -10)
+
+	problems, err := manager.CheckSupply()
+	if err != nil {
+		t.Fatalf("CheckSupply failed: %v", err)
+	}
+	if len(problems) != 1 || !hasProblem(problems, "is negative") {
+		t.Fatalf("Expected only the negative balance to be reported, got %v", problems)
+	}
+}
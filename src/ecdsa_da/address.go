@@ -0,0 +1,68 @@
+package ecdsa_da
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// AddressPrefix starts every encoded address. The colon is not a hex digit, so an
+// encoded address can never be mistaken for a raw hex one.
+const AddressPrefix = "da:"
+
+const addressChecksumLen = 4
+
+// EncodedAddressLen is the length of an address produced by EncodeAddress
+const EncodedAddressLen = len(AddressPrefix) + 2*(32+addressChecksumLen)
+
+var (
+	// ErrAddressLength means the address has the wrong number of characters
+	ErrAddressLength = errors.New("wrong length")
+	// ErrAddressChecksum means the address is well formed but was mistyped
+	ErrAddressChecksum = errors.New("bad checksum")
+)
+
+func addressChecksum(address [32]byte) []byte {
+	sum := sha256.Sum256(address[:])
+	return sum[:addressChecksumLen]
+}
+
+// EncodeAddress returns the human readable form of an address: AddressPrefix,
+// then the address and a 4-byte checksum in hex
+func EncodeAddress(address [32]byte) string {
+	return AddressPrefix + hex.EncodeToString(address[:]) + hex.EncodeToString(addressChecksum(address))
+}
+
+// ParseAddress accepts an encoded address or the raw 64-character hex form.
+// Errors wrap ErrAddressLength or ErrAddressChecksum where those apply.
+func ParseAddress(s string) ([32]byte, error) {
+	var address [32]byte
+	s = strings.TrimSpace(s)
+
+	encoded, isEncoded := strings.CutPrefix(s, AddressPrefix)
+	if !isEncoded {
+		if len(s) != 64 {
+			return address, fmt.Errorf("%w: hex address has %d characters, want 64", ErrAddressLength, len(s))
+		}
+		if _, err := hex.Decode(address[:], []byte(s)); err != nil {
+			return address, fmt.Errorf("invalid hex address: %v", err)
+		}
+		return address, nil
+	}
+
+	if len(s) != EncodedAddressLen {
+		return address, fmt.Errorf("%w: encoded address has %d characters, want %d", ErrAddressLength, len(s), EncodedAddressLen)
+	}
+	decoded, err := hex.DecodeString(encoded)
+	if err != nil {
+		return address, fmt.Errorf("invalid encoded address: %v", err)
+	}
+	copy(address[:], decoded[:32])
+	if !bytes.Equal(decoded[32:], addressChecksum(address)) {
+		return [32]byte{}, fmt.Errorf("%w: address was probably mistyped", ErrAddressChecksum)
+	}
+	return address, nil
+}
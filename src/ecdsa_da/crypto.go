@@ -6,9 +6,12 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"math"
 	"math/big"
+
+	"github.com/nanlour/da/src/block"
 )
 
 // GenerateKeyPair creates a new ECDSA keypair
@@ -22,6 +25,16 @@ func BytesToPublicKey(pubKeyBytes [64]byte) (*ecdsa.PublicKey, error) {
 	x := new(big.Int).SetBytes(pubKeyBytes[:32])
 	y := new(big.Int).SetBytes(pubKeyBytes[32:])
 
+	// Reject encodings ecdh would otherwise have to catch, including the
+	// all-zero point at infinity and coordinates outside the field
+	p := elliptic.P256().Params().P
+	if x.Sign() == 0 || y.Sign() == 0 {
+		return nil, errors.New("invalid public key: zero coordinate")
+	}
+	if x.Cmp(p) >= 0 || y.Cmp(p) >= 0 {
+		return nil, errors.New("invalid public key: coordinate not less than the field prime")
+	}
+
 	// Create and validate the public key with crypto/ecdh package
 	// First, encode the point in uncompressed form (0x04 + X + Y)
 	ecdhEncoded := make([]byte, 65)
@@ -77,6 +90,11 @@ func Sign(privateKey *ecdsa.PrivateKey, message []byte) ([]byte, error) {
 		return nil, fmt.Errorf("failed to sign message: %w", err)
 	}
 
+	// (r, n-s) verifies too, always pick the low-S form so Verify accepts it
+	if !block.IsLowS(s) {
+		s.Sub(elliptic.P256().Params().N, s)
+	}
+
 	// Create signature by concatenating r and s
 	// Each value gets 32 bytes (P256 curve parameters)
 	signature := make([]byte, 64)
@@ -105,24 +123,20 @@ func Verify(publicKey *ecdsa.PublicKey, message []byte, signature []byte) bool {
 	r := new(big.Int).SetBytes(signature[:32])
 	s := new(big.Int).SetBytes(signature[32:])
 
+	// Only the canonical low-S form is valid, otherwise anyone could flip s to n-s and change
+	// the signed data's hash without the key
+	if !block.IsLowS(s) {
+		return false
+	}
+
 	// Verify the signature
 	return ecdsa.Verify(publicKey, hash[:], r, s)
 }
 
 // difficulty(Mid creates a combined hash of epoch hash and block height
 func DifficultySeed(epohHash *[32]byte, height uint64) [32]byte {
-	// Convert height to bytes
-	heightBytes := make([]byte, 8)
-
-	// Convert uint64 height to big-endian byte representation
-	heightBytes[0] = byte(height >> 56)
-	heightBytes[1] = byte(height >> 48)
-	heightBytes[2] = byte(height >> 40)
-	heightBytes[3] = byte(height >> 32)
-	heightBytes[4] = byte(height >> 24)
-	heightBytes[5] = byte(height >> 16)
-	heightBytes[6] = byte(height >> 8)
-	heightBytes[7] = byte(height)
+	// Same bytes as the height in block and transaction hashes
+	heightBytes := block.EncodeUint64(height)
 
 	// Combine epoch hash and height bytes
 	combined := make([]byte, 32+8)
@@ -133,8 +147,20 @@ func DifficultySeed(epohHash *[32]byte, height uint64) [32]byte {
 	return sha256.Sum256(combined)
 }
 
+// Default bounds applied by Difficulty
+const (
+	DefaultDifficultyFloor         uint64  = 100 // VDF iterations every block costs at least
+	DefaultDifficultyCapMultiplier float64 = 10  // Cap is this many times MiningDifficulty, scaled by StakeSum/StakeMine
+)
+
 // Difficulty maps a signature to a Difficulty, evenly distributed way
 func Difficulty(signature []byte, StakeSum float64, StakeMine float64, MiningDifficulty uint64) uint64 {
+	return DifficultyWithBounds(signature, StakeSum, StakeMine, MiningDifficulty, DefaultDifficultyFloor, DefaultDifficultyCapMultiplier)
+}
+
+// DifficultyWithBounds is Difficulty with an explicit floor added to every result and the
+// multiplier of the cap on the stake-dependent part
+func DifficultyWithBounds(signature []byte, StakeSum float64, StakeMine float64, MiningDifficulty uint64, floor uint64, capMultiplier float64) uint64 {
 	// Hash the signature to ensure uniform distribution
 	signatureHash := sha256.Sum256(signature)
 
@@ -148,13 +174,34 @@ func Difficulty(signature []byte, StakeSum float64, StakeMine float64, MiningDif
 	rm := math.Log(float64(value) / float64(^uint64(0)))
 	t := math.Log(1 - float64(StakeMine/(StakeSum*float64(MiningDifficulty))))
 
-	diff := uint64(rm / t)
+	// A stake share too small to move the logarithm needs unboundedly many iterations
+	quotient := math.Inf(1)
+	if t != 0 {
+		quotient = rm / t
+	}
+	diff := saturatingUint64(quotient)
 
-	// Ensure diff is smaller than 10 * MiningDifficulty
-	maxDiff := uint64(float64(MiningDifficulty) * (10 * StakeSum / StakeMine))
+	// Ensure diff is smaller than capMultiplier * MiningDifficulty
+	maxDiff := saturatingUint64(float64(MiningDifficulty) * (capMultiplier * StakeSum / StakeMine))
 	if diff > maxDiff {
 		diff = maxDiff
 	}
 
-	return 100 + diff
+	if diff > math.MaxUint64-floor {
+		return math.MaxUint64
+	}
+	return floor + diff
+}
+
+// saturatingUint64 converts f to uint64, values out of range or NaN give the nearest bound
+// instead of the platform-dependent result of a plain conversion. A zero stake makes the
+// difficulty infinite.
+func saturatingUint64(f float64) uint64 {
+	switch {
+	case !(f > 0):
+		return 0
+	case f >= math.MaxUint64:
+		return math.MaxUint64
+	}
+	return uint64(f)
 }
@@ -5,12 +5,17 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
 	"math/big"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/nanlour/da/src/block"
 	"github.com/nanlour/da/src/vdf_go"
 )
 
@@ -152,6 +157,71 @@ func TestDifficulty(t *testing.T) {
 	}
 }
 
+// TestDifficultySaturates verifies a zero stake and a huge floor give the largest difficulty
+// instead of wrapping around
+func TestDifficultySaturates(t *testing.T) {
+	signature := []byte("test signature")
+	if diff := DifficultyWithBounds(signature, 1000, 0, 10, 100, 10); diff != math.MaxUint64 {
+		t.Errorf("Difficulty with zero stake = %d, expected %d", diff, uint64(math.MaxUint64))
+	}
+	if diff := DifficultyWithBounds(signature, 1000, 1e-300, 10, math.MaxUint64-1, 10); diff != math.MaxUint64 {
+		t.Errorf("Difficulty above the floor overflowed to %d", diff)
+	}
+}
+
+// TestDifficultyBounds verifies the floor and cap multiplier are respected
+func TestDifficultyBounds(t *testing.T) {
+	stakeSum := 1000.0
+	stakeMine := 100.0
+	miningDifficulty := uint64(10)
+
+	privateKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	epochHash := sha256.Sum256([]byte("epoch hash for testing"))
+
+	floor := uint64(5)
+	capMultiplier := 2.0
+	maxDiff := floor + uint64(float64(miningDifficulty)*capMultiplier*stakeSum/stakeMine)
+
+	var min, max uint64
+	min = ^uint64(0)
+	for i := 0; i < 1000; i++ {
+		seed := DifficultySeed(&epochHash, uint64(i))
+		signature, err := Sign(privateKey, seed[:])
+		if err != nil {
+			t.Fatalf("Failed to sign seed in iteration %d: %v", i, err)
+		}
+
+		// The defaults match Difficulty
+		if Difficulty(signature, stakeSum, stakeMine, miningDifficulty) !=
+			DifficultyWithBounds(signature, stakeSum, stakeMine, miningDifficulty, DefaultDifficultyFloor, DefaultDifficultyCapMultiplier) {
+			t.Fatalf("Difficulty should use the default bounds")
+		}
+
+		diff := DifficultyWithBounds(signature, stakeSum, stakeMine, miningDifficulty, floor, capMultiplier)
+		if diff < min {
+			min = diff
+		}
+		if diff > max {
+			max = diff
+		}
+
+		// A zero cap leaves only the floor
+		if capped := DifficultyWithBounds(signature, stakeSum, stakeMine, miningDifficulty, floor, 0); capped != floor {
+			t.Fatalf("Difficulty with zero cap should equal the floor, got %d", capped)
+		}
+	}
+
+	if min < floor {
+		t.Errorf("Difficulty %d is below the floor %d", min, floor)
+	}
+	if max != maxDiff {
+		t.Errorf("Difficulty should reach but not exceed the cap %d, max was %d", maxDiff, max)
+	}
+}
+
 // TestDifficultyStatistics runs statistical tests on the difficulty calculation
 func TestDifficultyStatistics(t *testing.T) {
 	// Set up parameters
@@ -437,3 +507,164 @@ func TestInvalidPublicKey(t *testing.T) {
 		t.Error("BytesToPublicKey should return an error for invalid public key")
 	}
 }
+
+// TestSignLowS checks Sign only produces low-S signatures and Verify rejects
+// the malleated high-S form of a valid signature
+func TestSignLowS(t *testing.T) {
+	privateKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	n := elliptic.P256().Params().N
+
+	for i := 0; i < 50; i++ {
+		message := []byte(fmt.Sprintf("message %d", i))
+		signature, err := Sign(privateKey, message)
+		if err != nil {
+			t.Fatalf("Failed to sign message: %v", err)
+		}
+
+		s := new(big.Int).SetBytes(signature[32:])
+		if !block.IsLowS(s) {
+			t.Fatalf("Sign produced high S %v", s)
+		}
+
+		// The malleated signature (r, n-s) is valid ECDSA but must be rejected
+		malleated := make([]byte, 64)
+		copy(malleated, signature[:32])
+		new(big.Int).Sub(n, s).FillBytes(malleated[32:])
+		hash := sha256.Sum256(message)
+		r := new(big.Int).SetBytes(signature[:32])
+		if !ecdsa.Verify(&privateKey.PublicKey, hash[:], r, new(big.Int).Sub(n, s)) {
+			t.Fatal("Malleated signature should still be valid ECDSA")
+		}
+		if Verify(&privateKey.PublicKey, message, malleated) {
+			t.Error("Verify accepted a high-S signature")
+		}
+		if !Verify(&privateKey.PublicKey, message, signature) {
+			t.Error("Verify rejected the low-S signature")
+		}
+	}
+}
+
+// TestPublicKeyEdgeEncodings checks the point at infinity and out-of-field
+// coordinates are rejected with a descriptive error
+func TestPublicKeyEdgeEncodings(t *testing.T) {
+	key, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	valid := PublicKeyToBytes(&key.PublicKey)
+
+	var prime [32]byte
+	elliptic.P256().Params().P.FillBytes(prime[:])
+
+	zeroX := valid
+	copy(zeroX[:32], make([]byte, 32))
+	zeroY := valid
+	copy(zeroY[32:], make([]byte, 32))
+	primeX := valid
+	copy(primeX[:32], prime[:])
+	primeY := valid
+	copy(primeY[32:], prime[:])
+
+	tests := []struct {
+		name  string
+		input [64]byte
+		want  string
+	}{
+		{"all zero", [64]byte{}, "zero coordinate"},
+		{"zero X", zeroX, "zero coordinate"},
+		{"zero Y", zeroY, "zero coordinate"},
+		{"X equals field prime", primeX, "field prime"},
+		{"Y equals field prime", primeY, "field prime"},
+	}
+	for _, tt := range tests {
+		_, err := BytesToPublicKey(tt.input)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: BytesToPublicKey error = %v, want it to mention %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+// TestAddressEncoding checks encoded and raw hex addresses parse to the same bytes
+func TestAddressEncoding(t *testing.T) {
+	address := sha256.Sum256([]byte("address"))
+	encoded := EncodeAddress(address)
+	if len(encoded) != EncodedAddressLen {
+		t.Fatalf("Encoded address has length %d, want %d", len(encoded), EncodedAddressLen)
+	}
+
+	for _, s := range []string{encoded, " " + encoded + "\n", fmt.Sprintf("%x", address)} {
+		parsed, err := ParseAddress(s)
+		if err != nil {
+			t.Fatalf("ParseAddress(%q) failed: %v", s, err)
+		}
+		if parsed != address {
+			t.Errorf("ParseAddress(%q) = %x, want %x", s, parsed, address)
+		}
+	}
+}
+
+// TestAddressEncodingErrors checks mistyped and truncated addresses are told apart
+func TestAddressEncodingErrors(t *testing.T) {
+	address := sha256.Sum256([]byte("address"))
+	encoded := EncodeAddress(address)
+
+	// Change one hex digit of the address part
+	corrupted := []byte(encoded)
+	if corrupted[10] == '0' {
+		corrupted[10] = '1'
+	} else {
+		corrupted[10] = '0'
+	}
+
+	tests := []struct {
+		input string
+		want  error
+	}{
+		{string(corrupted), ErrAddressChecksum},
+		{encoded[:len(encoded)-1], ErrAddressLength},
+		{fmt.Sprintf("%x", address[:31]), ErrAddressLength},
+	}
+	for _, tt := range tests {
+		_, err := ParseAddress(tt.input)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("ParseAddress(%q) error = %v, want %v", tt.input, err, tt.want)
+		}
+	}
+
+	if _, err := ParseAddress(AddressPrefix + strings.Repeat("zz", 36)); err == nil {
+		t.Error("ParseAddress accepted non-hex characters")
+	}
+}
+
+// TestDifficultySeedMatchesBlockHeight verifies that the difficulty seed and the block hash
+// encode a height to the same big-endian bytes
+func TestDifficultySeedMatchesBlockHeight(t *testing.T) {
+	epochHash := sha256.Sum256([]byte("test epoch hash"))
+	height := uint64(0x0102030405060708)
+	want := binary.BigEndian.AppendUint64(nil, height)
+
+	if got := block.EncodeUint64(height); !bytes.Equal(got, want) {
+		t.Fatalf("EncodeUint64(%#x) = %x, expected %x", height, got, want)
+	}
+
+	if seed := DifficultySeed(&epochHash, height); seed != sha256.Sum256(append(epochHash[:], want...)) {
+		t.Errorf("DifficultySeed does not hash the height as %x", want)
+	}
+
+	b := &block.Block{PreHash: [32]byte{1}, Height: height, EpochBeginHash: epochHash}
+	txnHash := b.Txn.Hash()
+	var buf bytes.Buffer
+	buf.Write(b.PreHash[:])
+	buf.Write(want)
+	buf.Write(b.EpochBeginHash[:])
+	buf.Write(txnHash[:])
+	buf.Write(make([]byte, 8)) // Zero amount
+	buf.Write(b.Signature[:])
+	buf.Write(b.PublicKey[:])
+	if b.HashwithoutProof() != sha256.Sum256(buf.Bytes()) {
+		t.Errorf("Block hash does not encode the height as %x", want)
+	}
+}
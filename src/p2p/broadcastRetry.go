@@ -0,0 +1,106 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBroadcastTTL is how long a broadcast made while no peer listens is retried
+	DefaultBroadcastTTL = 2 * time.Minute
+
+	broadcastRetryInterval = time.Second
+	maxPendingBroadcasts   = 256
+)
+
+type pendingBroadcast struct {
+	topic   string
+	data    []byte
+	expires time.Time
+}
+
+// broadcastRetry holds broadcasts made while no peer was subscribed to their topic and
+// publishes them again once one is. Broadcasts still waiting after the TTL are dropped, as are
+// the oldest ones when too many are waiting.
+type broadcastRetry struct {
+	transport Transport
+	ttl       time.Duration
+	mu        sync.Mutex
+	pending   []pendingBroadcast
+	wake      chan struct{}
+}
+
+func newBroadcastRetry(transport Transport, ttl time.Duration) *broadcastRetry {
+	return &broadcastRetry{transport: transport, ttl: ttl, wake: make(chan struct{}, 1)}
+}
+
+// add queues a broadcast for another attempt
+func (r *broadcastRetry) add(topic string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.pending) == maxPendingBroadcasts {
+		fmt.Printf("Too many broadcasts waiting for peers, dropping the oldest on %s\n", r.pending[0].topic)
+		r.pending = r.pending[1:]
+	}
+	r.pending = append(r.pending, pendingBroadcast{topic: topic, data: data, expires: time.Now().Add(r.ttl)})
+}
+
+// notify asks for an attempt now rather than at the next interval, it never blocks
+func (r *broadcastRetry) notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run retries pending broadcasts every interval and when notified until ctx is done
+func (r *broadcastRetry) run(ctx context.Context) {
+	ticker := time.NewTicker(broadcastRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.wake:
+		}
+		r.flush(ctx, time.Now())
+	}
+}
+
+// flush publishes the pending broadcasts whose topic has a subscribed peer and drops the expired ones
+func (r *broadcastRetry) flush(ctx context.Context, now time.Time) {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = nil
+	r.mu.Unlock()
+
+	var waiting []pendingBroadcast
+	for _, b := range pending {
+		if now.After(b.expires) {
+			fmt.Printf("Dropping broadcast on %s, no peer subscribed within %s\n", b.topic, r.ttl)
+			continue
+		}
+		if len(r.transport.TopicPeers(b.topic)) == 0 {
+			waiting = append(waiting, b)
+			continue
+		}
+		if err := r.transport.Broadcast(ctx, b.topic, b.data); err != nil {
+			fmt.Printf("Error retrying broadcast on %s: %s\n", b.topic, err)
+			waiting = append(waiting, b)
+		}
+	}
+
+	// Keep the order, broadcasts added meanwhile are newer
+	r.mu.Lock()
+	r.pending = append(waiting, r.pending...)
+	r.mu.Unlock()
+}
+
+func (r *broadcastRetry) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.pending)
+}
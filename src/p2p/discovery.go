@@ -1,7 +1,10 @@
 package p2p
 
 import (
+	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	dht "github.com/libp2p/go-libp2p-kad-dht"
@@ -13,14 +16,19 @@ import (
 // DiscoveryInterval is how often we re-publish our mDNS records.
 const DiscoveryInterval = 10 * time.Second
 
+// DefaultBootstrapTimeout bounds the initial attempt to reach the bootstrap peers
+const DefaultBootstrapTimeout = 30 * time.Second
+
 // DiscoveryServiceTag is used in our mDNS advertisements to discover other peers.
 const DiscoveryServiceTag = "da-p2p-discovery"
 
 // setupDiscovery configures peer discovery mechanisms
 func (s *Service) setupDiscovery() error {
-	// Setup mDNS discovery
-	if err := s.setupMDNS(); err != nil {
-		return err
+	// Setup mDNS discovery, off unless enabled since it connects to every node on the LAN
+	if s.mdnsEnabled {
+		if err := s.setupMDNS(); err != nil {
+			return err
+		}
 	}
 
 	// Setup DHT discovery
@@ -57,17 +65,20 @@ func (n *discoveryNotifee) HandlePeerFound(pi peer.AddrInfo) {
 		return
 	}
 
-	n.s.peersMu.Lock()
-	n.s.peers[pi.ID] = pi
-	n.s.peersMu.Unlock()
-
 	// Connect to the newly discovered peer
-	err := n.s.host.Connect(n.s.ctx, pi)
+	err := n.s.transport.Connect(n.s.ctx, pi)
 	if err != nil {
 		fmt.Printf("Error connecting to peer %s: %s\n", pi.ID.String(), err)
 		return
 	}
 
+	// Nodes of other networks on the LAN are found too, they only become peers once the
+	// handshake accepts them
+	if err := n.s.handshake(pi.ID); err != nil {
+		fmt.Printf("Handshake with peer %s failed: %s\n", pi.ID.String(), err)
+		return
+	}
+
 	fmt.Printf("%s Connected to peer: %s\n", n.s.host.ID(), pi.ID.String())
 }
 
@@ -87,16 +98,25 @@ func (s *Service) setupDHT() error {
 	// Add DHT to service for later use
 	s.dht = kdht
 
-	// Connect to bootstrap nodes if specified
-	if len(s.bootstrapPeers) > 0 {
-		go s.connectToBootstrapPeers()
-	}
+	// Bootstrap peers are reached in the background, Start does not wait for them
+	go s.connectToBootstrapPeers()
 
 	return nil
 }
 
-// connectToBootstrapPeers tries to connect to the bootstrap peers
+// connectToBootstrapPeers dials every bootstrap peer at once and gives up on those not
+// reached within the bootstrap timeout
 func (s *Service) connectToBootstrapPeers() {
+	defer close(s.bootstrapped)
+	if len(s.bootstrapPeers) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, s.bootstrapTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var connected atomic.Int32
 	for _, peerAddr := range s.bootstrapPeers {
 		pi, err := peer.AddrInfoFromP2pAddr(peerAddr)
 		if err != nil {
@@ -104,19 +124,39 @@ func (s *Service) connectToBootstrapPeers() {
 			continue
 		}
 
-		s.peersMu.Lock()
-		s.peers[pi.ID] = *pi
-		s.peersMu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.host.Connect(ctx, *pi); err != nil {
+				fmt.Printf("Failed to connect to bootstrap node %s: %s\n", pi.ID, err)
+			} else if err := s.handshake(pi.ID); err != nil {
+				fmt.Printf("Handshake with bootstrap node %s failed: %s\n", pi.ID, err)
+			} else {
+				connected.Add(1)
+				fmt.Printf("Connected to bootstrap node: %s\n", pi.ID)
+			}
+		}()
+	}
+	wg.Wait()
 
-		err = s.host.Connect(s.ctx, *pi)
-		if err != nil {
-			fmt.Printf("Failed to connect to bootstrap node %s: %s\n", pi.ID, err)
-		} else {
-			fmt.Printf("Connected to bootstrap node: %s\n", pi.ID)
-		}
+	if n := connected.Load(); n > 0 {
+		fmt.Printf("Bootstrap finished, connected to %d of %d bootstrap peers\n", n, len(s.bootstrapPeers))
+	} else {
+		fmt.Printf("Bootstrap gave up, none of the %d bootstrap peers was reached within %s\n", len(s.bootstrapPeers), s.bootstrapTimeout)
 	}
 }
 
+// SetMDNS turns discovery of peers on the local network on or off, it must be called before Start
+func (s *Service) SetMDNS(enabled bool) {
+	s.mdnsEnabled = enabled
+}
+
+// SetBootstrapTimeout bounds the initial attempt to reach the bootstrap peers, it must be
+// called before Start
+func (s *Service) SetBootstrapTimeout(timeout time.Duration) {
+	s.bootstrapTimeout = timeout
+}
+
 // AddBootstrapPeer adds a peer multiaddress to the bootstrap list
 func (s *Service) AddBootstrapPeer(addr string) error {
 	maddr, err := multiaddr.NewMultiaddr(addr)
@@ -0,0 +1,80 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Defaults NewService applies to its gossip queues
+const (
+	DefaultGossipQueueSize = 256
+	DefaultGossipWorkers   = 1
+)
+
+// GossipQueueStats reports the state of one topic's queue
+type GossipQueueStats struct {
+	Depth   int    // Messages waiting for a worker
+	Dropped uint64 // Messages dropped because the queue was full
+}
+
+type gossipMessage struct {
+	from peer.ID
+	data []byte
+}
+
+// gossipQueue decouples a subscription from its handler. The subscription only enqueues, so
+// a slow handler backs up this topic's queue instead of the pubsub buffer, and messages
+// arriving while the queue is full are dropped.
+type gossipQueue struct {
+	topic   string
+	handler func(from peer.ID, data []byte)
+	queue   chan gossipMessage
+	dropped atomic.Uint64
+}
+
+// newGossipQueue starts workers handling the queue until ctx is done, counted in running
+func newGossipQueue(ctx context.Context, running *sync.WaitGroup, topic string, size int, workers int, handler func(from peer.ID, data []byte)) *gossipQueue {
+	q := &gossipQueue{
+		topic:   topic,
+		handler: handler,
+		queue:   make(chan gossipMessage, size),
+	}
+	for range max(workers, 1) {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			q.work(ctx)
+		}()
+	}
+	return q
+}
+
+func (q *gossipQueue) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-q.queue:
+			q.handler(msg.from, msg.data)
+		}
+	}
+}
+
+// enqueue is the subscription handler, it never blocks
+func (q *gossipQueue) enqueue(from peer.ID, data []byte) {
+	select {
+	case q.queue <- gossipMessage{from: from, data: data}:
+	default:
+		if dropped := q.dropped.Add(1); dropped == 1 || dropped%100 == 0 {
+			fmt.Printf("Gossip queue for %s is full, %d message(s) dropped so far\n", q.topic, dropped)
+		}
+	}
+}
+
+func (q *gossipQueue) stats() GossipQueueStats {
+	return GossipQueueStats{Depth: len(q.queue), Dropped: q.dropped.Load()}
+}
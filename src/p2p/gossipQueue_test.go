@@ -0,0 +1,80 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/nanlour/da/src/block"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowBlockchain blocks in AddBlock until released and reports every transaction it receives
+type slowBlockchain struct {
+	*MockBlockchain
+	release chan struct{}
+	txns    chan *block.Transaction
+}
+
+func (s *slowBlockchain) AddBlock(b *P2PBlock) error {
+	<-s.release
+	return s.MockBlockchain.AddBlock(b)
+}
+
+func (s *slowBlockchain) AddTxn(txn *block.Transaction) error {
+	s.txns <- txn
+	return nil
+}
+
+// TestGossipQueueSlowBlockHandler tests that a stalled block handler neither blocks the
+// sender nor transaction processing, and that blocks beyond the queue are dropped
+func TestGossipQueueSlowBlockHandler(t *testing.T) {
+	network := NewMemoryNetwork()
+	slow := &slowBlockchain{
+		MockBlockchain: NewMockBlockchain(),
+		release:        make(chan struct{}),
+		txns:           make(chan *block.Transaction, 1),
+	}
+
+	transport, err := network.NewTransport()
+	require.NoError(t, err)
+	receiver := NewServiceWithTransport(transport, slow)
+	receiver.SetGossipQueue(2, 1)
+	require.NoError(t, receiver.Start())
+	t.Cleanup(func() { receiver.Stop() })
+
+	sender := newMemoryService(t, network, NewMockBlockchain(), "")
+	require.NoError(t, sender.ConnectPeer(peer.AddrInfo{ID: receiver.ID()}))
+
+	// The first block stalls the worker. The memory network delivers inline, so the
+	// broadcasts would hang here without the queue.
+	require.NoError(t, sender.BroadcastBlock(&block.Block{Height: 1}))
+	require.Eventually(t, func() bool {
+		return receiver.GossipStats()[blockTopic].Depth == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Two more fill the queue and the rest are dropped
+	for height := uint64(2); height <= 5; height++ {
+		require.NoError(t, sender.BroadcastBlock(&block.Block{Height: height}))
+	}
+	assert.Equal(t, GossipQueueStats{Depth: 2, Dropped: 2}, receiver.GossipStats()[blockTopic])
+
+	tx := &block.Transaction{Height: 7, Amount: 3}
+	require.NoError(t, sender.BroadcastTransaction(tx))
+	select {
+	case received := <-slow.txns:
+		assert.Equal(t, *tx, *received)
+	case <-time.After(5 * time.Second):
+		t.Fatal("transaction was not handled while the block handler was stalled")
+	}
+
+	// Released, the queued blocks are handled
+	close(slow.release)
+	require.Eventually(t, func() bool {
+		slow.blocksMutex.RLock()
+		defer slow.blocksMutex.RUnlock()
+		return len(slow.blocks) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, GossipQueueStats{Depth: 0, Dropped: 2}, receiver.GossipStats()[blockTopic])
+}
@@ -0,0 +1,272 @@
+package p2p
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// MemoryNetwork links memory transports in the same process, broadcasts are delivered
+// synchronously to every connected subscriber before Broadcast returns
+type MemoryNetwork struct {
+	mu         sync.RWMutex
+	transports map[peer.ID]*memoryTransport
+}
+
+// NewMemoryNetwork creates an empty in-process network
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{transports: make(map[peer.ID]*memoryTransport)}
+}
+
+// NewTransport adds a transport with a fresh peer ID to the network
+func (n *MemoryNetwork) NewTransport() (Transport, error) {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &memoryTransport{
+		net:         n,
+		id:          id,
+		peers:       make(map[peer.ID]bool),
+		handlers:    make(map[protocol.ID]StreamHandler),
+		subscribers: make(map[string][]func(peer.ID, []byte)),
+	}
+
+	n.mu.Lock()
+	n.transports[id] = t
+	n.mu.Unlock()
+	return t, nil
+}
+
+func (n *MemoryNetwork) lookup(id peer.ID) (*memoryTransport, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	t, ok := n.transports[id]
+	return t, ok
+}
+
+type memoryTransport struct {
+	net         *MemoryNetwork
+	id          peer.ID
+	mu          sync.RWMutex
+	closed      bool
+	peers       map[peer.ID]bool
+	handlers    map[protocol.ID]StreamHandler
+	connHandler ConnHandler
+	subscribers map[string][]func(peer.ID, []byte)
+}
+
+var errPeerUnreachable = errors.New("peer not reachable")
+
+func (t *memoryTransport) ID() peer.ID {
+	return t.id
+}
+
+func (t *memoryTransport) Connect(ctx context.Context, pi peer.AddrInfo) error {
+	remote, ok := t.net.lookup(pi.ID)
+	if !ok || remote == t || remote.isClosed() || t.isClosed() {
+		return errPeerUnreachable
+	}
+
+	t.setPeer(pi.ID, network.DirOutbound, true)
+	remote.setPeer(t.id, network.DirInbound, true)
+	return nil
+}
+
+func (t *memoryTransport) ClosePeer(peerID peer.ID) error {
+	t.setPeer(peerID, network.DirUnknown, false)
+	if remote, ok := t.net.lookup(peerID); ok {
+		remote.setPeer(t.id, network.DirUnknown, false)
+	}
+	return nil
+}
+
+func (t *memoryTransport) Peers() []peer.ID {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	peers := make([]peer.ID, 0, len(t.peers))
+	for id := range t.peers {
+		peers = append(peers, id)
+	}
+	return peers
+}
+
+func (t *memoryTransport) NewStream(ctx context.Context, peerID peer.ID, proto protocol.ID) (Stream, error) {
+	remote, ok := t.connected(peerID)
+	if !ok {
+		return nil, errPeerUnreachable
+	}
+
+	remote.mu.RLock()
+	handler, ok := remote.handlers[proto]
+	remote.mu.RUnlock()
+	if !ok {
+		return nil, errors.New("protocol not supported by peer")
+	}
+
+	// Two pipes give each side its own half that can be closed independently
+	localRead, remoteWrite := io.Pipe()
+	remoteRead, localWrite := io.Pipe()
+	go handler(&memoryStream{reader: remoteRead, writer: remoteWrite, remote: t.id})
+	return &memoryStream{reader: localRead, writer: localWrite, remote: peerID}, nil
+}
+
+func (t *memoryTransport) SetStreamHandler(proto protocol.ID, handler StreamHandler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handlers[proto] = handler
+}
+
+func (t *memoryTransport) SetConnHandler(handler ConnHandler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.connHandler = handler
+}
+
+func (t *memoryTransport) Broadcast(ctx context.Context, topic string, data []byte) error {
+	t.mu.RLock()
+	_, subscribed := t.subscribers[topic]
+	peers := make([]peer.ID, 0, len(t.peers))
+	for id, up := range t.peers {
+		if up {
+			peers = append(peers, id)
+		}
+	}
+	t.mu.RUnlock()
+	if !subscribed {
+		return errors.New("pubsub not initialized")
+	}
+
+	for _, id := range peers {
+		remote, ok := t.connected(id)
+		if !ok {
+			continue
+		}
+		remote.mu.RLock()
+		handlers := remote.subscribers[topic]
+		remote.mu.RUnlock()
+
+		for _, handler := range handlers {
+			handler(t.id, append([]byte(nil), data...))
+		}
+	}
+	return nil
+}
+
+func (t *memoryTransport) Subscribe(ctx context.Context, topic string, handler func(from peer.ID, data []byte)) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.subscribers[topic] = append(t.subscribers[topic], handler)
+	return nil
+}
+
+func (t *memoryTransport) TopicPeers(topic string) []peer.ID {
+	var peers []peer.ID
+	for _, id := range t.Peers() {
+		remote, ok := t.connected(id)
+		if !ok {
+			continue
+		}
+		remote.mu.RLock()
+		_, subscribed := remote.subscribers[topic]
+		remote.mu.RUnlock()
+		if subscribed {
+			peers = append(peers, id)
+		}
+	}
+	return peers
+}
+
+func (t *memoryTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	peers := t.peers
+	t.peers = make(map[peer.ID]bool)
+	t.subscribers = make(map[string][]func(peer.ID, []byte))
+	t.mu.Unlock()
+
+	for id := range peers {
+		if remote, ok := t.net.lookup(id); ok {
+			remote.setPeer(t.id, network.DirUnknown, false)
+		}
+	}
+	return nil
+}
+
+func (t *memoryTransport) isClosed() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.closed
+}
+
+// setPeer links or unlinks a peer, telling the connection handler when that changes anything
+func (t *memoryTransport) setPeer(id peer.ID, dir network.Direction, up bool) {
+	t.mu.Lock()
+	changed := t.peers[id] != up
+	if up {
+		t.peers[id] = true
+	} else {
+		delete(t.peers, id)
+	}
+	handler := t.connHandler
+	t.mu.Unlock()
+
+	if changed && handler != nil {
+		handler(id, dir, up)
+	}
+}
+
+// connected returns the remote transport if both sides are up and linked
+func (t *memoryTransport) connected(id peer.ID) (*memoryTransport, bool) {
+	t.mu.RLock()
+	up := t.peers[id] && !t.closed
+	t.mu.RUnlock()
+	if !up {
+		return nil, false
+	}
+
+	remote, ok := t.net.lookup(id)
+	if !ok || remote.isClosed() {
+		return nil, false
+	}
+	return remote, true
+}
+
+type memoryStream struct {
+	reader *io.PipeReader
+	writer *io.PipeWriter
+	remote peer.ID
+}
+
+func (s *memoryStream) Read(p []byte) (int, error) {
+	return s.reader.Read(p)
+}
+
+func (s *memoryStream) Write(p []byte) (int, error) {
+	return s.writer.Write(p)
+}
+
+func (s *memoryStream) CloseWrite() error {
+	return s.writer.Close()
+}
+
+func (s *memoryStream) Close() error {
+	s.writer.Close()
+	return s.reader.Close()
+}
+
+func (s *memoryStream) RemotePeer() peer.ID {
+	return s.remote
+}
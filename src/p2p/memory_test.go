@@ -0,0 +1,546 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/nanlour/da/src/block"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMemoryService starts a service on the memory network
+func newMemoryService(t *testing.T, network *MemoryNetwork, bc BlockchainInterface, networkID string) *Service {
+	return newMemoryServiceFormat(t, network, bc, networkID, DefaultWireFormat)
+}
+
+// newMemoryServiceFormat starts a service on the memory network gossiping in the given format
+func newMemoryServiceFormat(t *testing.T, network *MemoryNetwork, bc BlockchainInterface, networkID string, format WireFormat) *Service {
+	transport, err := network.NewTransport()
+	require.NoError(t, err)
+
+	service := NewServiceWithTransport(transport, bc)
+	service.SetNetworkID(networkID)
+	service.SetWireFormat(format)
+	require.NoError(t, service.Start())
+	t.Cleanup(func() { service.Stop() })
+	return service
+}
+
+// TestMemoryBlockBroadcast tests that blocks reach connected peers synchronously
+func TestMemoryBlockBroadcast(t *testing.T) {
+	network := NewMemoryNetwork()
+	mockBC1 := NewMockBlockchain()
+	mockBC2 := NewMockBlockchain()
+	mockBC3 := NewMockBlockchain()
+
+	service1 := newMemoryService(t, network, mockBC1, "")
+	service2 := newMemoryService(t, network, mockBC2, "")
+	newMemoryService(t, network, mockBC3, "")
+
+	require.NoError(t, service1.ConnectPeer(peer.AddrInfo{ID: service2.ID()}))
+
+	testBlock := &block.Block{
+		Height: 1,
+		Txn: block.Transaction{
+			Amount: 100,
+		},
+	}
+	require.NoError(t, service1.BroadcastBlock(testBlock))
+
+	// Delivery is synchronous, so no waiting is needed
+	blockHash := testBlock.Hash()
+	received, err := mockBC2.GetBlockByHash(blockHash[:])
+	require.NoError(t, err)
+	require.NotNil(t, received)
+	assert.Equal(t, testBlock.Height, received.Height)
+	assert.Equal(t, testBlock.Txn.Amount, received.Txn.Amount)
+
+	// The sender does not receive its own block and unconnected peers see nothing
+	assert.Empty(t, mockBC1.blocks)
+	assert.Empty(t, mockBC3.blocks)
+
+	// Broadcasts travel in both directions once connected
+	testBlock2 := &block.Block{Height: 2}
+	require.NoError(t, service2.BroadcastBlock(testBlock2))
+	blockHash2 := testBlock2.Hash()
+	received, err = mockBC1.GetBlockByHash(blockHash2[:])
+	require.NoError(t, err)
+	assert.NotNil(t, received)
+}
+
+// TestMemoryProtocolHandlers tests the request protocols over the memory transport
+func TestMemoryProtocolHandlers(t *testing.T) {
+	network := NewMemoryNetwork()
+	mockBC1 := NewMockBlockchain()
+	mockBC2 := NewMockBlockchain()
+
+	testBlock := &block.Block{Height: 1, Txn: block.Transaction{Amount: 100}}
+	testBlock2 := &block.Block{Height: 2, Txn: block.Transaction{Amount: 101}}
+	mockBC2.AddBlock(&P2PBlock{Block: *testBlock})
+	mockBC2.AddBlock(&P2PBlock{Block: *testBlock2})
+
+	service1 := newMemoryService(t, network, mockBC1, "")
+	service2 := newMemoryService(t, network, mockBC2, "")
+	require.NoError(t, service1.ConnectPeer(peer.AddrInfo{ID: service2.ID()}))
+	assert.Contains(t, service1.Peers(), service2.ID())
+
+	retrievedBlock, err := service1.GetBlockByHash(testBlock.Hash(), service2.ID())
+	require.NoError(t, err)
+	assert.Equal(t, testBlock.Txn.Amount, retrievedBlock.Txn.Amount)
+
+	retrievedBlock, err = service1.GetTip(service2.ID())
+	require.NoError(t, err)
+	assert.Equal(t, testBlock2.Height, retrievedBlock.Height)
+}
+
+// TestMemoryMissingBlockRejected tests that a response carrying neither a block nor an error
+// is an error rather than a nil block
+func TestMemoryMissingBlockRejected(t *testing.T) {
+	network := NewMemoryNetwork()
+
+	// The mock answers unknown hashes and an empty chain's tip with a null block
+	service1 := newMemoryService(t, network, NewMockBlockchain(), "")
+	service2 := newMemoryService(t, network, NewMockBlockchain(), "")
+	require.NoError(t, service1.ConnectPeer(peer.AddrInfo{ID: service2.ID()}))
+
+	b, err := service1.GetBlockByHash([32]byte{0xaa}, service2.ID())
+	assert.ErrorIs(t, err, errNoBlock)
+	assert.Nil(t, b)
+
+	b, err = service1.GetTip(service2.ID())
+	assert.ErrorIs(t, err, errNoBlock)
+	assert.Nil(t, b)
+}
+
+// TestMemoryOversizedBlocksDropped tests that gossiped blocks and responses above the size
+// limit are dropped before decoding while normal ones still arrive
+func TestMemoryOversizedBlocksDropped(t *testing.T) {
+	network := NewMemoryNetwork()
+	mockBC1 := NewMockBlockchain()
+	mockBC2 := NewMockBlockchain()
+
+	// Padding keeps a JSON encoding valid, so the size check alone has to drop it
+	service1 := newMemoryServiceFormat(t, network, mockBC1, "", WireJSON)
+	service2 := newMemoryServiceFormat(t, network, mockBC2, "", WireJSON)
+	require.NoError(t, service1.ConnectPeer(peer.AddrInfo{ID: service2.ID()}))
+
+	normal := &block.Block{Height: 1, Txn: block.Transaction{Amount: 100}}
+	data, err := json.Marshal(normal)
+	require.NoError(t, err)
+	require.NoError(t, service1.transport.Broadcast(service1.ctx, blockTopic, data))
+	normalHash := normal.Hash()
+	received, err := mockBC2.GetBlockByHash(normalHash[:])
+	require.NoError(t, err)
+	assert.NotNil(t, received)
+
+	// Still a valid encoding, padded past the limit
+	oversized := &block.Block{Height: 2}
+	data, err = json.Marshal(oversized)
+	require.NoError(t, err)
+	padded := append(data, bytes.Repeat([]byte(" "), block.MaxBlockSize(1))...)
+	require.NoError(t, service1.transport.Broadcast(service1.ctx, blockTopic, padded))
+	oversizedHash := oversized.Hash()
+	received, err = mockBC2.GetBlockByHash(oversizedHash[:])
+	require.NoError(t, err)
+	assert.Nil(t, received, "oversized block should be dropped")
+
+	// A response larger than the requester accepts fails to decode
+	mockBC1.AddBlock(&P2PBlock{Block: *normal})
+	_, err = service2.GetBlockByHash(normalHash, service1.ID())
+	require.NoError(t, err)
+	service2.SetMaxBlockSize(16)
+	_, err = service2.GetBlockByHash(normalHash, service1.ID())
+	assert.Error(t, err, "response above the limit should be rejected")
+}
+
+// panickingBlockchain panics when asked for the poison hash, as a handler bug hit by a
+// crafted request would
+type panickingBlockchain struct {
+	*MockBlockchain
+	poison [32]byte
+}
+
+func (p *panickingBlockchain) GetBlockByHash(hash []byte) (*block.Block, error) {
+	if [32]byte(hash) == p.poison {
+		var b *block.Block
+		_ = b.Height
+	}
+	return p.MockBlockchain.GetBlockByHash(hash)
+}
+
+// TestMemoryHandlerPanicRecovered tests that a panicking handler answers with an error and
+// the service keeps serving requests
+func TestMemoryHandlerPanicRecovered(t *testing.T) {
+	network := NewMemoryNetwork()
+	mockBC2 := &panickingBlockchain{MockBlockchain: NewMockBlockchain(), poison: [32]byte{0xde, 0xad}}
+	testBlock := &block.Block{Height: 1, Txn: block.Transaction{Amount: 100}}
+	mockBC2.AddBlock(&P2PBlock{Block: *testBlock})
+
+	service1 := newMemoryService(t, network, NewMockBlockchain(), "")
+	service2 := newMemoryService(t, network, mockBC2, "")
+	require.NoError(t, service1.ConnectPeer(peer.AddrInfo{ID: service2.ID()}))
+
+	_, err := service1.GetBlockByHash(mockBC2.poison, service2.ID())
+	assert.Error(t, err)
+	_, err = service1.GetBlocks(mockBC2.poison, 3, service2.ID())
+	assert.Error(t, err)
+	assert.Equal(t, uint64(2), service2.HandlerPanics())
+
+	retrievedBlock, err := service1.GetBlockByHash(testBlock.Hash(), service2.ID())
+	require.NoError(t, err)
+	assert.Equal(t, testBlock.Height, retrievedBlock.Height)
+	assert.Contains(t, service1.Peers(), service2.ID())
+}
+
+// TestMemoryGetBlocks tests fetching a batch of ancestors over the memory transport
+func TestMemoryGetBlocks(t *testing.T) {
+	network := NewMemoryNetwork()
+	mockBC2 := NewMockBlockchain()
+
+	var parent [32]byte
+	hashes := make([][32]byte, 5)
+	for height := range uint64(5) {
+		b := block.Block{Height: height, PreHash: parent}
+		mockBC2.AddBlock(&P2PBlock{Block: b})
+		hashes[height] = b.Hash()
+		parent = hashes[height]
+	}
+
+	service1 := newMemoryService(t, network, NewMockBlockchain(), "")
+	service2 := newMemoryService(t, network, mockBC2, "")
+	require.NoError(t, service1.ConnectPeer(peer.AddrInfo{ID: service2.ID()}))
+
+	blocks, err := service1.GetBlocks(hashes[4], 3, service2.ID())
+	require.NoError(t, err)
+	require.Len(t, blocks, 3)
+	for i, b := range blocks {
+		assert.Equal(t, hashes[4-i], b.Hash())
+	}
+
+	// The walk stops at genesis
+	blocks, err = service1.GetBlocks(hashes[2], 10, service2.ID())
+	require.NoError(t, err)
+	require.Len(t, blocks, 3)
+	assert.Equal(t, uint64(0), blocks[2].Height)
+
+	_, err = service1.GetBlocks([32]byte{0xaa}, 10, service2.ID())
+	assert.Error(t, err)
+}
+
+// TestMemoryGetBlocksAfter tests fetching the main chain following a block over the memory transport
+func TestMemoryGetBlocksAfter(t *testing.T) {
+	network := NewMemoryNetwork()
+	mockBC2 := NewMockBlockchain()
+
+	var parent [32]byte
+	hashes := make([][32]byte, 5)
+	for height := range uint64(5) {
+		b := block.Block{Height: height, PreHash: parent}
+		mockBC2.AddBlock(&P2PBlock{Block: b})
+		hashes[height] = b.Hash()
+		parent = hashes[height]
+	}
+	// A fork block that is stored but not on the main chain
+	fork := block.Block{Height: 2, PreHash: hashes[1], Txn: block.Transaction{Amount: 1}}
+	mockBC2.blocks[fork.Hash()] = &fork
+
+	service1 := newMemoryService(t, network, NewMockBlockchain(), "")
+	service2 := newMemoryService(t, network, mockBC2, "")
+	require.NoError(t, service1.ConnectPeer(peer.AddrInfo{ID: service2.ID()}))
+
+	blocks, err := service1.GetBlocksAfter(hashes[1], 2, service2.ID())
+	require.NoError(t, err)
+	require.Len(t, blocks, 2)
+	assert.Equal(t, hashes[2], blocks[0].Hash())
+	assert.Equal(t, hashes[3], blocks[1].Hash())
+
+	// The answer ends at the tip
+	blocks, err = service1.GetBlocksAfter(hashes[2], 10, service2.ID())
+	require.NoError(t, err)
+	require.Len(t, blocks, 2)
+	assert.Equal(t, hashes[4], blocks[1].Hash())
+
+	for _, hash := range [][32]byte{fork.Hash(), hashes[4], {0xaa}} {
+		_, err = service1.GetBlocksAfter(hash, 10, service2.ID())
+		assert.Error(t, err)
+	}
+}
+
+// TestMemoryWireFormats tests that blocks and transactions round-trip in either wire format,
+// byte for byte, and that binary gossip is far smaller
+func TestMemoryWireFormats(t *testing.T) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	txn := block.Transaction{FromAddress: [32]byte{1}, ToAddress: [32]byte{2}, Amount: 12.5, Height: 3, Nonce: 1}
+	txn.Sign(privKey)
+	sent := &block.Block{PreHash: [32]byte{9}, Height: 3, Txn: txn}
+	sent.Proof[515] = 1
+
+	sizes := map[WireFormat]int{}
+	for _, format := range []WireFormat{WireBinary, WireJSON} {
+		t.Run(string(format), func(t *testing.T) {
+			network := NewMemoryNetwork()
+			receiver := NewMockBlockchain()
+			service1 := newMemoryServiceFormat(t, network, NewMockBlockchain(), "", format)
+			service2 := newMemoryServiceFormat(t, network, receiver, "", format)
+			require.NoError(t, service1.ConnectPeer(peer.AddrInfo{ID: service2.ID()}))
+
+			require.NoError(t, service1.BroadcastBlock(sent))
+			hash := sent.Hash()
+			received, err := receiver.GetBlockByHash(hash[:])
+			require.NoError(t, err)
+			require.NotNil(t, received)
+			assert.Equal(t, *sent, *received)
+
+			require.NoError(t, service1.BroadcastTransaction(&txn))
+			assert.Equal(t, [][32]byte{txn.Hash()}, receiver.receivedTxns())
+
+			data, err := service1.encodeBlock(sent)
+			require.NoError(t, err)
+			sizes[format] = len(data)
+		})
+	}
+	assert.Less(t, 2*sizes[WireBinary], sizes[WireJSON])
+}
+
+// TestMemoryWireFormatMismatch tests that peers gossiping in another format are refused, and
+// that a peer announcing none is taken to gossip JSON
+func TestMemoryWireFormatMismatch(t *testing.T) {
+	network := NewMemoryNetwork()
+	binaryNode := newMemoryServiceFormat(t, network, NewMockBlockchain(), "", WireBinary)
+	jsonNode := newMemoryServiceFormat(t, network, NewMockBlockchain(), "", WireJSON)
+
+	assert.Error(t, binaryNode.ConnectPeer(peer.AddrInfo{ID: jsonNode.ID()}))
+	assert.Empty(t, binaryNode.Peers())
+
+	legacy := HandshakeMessage{Version: ProtocolVersion}
+	assert.NoError(t, jsonNode.checkHandshake(legacy))
+	assert.Error(t, binaryNode.checkHandshake(legacy))
+}
+
+// TestMemoryNetworkIDMismatch tests that the handshake disconnects peers from other networks
+func TestMemoryNetworkIDMismatch(t *testing.T) {
+	network := NewMemoryNetwork()
+	mockBC2 := NewMockBlockchain()
+
+	service1 := newMemoryService(t, network, NewMockBlockchain(), "alpha")
+	service2 := newMemoryService(t, network, mockBC2, "beta")
+
+	err := service1.ConnectPeer(peer.AddrInfo{ID: service2.ID()})
+	assert.Error(t, err)
+	assert.Empty(t, service1.Peers())
+	_, ok := service1.PeerHandshake(service2.ID())
+	assert.False(t, ok, "a refused peer's tip should not be recorded")
+
+	// Broadcasts no longer reach the dropped peer
+	require.NoError(t, service1.BroadcastBlock(&block.Block{Height: 1}))
+	assert.Empty(t, mockBC2.blocks)
+}
+
+// flakyTransport fails its first connection attempts, as many as failures
+type flakyTransport struct {
+	Transport
+	failures int
+}
+
+func (t *flakyTransport) Connect(ctx context.Context, pi peer.AddrInfo) error {
+	if t.failures > 0 {
+		t.failures--
+		return errPeerUnreachable
+	}
+	return t.Transport.Connect(ctx, pi)
+}
+
+// TestMemoryConnectRetried tests that a connection made on the last attempt still runs the
+// handshake, and that a peer on another network is refused whichever attempt reached it
+func TestMemoryConnectRetried(t *testing.T) {
+	network := NewMemoryNetwork()
+	remote := newMemoryService(t, network, NewMockBlockchain(), "beta")
+
+	for _, networkID := range []string{"beta", "alpha"} {
+		transport, err := network.NewTransport()
+		require.NoError(t, err)
+		service := NewServiceWithTransport(&flakyTransport{Transport: transport, failures: 2}, NewMockBlockchain())
+		service.SetNetworkID(networkID)
+		require.NoError(t, service.Start())
+		t.Cleanup(func() { service.Stop() })
+
+		err = service.ConnectPeer(peer.AddrInfo{ID: remote.ID()})
+		_, handshaken := service.PeerHandshake(remote.ID())
+		if networkID == "beta" {
+			require.NoError(t, err)
+			assert.True(t, handshaken)
+		} else {
+			assert.Error(t, err)
+			assert.False(t, handshaken)
+			assert.Empty(t, service.Peers())
+		}
+	}
+
+	// Three failed attempts give up
+	transport, err := network.NewTransport()
+	require.NoError(t, err)
+	service := NewServiceWithTransport(&flakyTransport{Transport: transport, failures: 3}, NewMockBlockchain())
+	service.SetNetworkID("beta")
+	require.NoError(t, service.Start())
+	t.Cleanup(func() { service.Stop() })
+	assert.ErrorIs(t, service.ConnectPeer(peer.AddrInfo{ID: remote.ID()}), errPeerUnreachable)
+}
+
+// TestMemoryHandshakeExchangesTips tests that connected peers learn each other's tip and the
+// one behind starts syncing from the one ahead
+func TestMemoryHandshakeExchangesTips(t *testing.T) {
+	network := NewMemoryNetwork()
+	behind := NewMockBlockchain()
+	ahead := NewMockBlockchain()
+	tip := &block.Block{Height: 7}
+	ahead.AddBlock(&P2PBlock{Block: *tip})
+
+	service1 := newMemoryService(t, network, behind, "alpha")
+	service2 := newMemoryService(t, network, ahead, "alpha")
+	require.NoError(t, service1.ConnectPeer(peer.AddrInfo{ID: service2.ID()}))
+
+	// Both sides have the other's handshake, the responder records it after replying
+	remote, ok := service1.PeerHandshake(service2.ID())
+	require.True(t, ok)
+	assert.Equal(t, HandshakeMessage{Version: ProtocolVersion, NetworkID: "alpha", WireFormat: WireBinary, TipHeight: 7, TipHash: tip.Hash()}, remote)
+	require.Eventually(t, func() bool {
+		remote, ok = service2.PeerHandshake(service1.ID())
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint64(0), remote.TipHeight)
+
+	// Only the node behind syncs
+	assert.Equal(t, []peer.ID{service2.ID()}, behind.syncedPeers())
+	assert.Empty(t, ahead.syncedPeers())
+}
+
+// TestMemoryVersionMismatch tests that peers announcing another protocol version are refused
+func TestMemoryVersionMismatch(t *testing.T) {
+	network := NewMemoryNetwork()
+	service1 := newMemoryService(t, network, NewMockBlockchain(), "alpha")
+	service2 := newMemoryService(t, network, NewMockBlockchain(), "alpha")
+
+	require.Error(t, service1.checkHandshake(HandshakeMessage{Version: ProtocolVersion + 1, NetworkID: "alpha"}))
+
+	// A peer on another version is dropped by the side receiving its handshake
+	require.NoError(t, service1.transport.Connect(service1.ctx, peer.AddrInfo{ID: service2.ID()}))
+	stream, err := service1.transport.NewStream(service1.ctx, service2.ID(), protocol.ID(handshakeProtocol))
+	require.NoError(t, err)
+	require.NoError(t, json.NewEncoder(stream).Encode(HandshakeMessage{Version: ProtocolVersion + 1, NetworkID: "alpha"}))
+	var response HandshakeMessage
+	require.NoError(t, json.NewDecoder(stream).Decode(&response))
+	stream.Close()
+	assert.Equal(t, uint32(ProtocolVersion), response.Version)
+
+	require.Eventually(t, func() bool {
+		_, err := service1.GetTip(service2.ID())
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond, "connection should be closed")
+	_, ok := service2.PeerHandshake(service1.ID())
+	assert.False(t, ok)
+}
+
+// TestMemoryBroadcastBeforeStart tests that broadcasting requires a started service
+func TestMemoryBroadcastBeforeStart(t *testing.T) {
+	transport, err := NewMemoryNetwork().NewTransport()
+	require.NoError(t, err)
+
+	service := NewServiceWithTransport(transport, NewMockBlockchain())
+	assert.Error(t, service.BroadcastBlock(&block.Block{}))
+}
+
+// TestMemoryTxnBroadcastRetried tests that a transaction broadcast before any peer is connected
+// reaches the first peer to join
+func TestMemoryTxnBroadcastRetried(t *testing.T) {
+	network := NewMemoryNetwork()
+	mockBC2 := NewMockBlockchain()
+	service1 := newMemoryService(t, network, NewMockBlockchain(), "")
+	service2 := newMemoryService(t, network, mockBC2, "")
+
+	txn := &block.Transaction{Amount: 5}
+	require.NoError(t, service1.BroadcastTransaction(txn))
+	assert.Empty(t, mockBC2.receivedTxns())
+	assert.Equal(t, 1, service1.retry.len())
+
+	require.NoError(t, service1.ConnectPeer(peer.AddrInfo{ID: service2.ID()}))
+	require.Eventually(t, func() bool {
+		return len(mockBC2.receivedTxns()) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, [][32]byte{txn.Hash()}, mockBC2.receivedTxns())
+	assert.Equal(t, 0, service1.retry.len())
+
+	// With a peer listening nothing is left to retry
+	require.NoError(t, service1.BroadcastTransaction(&block.Transaction{Amount: 6}))
+	assert.Equal(t, 0, service1.retry.len())
+	assert.Len(t, mockBC2.receivedTxns(), 2)
+}
+
+// TestMemoryTxnBroadcastExpires tests that a broadcast nobody heard within the TTL is dropped
+func TestMemoryTxnBroadcastExpires(t *testing.T) {
+	network := NewMemoryNetwork()
+	mockBC2 := NewMockBlockchain()
+	service1 := newMemoryService(t, network, NewMockBlockchain(), "")
+	service2 := newMemoryService(t, network, mockBC2, "")
+
+	require.NoError(t, service1.BroadcastTransaction(&block.Transaction{Amount: 5}))
+	service1.retry.flush(service1.ctx, time.Now().Add(DefaultBroadcastTTL+time.Second))
+	assert.Equal(t, 0, service1.retry.len())
+
+	require.NoError(t, service1.ConnectPeer(peer.AddrInfo{ID: service2.ID()}))
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, mockBC2.receivedTxns())
+}
+
+// TestMemoryStatusAnnounced tests that peers learn each other's tip from status gossip once it
+// moves past the one sent in the handshake, and that a peer announcing too often is ignored
+func TestMemoryStatusAnnounced(t *testing.T) {
+	network := NewMemoryNetwork()
+	ahead := NewMockBlockchain()
+
+	behind := NewMockBlockchain()
+	service1 := newMemoryService(t, network, behind, "alpha")
+	transport, err := network.NewTransport()
+	require.NoError(t, err)
+	service2 := NewServiceWithTransport(transport, ahead)
+	service2.SetNetworkID("alpha")
+	service2.SetStatusInterval(20 * time.Millisecond)
+	require.NoError(t, service2.Start())
+	t.Cleanup(func() { service2.Stop() })
+	require.NoError(t, service1.ConnectPeer(peer.AddrInfo{ID: service2.ID()}))
+
+	status, ok := service1.PeerStatus(service2.ID())
+	require.True(t, ok)
+	assert.Equal(t, uint64(0), status.TipHeight)
+
+	tip := &block.Block{Height: 9}
+	ahead.AddBlock(&P2PBlock{Block: *tip})
+	require.Eventually(t, func() bool {
+		status, _ = service1.PeerStatus(service2.ID())
+		return status.TipHeight == 9
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, tip.Hash(), status.TipHash)
+
+	// A second status right after the first is dropped
+	service1.handleStatusMessage(service2.ID(), []byte(`{"tip_height":11}`))
+	status, _ = service1.PeerStatus(service2.ID())
+	assert.Equal(t, uint64(9), status.TipHeight)
+
+	// Peers that never completed a handshake are not recorded
+	service1.handleStatusMessage(peer.ID("stranger"), []byte(`{"tip_height":11}`))
+	_, ok = service1.PeerStatus(peer.ID("stranger"))
+	assert.False(t, ok)
+
+	// The new tip was handed to the blockchain once, repeating it is no news
+	time.Sleep(minStatusSpacing + 100*time.Millisecond)
+	assert.Equal(t, []StatusMessage{{TipHeight: 9, TipHash: tip.Hash()}}, behind.announcedTips())
+}
@@ -2,12 +2,16 @@ package p2p
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/p2p/security/noise"
 	"github.com/multiformats/go-multiaddr"
@@ -16,15 +20,30 @@ import (
 
 // Service represents the P2P networking service
 type Service struct {
-	host           host.Host
-	ctx            context.Context
-	cancel         context.CancelFunc
-	peersMu        sync.RWMutex
-	peers          map[peer.ID]peer.AddrInfo
-	pubsubMgr      *PubSubManager
-	blockchain     BlockchainInterface
-	dht            *dht.IpfsDHT
-	bootstrapPeers []multiaddr.Multiaddr
+	host             host.Host // Nil unless the service runs over libp2p
+	transport        Transport
+	ctx              context.Context
+	cancel           context.CancelFunc
+	peersMu          sync.RWMutex
+	peerHandshakes   map[peer.ID]HandshakeMessage  // Handshake of each accepted peer, guarded by peersMu
+	peerDirections   map[peer.ID]network.Direction // Who dialled each connected peer, guarded by peersMu
+	blockchain       BlockchainInterface
+	dht              *dht.IpfsDHT
+	bootstrapPeers   []multiaddr.Multiaddr
+	networkID        string // Scopes pubsub topics and is checked in the handshake
+	gossipQueueSize  int    // Messages buffered per topic, zero handles them inline
+	gossipWorkers    int    // Handlers draining each topic's queue
+	gossipQueues     map[string]*gossipQueue
+	handlerPanics    atomic.Uint64 // Stream handler panics recovered so far
+	maxBlockSize     int           // Longest block encoding accepted from peers
+	bootstrapTimeout time.Duration // Bound on the initial attempt to reach the bootstrap peers
+	bootstrapped     chan struct{} // Closed once that attempt is over
+	mdnsEnabled      bool          // Whether peers on the local network are discovered over mDNS
+	retry            *broadcastRetry
+	peerStatuses     map[peer.ID]peerStatus // Latest tip each peer announced, guarded by peersMu
+	statusInterval   time.Duration          // How often the tip is announced to peers
+	workers          sync.WaitGroup         // Goroutines Start runs until the context is done
+	wireFormat       WireFormat             // How blocks and transactions are gossiped
 }
 
 type P2PBlock struct {
@@ -32,62 +51,125 @@ type P2PBlock struct {
 	Sender string
 }
 
+// ErrKnownTxn is returned by AddTxn for a transaction the node already has, pending or in
+// its chain, such transactions are dropped quietly
+var ErrKnownTxn = errors.New("transaction already known")
+
 // BlockchainInterface defines the methods required from the blockchain
 type BlockchainInterface interface {
 	AddBlock(block *P2PBlock) error
 	AddTxn(txn *block.Transaction) error
 	GetBlockByHash(hash []byte) (*block.Block, error)
 	GetTipBlock() (*block.Block, error)
+	GetMainChain(from, to uint64) ([]block.Block, error) // Main chain blocks by height, up to the tip
+	SyncFromPeer(peerID peer.ID)                         // Called when a peer announces a higher tip in its handshake
+	TipAnnounced(peerID peer.ID, tip StatusMessage)      // Called when a peer announces a tip it did not announce before
 }
 
-// NewService creates and initializes a new P2P service
-func NewService(listenAddr string, blockchain BlockchainInterface) (*Service, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-
-	// Parse the multiaddress
-	addr, err := multiaddr.NewMultiaddr(listenAddr)
+// NewService creates and initializes a new P2P service listening on every address in
+// listenAddrs. When announceAddrs is set peers are told those addresses instead of the
+// listen addresses, for nodes behind NAT.
+func NewService(listenAddrs []string, announceAddrs []string, blockchain BlockchainInterface) (*Service, error) {
+	if len(listenAddrs) == 0 {
+		return nil, errors.New("no listen address")
+	}
+	listen, err := parseMultiaddrs(listenAddrs)
+	if err != nil {
+		return nil, err
+	}
+	announce, err := parseMultiaddrs(announceAddrs)
 	if err != nil {
-		cancel()
 		return nil, err
 	}
 
-	// Create a new libp2p Host
-	h, err := libp2p.New(
-		libp2p.ListenAddrs(addr),
+	options := []libp2p.Option{
+		libp2p.ListenAddrs(listen...),
 		libp2p.Security("/noise", noise.New),
-	)
+	}
+	if len(announce) > 0 {
+		options = append(options, libp2p.AddrsFactory(func([]multiaddr.Multiaddr) []multiaddr.Multiaddr {
+			return announce
+		}))
+	}
+
+	// Create a new libp2p Host
+	h, err := libp2p.New(options...)
 	if err != nil {
-		cancel()
 		return nil, err
 	}
 
+	s := NewServiceWithTransport(newLibp2pTransport(h), blockchain)
+	s.host = h
+	s.SetGossipQueue(DefaultGossipQueueSize, DefaultGossipWorkers)
+	return s, nil
+}
+
+func parseMultiaddrs(addrs []string) ([]multiaddr.Multiaddr, error) {
+	parsed := make([]multiaddr.Multiaddr, 0, len(addrs))
+	for _, addr := range addrs {
+		maddr, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %s: %w", addr, err)
+		}
+		parsed = append(parsed, maddr)
+	}
+	return parsed, nil
+}
+
+// NewServiceWithTransport creates a P2P service that sends all traffic over the given transport,
+// gossip is handled inline until SetGossipQueue is called
+func NewServiceWithTransport(transport Transport, blockchain BlockchainInterface) *Service {
+	ctx, cancel := context.WithCancel(context.Background())
+
 	s := &Service{
-		host:           h,
-		ctx:            ctx,
-		cancel:         cancel,
-		peers:          make(map[peer.ID]peer.AddrInfo),
-		blockchain:     blockchain,
-		bootstrapPeers: []multiaddr.Multiaddr{},
+		transport:        transport,
+		ctx:              ctx,
+		cancel:           cancel,
+		peerHandshakes:   make(map[peer.ID]HandshakeMessage),
+		peerDirections:   make(map[peer.ID]network.Direction),
+		peerStatuses:     make(map[peer.ID]peerStatus),
+		statusInterval:   DefaultStatusInterval,
+		blockchain:       blockchain,
+		bootstrapPeers:   []multiaddr.Multiaddr{},
+		gossipQueues:     make(map[string]*gossipQueue),
+		maxBlockSize:     block.MaxBlockSize(1),
+		bootstrapTimeout: DefaultBootstrapTimeout,
+		bootstrapped:     make(chan struct{}),
+		retry:            newBroadcastRetry(transport, DefaultBroadcastTTL),
+		wireFormat:       DefaultWireFormat,
 	}
 
 	// Set up protocol handlers
 	s.setupProtocols()
+	transport.SetConnHandler(s.handleConn)
 
-	return s, nil
+	return s
 }
 
 // Start starts the P2P service
 func (s *Service) Start() error {
-	fmt.Printf("P2P service started. Host ID: %s\n", s.host.ID().String())
-	fmt.Println("Listening on:")
-	for _, addr := range s.host.Addrs() {
-		fmt.Printf("  %s/p2p/%s\n", addr, s.host.ID().String())
-	}
+	fmt.Printf("P2P service started. Host ID: %s\n", s.transport.ID().String())
 
 	// Initialize pubsub
 	if err := s.initPubSub(); err != nil {
 		return err
 	}
+	s.goWorker(func() { s.retry.run(s.ctx) })
+	s.goWorker(func() { s.announceStatus(s.ctx) })
+
+	// Memory transports have no addresses to listen on or discover
+	if s.host == nil {
+		return nil
+	}
+
+	fmt.Println("Listening on:")
+	for _, addr := range s.host.Network().ListenAddresses() {
+		fmt.Printf("  %s/p2p/%s\n", addr, s.host.ID().String())
+	}
+	fmt.Println("Advertising:")
+	for _, addr := range s.host.Addrs() {
+		fmt.Printf("  %s/p2p/%s\n", addr, s.host.ID().String())
+	}
 
 	// Initialize peer discovery
 	if err := s.setupDiscovery(); err != nil {
@@ -97,10 +179,28 @@ func (s *Service) Start() error {
 	return nil
 }
 
-// Stop gracefully stops the P2P service
+// Stop gracefully stops the P2P service and returns once the goroutines handling gossip
+// have exited. Subscriptions are closed before the context is canceled, as leaving a topic
+// needs the router that runs on it.
 func (s *Service) Stop() error {
+	if s.dht != nil {
+		if err := s.dht.Close(); err != nil {
+			fmt.Printf("Error closing DHT: %s\n", err)
+		}
+	}
+	err := s.transport.Close()
 	s.cancel()
-	return s.host.Close()
+	s.workers.Wait()
+	return err
+}
+
+// goWorker runs f in a goroutine Stop waits for, f must return once the context is done
+func (s *Service) goWorker(f func()) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		f()
+	}()
 }
 
 // Connect attempts to connect to a peer at the given address
@@ -115,34 +215,87 @@ func (s *Service) Connect(addr string) error {
 		return err
 	}
 
-	attempt := 3
+	return s.ConnectPeer(*addrInfo)
+}
+
+// ConnectPeer connects to a known peer and checks that it belongs to our network
+func (s *Service) ConnectPeer(addrInfo peer.AddrInfo) error {
+	var err error
 	for range 3 {
-		attempt--
-		if err = s.host.Connect(s.ctx, *addrInfo); err == nil {
+		if err = s.transport.Connect(s.ctx, addrInfo); err == nil {
 			break
 		}
 	}
-
-	if attempt == 0 {
+	if err != nil {
 		return err
 	}
 
-	s.peersMu.Lock()
-	s.peers[addrInfo.ID] = *addrInfo
-	s.peersMu.Unlock()
+	if err := s.handshake(addrInfo.ID); err != nil {
+		return err
+	}
 
 	fmt.Printf("Connected to peer: %s\n", addrInfo.ID.String())
 	return nil
 }
 
-// Peers returns a list of connected peers
+// ID returns the peer ID of this service
+func (s *Service) ID() peer.ID {
+	return s.transport.ID()
+}
+
+// SetNetworkID sets the network this service belongs to, it must be called before Start
+func (s *Service) SetNetworkID(networkID string) {
+	s.networkID = networkID
+}
+
+// SetMaxBlockSize sets the longest block encoding accepted from peers, larger gossip messages
+// and responses are dropped before they are decoded. It must be called before Start.
+func (s *Service) SetMaxBlockSize(size int) {
+	s.maxBlockSize = size
+}
+
+// NetworkID returns the network this service belongs to
+func (s *Service) NetworkID() string {
+	return s.networkID
+}
+
+// handleConn tracks the direction of connected peers and forgets peers once disconnected
+func (s *Service) handleConn(peerID peer.ID, dir network.Direction, connected bool) {
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
+
+	if connected {
+		s.peerDirections[peerID] = dir
+		s.retry.notify()
+		return
+	}
+	delete(s.peerDirections, peerID)
+	delete(s.peerHandshakes, peerID)
+	delete(s.peerStatuses, peerID)
+}
+
+// PeerDirection reports whether a connected peer dialled us or we dialled it
+func (s *Service) PeerDirection(peerID peer.ID) (network.Direction, bool) {
+	s.peersMu.RLock()
+	defer s.peersMu.RUnlock()
+	dir, ok := s.peerDirections[peerID]
+	return dir, ok
+}
+
+// Peers returns the connected peers whose handshake was accepted, whether they dialled us or we
+// dialled them. It asks the transport what is connected, so a peer is gone as soon as its last
+// connection closes.
 func (s *Service) Peers() []peer.ID {
+	connected := s.transport.Peers()
+
 	s.peersMu.RLock()
 	defer s.peersMu.RUnlock()
 
-	peers := make([]peer.ID, 0, len(s.peers))
-	for id := range s.peers {
-		peers = append(peers, id)
+	peers := make([]peer.ID, 0, len(connected))
+	for _, id := range connected {
+		if _, ok := s.peerHandshakes[id]; ok {
+			peers = append(peers, id)
+		}
 	}
 	return peers
 }
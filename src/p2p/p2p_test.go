@@ -1,10 +1,19 @@
 package p2p
 
 import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"runtime"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/nanlour/da/src/block"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -16,6 +25,9 @@ type MockBlockchain struct {
 	tipHash     [32]byte
 	tipHeight   int64
 	blocksMutex sync.RWMutex
+	syncedFrom  []peer.ID       // Peers SyncFromPeer was called with, guarded by blocksMutex
+	announced   []StatusMessage // Tips TipAnnounced was called with, guarded by blocksMutex
+	txns        [][32]byte      // Hashes of the transactions received, guarded by blocksMutex
 }
 
 func NewMockBlockchain() *MockBlockchain {
@@ -40,6 +52,9 @@ func (m *MockBlockchain) AddBlock(b *P2PBlock) error {
 }
 
 func (m *MockBlockchain) AddTxn(b *block.Transaction) error {
+	m.blocksMutex.Lock()
+	defer m.blocksMutex.Unlock()
+	m.txns = append(m.txns, b.Hash())
 	return nil
 }
 
@@ -63,6 +78,56 @@ func (m *MockBlockchain) GetTipBlock() (*block.Block, error) {
 	return m.GetBlockByHash(m.tipHash[:])
 }
 
+// GetMainChain walks back from the tip, the mock keeps no height index
+func (m *MockBlockchain) GetMainChain(from, to uint64) ([]block.Block, error) {
+	m.blocksMutex.RLock()
+	defer m.blocksMutex.RUnlock()
+
+	if m.tipHeight < 0 || from > uint64(m.tipHeight) {
+		return nil, fmt.Errorf("height %d is above the tip", from)
+	}
+	var blocks []block.Block
+	for b := m.blocks[m.tipHash]; b != nil && b.Height >= from; b = m.blocks[b.PreHash] {
+		if b.Height <= to {
+			blocks = append([]block.Block{*b}, blocks...)
+		}
+		if b.Height == 0 {
+			break
+		}
+	}
+	return blocks, nil
+}
+
+func (m *MockBlockchain) SyncFromPeer(peerID peer.ID) {
+	m.blocksMutex.Lock()
+	defer m.blocksMutex.Unlock()
+	m.syncedFrom = append(m.syncedFrom, peerID)
+}
+
+func (m *MockBlockchain) TipAnnounced(peerID peer.ID, tip StatusMessage) {
+	m.blocksMutex.Lock()
+	defer m.blocksMutex.Unlock()
+	m.announced = append(m.announced, tip)
+}
+
+func (m *MockBlockchain) announcedTips() []StatusMessage {
+	m.blocksMutex.RLock()
+	defer m.blocksMutex.RUnlock()
+	return append([]StatusMessage(nil), m.announced...)
+}
+
+func (m *MockBlockchain) syncedPeers() []peer.ID {
+	m.blocksMutex.RLock()
+	defer m.blocksMutex.RUnlock()
+	return append([]peer.ID(nil), m.syncedFrom...)
+}
+
+func (m *MockBlockchain) receivedTxns() [][32]byte {
+	m.blocksMutex.RLock()
+	defer m.blocksMutex.RUnlock()
+	return append([][32]byte(nil), m.txns...)
+}
+
 func (m *MockBlockchain) GetBlockHeight(hash []byte) (int64, error) {
 	m.blocksMutex.RLock()
 	defer m.blocksMutex.RUnlock()
@@ -82,7 +147,7 @@ func TestServiceCreation(t *testing.T) {
 	mockBC := NewMockBlockchain()
 
 	// Create a P2P service
-	service, err := NewService("/ip4/127.0.0.1/tcp/0", mockBC)
+	service, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, mockBC)
 	require.NoError(t, err)
 	require.NotNil(t, service)
 
@@ -98,6 +163,39 @@ func TestServiceCreation(t *testing.T) {
 	require.NoError(t, err)
 }
 
+// TestStartWithUnreachableBootstrapPeer tests that Start returns while a bootstrap peer that
+// never answers is still being dialled, and that the attempt gives up after the timeout
+func TestStartWithUnreachableBootstrapPeer(t *testing.T) {
+	// Accepts connections but never completes the security handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	silentID, err := peer.IDFromPrivateKey(key)
+	require.NoError(t, err)
+
+	service, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, NewMockBlockchain())
+	require.NoError(t, err)
+	require.NoError(t, service.AddBootstrapPeer(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d/p2p/%s", port, silentID)))
+	service.SetBootstrapTimeout(time.Second)
+
+	start := time.Now()
+	require.NoError(t, service.Start())
+	defer service.Stop()
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "Start should not wait for bootstrap peers")
+
+	select {
+	case <-service.bootstrapped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("bootstrap should give up after its timeout")
+	}
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+	assert.Empty(t, service.host.Network().Peers())
+}
+
 // TestPeerConnection tests connecting two P2P nodes
 func TestPeerConnection(t *testing.T) {
 	// Create two mock blockchains
@@ -105,10 +203,10 @@ func TestPeerConnection(t *testing.T) {
 	mockBC2 := NewMockBlockchain()
 
 	// Create two P2P services
-	service1, err := NewService("/ip4/127.0.0.1/tcp/0", mockBC1)
+	service1, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, mockBC1)
 	require.NoError(t, err)
 
-	service2, err := NewService("/ip4/127.0.0.1/tcp/0", mockBC2)
+	service2, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, mockBC2)
 	require.NoError(t, err)
 
 	// Start both services
@@ -134,6 +232,163 @@ func TestPeerConnection(t *testing.T) {
 	assert.Contains(t, peers, service2.host.ID())
 }
 
+// TestStartStopNoLeak tests that starting and stopping connected services over and over leaves
+// no goroutine behind, subscriptions and gossip workers included
+func TestStartStopNoLeak(t *testing.T) {
+	cycle := func() {
+		service1, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, NewMockBlockchain())
+		require.NoError(t, err)
+		service2, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, NewMockBlockchain())
+		require.NoError(t, err)
+		require.NoError(t, service1.Start())
+		require.NoError(t, service2.Start())
+
+		addr2 := service2.host.Addrs()[0].String() + "/p2p/" + service2.host.ID().String()
+		require.NoError(t, service1.Connect(addr2))
+		require.NoError(t, service1.BroadcastBlock(&block.Block{Height: 1}))
+
+		require.NoError(t, service1.Stop())
+		require.NoError(t, service2.Stop())
+	}
+
+	// The first cycle starts goroutines libp2p keeps for the whole process
+	cycle()
+	before := runtime.NumGoroutine()
+	for range 5 {
+		cycle()
+	}
+
+	// Connections wind down in the background after the host closes
+	deadline := time.Now().Add(10 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before, "goroutines left running after Stop")
+}
+
+// TestInboundPeer tests that a node records peers that dial it, along with the direction of
+// each connection, and forgets them once they disconnect
+func TestInboundPeer(t *testing.T) {
+	serviceA, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, NewMockBlockchain())
+	require.NoError(t, err)
+	serviceB, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, NewMockBlockchain())
+	require.NoError(t, err)
+
+	require.NoError(t, serviceA.Start())
+	defer serviceA.Stop()
+	require.NoError(t, serviceB.Start())
+	defer serviceB.Stop()
+
+	addrA := serviceA.host.Addrs()[0].String() + "/p2p/" + serviceA.host.ID().String()
+	require.NoError(t, serviceB.Connect(addrA))
+
+	// A adds B once it has answered B's handshake
+	require.Eventually(t, func() bool {
+		return slices.Contains(serviceA.Peers(), serviceB.ID())
+	}, 5*time.Second, 10*time.Millisecond)
+
+	dir, ok := serviceA.PeerDirection(serviceB.ID())
+	require.True(t, ok)
+	assert.Equal(t, network.DirInbound, dir)
+	dir, ok = serviceB.PeerDirection(serviceA.ID())
+	require.True(t, ok)
+	assert.Equal(t, network.DirOutbound, dir)
+
+	require.NoError(t, serviceB.host.Network().ClosePeer(serviceA.ID()))
+	require.Eventually(t, func() bool {
+		return !slices.Contains(serviceA.Peers(), serviceB.ID())
+	}, 5*time.Second, 10*time.Millisecond)
+	_, ok = serviceA.PeerDirection(serviceB.ID())
+	assert.False(t, ok)
+}
+
+// TestPeerGoneAfterStop tests that a peer leaves Peers() soon after it shuts down
+func TestPeerGoneAfterStop(t *testing.T) {
+	service1, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, NewMockBlockchain())
+	require.NoError(t, err)
+	service2, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, NewMockBlockchain())
+	require.NoError(t, err)
+
+	require.NoError(t, service1.Start())
+	defer service1.Stop()
+	require.NoError(t, service2.Start())
+
+	addr2 := service2.host.Addrs()[0].String() + "/p2p/" + service2.host.ID().String()
+	require.NoError(t, service1.Connect(addr2))
+	require.Contains(t, service1.Peers(), service2.ID())
+
+	require.NoError(t, service2.Stop())
+	assert.Eventually(t, func() bool {
+		return !slices.Contains(service1.Peers(), service2.ID())
+	}, 2*time.Second, 10*time.Millisecond)
+	_, ok := service1.PeerHandshake(service2.ID())
+	assert.False(t, ok)
+}
+
+// TestMDNSDisabled tests that services without mDNS only connect to peers they are told about
+func TestMDNSDisabled(t *testing.T) {
+	service1, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, NewMockBlockchain())
+	require.NoError(t, err)
+	service2, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, NewMockBlockchain())
+	require.NoError(t, err)
+
+	require.NoError(t, service1.Start())
+	defer service1.Stop()
+	require.NoError(t, service2.Start())
+	defer service2.Stop()
+
+	// mDNS would have found the other node within this time
+	time.Sleep(500 * time.Millisecond)
+	assert.NotContains(t, service1.Peers(), service2.host.ID())
+	assert.NotContains(t, service1.host.Network().Peers(), service2.host.ID())
+	assert.NotContains(t, service2.Peers(), service1.host.ID())
+
+	addr2 := service2.host.Addrs()[0].String() + "/p2p/" + service2.host.ID().String()
+	require.NoError(t, service1.Connect(addr2))
+	assert.Contains(t, service1.Peers(), service2.host.ID())
+}
+
+// TestAnnounceAddrs tests that a node listening on several addresses advertises its announce
+// address to a connecting peer instead
+func TestAnnounceAddrs(t *testing.T) {
+	announce := "/ip4/203.0.113.7/tcp/4001"
+	service1, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, NewMockBlockchain())
+	require.NoError(t, err)
+	service2, err := NewService([]string{"/ip4/127.0.0.1/tcp/0", "/ip4/127.0.0.2/tcp/0"}, []string{announce}, NewMockBlockchain())
+	require.NoError(t, err)
+
+	require.NoError(t, service1.Start())
+	defer service1.Stop()
+	require.NoError(t, service2.Start())
+	defer service2.Stop()
+
+	require.Len(t, service2.host.Addrs(), 1)
+	assert.Equal(t, announce, service2.host.Addrs()[0].String())
+
+	// Dial a real address, identify then tells service1 about the announced one
+	var listen []string
+	for _, addr := range service2.host.Network().ListenAddresses() {
+		if strings.Contains(addr.String(), "/tcp/") {
+			listen = append(listen, addr.String())
+		}
+	}
+	require.Len(t, listen, 2)
+	require.NoError(t, service1.Connect(listen[1]+"/p2p/"+service2.host.ID().String()))
+	assert.Eventually(t, func() bool {
+		for _, addr := range service1.host.Peerstore().Addrs(service2.host.ID()) {
+			if addr.String() == announce {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 50*time.Millisecond, "announce address should reach the peer")
+
+	_, err = NewService([]string{"not an address"}, nil, NewMockBlockchain())
+	assert.Error(t, err)
+	_, err = NewService(nil, nil, NewMockBlockchain())
+	assert.Error(t, err)
+}
+
 // TestProtocolHandlers tests the custom protocol handlers (GetBlockByHash and GetTip)
 func TestProtocolHandlers(t *testing.T) {
 	// Create two mock blockchains
@@ -159,10 +414,10 @@ func TestProtocolHandlers(t *testing.T) {
 	mockBC2.AddBlock(&P2PBlock{Block: *testBlock2, Sender: ""})
 
 	// Create two P2P services
-	service1, err := NewService("/ip4/127.0.0.1/tcp/0", mockBC1)
+	service1, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, mockBC1)
 	require.NoError(t, err)
 
-	service2, err := NewService("/ip4/127.0.0.1/tcp/0", mockBC2)
+	service2, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, mockBC2)
 	require.NoError(t, err)
 
 	// Start both services
@@ -206,8 +461,9 @@ func TestDiscovery(t *testing.T) {
 	for i := 0; i < 3; i++ {
 		mockBCs[i] = NewMockBlockchain()
 		var err error
-		services[i], err = NewService("/ip4/127.0.0.1/tcp/0", mockBCs[i])
+		services[i], err = NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, mockBCs[i])
 		require.NoError(t, err)
+		services[i].SetMDNS(true)
 	}
 
 	// Start all services
@@ -227,10 +483,10 @@ func TestDiscovery(t *testing.T) {
 	err = services[1].Connect(addr2)
 	require.NoError(t, err)
 
-	// Wait for DHT discovery to propagate
+	// Wait for discovery to propagate
 	time.Sleep(2 * time.Second)
 
-	// Eventually service[0] should discover service[2] through DHT
+	// Eventually service[0] should discover service[2]
 	discovered := false
 	for i := 0; i < 5; i++ { // Try a few times
 		peers := services[0].Peers()
@@ -246,5 +502,5 @@ func TestDiscovery(t *testing.T) {
 		time.Sleep(500 * time.Millisecond)
 	}
 
-	assert.True(t, discovered, "Service[0] should eventually discover Service[2] through DHT")
+	assert.True(t, discovered, "Service[0] should eventually discover Service[2]")
 }
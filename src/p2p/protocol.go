@@ -1,10 +1,13 @@
 package p2p
 
 import (
+	"cmp"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"runtime/debug"
 
-	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/nanlour/da/src/block"
@@ -14,8 +17,26 @@ const (
 	// Protocol identifiers
 	blockByHashProtocol = "/blockchain/getblockbyhash/1.0.0"
 	getTipProtocol      = "/blockchain/gettip/1.0.0"
+	handshakeProtocol   = "/blockchain/handshake/1.0.0"
+	getBlocksProtocol   = "/blockchain/getblocks/1.0.0"
+	blocksAfterProtocol = "/blockchain/getblocksafter/1.0.0"
 )
 
+// MaxBlocksPerRequest caps the blocks one getblocks response carries
+const MaxBlocksPerRequest = 128
+
+// Bounds on messages read from a stream, requests and handshakes carry no blocks
+const (
+	maxRequestSize  = 4 << 10
+	maxEnvelopeSize = 1 << 10 // Response fields around the blocks
+)
+
+// ProtocolVersion is the version of the messages and protocols above, peers on another version are refused
+const ProtocolVersion = 1
+
+// errNoBlock is returned when a peer answers a block request without error and without a block
+var errNoBlock = errors.New("peer sent no block")
+
 // Request/response types
 type BlockByHashRequest struct {
 	Hash [32]byte `json:"hash"`
@@ -26,20 +47,155 @@ type BlockResponse struct {
 	Error string       `json:"error,omitempty"`
 }
 
+// BlocksRequest asks for up to Count blocks ending at Hash, walking back along PreHash
+type BlocksRequest struct {
+	Hash  [32]byte `json:"hash"`
+	Count int      `json:"count"`
+}
+
+// BlocksResponse carries the requested blocks, newest first for getblocks and oldest first for
+// getblocksafter
+type BlocksResponse struct {
+	Blocks []*block.Block `json:"blocks"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// HandshakeMessage is exchanged by both sides when a connection is set up. Connections are
+// authenticated by the transport, so the message is bound to the remote peer ID.
+type HandshakeMessage struct {
+	Version    uint32     `json:"version"`
+	NetworkID  string     `json:"network_id"`
+	WireFormat WireFormat `json:"wire_format,omitempty"` // Gossip encoding, JSON when empty as before it was announced
+	TipHeight  uint64     `json:"tip_height"`
+	TipHash    [32]byte   `json:"tip_hash"`
+}
+
 // setupProtocols initializes all protocol handlers
 func (s *Service) setupProtocols() {
 	// Register protocol handlers
-	s.host.SetStreamHandler(protocol.ID(blockByHashProtocol), s.handleBlockByHashRequest)
-	s.host.SetStreamHandler(protocol.ID(getTipProtocol), s.handleGetTipRequest)
+	s.transport.SetStreamHandler(protocol.ID(blockByHashProtocol), s.handleBlockByHashRequest)
+	s.transport.SetStreamHandler(protocol.ID(getTipProtocol), s.handleGetTipRequest)
+	s.transport.SetStreamHandler(protocol.ID(handshakeProtocol), s.handleHandshake)
+	s.transport.SetStreamHandler(protocol.ID(getBlocksProtocol), s.handleGetBlocksRequest)
+	s.transport.SetStreamHandler(protocol.ID(blocksAfterProtocol), s.handleBlocksAfterRequest)
+}
+
+// handleHandshake answers a handshake with our own and drops peers on another version or network
+func (s *Service) handleHandshake(stream Stream) {
+	defer stream.Close()
+	defer s.recoverHandler(stream, "handshake")
+
+	var request HandshakeMessage
+	if err := decodeLimited(stream, maxRequestSize, &request); err != nil {
+		sendErrorResponse(stream, "Failed to decode handshake")
+		return
+	}
+
+	local := s.localHandshake()
+	if err := json.NewEncoder(stream).Encode(local); err != nil {
+		fmt.Printf("Error sending handshake: %s\n", err)
+		return
+	}
+
+	remote := stream.RemotePeer()
+	if err := s.checkHandshake(request); err != nil {
+		fmt.Printf("Rejecting peer %s: %s\n", remote, err)
+		s.dropPeer(remote)
+		return
+	}
+	s.acceptHandshake(remote, local, request)
+}
+
+// handshake exchanges handshakes with a newly connected peer, disconnecting it if it runs
+// another protocol version or belongs to another network
+func (s *Service) handshake(peerID peer.ID) error {
+	stream, err := s.transport.NewStream(s.ctx, peerID, protocol.ID(handshakeProtocol))
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	local := s.localHandshake()
+	if err := json.NewEncoder(stream).Encode(local); err != nil {
+		return err
+	}
+
+	var response HandshakeMessage
+	if err := decodeLimited(stream, maxRequestSize, &response); err != nil {
+		return err
+	}
+
+	if err := s.checkHandshake(response); err != nil {
+		s.dropPeer(peerID)
+		return fmt.Errorf("peer %s: %w", peerID, err)
+	}
+	s.acceptHandshake(peerID, local, response)
+	return nil
+}
+
+// localHandshake describes this node, a node without a tip announces height zero
+func (s *Service) localHandshake() HandshakeMessage {
+	msg := HandshakeMessage{Version: ProtocolVersion, NetworkID: s.networkID, WireFormat: s.wireFormat}
+	if tip, err := s.blockchain.GetTipBlock(); err == nil && tip != nil {
+		msg.TipHeight = tip.Height
+		msg.TipHash = tip.Hash()
+	}
+	return msg
+}
+
+// checkHandshake returns why a peer's handshake is unacceptable, or nil
+func (s *Service) checkHandshake(remote HandshakeMessage) error {
+	if remote.Version != ProtocolVersion {
+		return fmt.Errorf("peer runs protocol version %d, expected %d", remote.Version, ProtocolVersion)
+	}
+	if remote.NetworkID != s.networkID {
+		return fmt.Errorf("peer is on network %q, expected %q", remote.NetworkID, s.networkID)
+	}
+	if format := cmp.Or(remote.WireFormat, WireJSON); format != s.wireFormat {
+		return fmt.Errorf("peer gossips %s, expected %s", format, s.wireFormat)
+	}
+	return nil
+}
+
+// acceptHandshake makes the peer one of our peers, remembers the tip it announced and syncs
+// from it if it is ahead of us
+func (s *Service) acceptHandshake(peerID peer.ID, local, remote HandshakeMessage) {
+	s.peersMu.Lock()
+	s.peerHandshakes[peerID] = remote
+	s.peersMu.Unlock()
+
+	if remote.TipHeight > local.TipHeight {
+		fmt.Printf("Peer %s is ahead at height %d, syncing from it\n", peerID, remote.TipHeight)
+		s.blockchain.SyncFromPeer(peerID)
+	}
+}
+
+// PeerHandshake returns the handshake a peer sent when it connected
+func (s *Service) PeerHandshake(peerID peer.ID) (HandshakeMessage, bool) {
+	s.peersMu.RLock()
+	defer s.peersMu.RUnlock()
+	msg, ok := s.peerHandshakes[peerID]
+	return msg, ok
+}
+
+// dropPeer forgets a peer and closes all connections to it
+func (s *Service) dropPeer(peerID peer.ID) {
+	s.peersMu.Lock()
+	delete(s.peerHandshakes, peerID)
+	delete(s.peerStatuses, peerID)
+	s.peersMu.Unlock()
+
+	s.transport.ClosePeer(peerID)
 }
 
 // handleBlockByHashRequest processes incoming block-by-hash requests
-func (s *Service) handleBlockByHashRequest(stream network.Stream) {
+func (s *Service) handleBlockByHashRequest(stream Stream) {
 	defer stream.Close()
+	defer s.recoverHandler(stream, "block by hash")
 
 	// Read the request
 	var request BlockByHashRequest
-	if err := json.NewDecoder(stream).Decode(&request); err != nil {
+	if err := decodeLimited(stream, maxRequestSize, &request); err != nil {
 		sendErrorResponse(stream, "Failed to decode request")
 		return
 	}
@@ -62,9 +218,87 @@ func (s *Service) handleBlockByHashRequest(stream network.Stream) {
 	}
 }
 
+// handleGetBlocksRequest answers with the requested block and its ancestors, stopping at
+// genesis, at a missing block or after MaxBlocksPerRequest
+func (s *Service) handleGetBlocksRequest(stream Stream) {
+	defer stream.Close()
+	defer s.recoverHandler(stream, "getblocks")
+
+	var request BlocksRequest
+	if err := decodeLimited(stream, maxRequestSize, &request); err != nil {
+		sendErrorResponse(stream, "Failed to decode request")
+		return
+	}
+
+	var response BlocksResponse
+	hash := request.Hash
+	for len(response.Blocks) < min(request.Count, MaxBlocksPerRequest) {
+		b, err := s.blockchain.GetBlockByHash(hash[:])
+		if err != nil || b == nil {
+			break
+		}
+		response.Blocks = append(response.Blocks, b)
+		if b.Height == 0 {
+			break
+		}
+		hash = b.PreHash
+	}
+	if len(response.Blocks) == 0 {
+		response.Error = "block not found"
+	}
+
+	if err := json.NewEncoder(stream).Encode(response); err != nil {
+		fmt.Printf("Error sending response: %s\n", err)
+		return
+	}
+}
+
+// handleBlocksAfterRequest answers with up to Count main chain blocks following the requested
+// block, oldest first. A block that is not on our main chain is answered with an error, the
+// requester has to ask again from a block we share.
+func (s *Service) handleBlocksAfterRequest(stream Stream) {
+	defer stream.Close()
+	defer s.recoverHandler(stream, "getblocksafter")
+
+	var request BlocksRequest
+	if err := decodeLimited(stream, maxRequestSize, &request); err != nil {
+		sendErrorResponse(stream, "Failed to decode request")
+		return
+	}
+
+	var response BlocksResponse
+	from, err := s.blockchain.GetBlockByHash(request.Hash[:])
+	count := min(request.Count, MaxBlocksPerRequest)
+	switch {
+	case err != nil || from == nil:
+		response.Error = "block not found"
+	case count < 1:
+		response.Error = "no blocks requested"
+	default:
+		blocks, err := s.blockchain.GetMainChain(from.Height+1, from.Height+uint64(count))
+		if err != nil {
+			response.Error = err.Error()
+			break
+		}
+		if blocks[0].PreHash != request.Hash {
+			response.Error = "block is not on the main chain"
+			break
+		}
+		for i := range blocks {
+			response.Blocks = append(response.Blocks, &blocks[i])
+		}
+	}
+
+	if err := json.NewEncoder(stream).Encode(response); err != nil {
+		fmt.Printf("Error sending response: %s\n", err)
+		return
+	}
+}
+
 // handleGetTipRequest processes incoming tip requests
-func (s *Service) handleGetTipRequest(stream network.Stream) {
+func (s *Service) handleGetTipRequest(stream Stream) {
 	defer stream.Close()
+	defer s.recoverHandler(stream, "get tip")
 
 	// Process the request using the blockchain
 	var response BlockResponse
@@ -85,15 +319,41 @@ func (s *Service) handleGetTipRequest(stream network.Stream) {
 	}
 }
 
+// recoverHandler is deferred by every stream handler, so a panic on a malformed request
+// answers that request with an error instead of taking the node down
+func (s *Service) recoverHandler(stream Stream, name string) {
+	if r := recover(); r != nil {
+		s.handlerPanics.Add(1)
+		fmt.Printf("Recovered from panic in %s handler for peer %s: %v\n%s", name, stream.RemotePeer(), r, debug.Stack())
+		sendErrorResponse(stream, "internal error")
+	}
+}
+
+// HandlerPanics reports how many stream handler panics have been recovered
+func (s *Service) HandlerPanics() uint64 {
+	return s.handlerPanics.Load()
+}
+
+// decodeLimited decodes one JSON value from r reading at most limit bytes, so a peer cannot
+// make us buffer an unbounded message
+func decodeLimited(r io.Reader, limit int, v any) error {
+	return json.NewDecoder(io.LimitReader(r, int64(limit))).Decode(v)
+}
+
+// responseLimit bounds a response carrying up to blocks blocks
+func (s *Service) responseLimit(blocks int) int {
+	return maxEnvelopeSize + blocks*(s.maxBlockSize+1)
+}
+
 // Helper function to send an error response
-func sendErrorResponse(stream network.Stream, errMsg string) {
+func sendErrorResponse(stream Stream, errMsg string) {
 	json.NewEncoder(stream).Encode(map[string]string{"error": errMsg})
 }
 
 // GetBlockByHash requests a block from the P2P network by its hash
 func (s *Service) GetBlockByHash(hash [32]byte, peerID peer.ID) (*block.Block, error) {
 	// Create a new stream
-	stream, err := s.host.NewStream(s.ctx, peerID, protocol.ID(blockByHashProtocol))
+	stream, err := s.transport.NewStream(s.ctx, peerID, protocol.ID(blockByHashProtocol))
 	if err != nil {
 		return nil, err
 	}
@@ -107,7 +367,7 @@ func (s *Service) GetBlockByHash(hash [32]byte, peerID peer.ID) (*block.Block, e
 
 	// Read response
 	var response BlockResponse
-	if err := json.NewDecoder(stream).Decode(&response); err != nil {
+	if err := decodeLimited(stream, s.responseLimit(1), &response); err != nil {
 		return nil, err
 	}
 
@@ -115,6 +375,9 @@ func (s *Service) GetBlockByHash(hash [32]byte, peerID peer.ID) (*block.Block, e
 	if response.Error != "" {
 		return nil, fmt.Errorf("peer error: %s", response.Error)
 	}
+	if response.Block == nil {
+		return nil, errNoBlock
+	}
 
 	return response.Block, nil
 }
@@ -122,7 +385,7 @@ func (s *Service) GetBlockByHash(hash [32]byte, peerID peer.ID) (*block.Block, e
 // GetTip requests the current blockchain tip from the P2P network
 func (s *Service) GetTip(peerID peer.ID) (*block.Block, error) {
 	// Create a new stream
-	stream, err := s.host.NewStream(s.ctx, peerID, protocol.ID(getTipProtocol))
+	stream, err := s.transport.NewStream(s.ctx, peerID, protocol.ID(getTipProtocol))
 	if err != nil {
 		return nil, err
 	}
@@ -135,7 +398,7 @@ func (s *Service) GetTip(peerID peer.ID) (*block.Block, error) {
 
 	// Read response
 	var response BlockResponse
-	if err := json.NewDecoder(stream).Decode(&response); err != nil {
+	if err := decodeLimited(stream, s.responseLimit(1), &response); err != nil {
 		return nil, err
 	}
 
@@ -143,6 +406,53 @@ func (s *Service) GetTip(peerID peer.ID) (*block.Block, error) {
 	if response.Error != "" {
 		return nil, fmt.Errorf("peer error: %s", response.Error)
 	}
+	if response.Block == nil {
+		return nil, errNoBlock
+	}
 
 	return response.Block, nil
 }
+
+// GetBlocksAfter requests up to count blocks of the peer's main chain following hash, oldest first
+func (s *Service) GetBlocksAfter(hash [32]byte, count int, peerID peer.ID) ([]*block.Block, error) {
+	stream, err := s.transport.NewStream(s.ctx, peerID, protocol.ID(blocksAfterProtocol))
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	if err := json.NewEncoder(stream).Encode(BlocksRequest{Hash: hash, Count: count}); err != nil {
+		return nil, err
+	}
+
+	var response BlocksResponse
+	if err := decodeLimited(stream, s.responseLimit(MaxBlocksPerRequest), &response); err != nil {
+		return nil, err
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("peer error: %s", response.Error)
+	}
+	return response.Blocks, nil
+}
+
+// GetBlocks requests up to count blocks ending at hash from a peer, newest first
+func (s *Service) GetBlocks(hash [32]byte, count int, peerID peer.ID) ([]*block.Block, error) {
+	stream, err := s.transport.NewStream(s.ctx, peerID, protocol.ID(getBlocksProtocol))
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	if err := json.NewEncoder(stream).Encode(BlocksRequest{Hash: hash, Count: count}); err != nil {
+		return nil, err
+	}
+
+	var response BlocksResponse
+	if err := decodeLimited(stream, s.responseLimit(MaxBlocksPerRequest), &response); err != nil {
+		return nil, err
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("peer error: %s", response.Error)
+	}
+	return response.Blocks, nil
+}
@@ -1,162 +1,205 @@
 package p2p
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 
-	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/nanlour/da/src/block"
 )
 
 const (
 	// PubSub topics
-	blockTopic = "blocks"
-	txTopic    = "transactions"
+	blockTopic  = "blocks"
+	txTopic     = "transactions"
+	statusTopic = "status"
 )
 
-// PubSubManager manages pubsub functionality
-type PubSubManager struct {
-	ps         *pubsub.PubSub
-	blockTopic *pubsub.Topic
-	blockSub   *pubsub.Subscription
-	txTopic    *pubsub.Topic
-	txSub      *pubsub.Subscription
-	ctx        context.Context
-	blockchain BlockchainInterface
+// WireFormat is how blocks and transactions are encoded on the pubsub topics
+type WireFormat string
+
+const (
+	WireBinary WireFormat = "binary" // Block.Marshal, compact and fast
+	WireJSON   WireFormat = "json"   // Readable, meant for debugging
+)
+
+// DefaultWireFormat is the format services use unless SetWireFormat is called
+const DefaultWireFormat = WireBinary
+
+// ParseWireFormat returns the format with the given name, empty means the default
+func ParseWireFormat(name string) (WireFormat, error) {
+	switch WireFormat(name) {
+	case "":
+		return DefaultWireFormat, nil
+	case WireBinary, WireJSON:
+		return WireFormat(name), nil
+	}
+	return "", fmt.Errorf("unknown wire format %q, expected %q or %q", name, WireBinary, WireJSON)
 }
 
-// initPubSub initializes the PubSub system
+// initPubSub subscribes to the block, transaction and status topics
 func (s *Service) initPubSub() error {
-	// Create a new PubSub service using GossipSub
-	ps, err := pubsub.NewGossipSub(s.ctx, s.host)
-	if err != nil {
+	if err := s.subscribe(blockTopic, s.handleBlockMessage); err != nil {
 		return err
 	}
-
-	// Join the block topic
-	blockTopic, err := ps.Join(blockTopic)
-	if err != nil {
+	if err := s.subscribe(txTopic, s.handleTxMessage); err != nil {
 		return err
 	}
+	return s.subscribe(statusTopic, s.handleStatusMessage)
+}
 
-	// Subscribe to the block topic
-	blockSub, err := blockTopic.Subscribe()
-	if err != nil {
-		return err
+// subscribe passes a topic's messages to handler, through a gossip queue unless the queue size is zero
+func (s *Service) subscribe(topic string, handler func(from peer.ID, data []byte)) error {
+	if s.gossipQueueSize > 0 {
+		q := newGossipQueue(s.ctx, &s.workers, topic, s.gossipQueueSize, s.gossipWorkers, handler)
+		s.gossipQueues[topic] = q
+		handler = q.enqueue
 	}
+	return s.transport.Subscribe(s.ctx, s.topicName(topic), handler)
+}
 
-	// Join the transaction topic
-	txTopic, err := ps.Join(txTopic)
-	if err != nil {
-		return err
+// SetGossipQueue sets the per-topic queue size and worker count, it must be called before
+// Start. A zero size handles messages on the subscription itself, one at a time.
+func (s *Service) SetGossipQueue(size int, workers int) {
+	s.gossipQueueSize = size
+	s.gossipWorkers = workers
+}
+
+// SetWireFormat sets how blocks and transactions are gossiped, it must be called before
+// Start. Peers using another format are refused in the handshake.
+func (s *Service) SetWireFormat(format WireFormat) {
+	s.wireFormat = format
+}
+
+// WireFormat returns how this service gossips blocks and transactions
+func (s *Service) WireFormat() WireFormat {
+	return s.wireFormat
+}
+
+func (s *Service) encodeBlock(b *block.Block) ([]byte, error) {
+	if s.wireFormat == WireJSON {
+		return json.Marshal(b)
 	}
+	return b.Marshal(), nil
+}
 
-	// Subscribe to the transaction topic
-	txSub, err := txTopic.Subscribe()
-	if err != nil {
-		return err
+func (s *Service) decodeBlock(data []byte, b *block.Block) error {
+	if s.wireFormat == WireJSON {
+		return json.Unmarshal(data, b)
 	}
+	return b.Unmarshal(data)
+}
 
-	s.pubsubMgr = &PubSubManager{
-		ps:         ps,
-		blockTopic: blockTopic,
-		blockSub:   blockSub,
-		txTopic:    txTopic,
-		txSub:      txSub,
-		ctx:        s.ctx,
-		blockchain: s.blockchain,
+func (s *Service) encodeTxn(tx *block.Transaction) ([]byte, error) {
+	if s.wireFormat == WireJSON {
+		return json.Marshal(tx)
 	}
+	return tx.Marshal(), nil
+}
 
-	// Start processing messages
-	go s.pubsubMgr.processBlockMessages()
-	go s.pubsubMgr.processTxMessages()
+func (s *Service) decodeTxn(data []byte, tx *block.Transaction) error {
+	if s.wireFormat == WireJSON {
+		return json.Unmarshal(data, tx)
+	}
+	return tx.Unmarshal(data)
+}
 
-	return nil
+// GossipStats reports the queue of every topic, keyed by topic name without the network suffix
+func (s *Service) GossipStats() map[string]GossipQueueStats {
+	stats := make(map[string]GossipQueueStats, len(s.gossipQueues))
+	for topic, q := range s.gossipQueues {
+		stats[topic] = q.stats()
+	}
+	return stats
 }
 
-// BroadcastBlock broadcasts a block to the network
-func (s *Service) BroadcastBlock(block *block.Block) error {
-	if s.pubsubMgr == nil || s.pubsubMgr.blockTopic == nil {
-		return fmt.Errorf("pubsub not initialized")
+// topicName scopes a topic to the service's network so different networks never share messages
+func (s *Service) topicName(base string) string {
+	if s.networkID == "" {
+		return base
 	}
+	return base + "-" + s.networkID
+}
 
-	blockData, err := json.Marshal(block)
+// BroadcastBlock broadcasts a block to the network
+func (s *Service) BroadcastBlock(block *block.Block) error {
+	blockData, err := s.encodeBlock(block)
 	if err != nil {
 		return err
 	}
 
-	return s.pubsubMgr.blockTopic.Publish(s.ctx, blockData)
+	return s.transport.Broadcast(s.ctx, s.topicName(blockTopic), blockData)
 }
 
-// BroadcastTransaction broadcasts a transaction to the network
+// BroadcastTransaction broadcasts a transaction to the network. When no peer is subscribed yet,
+// as right after startup, it is broadcast again once one is.
 func (s *Service) BroadcastTransaction(tx *block.Transaction) error {
-	if s.pubsubMgr == nil || s.pubsubMgr.txTopic == nil {
-		return fmt.Errorf("pubsub not initialized")
-	}
-
-	txData, err := json.Marshal(tx)
+	txData, err := s.encodeTxn(tx)
 	if err != nil {
 		return err
 	}
 
-	return s.pubsubMgr.txTopic.Publish(s.ctx, txData)
+	topic := s.topicName(txTopic)
+	if err := s.transport.Broadcast(s.ctx, topic, txData); err != nil {
+		return err
+	}
+	if len(s.transport.TopicPeers(topic)) == 0 {
+		s.retry.add(topic, txData)
+	}
+	return nil
 }
 
-// Process incoming block messages
-func (pm *PubSubManager) processBlockMessages() {
-	for {
-		msg, err := pm.blockSub.Next(pm.ctx)
-		if err != nil {
-			// Context canceled or subscription closed
-			return
-		}
-
-		// Get the sender's peer ID
-		sender := msg.ReceivedFrom.String()
+// handleBlockMessage processes an incoming block message
+func (s *Service) handleBlockMessage(from peer.ID, data []byte) {
+	// Get the sender's peer ID
+	sender := from.String()
 
-		var block P2PBlock
-		block.Sender = sender
-		if err := json.Unmarshal(msg.Data, &block.Block); err != nil {
-			fmt.Printf("Error unmarshaling block from %s: %s\n", sender, err)
-			continue
-		}
+	if len(data) > s.maxBlockSize {
+		fmt.Printf("Dropping %d byte block from %s, above the %d byte limit\n", len(data), sender, s.maxBlockSize)
+		return
+	}
 
-		// Add the block to the blockchain
-		if err := pm.blockchain.AddBlock(&block); err != nil {
-			fmt.Printf("Error adding block from %s to blockchain: %s\n", sender, err)
-			continue
-		}
+	var block P2PBlock
+	block.Sender = sender
+	if err := s.decodeBlock(data, &block.Block); err != nil {
+		fmt.Printf("Error unmarshaling block from %s: %s\n", sender, err)
+		return
+	}
 
-		fmt.Printf("Received and added new block from %s: %x\n", sender, block.Block.Hash())
+	// Add the block to the blockchain
+	if err := s.blockchain.AddBlock(&block); err != nil {
+		fmt.Printf("Error adding block from %s to blockchain: %s\n", sender, err)
+		return
 	}
-}
 
-// Process incoming transaction messages
-func (pm *PubSubManager) processTxMessages() {
-	for {
-		msg, err := pm.txSub.Next(pm.ctx)
-		if err != nil {
-			// Context canceled or subscription closed
-			return
-		}
+	fmt.Printf("Received and added new block from %s: %x\n", sender, block.Block.Hash())
+}
 
-		// Get the sender's peer ID
-		sender := msg.ReceivedFrom.String()
+// handleTxMessage processes an incoming transaction message
+func (s *Service) handleTxMessage(from peer.ID, data []byte) {
+	// Get the sender's peer ID
+	sender := from.String()
 
-		var tx block.Transaction
-		if err := json.Unmarshal(msg.Data, &tx); err != nil {
-			fmt.Printf("Error unmarshaling transaction from %s: %s\n", sender, err)
-			continue
-		}
+	if len(data) > block.MaxTxnSize {
+		fmt.Printf("Dropping %d byte transaction from %s, above the %d byte limit\n", len(data), sender, block.MaxTxnSize)
+		return
+	}
 
-		// Add the txn to mempool
-		if err := pm.blockchain.AddTxn(&tx); err != nil {
-			fmt.Printf("Error adding block from %s to blockchain: %s\n", sender, err)
-			continue
-		}
+	var tx block.Transaction
+	if err := s.decodeTxn(data, &tx); err != nil {
+		fmt.Printf("Error unmarshaling transaction from %s: %s\n", sender, err)
+		return
+	}
 
-		// Process the transaction (add to mempool, etc.)
-		fmt.Printf("Received new transaction from %s: %x\n", sender, tx.Hash())
+	// Add the txn to mempool
+	if err := s.blockchain.AddTxn(&tx); errors.Is(err, ErrKnownTxn) {
+		return
+	} else if err != nil {
+		fmt.Printf("Error adding transaction from %s to mempool: %s\n", sender, err)
+		return
 	}
+
+	// Process the transaction (add to mempool, etc.)
+	fmt.Printf("Received new transaction from %s: %x\n", sender, tx.Hash())
 }
@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/nanlour/da/src/block"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -16,10 +17,10 @@ func TestPubSub(t *testing.T) {
 	mockBC2 := NewMockBlockchain()
 
 	// Create two P2P services
-	service1, err := NewService("/ip4/127.0.0.1/tcp/0", mockBC1)
+	service1, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, mockBC1)
 	require.NoError(t, err)
 
-	service2, err := NewService("/ip4/127.0.0.1/tcp/0", mockBC2)
+	service2, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, mockBC2)
 	require.NoError(t, err)
 
 	// Start both services
@@ -103,13 +104,13 @@ func TestPubSubWithMultiplePeers(t *testing.T) {
 	mockBC3 := NewMockBlockchain()
 
 	// Create three P2P services
-	service1, err := NewService("/ip4/127.0.0.1/tcp/0", mockBC1)
+	service1, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, mockBC1)
 	require.NoError(t, err)
 
-	service2, err := NewService("/ip4/127.0.0.1/tcp/0", mockBC2)
+	service2, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, mockBC2)
 	require.NoError(t, err)
 
-	service3, err := NewService("/ip4/127.0.0.1/tcp/0", mockBC3)
+	service3, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, mockBC3)
 	require.NoError(t, err)
 
 	// Start all services
@@ -168,3 +169,46 @@ func TestPubSubWithMultiplePeers(t *testing.T) {
 	assert.NotNil(t, block3)
 	assert.Equal(t, testBlock.Height, block3.Height)
 }
+
+// TestNetworkIDMismatch tests that services on different networks never exchange blocks
+func TestNetworkIDMismatch(t *testing.T) {
+	mockBC1 := NewMockBlockchain()
+	mockBC2 := NewMockBlockchain()
+
+	service1, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, mockBC1)
+	require.NoError(t, err)
+	service1.SetNetworkID("testnet-a")
+
+	service2, err := NewService([]string{"/ip4/127.0.0.1/tcp/0"}, nil, mockBC2)
+	require.NoError(t, err)
+	service2.SetNetworkID("testnet-b")
+
+	err = service1.Start()
+	require.NoError(t, err)
+	defer service1.Stop()
+
+	err = service2.Start()
+	require.NoError(t, err)
+	defer service2.Stop()
+
+	// The handshake refuses the connection
+	addr2 := service2.host.Addrs()[0].String() + "/p2p/" + service2.host.ID().String()
+	err = service1.Connect(addr2)
+	assert.Error(t, err, "Connecting to a peer on another network should fail")
+	assert.NotContains(t, service1.Peers(), service2.host.ID())
+
+	// Even with a raw transport connection, topics are scoped by network
+	err = service1.host.Connect(service1.ctx, peer.AddrInfo{ID: service2.host.ID(), Addrs: service2.host.Addrs()})
+	require.NoError(t, err)
+	time.Sleep(500 * time.Millisecond)
+
+	testBlock := &block.Block{Height: 1, Txn: block.Transaction{Amount: 100}}
+	err = service1.BroadcastBlock(testBlock)
+	require.NoError(t, err)
+
+	time.Sleep(500 * time.Millisecond)
+
+	mockBC2.blocksMutex.RLock()
+	defer mockBC2.blocksMutex.RUnlock()
+	assert.Empty(t, mockBC2.blocks, "Block from another network should never be received")
+}
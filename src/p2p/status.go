@@ -0,0 +1,125 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// DefaultStatusInterval is how often a node announces its tip to its peers
+	DefaultStatusInterval = 10 * time.Second
+
+	maxStatusSize    = 256         // A status message is two numbers, anything longer is dropped
+	minStatusSpacing = time.Second // Statuses from a peer closer together than this are dropped
+)
+
+// StatusMessage is the tip a node announces to its peers every status interval
+type StatusMessage struct {
+	TipHeight uint64   `json:"tip_height"`
+	TipHash   [32]byte `json:"tip_hash"`
+}
+
+type peerStatus struct {
+	status StatusMessage
+	at     time.Time
+}
+
+// SetStatusInterval sets how often the tip is announced, it must be called before Start
+func (s *Service) SetStatusInterval(interval time.Duration) {
+	s.statusInterval = interval
+}
+
+// PeerStatus returns the latest tip a peer announced, the one from its handshake until it
+// announced another
+func (s *Service) PeerStatus(peerID peer.ID) (StatusMessage, bool) {
+	s.peersMu.RLock()
+	defer s.peersMu.RUnlock()
+	if status, ok := s.peerStatuses[peerID]; ok {
+		return status.status, true
+	}
+	if handshake, ok := s.peerHandshakes[peerID]; ok {
+		return StatusMessage{TipHeight: handshake.TipHeight, TipHash: handshake.TipHash}, true
+	}
+	return StatusMessage{}, false
+}
+
+// statusJitter spreads announcements over 75% to 125% of the interval, so nodes started
+// together do not all announce at once
+func statusJitter(interval time.Duration) time.Duration {
+	if interval < 2 {
+		return interval
+	}
+	return interval - interval/4 + rand.N(interval/2)
+}
+
+// announceStatus publishes the tip about every status interval until ctx is done
+func (s *Service) announceStatus(ctx context.Context) {
+	timer := time.NewTimer(statusJitter(s.statusInterval))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		timer.Reset(statusJitter(s.statusInterval))
+
+		topic := s.topicName(statusTopic)
+		if len(s.transport.TopicPeers(topic)) == 0 {
+			continue
+		}
+		tip, err := s.blockchain.GetTipBlock()
+		if err != nil || tip == nil {
+			continue
+		}
+		data, err := json.Marshal(StatusMessage{TipHeight: tip.Height, TipHash: tip.Hash()})
+		if err != nil {
+			continue
+		}
+		if err := s.transport.Broadcast(ctx, topic, data); err != nil {
+			fmt.Printf("Error announcing status: %s\n", err)
+		}
+	}
+}
+
+// handleStatusMessage records the tip a peer announced
+func (s *Service) handleStatusMessage(from peer.ID, data []byte) {
+	if len(data) > maxStatusSize {
+		fmt.Printf("Dropping %d byte status from %s, above the %d byte limit\n", len(data), from, maxStatusSize)
+		return
+	}
+
+	var status StatusMessage
+	if err := json.Unmarshal(data, &status); err != nil {
+		fmt.Printf("Error unmarshaling status from %s: %s\n", from, err)
+		return
+	}
+
+	now := time.Now()
+	s.peersMu.Lock()
+	handshake, ok := s.peerHandshakes[from]
+	if !ok {
+		s.peersMu.Unlock()
+		return
+	}
+	previous := handshake.TipHash
+	if last, ok := s.peerStatuses[from]; ok {
+		if now.Sub(last.at) < minStatusSpacing {
+			s.peersMu.Unlock()
+			return
+		}
+		previous = last.status.TipHash
+	}
+	s.peerStatuses[from] = peerStatus{status: status, at: now}
+	s.peersMu.Unlock()
+
+	// A new tip may be a block whose gossip we missed
+	if status.TipHash != previous {
+		s.blockchain.TipAnnounced(from, status)
+	}
+}
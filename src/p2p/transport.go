@@ -0,0 +1,202 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Stream is a bidirectional request/response channel to one peer
+type Stream interface {
+	io.ReadWriteCloser
+	CloseWrite() error
+	RemotePeer() peer.ID
+}
+
+// StreamHandler serves streams opened by peers for one protocol
+type StreamHandler func(stream Stream)
+
+// ConnHandler is told when the first connection to a peer opens, in which direction, and when
+// the last one closes
+type ConnHandler func(peerID peer.ID, dir network.Direction, connected bool)
+
+// Transport carries the service's traffic, libp2p by default and memory in tests
+type Transport interface {
+	ID() peer.ID
+	Connect(ctx context.Context, pi peer.AddrInfo) error
+	ClosePeer(peerID peer.ID) error
+	Peers() []peer.ID // Peers with an open connection
+	NewStream(ctx context.Context, peerID peer.ID, proto protocol.ID) (Stream, error)
+	SetStreamHandler(proto protocol.ID, handler StreamHandler)
+	SetConnHandler(handler ConnHandler)
+	Broadcast(ctx context.Context, topic string, data []byte) error
+	Subscribe(ctx context.Context, topic string, handler func(from peer.ID, data []byte)) error
+	TopicPeers(topic string) []peer.ID // Connected peers subscribed to topic
+	Close() error
+}
+
+// libp2pTransport sends streams over a libp2p host and broadcasts through GossipSub
+type libp2pTransport struct {
+	host    host.Host
+	mu      sync.Mutex
+	ps      *pubsub.PubSub
+	topics  map[string]*pubsub.Topic
+	subs    []*pubsub.Subscription
+	readers sync.WaitGroup // Goroutines reading the subscriptions
+}
+
+func newLibp2pTransport(h host.Host) *libp2pTransport {
+	return &libp2pTransport{host: h, topics: make(map[string]*pubsub.Topic)}
+}
+
+type libp2pStream struct {
+	network.Stream
+}
+
+func (s libp2pStream) RemotePeer() peer.ID {
+	return s.Conn().RemotePeer()
+}
+
+func (t *libp2pTransport) ID() peer.ID {
+	return t.host.ID()
+}
+
+func (t *libp2pTransport) Connect(ctx context.Context, pi peer.AddrInfo) error {
+	return t.host.Connect(ctx, pi)
+}
+
+func (t *libp2pTransport) ClosePeer(peerID peer.ID) error {
+	return t.host.Network().ClosePeer(peerID)
+}
+
+func (t *libp2pTransport) Peers() []peer.ID {
+	return t.host.Network().Peers()
+}
+
+func (t *libp2pTransport) NewStream(ctx context.Context, peerID peer.ID, proto protocol.ID) (Stream, error) {
+	stream, err := t.host.NewStream(ctx, peerID, proto)
+	if err != nil {
+		return nil, err
+	}
+	return libp2pStream{stream}, nil
+}
+
+func (t *libp2pTransport) SetStreamHandler(proto protocol.ID, handler StreamHandler) {
+	t.host.SetStreamHandler(proto, func(stream network.Stream) {
+		handler(libp2pStream{stream})
+	})
+}
+
+func (t *libp2pTransport) SetConnHandler(handler ConnHandler) {
+	t.host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(n network.Network, conn network.Conn) {
+			handler(conn.RemotePeer(), conn.Stat().Direction, true)
+		},
+		DisconnectedF: func(n network.Network, conn network.Conn) {
+			// Peers are often linked by more than one connection
+			if n.Connectedness(conn.RemotePeer()) != network.Connected {
+				handler(conn.RemotePeer(), conn.Stat().Direction, false)
+			}
+		},
+	})
+}
+
+// topic joins a GossipSub topic once, creating the router on first use
+func (t *libp2pTransport) topic(ctx context.Context, name string) (*pubsub.Topic, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.ps == nil {
+		ps, err := pubsub.NewGossipSub(ctx, t.host)
+		if err != nil {
+			return nil, err
+		}
+		t.ps = ps
+	}
+
+	if topic, ok := t.topics[name]; ok {
+		return topic, nil
+	}
+	topic, err := t.ps.Join(name)
+	if err != nil {
+		return nil, err
+	}
+	t.topics[name] = topic
+	return topic, nil
+}
+
+func (t *libp2pTransport) Broadcast(ctx context.Context, topic string, data []byte) error {
+	t.mu.Lock()
+	joined, ok := t.topics[topic]
+	t.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("pubsub not initialized")
+	}
+	return joined.Publish(ctx, data)
+}
+
+func (t *libp2pTransport) Subscribe(ctx context.Context, topic string, handler func(from peer.ID, data []byte)) error {
+	joined, err := t.topic(ctx, topic)
+	if err != nil {
+		return err
+	}
+	sub, err := joined.Subscribe()
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.subs = append(t.subs, sub)
+	t.mu.Unlock()
+
+	t.readers.Add(1)
+	go func() {
+		defer t.readers.Done()
+		for {
+			msg, err := sub.Next(ctx)
+			if err != nil {
+				// Context canceled or subscription closed
+				return
+			}
+			handler(msg.ReceivedFrom, msg.Data)
+		}
+	}()
+	return nil
+}
+
+func (t *libp2pTransport) TopicPeers(topic string) []peer.ID {
+	t.mu.Lock()
+	joined, ok := t.topics[topic]
+	t.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return joined.ListPeers()
+}
+
+// Close leaves every topic before closing the host, and returns once the subscription
+// readers have exited
+func (t *libp2pTransport) Close() error {
+	t.mu.Lock()
+	subs, topics := t.subs, t.topics
+	t.subs, t.topics = nil, make(map[string]*pubsub.Topic)
+	t.mu.Unlock()
+
+	// A topic can only be closed once nothing is subscribed to it
+	for _, sub := range subs {
+		sub.Cancel()
+	}
+	for name, topic := range topics {
+		if err := topic.Close(); err != nil {
+			fmt.Printf("Error closing topic %s: %s\n", name, err)
+		}
+	}
+	t.readers.Wait()
+	return t.host.Close()
+}
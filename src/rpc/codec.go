@@ -0,0 +1,196 @@
+package rpc
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	netRPC "net/rpc"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCallTimeout bounds how long a call may run before the client gets an error
+	DefaultCallTimeout = 30 * time.Second
+
+	// maxRequestSize bounds the encoded header and arguments of one call, the largest
+	// legitimate request is a GetBalances with maxBalancesPerCall addresses
+	maxRequestSize = 1 << 20
+
+	// requestReadTimeout bounds reading the arguments once a request header arrived, a
+	// connection may stay idle between calls for as long as it likes
+	requestReadTimeout = 10 * time.Second
+)
+
+// methodTimeouts holds the calls that wait on purpose, they get their own cap plus the default
+var methodTimeouts = map[string]time.Duration{
+	"BlockchainService.WaitForTip":     maxWaitForTip + DefaultCallTimeout,
+	"BlockchainService.SendTxnAndWait": maxWaitForTxn + DefaultCallTimeout,
+}
+
+var errRequestTooLarge = fmt.Errorf("request larger than %d bytes", maxRequestSize)
+
+// budgetReader fails reads once more than its budget has been read since the last reset
+type budgetReader struct {
+	r      io.Reader
+	budget int
+}
+
+func (b *budgetReader) Read(p []byte) (int, error) {
+	if b.budget <= 0 {
+		return 0, errRequestTooLarge
+	}
+	if len(p) > b.budget {
+		p = p[:b.budget]
+	}
+	n, err := b.r.Read(p)
+	b.budget -= n
+	return n, err
+}
+
+// serverCodec is the gob codec of net/rpc with limits: every request gets a size budget and a
+// deadline for its arguments, and a call still running after its timeout is answered with
+// ErrTimeout. The reply the handler sends later is dropped.
+type serverCodec struct {
+	conn    net.Conn
+	budget  *budgetReader
+	dec     *gob.Decoder
+	encBuf  *bufio.Writer
+	enc     *gob.Encoder
+	timeout time.Duration
+
+	header netRPC.Request // last header read, to know which call the arguments belong to
+	broken bool           // the stream lost its framing, the connection must be closed
+
+	mu       sync.Mutex // guards writes and the maps below
+	pending  map[uint64]*time.Timer
+	timedOut map[uint64]bool
+	closed   bool
+}
+
+func newServerCodec(conn net.Conn, timeout time.Duration) *serverCodec {
+	budget := &budgetReader{r: conn}
+	encBuf := bufio.NewWriter(conn)
+	return &serverCodec{
+		conn:     conn,
+		budget:   budget,
+		dec:      gob.NewDecoder(bufio.NewReader(budget)),
+		encBuf:   encBuf,
+		enc:      gob.NewEncoder(encBuf),
+		timeout:  timeout,
+		pending:  make(map[uint64]*time.Timer),
+		timedOut: make(map[uint64]bool),
+	}
+}
+
+func (c *serverCodec) ReadRequestHeader(r *netRPC.Request) error {
+	if c.broken {
+		return errRequestTooLarge
+	}
+	c.budget.budget = maxRequestSize
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	c.header = *r
+	return nil
+}
+
+func (c *serverCodec) ReadRequestBody(body any) error {
+	c.conn.SetReadDeadline(time.Now().Add(requestReadTimeout))
+	err := c.dec.Decode(body)
+	c.conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		if errors.Is(err, errRequestTooLarge) {
+			c.broken = true
+		}
+		return err
+	}
+	if body != nil {
+		c.startTimer(c.header.ServiceMethod, c.header.Seq)
+	}
+	return nil
+}
+
+// startTimer answers the call with ErrTimeout unless it replied before its timeout
+func (c *serverCodec) startTimer(method string, seq uint64) {
+	timeout := c.timeout
+	if t, ok := methodTimeouts[method]; ok && t > timeout {
+		timeout = t
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[seq] = time.AfterFunc(timeout, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if _, ok := c.pending[seq]; !ok {
+			return
+		}
+		delete(c.pending, seq)
+		c.timedOut[seq] = true
+
+		log.Printf("RPC call %s timed out after %s", method, timeout)
+		err := wireError(fmt.Errorf("%w: %s did not finish within %s", ErrTimeout, method, timeout))
+		c.write(&netRPC.Response{ServiceMethod: method, Seq: seq, Error: err.Error()}, struct{}{})
+	})
+}
+
+func (c *serverCodec) WriteResponse(r *netRPC.Response, body any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if timer, ok := c.pending[r.Seq]; ok {
+		timer.Stop()
+		delete(c.pending, r.Seq)
+	}
+	if c.timedOut[r.Seq] {
+		delete(c.timedOut, r.Seq)
+		return nil
+	}
+	return c.write(r, body)
+}
+
+// write encodes a response, c.mu must be held
+func (c *serverCodec) write(r *netRPC.Response, body any) error {
+	if c.closed {
+		return net.ErrClosed
+	}
+	if err := c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Gob couldn't encode the header, this shouldn't happen
+			log.Println("rpc: gob error encoding response:", err)
+			c.closeLocked()
+		}
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Was a gob problem encoding the body but the header has been written
+			log.Println("rpc: gob error encoding body:", err)
+			c.closeLocked()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *serverCodec) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeLocked()
+}
+
+func (c *serverCodec) closeLocked() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	for seq, timer := range c.pending {
+		timer.Stop()
+		delete(c.pending, seq)
+	}
+	return c.conn.Close()
+}
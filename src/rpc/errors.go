@@ -0,0 +1,77 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	netRPC "net/rpc"
+	"strconv"
+	"strings"
+)
+
+// ErrorCode classifies a failed call so clients can tell failures apart without matching messages
+type ErrorCode int
+
+const (
+	CodeUnknown ErrorCode = iota
+	CodeBlockNotFound
+	CodeAccountNotFound
+	CodeInsufficientFunds
+	CodeTimeout
+	CodeMempoolFull
+)
+
+// Error is a failure with a code. net/rpc sends only the message of a returned error, so the
+// service writes the code in front of the message and ParseError reads it back.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+var (
+	ErrBlockNotFound     = &Error{Code: CodeBlockNotFound, Message: "block not found"}
+	ErrAccountNotFound   = &Error{Code: CodeAccountNotFound, Message: "account not found"}
+	ErrInsufficientFunds = &Error{Code: CodeInsufficientFunds, Message: "insufficient funds"}
+	ErrTimeout           = &Error{Code: CodeTimeout, Message: "call timed out"}
+	ErrMempoolFull       = &Error{Code: CodeMempoolFull, Message: "mempool full"}
+)
+
+// codePrefix starts the message of an error sent with a code
+const codePrefix = "rpc error "
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is matches errors with the same code, whatever their message
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// wireError puts the code of an *Error in err's chain in front of err's message
+func wireError(err error) error {
+	var coded *Error
+	if !errors.As(err, &coded) {
+		return err
+	}
+	return fmt.Errorf("%s%d: %s", codePrefix, coded.Code, err.Error())
+}
+
+// ParseError turns the error a call failed with back into an *Error when the service sent a
+// code, other errors are returned unchanged
+func ParseError(err error) error {
+	var serverErr netRPC.ServerError
+	if !errors.As(err, &serverErr) {
+		return err
+	}
+	rest, ok := strings.CutPrefix(string(serverErr), codePrefix)
+	if !ok {
+		return err
+	}
+	code, message, ok := strings.Cut(rest, ": ")
+	n, convErr := strconv.Atoi(code)
+	if !ok || convErr != nil {
+		return err
+	}
+	return &Error{Code: ErrorCode(n), Message: message}
+}
@@ -1,11 +1,27 @@
 package rpc
 
 import (
-	"errors"
+	"fmt"
+	"time"
 
 	"github.com/nanlour/da/src/block"
 )
 
+// maxWaitForTip caps how long a single WaitForTip call may hold a connection
+const maxWaitForTip = time.Minute
+
+// maxBalancesPerCall caps how many addresses one GetBalances call may ask for
+const maxBalancesPerCall = 1000
+
+// maxHistoryPerCall caps how many entries one GetAccountHistory call may return
+const maxHistoryPerCall = 500
+
+// maxBlocksPerCall caps how many blocks one GetMainChain call may ask for
+const maxBlocksPerCall = 100
+
+// maxWaitForTxn caps how long a single SendTxnAndWait call may hold a connection
+const maxWaitForTxn = 5 * time.Minute
+
 // BlockchainService defines the RPC methods for blockchain interaction
 type BlockchainService struct {
 	blockchain BlockchainInterface
@@ -13,22 +29,121 @@ type BlockchainService struct {
 
 type BlockchainInterface interface {
 	GetBlockByHash(hash []byte) (*block.Block, error)
+	GetMainChain(from, to uint64) ([]block.Block, error) // Up to the tip when to is above it
 	GetTipBlock() (*block.Block, error)
 	GetAddress() ([32]byte, error)
 	GetAccountBalance(address *[32]byte) (float64, error)
+	GetAccountBalances(addresses [][32]byte) (map[[32]byte]float64, error) // Zero for accounts never written
 	SendTxn(dest [32]byte, amount float64) error
+	SubmitTxn(dest [32]byte, amount float64) ([32]byte, error)
+	GetTransactionStatus(txHash [32]byte) (bool, uint64, uint64, error)
+	GetEpochInfo() (EpochInfo, error)
+	GetBlockReceipts(blockHash [32]byte) ([]Receipt, error)
+	GetAccountHistory(address [32]byte, offset, limit int) ([]AccountTxn, error)
+	Faucet(address [32]byte) error
+	GetDBSize() (uint64, error)
+	SyncStatus() SyncStatus
+	MiningStats() MiningStats
+	MempoolStats() MempoolStats
+	TipChanged() <-chan struct{}
 }
 
 // SendTxnArgs defines parameters for the SendTxn RPC method
 type SendTxnArgs struct {
 	Destination [32]byte
 	Amount      float64
+	Timeout     time.Duration // Only used by SendTxnAndWait, capped at maxWaitForTxn
+}
+
+// TxnResult locates a transaction sent by SendTxnAndWait on the main chain
+type TxnResult struct {
+	TxHash      [32]byte
+	BlockHash   [32]byte
+	BlockHeight uint64
+}
+
+// WaitForTipArgs defines parameters for the WaitForTip RPC method
+type WaitForTipArgs struct {
+	Known   [32]byte      // Tip hash the caller already has
+	Timeout time.Duration // Capped at maxWaitForTip
+}
+
+// MainChainArgs defines parameters for the GetMainChain RPC method
+type MainChainArgs struct {
+	FromHeight uint64
+	ToHeight   uint64 // Inclusive, at most maxBlocksPerCall-1 above FromHeight
+}
+
+// AccountTxn is a transaction on the main chain sent from or paying an account
+type AccountTxn struct {
+	Height uint64
+	TxHash [32]byte
+}
+
+// AccountHistoryArgs defines parameters for the GetAccountHistory RPC method
+type AccountHistoryArgs struct {
+	Address [32]byte
+	Offset  int // Entries to skip, counted from the newest
+	Limit   int // Capped at maxHistoryPerCall
+}
+
+// TxnStatus describes where a transaction is in its lifecycle
+type TxnStatus struct {
+	Confirmed     bool
+	Pending       bool
+	BlockHeight   uint64
+	Confirmations uint64
+}
+
+// SyncStatus reports the progress of the initial block download
+type SyncStatus struct {
+	Syncing       bool
+	CurrentHeight uint64
+	TargetHeight  uint64  // Tip height of the peer last synced from
+	Progress      float64 // Percentage of TargetHeight reached
+}
+
+// MiningStats reports what the node's miner has done since the node started
+type MiningStats struct {
+	Mining        bool      // Whether the mining loop is running
+	Difficulty    uint64    // VDF iterations of the block last mined or being mined, zero before the first
+	BlocksMined   uint64    // Blocks mined on the tip they were built on
+	LastBlockTime time.Time // When the last of them was mined, zero before the first
+}
+
+// MempoolStats summarises the transactions waiting in the node's pool
+type MempoolStats struct {
+	Pending   int              // Transactions waiting to be mined
+	BySender  map[[32]byte]int // Pending transactions per sender
+	Outflow   float64          // Total amount the pending transactions move out of their senders
+	OldestAge time.Duration    // How long the oldest has waited, zero when the pool is empty
+}
+
+// Receipt records one payment of a transaction applied in a block, or with zero TxHash
+// and From the block reward
+type Receipt struct {
+	TxHash  [32]byte
+	From    [32]byte
+	To      [32]byte
+	Amount  float64
+	Success bool // False when the sender could not cover the transaction
+}
+
+// EpochInfo describes the epoch the chain tip is in and the difficulty blocks are mined at
+type EpochInfo struct {
+	EpochBeginHash   [32]byte
+	StartHeight      uint64
+	TipHeight        uint64
+	Difficulty       uint64 // Stake-adjusted difficulty the node last drew for its own key, zero before it drew one
+	MiningDifficulty uint64 // Configured difficulty the stake adjustment starts from
+	DifficultyFloor  uint64
+	DifficultyCap    float64
 }
 
 func (s *BlockchainService) GetTip(args *struct{}, reply *[32]byte) error {
 	TipBlock, err := s.blockchain.GetTipBlock()
 	if err != nil {
-		return err
+		return wireError(err)
 	}
 	var hashArray [32]byte
 	hashArray = TipBlock.Hash()
@@ -43,12 +158,12 @@ func (s *BlockchainService) GetBlockByHash(hash [32]byte, reply *block.Block) er
 	// Get block head data from database
 	blockHead, err := s.blockchain.GetBlockByHash(hash[:])
 	if err != nil {
-		return err
+		return wireError(err)
 	}
 
 	// If block doesn't exist
 	if blockHead == nil {
-		return errors.New("block not found")
+		return wireError(ErrBlockNotFound)
 	}
 
 	// Copy the block head data to the reply pointer
@@ -57,11 +172,31 @@ func (s *BlockchainService) GetBlockByHash(hash [32]byte, reply *block.Block) er
 	return nil
 }
 
+// GetMainChain replies with the blocks of the current main chain from FromHeight to ToHeight,
+// ending early at the tip. Blocks are resolved by height rather than by walking PreHash, so
+// each is on the main chain even while forks are stored.
+func (s *BlockchainService) GetMainChain(args *MainChainArgs, reply *[]block.Block) error {
+	if args.FromHeight > args.ToHeight {
+		return fmt.Errorf("from height %d is above to height %d", args.FromHeight, args.ToHeight)
+	}
+	if args.ToHeight-args.FromHeight >= maxBlocksPerCall {
+		return fmt.Errorf("at most %d blocks per call, asked for heights %d to %d", maxBlocksPerCall, args.FromHeight, args.ToHeight)
+	}
+
+	blocks, err := s.blockchain.GetMainChain(args.FromHeight, args.ToHeight)
+	if err != nil {
+		return wireError(err)
+	}
+
+	*reply = blocks
+	return nil
+}
+
 func (s *BlockchainService) GetBalanceByAddress(address [32]byte, reply *float64) error {
 	// Get balance from database
 	balance, err := s.blockchain.GetAccountBalance(&address)
 	if err != nil {
-		return err
+		return wireError(err)
 	}
 
 	// Set the reply value
@@ -70,11 +205,26 @@ func (s *BlockchainService) GetBalanceByAddress(address [32]byte, reply *float64
 	return nil
 }
 
+// GetBalances replies with the balance of every address, accounts never written hold zero
+func (s *BlockchainService) GetBalances(addrs [][32]byte, reply *map[[32]byte]float64) error {
+	if len(addrs) > maxBalancesPerCall {
+		return fmt.Errorf("at most %d addresses per call, got %d", maxBalancesPerCall, len(addrs))
+	}
+
+	balances, err := s.blockchain.GetAccountBalances(addrs)
+	if err != nil {
+		return wireError(err)
+	}
+
+	*reply = balances
+	return nil
+}
+
 func (s *BlockchainService) SendTxn(args *SendTxnArgs, reply *bool) error {
 	// Call the blockchain's SendTxn method with the provided arguments
 	err := s.blockchain.SendTxn(args.Destination, args.Amount)
 	if err != nil {
-		return err
+		return wireError(err)
 	}
 
 	// Set reply to true to indicate success
@@ -82,10 +232,199 @@ func (s *BlockchainService) SendTxn(args *SendTxnArgs, reply *bool) error {
 	return nil
 }
 
+// SubmitTxn sends a transaction like SendTxn but replies with the transaction hash
+func (s *BlockchainService) SubmitTxn(args *SendTxnArgs, reply *[32]byte) error {
+	hash, err := s.blockchain.SubmitTxn(args.Destination, args.Amount)
+	if err != nil {
+		return wireError(err)
+	}
+
+	*reply = hash
+	return nil
+}
+
+// SendTxnAndWait sends a transaction and replies once a block on the main chain includes it.
+// It fails if the transaction is dropped or the timeout passes first, the caller may resend.
+func (s *BlockchainService) SendTxnAndWait(args *SendTxnArgs, reply *TxnResult) error {
+	timeout := args.Timeout
+	if timeout <= 0 || timeout > maxWaitForTxn {
+		timeout = maxWaitForTxn
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	hash, err := s.blockchain.SubmitTxn(args.Destination, args.Amount)
+	if err != nil {
+		return wireError(err)
+	}
+	reply.TxHash = hash
+
+	for {
+		// Subscribe before checking the status so the including block is not missed
+		changed := s.blockchain.TipChanged()
+		confirmed, height, _, err := s.blockchain.GetTransactionStatus(hash)
+		if err != nil {
+			return wireError(err)
+		}
+		if confirmed {
+			b, err := s.mainChainBlock(height)
+			if err != nil {
+				return wireError(err)
+			}
+			reply.BlockHash = b.Hash()
+			reply.BlockHeight = height
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return fmt.Errorf("transaction %x not confirmed within %s", hash, timeout)
+		}
+	}
+}
+
+// mainChainBlock walks back from the tip to the block at height
+func (s *BlockchainService) mainChainBlock(height uint64) (*block.Block, error) {
+	b, err := s.blockchain.GetTipBlock()
+	for err == nil && b != nil && b.Height > height {
+		b, err = s.blockchain.GetBlockByHash(b.PreHash[:])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if b == nil || b.Height != height {
+		return nil, fmt.Errorf("no block at height %d", height)
+	}
+	return b, nil
+}
+
+func (s *BlockchainService) GetTransactionStatus(hash [32]byte, reply *TxnStatus) error {
+	confirmed, height, confirmations, err := s.blockchain.GetTransactionStatus(hash)
+	if err != nil {
+		return wireError(err)
+	}
+
+	*reply = TxnStatus{
+		Confirmed:     confirmed,
+		Pending:       !confirmed,
+		BlockHeight:   height,
+		Confirmations: confirmations,
+	}
+	return nil
+}
+
+// GetEpochInfo reports the current epoch and the effective difficulty parameters
+func (s *BlockchainService) GetEpochInfo(args *struct{}, reply *EpochInfo) error {
+	info, err := s.blockchain.GetEpochInfo()
+	if err != nil {
+		return wireError(err)
+	}
+
+	*reply = info
+	return nil
+}
+
+// GetBlockReceipts replies with the receipts of a block on the main chain
+func (s *BlockchainService) GetBlockReceipts(blockHash [32]byte, reply *[]Receipt) error {
+	receipts, err := s.blockchain.GetBlockReceipts(blockHash)
+	if err != nil {
+		return wireError(err)
+	}
+
+	*reply = receipts
+	return nil
+}
+
+// GetAccountHistory replies with a page of an account's transactions, newest first
+func (s *BlockchainService) GetAccountHistory(args *AccountHistoryArgs, reply *[]AccountTxn) error {
+	if args.Offset < 0 || args.Limit < 0 {
+		return fmt.Errorf("offset and limit must not be negative")
+	}
+	limit := min(args.Limit, maxHistoryPerCall)
+
+	history, err := s.blockchain.GetAccountHistory(args.Address, args.Offset, limit)
+	if err != nil {
+		return wireError(err)
+	}
+
+	*reply = history
+	return nil
+}
+
+// GetDBSize replies with the approximate size of the node's database in bytes
+func (s *BlockchainService) GetDBSize(args *struct{}, reply *uint64) error {
+	size, err := s.blockchain.GetDBSize()
+	if err != nil {
+		return wireError(err)
+	}
+
+	*reply = size
+	return nil
+}
+
+// GetSyncStatus replies with how far the node is through its initial block download
+func (s *BlockchainService) GetSyncStatus(args *struct{}, reply *SyncStatus) error {
+	*reply = s.blockchain.SyncStatus()
+	return nil
+}
+
+// GetMiningStats replies with the current difficulty and the blocks this node has mined
+func (s *BlockchainService) GetMiningStats(args *struct{}, reply *MiningStats) error {
+	*reply = s.blockchain.MiningStats()
+	return nil
+}
+
+// GetMempoolStats replies with aggregate figures about the pending transactions
+func (s *BlockchainService) GetMempoolStats(args *struct{}, reply *MempoolStats) error {
+	*reply = s.blockchain.MempoolStats()
+	return nil
+}
+
+// Faucet sends testnet coins to the address if the node has the faucet enabled
+func (s *BlockchainService) Faucet(address [32]byte, reply *bool) error {
+	if err := s.blockchain.Faucet(address); err != nil {
+		return wireError(err)
+	}
+
+	*reply = true
+	return nil
+}
+
+// WaitForTip is a long poll, it replies with the tip hash once it differs from
+// args.Known or the timeout passes, whichever comes first
+func (s *BlockchainService) WaitForTip(args *WaitForTipArgs, reply *[32]byte) error {
+	timeout := args.Timeout
+	if timeout <= 0 || timeout > maxWaitForTip {
+		timeout = maxWaitForTip
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		// Subscribe before reading the tip so a change in between is not missed
+		changed := s.blockchain.TipChanged()
+		tip, err := s.blockchain.GetTipBlock()
+		if err != nil {
+			return wireError(err)
+		}
+		*reply = tip.Hash()
+		if *reply != args.Known {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
 func (s *BlockchainService) GetAddress(args *struct{}, reply *[32]byte) error {
 	address, err := s.blockchain.GetAddress()
 	if err != nil {
-		return err
+		return wireError(err)
 	}
 	*reply = address
 	return nil
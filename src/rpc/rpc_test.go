@@ -2,7 +2,12 @@ package rpc
 
 import (
 	"errors"
+	"fmt"
+	"net"
 	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -18,6 +23,18 @@ type MockBlockchain struct {
 	balances      map[[32]byte]float64
 	sendTxnCalled bool
 	sendTxnError  error
+	confirmedTxns map[[32]byte]uint64
+	pendingTxns   map[[32]byte]bool
+	faucetGrants  map[[32]byte]bool
+	receipts      map[[32]byte][]Receipt
+	history       map[[32]byte][]AccountTxn // Newest first
+	dbSize        uint64
+	dbSizeHang    chan struct{} // GetDBSize blocks until closed when set
+	syncStatus    SyncStatus
+	miningStats   MiningStats
+	mempoolStats  MempoolStats
+	tipMu         sync.Mutex
+	tipCh         chan struct{}
 }
 
 // NewMockBlockchain creates a new mock blockchain for testing
@@ -45,25 +62,44 @@ func NewMockBlockchain() *MockBlockchain {
 	balances[[32]byte{4, 5, 6}] = 200.0
 
 	return &MockBlockchain{
-		tipBlock: &tipBlock,
-		blocks:   blocks,
-		balances: balances,
+		tipBlock:      &tipBlock,
+		blocks:        blocks,
+		balances:      balances,
+		confirmedTxns: make(map[[32]byte]uint64),
+		pendingTxns:   make(map[[32]byte]bool),
 	}
 }
 
 // GetBlockByHash implements BlockchainInterface
 func (m *MockBlockchain) GetBlockByHash(hash []byte) (*block.Block, error) {
+	m.tipMu.Lock()
+	defer m.tipMu.Unlock()
 	var hashArray [32]byte
 	copy(hashArray[:], hash)
 
 	if block, exists := m.blocks[hashArray]; exists {
 		return block, nil
 	}
-	return nil, errors.New("block not found")
+	return nil, ErrBlockNotFound
+}
+
+// GetMainChain implements BlockchainInterface, the mock's main chain is its tip alone
+func (m *MockBlockchain) GetMainChain(from, to uint64) ([]block.Block, error) {
+	m.tipMu.Lock()
+	defer m.tipMu.Unlock()
+	if from > m.tipBlock.Height {
+		return nil, ErrBlockNotFound
+	}
+	if from == m.tipBlock.Height {
+		return []block.Block{*m.tipBlock}, nil
+	}
+	return nil, errors.New("only the tip is known")
 }
 
 // GetTipBlock implements BlockchainInterface
 func (m *MockBlockchain) GetTipBlock() (*block.Block, error) {
+	m.tipMu.Lock()
+	defer m.tipMu.Unlock()
 	if m.tipBlock == nil {
 		return nil, errors.New("no tip block")
 	}
@@ -80,7 +116,16 @@ func (m *MockBlockchain) GetAccountBalance(address *[32]byte) (float64, error) {
 	if balance, exists := m.balances[*address]; exists {
 		return balance, nil
 	}
-	return 0, errors.New("account not found")
+	return 0, ErrAccountNotFound
+}
+
+// GetAccountBalances implements BlockchainInterface
+func (m *MockBlockchain) GetAccountBalances(addresses [][32]byte) (map[[32]byte]float64, error) {
+	balances := make(map[[32]byte]float64, len(addresses))
+	for _, address := range addresses {
+		balances[address] = m.balances[address]
+	}
+	return balances, nil
 }
 
 // SendTxn implements BlockchainInterface
@@ -90,6 +135,135 @@ func (m *MockBlockchain) SendTxn(dest [32]byte, amount float64) error {
 	return m.sendTxnError
 }
 
+// SubmitTxn implements BlockchainInterface
+func (m *MockBlockchain) SubmitTxn(dest [32]byte, amount float64) ([32]byte, error) {
+	m.tipMu.Lock()
+	defer m.tipMu.Unlock()
+	m.sendTxnCalled = true
+	if m.sendTxnError != nil {
+		return [32]byte{}, m.sendTxnError
+	}
+	hash := [32]byte{dest[0], 0xff}
+	m.pendingTxns[hash] = true
+	return hash, nil
+}
+
+// GetBlockReceipts implements BlockchainInterface
+func (m *MockBlockchain) GetBlockReceipts(blockHash [32]byte) ([]Receipt, error) {
+	receipts, ok := m.receipts[blockHash]
+	if !ok {
+		return nil, errors.New("no receipts for block")
+	}
+	return receipts, nil
+}
+
+// GetAccountHistory implements BlockchainInterface
+func (m *MockBlockchain) GetAccountHistory(address [32]byte, offset, limit int) ([]AccountTxn, error) {
+	history := m.history[address]
+	if offset >= len(history) {
+		return nil, nil
+	}
+	return history[offset:min(offset+limit, len(history))], nil
+}
+
+// GetDBSize implements BlockchainInterface
+func (m *MockBlockchain) GetDBSize() (uint64, error) {
+	if m.dbSizeHang != nil {
+		<-m.dbSizeHang
+	}
+	return m.dbSize, nil
+}
+
+// SyncStatus implements BlockchainInterface
+func (m *MockBlockchain) SyncStatus() SyncStatus {
+	return m.syncStatus
+}
+
+// MiningStats implements BlockchainInterface
+func (m *MockBlockchain) MiningStats() MiningStats {
+	return m.miningStats
+}
+
+// MempoolStats implements BlockchainInterface
+func (m *MockBlockchain) MempoolStats() MempoolStats {
+	return m.mempoolStats
+}
+
+// GetTransactionStatus implements BlockchainInterface
+func (m *MockBlockchain) GetTransactionStatus(txHash [32]byte) (bool, uint64, uint64, error) {
+	m.tipMu.Lock()
+	defer m.tipMu.Unlock()
+	if height, exists := m.confirmedTxns[txHash]; exists {
+		return true, height, m.tipBlock.Height - height + 1, nil
+	}
+	if m.pendingTxns[txHash] {
+		return false, 0, 0, nil
+	}
+	return false, 0, 0, errors.New("transaction not found")
+}
+
+// GetEpochInfo implements BlockchainInterface
+func (m *MockBlockchain) GetEpochInfo() (EpochInfo, error) {
+	if m.tipBlock == nil {
+		return EpochInfo{}, errors.New("no tip block")
+	}
+	return EpochInfo{
+		EpochBeginHash:   m.tipBlock.EpochBeginHash,
+		TipHeight:        m.tipBlock.Height,
+		Difficulty:       12,
+		MiningDifficulty: 10,
+	}, nil
+}
+
+// Faucet implements BlockchainInterface, each address is granted once
+func (m *MockBlockchain) Faucet(address [32]byte) error {
+	if m.faucetGrants == nil {
+		m.faucetGrants = make(map[[32]byte]bool)
+	}
+	if m.faucetGrants[address] {
+		return errors.New("address already received coins")
+	}
+	m.faucetGrants[address] = true
+	return nil
+}
+
+// TipChanged implements BlockchainInterface
+func (m *MockBlockchain) TipChanged() <-chan struct{} {
+	m.tipMu.Lock()
+	defer m.tipMu.Unlock()
+	if m.tipCh == nil {
+		m.tipCh = make(chan struct{})
+	}
+	return m.tipCh
+}
+
+// Helper method to replace the tip and wake up WaitForTip callers
+func (m *MockBlockchain) setTip(b *block.Block) {
+	m.tipMu.Lock()
+	defer m.tipMu.Unlock()
+	m.blocks[b.Hash()] = b
+	m.tipBlock = b
+	if m.tipCh != nil {
+		close(m.tipCh)
+	}
+	m.tipCh = make(chan struct{})
+}
+
+// Helper method to mine a block confirming a pending transaction
+func (m *MockBlockchain) confirmTxn(txHash [32]byte, b *block.Block) bool {
+	m.tipMu.Lock()
+	if !m.pendingTxns[txHash] {
+		m.tipMu.Unlock()
+		return false
+	}
+	delete(m.pendingTxns, txHash)
+	m.confirmedTxns[txHash] = b.Height
+	m.tipMu.Unlock()
+
+	m.setTip(b)
+	return true
+}
+
 // Helper method to configure SendTxn to return an error
 func (m *MockBlockchain) SetSendTxnError(err error) {
 	m.sendTxnError = err
@@ -126,6 +300,57 @@ func TestStartStopRPCServer(t *testing.T) {
 	assert.Error(t, err, "Should not be able to connect after server is stopped")
 }
 
+// TestRPCServerBindAddr tests that the server listens only on the configured interface
+func TestRPCServerBindAddr(t *testing.T) {
+	server := NewRPCServer(0)
+	require.NoError(t, server.Start(NewMockBlockchain()))
+	defer server.Stop()
+
+	addr := server.Addr().(*net.TCPAddr)
+	assert.True(t, addr.IP.Equal(net.IPv4(127, 0, 0, 1)), "listening on %v", addr.IP)
+	client, err := rpc.Dial(SplitAddress(addr.String()))
+	require.NoError(t, err)
+	client.Close()
+
+	// An interface this host does not have cannot be bound
+	unreachable := NewRPCServerOn("tcp", "203.0.113.1:0")
+	assert.Error(t, unreachable.Start(NewMockBlockchain()))
+}
+
+// TestRPCServerUnixSocket tests serving over a Unix socket, only to the node's user, and that
+// a socket left behind by an unclean shutdown is replaced
+func TestRPCServerUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rpc.sock")
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	mockBC := NewMockBlockchain()
+	server := NewRPCServerOn("unix", path)
+	require.NoError(t, server.Start(mockBC))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	network, address := SplitAddress("unix:" + path)
+	assert.Equal(t, "unix", network)
+	client, err := rpc.Dial(network, address)
+	require.NoError(t, err)
+	var reply [32]byte
+	require.NoError(t, client.Call("BlockchainService.GetTip", struct{}{}, &reply))
+	assert.Equal(t, mockBC.tipBlock.Hash(), reply)
+	client.Close()
+
+	// A second server cannot take over a socket in use
+	assert.Error(t, NewRPCServerOn("unix", path).Start(NewMockBlockchain()))
+
+	require.NoError(t, server.Stop())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "socket should be removed on stop")
+}
+
 // TestGetTip tests the GetTip RPC method
 func TestGetTip(t *testing.T) {
 	mockBC := NewMockBlockchain()
@@ -180,6 +405,28 @@ func TestGetBlockByHashNotFound(t *testing.T) {
 	assert.Contains(t, err.Error(), "block not found", "Error message should indicate block not found")
 }
 
+// TestGetMainChain tests the GetMainChain RPC method and its range checks
+func TestGetMainChain(t *testing.T) {
+	mockBC := NewMockBlockchain()
+	server, client := setupRPCTest(t, mockBC)
+	defer server.Stop()
+
+	var reply []block.Block
+	err := client.Call("BlockchainService.GetMainChain", &MainChainArgs{FromHeight: 1, ToHeight: 5}, &reply)
+	require.NoError(t, err, "GetMainChain RPC call failed")
+	require.Len(t, reply, 1)
+	assert.Equal(t, mockBC.tipBlock.Hash(), reply[0].Hash())
+
+	err = client.Call("BlockchainService.GetMainChain", &MainChainArgs{FromHeight: 3, ToHeight: 2}, &reply)
+	assert.Error(t, err, "GetMainChain should refuse an empty range")
+
+	err = client.Call("BlockchainService.GetMainChain", &MainChainArgs{FromHeight: 0, ToHeight: maxBlocksPerCall}, &reply)
+	assert.Error(t, err, "GetMainChain should refuse too many blocks")
+
+	err = ParseError(client.Call("BlockchainService.GetMainChain", &MainChainArgs{FromHeight: 2, ToHeight: 2}, &reply))
+	assert.ErrorIs(t, err, ErrBlockNotFound, "heights above the tip should report the block as not found")
+}
+
 // TestGetBalanceByAddress tests the GetBalanceByAddress RPC method
 func TestGetBalanceByAddress(t *testing.T) {
 	mockBC := NewMockBlockchain()
@@ -218,6 +465,55 @@ func TestGetBalanceByAddressNotFound(t *testing.T) {
 	assert.Contains(t, err.Error(), "account not found", "Error message should indicate account not found")
 }
 
+// TestGetBalances tests the GetBalances RPC method with known and unknown addresses
+func TestGetBalances(t *testing.T) {
+	mockBC := NewMockBlockchain()
+	server, client := setupRPCTest(t, mockBC)
+	defer server.Stop()
+
+	known1, known2, unknown := [32]byte{1, 2, 3}, [32]byte{4, 5, 6}, [32]byte{0xee}
+	var reply map[[32]byte]float64
+	err := client.Call("BlockchainService.GetBalances", [][32]byte{known1, unknown, known2}, &reply)
+	require.NoError(t, err, "GetBalances RPC call failed")
+	assert.Equal(t, map[[32]byte]float64{known1: 500, known2: 200, unknown: 0}, reply)
+
+	err = client.Call("BlockchainService.GetBalances", make([][32]byte, maxBalancesPerCall+1), &reply)
+	assert.Error(t, err, "GetBalances should refuse too many addresses")
+}
+
+// TestErrorCodes tests that clients can tell failures apart by the code sent with them
+func TestErrorCodes(t *testing.T) {
+	mockBC := NewMockBlockchain()
+	server, client := setupRPCTest(t, mockBC)
+	defer server.Stop()
+
+	var b block.Block
+	err := ParseError(client.Call("BlockchainService.GetBlockByHash", [32]byte{0xaa}, &b))
+	assert.ErrorIs(t, err, ErrBlockNotFound)
+	assert.NotErrorIs(t, err, ErrAccountNotFound)
+
+	var balance float64
+	err = ParseError(client.Call("BlockchainService.GetBalanceByAddress", [32]byte{0xaa}, &balance))
+	assert.ErrorIs(t, err, ErrAccountNotFound)
+
+	var hash [32]byte
+	args := &SendTxnArgs{Destination: [32]byte{7}, Amount: 5}
+	mockBC.SetSendTxnError(fmt.Errorf("%w: balance 1, amount 5", ErrInsufficientFunds))
+	err = ParseError(client.Call("BlockchainService.SubmitTxn", args, &hash))
+	var rpcErr *Error
+	require.ErrorAs(t, err, &rpcErr)
+	assert.Equal(t, CodeInsufficientFunds, rpcErr.Code)
+	assert.Equal(t, "insufficient funds: balance 1, amount 5", rpcErr.Message)
+
+	// Errors without a code are left as they are
+	mockBC.SetSendTxnError(errors.New("network down"))
+	err = ParseError(client.Call("BlockchainService.SubmitTxn", args, &hash))
+	require.Error(t, err)
+	assert.False(t, errors.As(err, &rpcErr))
+	assert.Contains(t, err.Error(), "network down")
+	assert.NoError(t, ParseError(nil))
+}
+
 // TestSendTxn tests the SendTxn RPC method
 func TestSendTxn(t *testing.T) {
 	mockBC := NewMockBlockchain()
@@ -261,6 +557,254 @@ func TestSendTxnError(t *testing.T) {
 	assert.Contains(t, err.Error(), "insufficient funds", "Error message should indicate insufficient funds")
 }
 
+// TestGetTransactionStatus tests the SubmitTxn and GetTransactionStatus RPC methods
+func TestGetTransactionStatus(t *testing.T) {
+	mockBC := NewMockBlockchain()
+	server, client := setupRPCTest(t, mockBC)
+	defer server.Stop()
+
+	// Submit a transaction and check it is pending
+	args := SendTxnArgs{
+		Destination: [32]byte{7, 8, 9},
+		Amount:      50.0,
+	}
+	var hash [32]byte
+	err := client.Call("BlockchainService.SubmitTxn", &args, &hash)
+	require.NoError(t, err, "SubmitTxn RPC call failed")
+
+	var status TxnStatus
+	err = client.Call("BlockchainService.GetTransactionStatus", hash, &status)
+	require.NoError(t, err, "GetTransactionStatus RPC call failed")
+	assert.True(t, status.Pending, "Submitted transaction should be pending")
+	assert.False(t, status.Confirmed, "Submitted transaction should not be confirmed")
+
+	// Confirm the transaction at the tip height
+	mockBC.confirmedTxns[hash] = mockBC.tipBlock.Height
+	err = client.Call("BlockchainService.GetTransactionStatus", hash, &status)
+	require.NoError(t, err, "GetTransactionStatus RPC call failed")
+	assert.True(t, status.Confirmed, "Transaction should be confirmed")
+	assert.Equal(t, mockBC.tipBlock.Height, status.BlockHeight)
+	assert.Equal(t, uint64(1), status.Confirmations)
+
+	// Unknown transaction
+	err = client.Call("BlockchainService.GetTransactionStatus", [32]byte{0xaa}, &status)
+	assert.Error(t, err, "GetTransactionStatus should fail for unknown transaction")
+	assert.Contains(t, err.Error(), "transaction not found")
+}
+
+// TestGetEpochInfo tests the GetEpochInfo RPC method
+func TestGetEpochInfo(t *testing.T) {
+	mockBC := NewMockBlockchain()
+	mockBC.tipBlock.EpochBeginHash = [32]byte{0xe0}
+	server, client := setupRPCTest(t, mockBC)
+	defer server.Stop()
+
+	var info EpochInfo
+	err := client.Call("BlockchainService.GetEpochInfo", struct{}{}, &info)
+	require.NoError(t, err, "GetEpochInfo RPC call failed")
+	assert.Equal(t, mockBC.tipBlock.EpochBeginHash, info.EpochBeginHash)
+	assert.Equal(t, mockBC.tipBlock.Height, info.TipHeight)
+	assert.Equal(t, uint64(12), info.Difficulty)
+	assert.Equal(t, uint64(10), info.MiningDifficulty)
+
+	// Errors from the blockchain are passed through
+	mockBC.tipBlock = nil
+	err = client.Call("BlockchainService.GetEpochInfo", struct{}{}, &info)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no tip block")
+}
+
+// TestGetBlockReceipts tests the GetBlockReceipts RPC method
+func TestGetBlockReceipts(t *testing.T) {
+	mockBC := NewMockBlockchain()
+	tip := mockBC.tipBlock
+	want := []Receipt{{
+		TxHash:  tip.Txn.Hash(),
+		From:    tip.Txn.FromAddress,
+		To:      tip.Txn.ToAddress,
+		Amount:  tip.Txn.Amount,
+		Success: true,
+	}}
+	mockBC.receipts = map[[32]byte][]Receipt{tip.Hash(): want}
+	server, client := setupRPCTest(t, mockBC)
+	defer server.Stop()
+
+	var receipts []Receipt
+	err := client.Call("BlockchainService.GetBlockReceipts", tip.Hash(), &receipts)
+	require.NoError(t, err, "GetBlockReceipts RPC call failed")
+	assert.Equal(t, want, receipts)
+
+	// Unknown blocks are an error
+	err = client.Call("BlockchainService.GetBlockReceipts", [32]byte{0xaa}, &receipts)
+	assert.Error(t, err, "GetBlockReceipts should fail for an unknown block")
+}
+
+// TestGetAccountHistory tests paging an account's history
+func TestGetAccountHistory(t *testing.T) {
+	mockBC := NewMockBlockchain()
+	address := [32]byte{1, 2, 3}
+	mockBC.history = map[[32]byte][]AccountTxn{
+		address: {{Height: 7, TxHash: [32]byte{7}}, {Height: 4, TxHash: [32]byte{4}}, {Height: 1, TxHash: [32]byte{1}}},
+	}
+	server, client := setupRPCTest(t, mockBC)
+	defer server.Stop()
+
+	var page []AccountTxn
+	err := client.Call("BlockchainService.GetAccountHistory", &AccountHistoryArgs{Address: address, Offset: 1, Limit: 5}, &page)
+	require.NoError(t, err)
+	assert.Equal(t, []AccountTxn{{Height: 4, TxHash: [32]byte{4}}, {Height: 1, TxHash: [32]byte{1}}}, page)
+
+	err = client.Call("BlockchainService.GetAccountHistory", &AccountHistoryArgs{Address: address, Offset: -1, Limit: 5}, &page)
+	assert.Error(t, err)
+}
+
+// TestGetDBSize tests the GetDBSize RPC method
+func TestGetDBSize(t *testing.T) {
+	mockBC := NewMockBlockchain()
+	mockBC.dbSize = 12345
+	server, client := setupRPCTest(t, mockBC)
+	defer server.Stop()
+
+	var size uint64
+	err := client.Call("BlockchainService.GetDBSize", struct{}{}, &size)
+	require.NoError(t, err, "GetDBSize RPC call failed")
+	assert.Equal(t, uint64(12345), size)
+}
+
+// TestGetSyncStatus tests the GetSyncStatus RPC method
+func TestGetSyncStatus(t *testing.T) {
+	mockBC := NewMockBlockchain()
+	mockBC.syncStatus = SyncStatus{Syncing: true, CurrentHeight: 10, TargetHeight: 40, Progress: 25}
+	server, client := setupRPCTest(t, mockBC)
+	defer server.Stop()
+
+	var status SyncStatus
+	err := client.Call("BlockchainService.GetSyncStatus", struct{}{}, &status)
+	require.NoError(t, err, "GetSyncStatus RPC call failed")
+	assert.Equal(t, mockBC.syncStatus, status)
+}
+
+// TestGetMiningStats tests the GetMiningStats RPC method
+func TestGetMiningStats(t *testing.T) {
+	mockBC := NewMockBlockchain()
+	mockBC.miningStats = MiningStats{
+		Mining:        true,
+		Difficulty:    420,
+		BlocksMined:   3,
+		LastBlockTime: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	server, client := setupRPCTest(t, mockBC)
+	defer server.Stop()
+
+	var stats MiningStats
+	err := client.Call("BlockchainService.GetMiningStats", struct{}{}, &stats)
+	require.NoError(t, err, "GetMiningStats RPC call failed")
+	assert.True(t, stats.LastBlockTime.Equal(mockBC.miningStats.LastBlockTime))
+	stats.LastBlockTime = mockBC.miningStats.LastBlockTime
+	assert.Equal(t, mockBC.miningStats, stats)
+}
+
+// TestGetMempoolStats tests the GetMempoolStats RPC method
+func TestGetMempoolStats(t *testing.T) {
+	mockBC := NewMockBlockchain()
+	mockBC.mempoolStats = MempoolStats{
+		Pending:   3,
+		BySender:  map[[32]byte]int{{1}: 2, {2}: 1},
+		Outflow:   17.5,
+		OldestAge: 90 * time.Second,
+	}
+	server, client := setupRPCTest(t, mockBC)
+	defer server.Stop()
+
+	var stats MempoolStats
+	err := client.Call("BlockchainService.GetMempoolStats", struct{}{}, &stats)
+	require.NoError(t, err, "GetMempoolStats RPC call failed")
+	assert.Equal(t, mockBC.mempoolStats, stats)
+}
+
+// TestFaucet tests the Faucet RPC method
+func TestFaucet(t *testing.T) {
+	mockBC := NewMockBlockchain()
+	server, client := setupRPCTest(t, mockBC)
+	defer server.Stop()
+
+	var reply bool
+	err := client.Call("BlockchainService.Faucet", [32]byte{7, 8, 9}, &reply)
+	require.NoError(t, err, "Faucet RPC call failed")
+	assert.True(t, reply)
+
+	// Refusals from the blockchain are passed through
+	reply = false
+	err = client.Call("BlockchainService.Faucet", [32]byte{7, 8, 9}, &reply)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "already received")
+	assert.False(t, reply)
+}
+
+// TestSendTxnAndWait tests that SendTxnAndWait replies once the transaction is mined and fails
+// when no block includes it in time
+func TestSendTxnAndWait(t *testing.T) {
+	mockBC := NewMockBlockchain()
+	server, client := setupRPCTest(t, mockBC)
+	defer server.Stop()
+
+	dest := [32]byte{7, 8, 9}
+	txHash := [32]byte{dest[0], 0xff}
+	next := block.Block{PreHash: mockBC.tipBlock.Hash(), Height: 2}
+	go func() {
+		for !mockBC.confirmTxn(txHash, &next) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	var result TxnResult
+	err := client.Call("BlockchainService.SendTxnAndWait", &SendTxnArgs{Destination: dest, Amount: 5, Timeout: time.Minute}, &result)
+	require.NoError(t, err, "SendTxnAndWait RPC call failed")
+	assert.Equal(t, TxnResult{TxHash: txHash, BlockHash: next.Hash(), BlockHeight: 2}, result)
+
+	// Nothing mines the second transaction
+	start := time.Now()
+	err = client.Call("BlockchainService.SendTxnAndWait", &SendTxnArgs{Destination: [32]byte{10}, Amount: 5, Timeout: 50 * time.Millisecond}, &result)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not confirmed")
+	assert.Less(t, time.Since(start), 10*time.Second)
+
+	mockBC.SetSendTxnError(errors.New("insufficient balance"))
+	err = client.Call("BlockchainService.SendTxnAndWait", &SendTxnArgs{Destination: dest, Amount: 5}, &result)
+	assert.Error(t, err)
+}
+
+// TestWaitForTip tests the WaitForTip long poll RPC method
+func TestWaitForTip(t *testing.T) {
+	mockBC := NewMockBlockchain()
+	server, client := setupRPCTest(t, mockBC)
+	defer server.Stop()
+	tipHash := mockBC.tipBlock.Hash()
+
+	// A stale known hash is answered straight away
+	var reply [32]byte
+	err := client.Call("BlockchainService.WaitForTip", &WaitForTipArgs{Known: [32]byte{0xff}, Timeout: time.Minute}, &reply)
+	require.NoError(t, err, "WaitForTip RPC call failed")
+	assert.Equal(t, tipHash, reply)
+
+	// With no tip change the call times out and replies with the same tip
+	err = client.Call("BlockchainService.WaitForTip", &WaitForTipArgs{Known: tipHash, Timeout: 50 * time.Millisecond}, &reply)
+	require.NoError(t, err)
+	assert.Equal(t, tipHash, reply)
+
+	// A tip change wakes up a waiting call
+	next := block.Block{PreHash: tipHash, Height: 2}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		mockBC.setTip(&next)
+	}()
+	start := time.Now()
+	err = client.Call("BlockchainService.WaitForTip", &WaitForTipArgs{Known: tipHash, Timeout: time.Minute}, &reply)
+	require.NoError(t, err)
+	assert.Equal(t, next.Hash(), reply)
+	assert.Less(t, time.Since(start), 10*time.Second)
+}
+
 // Helper function to set up RPC server and client for tests
 func setupRPCTest(t *testing.T, mockBC *MockBlockchain) (*RPCServer, *rpc.Client) {
 	// Create RPC server with a random port
@@ -282,3 +826,48 @@ func setupRPCTest(t *testing.T, mockBC *MockBlockchain) (*RPCServer, *rpc.Client
 
 	return server, client
 }
+
+// TestCallTimeout tests that a handler running past its timeout fails the call instead of hanging
+func TestCallTimeout(t *testing.T) {
+	mockBC := NewMockBlockchain()
+	mockBC.dbSizeHang = make(chan struct{})
+	server := NewRPCServer(0)
+	server.callTimeout = 100 * time.Millisecond
+	require.NoError(t, server.Start(mockBC))
+	defer server.Stop()
+
+	client, err := rpc.Dial("tcp", server.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	var size uint64
+	call := client.Go("BlockchainService.GetDBSize", struct{}{}, &size, nil)
+	select {
+	case <-call.Done:
+		assert.ErrorIs(t, ParseError(call.Error), ErrTimeout)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Call did not time out")
+	}
+
+	// The late reply is dropped and the connection keeps serving calls
+	close(mockBC.dbSizeHang)
+	var tip [32]byte
+	require.NoError(t, client.Call("BlockchainService.GetTip", struct{}{}, &tip))
+	assert.Equal(t, mockBC.tipBlock.Hash(), tip)
+}
+
+// TestOversizedRequestRejected tests that arguments above the size limit fail the call
+func TestOversizedRequestRejected(t *testing.T) {
+	mockBC := NewMockBlockchain()
+	server, client := setupRPCTest(t, mockBC)
+	defer server.Stop()
+	defer client.Close()
+
+	addrs := make([][32]byte, maxRequestSize/32+1)
+	for i := range addrs {
+		addrs[i][0], addrs[i][1], addrs[i][2] = byte(i), byte(i>>8), byte(i>>16)
+	}
+	var balances map[[32]byte]float64
+	err := client.Call("BlockchainService.GetBalances", addrs, &balances)
+	assert.Error(t, err)
+}
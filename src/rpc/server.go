@@ -1,30 +1,64 @@
 package rpc
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"net"
 	netRPC "net/rpc"
+	"os"
+	"strconv"
+	"strings"
 	"sync/atomic"
+	"time"
 )
 
+// DefaultBindAddr keeps the RPC server local unless another interface is asked for, since
+// anyone who can reach it can move the node's funds
+const DefaultBindAddr = "127.0.0.1"
+
+// unixPrefix marks a client address as the path of a Unix socket
+const unixPrefix = "unix:"
+
 // RPCServer represents the blockchain RPC server
 type RPCServer struct {
 	server    *netRPC.Server
 	listener  net.Listener
-	port      int
+	network   string // "tcp" or "unix"
+	address   string // host:port for tcp, the socket path for unix
 	isRunning int32
+
+	callTimeout time.Duration // Calls not in methodTimeouts are answered with ErrTimeout after this
 }
 
-// NewRPCServer creates and returns a new RPCServer instance
+// NewRPCServer creates an RPC server listening on port of the loopback interface
 func NewRPCServer(port int) *RPCServer {
+	return NewRPCServerOn("tcp", net.JoinHostPort(DefaultBindAddr, strconv.Itoa(port)))
+}
+
+// NewRPCServerOn creates an RPC server listening on address of network, a host:port for
+// "tcp" or the path of a socket for "unix"
+func NewRPCServerOn(network, address string) *RPCServer {
 	return &RPCServer{
 		server:    netRPC.NewServer(),
-		port:      port,
+		network:   network,
+		address:   address,
 		isRunning: 0,
+
+		callTimeout: DefaultCallTimeout,
 	}
 }
 
+// SplitAddress returns the network and address a client dials: "unix:" followed by a path
+// names a Unix socket, anything else a TCP host:port
+func SplitAddress(address string) (string, string) {
+	if path, ok := strings.CutPrefix(address, unixPrefix); ok {
+		return "unix", path
+	}
+	return "tcp", address
+}
+
 // Start initializes and starts the RPC server
 func (s *RPCServer) Start(blockchain BlockchainInterface) error {
 	if !atomic.CompareAndSwapInt32(&s.isRunning, 0, 1) {
@@ -37,14 +71,14 @@ func (s *RPCServer) Start(blockchain BlockchainInterface) error {
 		return fmt.Errorf("failed to register BlockchainService: %v", err)
 	}
 
-	// Create a TCP listener
-	var err error
-	s.listener, err = net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	listener, err := s.listen()
 	if err != nil {
-		return fmt.Errorf("failed to start RPC listener on port %d: %v", s.port, err)
+		atomic.StoreInt32(&s.isRunning, 0)
+		return fmt.Errorf("failed to start RPC listener on %s %s: %v", s.network, s.address, err)
 	}
+	s.listener = listener
 
-	log.Printf("RPC server started on port %d", s.port)
+	log.Printf("RPC server started on %s %s", s.network, listener.Addr())
 
 	// Accept connections in a goroutine
 	go s.acceptConnections()
@@ -52,6 +86,41 @@ func (s *RPCServer) Start(blockchain BlockchainInterface) error {
 	return nil
 }
 
+// listen opens the listener. A socket left behind by a node that did not shut down cleanly is
+// replaced, and the socket is only accessible to the node's user.
+func (s *RPCServer) listen() (net.Listener, error) {
+	if s.network != "unix" {
+		return net.Listen(s.network, s.address)
+	}
+
+	if info, err := os.Lstat(s.address); err == nil && info.Mode()&fs.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", s.address); err == nil {
+			conn.Close()
+			return nil, errors.New("another server is listening on the socket")
+		}
+		if err := os.Remove(s.address); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", s.address)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(s.address, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Addr returns the address the server listens on, nil before it started
+func (s *RPCServer) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
 // acceptConnections handles incoming RPC connections
 func (s *RPCServer) acceptConnections() {
 	for atomic.LoadInt32(&s.isRunning) == 1 {
@@ -66,7 +135,7 @@ func (s *RPCServer) acceptConnections() {
 		}
 
 		// Handle the connection in a new goroutine
-		go s.server.ServeConn(conn)
+		go s.server.ServeCodec(newServerCodec(conn, s.callTimeout))
 	}
 }
 
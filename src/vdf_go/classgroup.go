@@ -30,6 +30,9 @@ func NewClassGroupFromAbDiscriminant(a, b, discriminant *big.Int) *ClassGroup {
 }
 
 func NewClassGroupFromBytesDiscriminant(buf []byte, discriminant *big.Int) (*ClassGroup, bool) {
+	if discriminant == nil {
+		return nil, false
+	}
 	int_size_bits := discriminant.BitLen()
 
 	//add additional one byte for sign
@@ -43,7 +46,18 @@ func NewClassGroupFromBytesDiscriminant(buf []byte, discriminant *big.Int) (*Cla
 	a := decodeTwosComplement(buf[:int_size])
 	b := decodeTwosComplement(buf[int_size:])
 
-	return NewClassGroupFromAbDiscriminant(a, b, discriminant), true
+	//the bytes come from peers, only a positive definite form of the discriminant is valid,
+	//anything else divides by zero or never reduces
+	if a.Sign() <= 0 {
+		return nil, false
+	}
+	z := new(big.Int).Sub(new(big.Int).Mul(b, b), discriminant)
+	c, r := new(big.Int).QuoRem(z, new(big.Int).Lsh(a, 2), new(big.Int))
+	if r.Sign() != 0 || c.Sign() <= 0 {
+		return nil, false
+	}
+
+	return NewClassGroup(a, b, c), true
 }
 
 func IdentityForDiscriminant(d *big.Int) *ClassGroup {
@@ -279,6 +293,111 @@ func (group *ClassGroup) Square() *ClassGroup {
 	return NewClassGroup(A, B, C).Reduced()
 }
 
+// squareScratch holds the temporaries of squareInPlace so repeated squarings
+// reuse the same buffers instead of allocating new big.Ints each time
+type squareScratch struct {
+	g, d, q, r, u, t big.Int
+}
+
+// copy returns a ClassGroup that shares no big.Int with group, so it can be
+// modified in place
+func (group *ClassGroup) copy() *ClassGroup {
+	cg := &ClassGroup{
+		a: new(big.Int).Set(group.a),
+		b: new(big.Int).Set(group.b),
+		c: new(big.Int).Set(group.c),
+	}
+	if group.d != nil {
+		cg.d = new(big.Int).Set(group.d)
+	}
+	return cg
+}
+
+// squareInPlace replaces group with its reduced square, giving the same result as
+// Square. group must not share its big.Ints with another ClassGroup, see copy.
+func (group *ClassGroup) squareInPlace(s *squareScratch) bool {
+	a, b, c := group.a, group.b, group.c
+
+	//µ = solve_mod(b, c, a), a is always positive so Euclidean division is floor division
+	s.g.GCD(&s.d, nil, b, a)
+	s.q.QuoRem(c, &s.g, &s.r)
+	if s.r.Sign() != 0 {
+		return false
+	}
+	s.u.Mul(&s.q, &s.d)
+	s.u.Mod(&s.u, a)
+
+	//C = µ ^ 2 - (bµ−c)//a
+	s.t.Mul(b, &s.u)
+	s.t.Sub(&s.t, c)
+	s.t.Div(&s.t, a)
+	c.Mul(&s.u, &s.u)
+	c.Sub(c, &s.t)
+
+	//B = b − 2aµ
+	s.t.Mul(a, &s.u)
+	s.t.Lsh(&s.t, 1)
+	b.Sub(b, &s.t)
+
+	//A = a^2
+	a.Mul(a, a)
+
+	group.reduceInPlace(s)
+	return true
+}
+
+// normalizeInPlace is Normalized without allocating
+func (group *ClassGroup) normalizeInPlace(s *squareScratch) {
+	a, b, c := group.a, group.b, group.c
+
+	//if b > -a && b <= a:
+	s.t.Neg(a)
+	if b.Cmp(&s.t) == 1 && b.Cmp(a) < 1 {
+		return
+	}
+
+	//r = (a - b) // (2 * a)
+	s.r.Sub(a, b)
+	s.t.Lsh(a, 1)
+	s.r.Div(&s.r, &s.t)
+
+	//b, c = b + 2 * r * a, a * r * r + b * r + c
+	s.t.Mul(a, &s.r)
+	s.t.Add(&s.t, b)
+	s.t.Mul(&s.t, &s.r)
+	c.Add(c, &s.t)
+	s.t.Mul(a, &s.r)
+	s.t.Lsh(&s.t, 1)
+	b.Add(b, &s.t)
+}
+
+// reduceInPlace is Reduced without allocating
+func (group *ClassGroup) reduceInPlace(s *squareScratch) {
+	group.normalizeInPlace(s)
+	a, b, c := group.a, group.b, group.c
+
+	//while a > c or (a == c and b < 0):
+	for a.Cmp(c) == 1 || (a.Cmp(c) == 0 && b.Sign() == -1) {
+		//s = (c + b) // (c + c)
+		s.r.Add(c, b)
+		s.t.Lsh(c, 1)
+		s.r.Div(&s.r, &s.t)
+
+		//a, b, c = c, -b + 2 * s * c, c * s * s - b * s + a
+		s.t.Mul(c, &s.r)
+		s.t.Sub(&s.t, b)
+		s.t.Mul(&s.t, &s.r)
+		s.t.Add(&s.t, a)
+		s.q.Mul(c, &s.r)
+		s.q.Lsh(&s.q, 1)
+		b.Sub(&s.q, b)
+		a.Set(c)
+		c.Set(&s.t)
+	}
+
+	group.normalizeInPlace(s)
+}
+
 func (group *ClassGroup) SquareUsingMultiply() *ClassGroup {
 	//a1, b1, c1 = self.reduced()
 	x := group.Reduced()
@@ -0,0 +1,128 @@
+package vdf_go
+
+import (
+	"math/big"
+	"testing"
+)
+
+// fuzzGenerator returns the VDF input form for a discriminant of the given size derived from seed
+func fuzzGenerator(seed []byte, bits uint8) *ClassGroup {
+	D := CreateDiscriminant(seed, 64+int(bits)%193)
+	return NewClassGroupFromAbDiscriminant(big.NewInt(2), big.NewInt(1), D)
+}
+
+// checkReduced fails unless g is a reduced form of discriminant D
+func checkReduced(t *testing.T, name string, g *ClassGroup, D *big.Int) {
+	t.Helper()
+	if g == nil {
+		t.Fatalf("%s failed", name)
+	}
+	fresh := NewClassGroup(g.a, g.b, g.c)
+	if fresh.Discriminant().Cmp(D) != 0 {
+		t.Fatalf("%s has discriminant %s, expected %s", name, fresh.Discriminant(), D)
+	}
+	negA := new(big.Int).Neg(g.a)
+	if g.b.Cmp(negA) <= 0 || g.b.Cmp(g.a) > 0 || g.a.Cmp(g.c) > 0 || (g.a.Cmp(g.c) == 0 && g.b.Sign() < 0) {
+		t.Fatalf("%s = (%s, %s, %s) is not reduced", name, g.a, g.b, g.c)
+	}
+}
+
+// FuzzClassGroupPow checks that exponentiation agrees with composition: x^a * x^b must be
+// x^(a+b) whichever way each side is computed
+func FuzzClassGroupPow(f *testing.F) {
+	f.Add([]byte("fuzz seed"), uint8(0), uint16(3), uint16(5))
+	f.Add([]byte("another seed"), uint8(64), uint16(0), uint16(1))
+	f.Add([]byte{0}, uint8(192), uint16(1000), uint16(4095))
+	f.Add([]byte("wide"), uint8(128), uint16(65535), uint16(65535))
+
+	f.Fuzz(func(t *testing.T, seed []byte, bits uint8, a, b uint16) {
+		x := fuzzGenerator(seed, bits)
+		D := x.Discriminant()
+
+		xa, xb := x.Pow(int64(a)), x.Pow(int64(b))
+		sum := x.Pow(int64(a) + int64(b))
+		checkReduced(t, "x^a", xa, D)
+		checkReduced(t, "x^b", xb, D)
+		checkReduced(t, "x^(a+b)", sum, D)
+
+		product := xa.Multiply(xb)
+		checkReduced(t, "x^a * x^b", product, D)
+		if !product.Equal(sum) {
+			t.Fatalf("x^%d * x^%d != x^%d", a, b, int(a)+int(b))
+		}
+		if !xb.Multiply(xa).Equal(sum) {
+			t.Fatalf("x^%d * x^%d is not commutative", b, a)
+		}
+
+		bigSum := x.BigPow(big.NewInt(int64(a) + int64(b)))
+		checkReduced(t, "BigPow", bigSum, D)
+		if !bigSum.Equal(sum) {
+			t.Fatalf("BigPow(%d) != Pow(%d)", int(a)+int(b), int(a)+int(b))
+		}
+
+		// Squaring three ways
+		square := xa.Square()
+		checkReduced(t, "Square", square, D)
+		if !square.Equal(xa.Multiply(xa)) || !square.Equal(xa.SquareUsingMultiply()) {
+			t.Fatalf("squares of x^%d disagree", a)
+		}
+		inPlace := xa.copy()
+		if !inPlace.squareInPlace(new(squareScratch)) || !inPlace.Equal(square) {
+			t.Fatalf("squareInPlace of x^%d differs from Square", a)
+		}
+
+		// The identity is neutral
+		if !xa.Multiply(x.identity()).Equal(xa) {
+			t.Fatalf("x^%d * 1 != x^%d", a, a)
+		}
+	})
+}
+
+// FuzzVerifyProof checks that every proof calculateVDF produces verifies, and fails for
+// another iteration count
+func FuzzVerifyProof(f *testing.F) {
+	f.Add([]byte("proof seed"), uint8(0), uint16(1))
+	f.Add([]byte("proof seed"), uint8(100), uint16(77))
+	f.Add([]byte{1, 2, 3}, uint8(192), uint16(500))
+
+	f.Fuzz(func(t *testing.T, seed []byte, bits uint8, iterations uint16) {
+		T := 1 + int(iterations)%1000
+		x := fuzzGenerator(seed, bits)
+		D := x.Discriminant()
+
+		y, proof, err := calculateVDF(D, x, T, D.BitLen(), nil)
+		if err != nil {
+			t.Fatalf("calculateVDF with %d iterations failed: %v", T, err)
+		}
+		checkReduced(t, "y", y, D)
+		if !y.Equal(x.BigPow(new(big.Int).Lsh(big.NewInt(1), uint(T)))) {
+			t.Fatalf("y is not x^(2^%d)", T)
+		}
+		if !verifyProof(x, y, proof, T) {
+			t.Fatalf("proof for %d iterations does not verify", T)
+		}
+		if verifyProof(x, y, proof, T+1) {
+			t.Fatalf("proof for %d iterations verifies for %d", T, T+1)
+		}
+	})
+}
+
+// FuzzVerifyVDFBlob checks that verifying an arbitrary proof blob never panics, peers
+// choose every byte of it
+func FuzzVerifyVDFBlob(f *testing.F) {
+	const bits = 128
+	size := 4 * ((bits + 16) >> 4)
+	y, proof, err := GenerateVDF([]byte("blob seed"), 10, bits)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(append(y, proof...))
+	f.Add(make([]byte, size))
+
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		if len(blob) != size {
+			return
+		}
+		VerifyVDF([]byte("blob seed"), blob, 10, bits)
+	})
+}
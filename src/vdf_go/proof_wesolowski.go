@@ -3,6 +3,7 @@ package vdf_go
 import (
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"math"
@@ -13,6 +14,13 @@ import (
 	"time"
 )
 
+// errClassGroupOp reports a multiplication or squaring with no solution
+var errClassGroupOp = errors.New("class group operation failed")
+
+// maxProofK bounds the k parameter. evalOptimized keeps 2^k ClassGroups and
+// indexes them with int64 block values, so k must stay well below 63.
+const maxProofK = 20
+
 // Creates L and k parameters from papers, based on how many iterations need to be
 // performed, and how much memory should be used.
 func approximateParameters(T int) (int, int, int) {
@@ -30,7 +38,12 @@ func approximateParameters(T int) (int, int, int) {
 	// k = W(T * log(2) / (2 * L))  / log(2), where W is the product log function
 	// W can be approximated by log(x) - log(log(x)) + 0.25
 	intermediate := float64(T) * math.Log(2) / float64(2*L)
-	k := int(math.Max(math.Round(math.Log(intermediate)-math.Log(math.Log(intermediate))+0.25), 1))
+	// For tiny T the double log is NaN, which would convert to a garbage int
+	kf := math.Round(math.Log(intermediate) - math.Log(math.Log(intermediate)) + 0.25)
+	k := 1
+	if kf > 1 {
+		k = int(math.Min(kf, maxProofK))
+	}
 
 	// 1/w is the approximate proportion of time spent on the proof
 	w := int(math.Floor(float64(T)/(float64(T)/float64(k)+float64(L)*math.Pow(2, float64(k+1)))) - 2)
@@ -42,19 +55,20 @@ func iterateSquarings(x *ClassGroup, powers_to_calculate []int, stop <-chan stru
 	powers_calculated := make(map[int]*ClassGroup)
 
 	previous_power := 0
-	currX := CloneClassGroup(x)
+	// Square one private copy in place, only the requested powers are saved
+	currX := x.copy()
+	var scratch squareScratch
 	sort.Ints(powers_to_calculate)
 	for _, current_power := range powers_to_calculate {
 
 		for i := 0; i < current_power-previous_power; i++ {
-			currX = currX.Pow(2)
-			if currX == nil {
+			if !currX.squareInPlace(&scratch) {
 				return nil
 			}
 		}
 
 		previous_power = current_power
-		powers_calculated[current_power] = currX
+		powers_calculated[current_power] = currX.copy()
 
 		select {
 		case <-stop:
@@ -66,22 +80,27 @@ func iterateSquarings(x *ClassGroup, powers_to_calculate []int, stop <-chan stru
 	return powers_calculated
 }
 
-func GenerateVDF(seed []byte, iterations, int_size_bits int) ([]byte, []byte) {
+func GenerateVDF(seed []byte, iterations, int_size_bits int) ([]byte, []byte, error) {
 	return GenerateVDFWithStopChan(seed, iterations, int_size_bits, nil)
 }
 
-func GenerateVDFWithStopChan(seed []byte, iterations, int_size_bits int, stop <-chan struct{}) ([]byte, []byte) {
+// GenerateVDFWithStopChan returns nil outputs and a nil error if stop is closed
+// before the squarings finish
+func GenerateVDFWithStopChan(seed []byte, iterations, int_size_bits int, stop <-chan struct{}) ([]byte, []byte, error) {
 	defer timeTrack(time.Now())
 
 	D := CreateDiscriminant(seed, int_size_bits)
 	x := NewClassGroupFromAbDiscriminant(big.NewInt(2), big.NewInt(1), D)
 
-	y, proof := calculateVDF(D, x, iterations, int_size_bits, stop)
+	y, proof, err := calculateVDF(D, x, iterations, int_size_bits, stop)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	if (y == nil) || (proof == nil) {
-		return nil, nil
+		return nil, nil, nil
 	} else {
-		return y.Serialize(), proof.Serialize()
+		return y.Serialize(), proof.Serialize(), nil
 	}
 }
 
@@ -90,10 +109,21 @@ func VerifyVDF(seed, proof_blob []byte, iterations, int_size_bits int) bool {
 
 	int_size := (int_size_bits + 16) >> 4
 
+	//the blob is y followed by proof, each two ints of int_size bytes
+	if int_size_bits <= 0 || len(proof_blob) != 4*int_size {
+		return false
+	}
+
 	D := CreateDiscriminant(seed, int_size_bits)
 	x := NewClassGroupFromAbDiscriminant(big.NewInt(2), big.NewInt(1), D)
-	y, _ := NewClassGroupFromBytesDiscriminant(proof_blob[:(2*int_size)], D)
-	proof, _ := NewClassGroupFromBytesDiscriminant(proof_blob[2*int_size:], D)
+	y, ok := NewClassGroupFromBytesDiscriminant(proof_blob[:(2*int_size)], D)
+	if !ok {
+		return false
+	}
+	proof, ok := NewClassGroupFromBytesDiscriminant(proof_blob[2*int_size:], D)
+	if !ok {
+		return false
+	}
 
 	return verifyProof(x, y, proof, iterations)
 }
@@ -125,26 +155,41 @@ func hashPrime(x, y []byte) *big.Int {
 // such that sum(get_block(i) * 2^ki) = t^T // B
 func getBlock(i, k, T int, B *big.Int) *big.Int {
 	//(pow(2, k) * pow(2, T - k * (i + 1), B)) // B
-	p1 := big.NewInt(int64(math.Pow(2, float64(k))))
+	p1 := new(big.Int).Lsh(big.NewInt(1), uint(k))
 	p2 := new(big.Int).Exp(big.NewInt(2), big.NewInt(int64(T-k*(i+1))), B)
 	return floorDivision(new(big.Int).Mul(p1, p2), B)
 }
 
+// blockIndex is getBlock as an index into a table of 2^k entries
+func blockIndex(i, k, T int, B *big.Int) (int64, error) {
+	block := getBlock(i, k, T, B)
+	if !block.IsInt64() || block.Sign() < 0 || block.Int64() >= int64(1)<<k {
+		return 0, fmt.Errorf("proof block %v out of range for k = %d", block, k)
+	}
+	return block.Int64(), nil
+}
+
 // Optimized evalutation of h ^ (2^T // B)
-func evalOptimized(identity, h *ClassGroup, B *big.Int, T, k, l int, C map[int]*ClassGroup) *ClassGroup {
+func evalOptimized(identity, h *ClassGroup, B *big.Int, T, k, l int, C map[int]*ClassGroup) (*ClassGroup, error) {
+	if k < 1 || k > maxProofK {
+		return nil, fmt.Errorf("proof parameter k = %d outside [1, %d]", k, maxProofK)
+	}
+
 	//k1 = k//2
 	var k1 int = k / 2
 	k0 := k - k1
 
 	//x = identity
-	x := CloneClassGroup(identity)
+	x := identity.copy()
+	var scratch squareScratch
 
 	for j := l - 1; j > -1; j-- {
-		//x = pow(x, pow(2, k))
-		b_limit := int64(math.Pow(2, float64(k)))
-		x = x.Pow(b_limit)
-		if x == nil {
-			return nil
+		//x = pow(x, pow(2, k)), as k squarings in place
+		b_limit := int64(1) << k
+		for i := 0; i < k; i++ {
+			if !x.squareInPlace(&scratch) {
+				return nil, errClassGroupOp
+			}
 		}
 
 		//ys = {}
@@ -159,11 +204,13 @@ func evalOptimized(identity, h *ClassGroup, B *big.Int, T, k, l int, C map[int]*
 				continue
 			}
 
-			///TODO: carefully check big.Int to int64 value conversion...might cause serious issues later
-			b := getBlock(i*l+j, k, T, B).Int64()
+			b, err := blockIndex(i*l+j, k, T, B)
+			if err != nil {
+				return nil, err
+			}
 			ys[b] = ys[b].Multiply(C[i*k*l])
 			if ys[b] == nil {
-				return nil
+				return nil, errClassGroupOp
 			}
 		}
 
@@ -175,18 +222,18 @@ func evalOptimized(identity, h *ClassGroup, B *big.Int, T, k, l int, C map[int]*
 				//z *= ys[b1 * pow(2, k0) + b0]
 				z = z.Multiply(ys[int64(b1)*int64(math.Pow(float64(2), float64(k0)))+int64(b0)])
 				if z == nil {
-					return nil
+					return nil, errClassGroupOp
 				}
 			}
 
 			//x *= pow(z, b1 * pow(2, k0))
 			c := z.Pow(int64(b1) * int64(math.Pow(float64(2), float64(k0))))
 			if c == nil {
-				return nil
+				return nil, errClassGroupOp
 			}
 			x = x.Multiply(c)
 			if x == nil {
-				return nil
+				return nil, errClassGroupOp
 			}
 		}
 
@@ -198,26 +245,26 @@ func evalOptimized(identity, h *ClassGroup, B *big.Int, T, k, l int, C map[int]*
 				//z *= ys[b1 * pow(2, k0) + b0]
 				z = z.Multiply(ys[int64(b1)*int64(math.Pow(float64(2), float64(k0)))+int64(b0)])
 				if z == nil {
-					return nil
+					return nil, errClassGroupOp
 				}
 			}
 			//x *= pow(z, b0)
 			d := z.Pow(int64(b0))
 			if d == nil {
-				return nil
+				return nil, errClassGroupOp
 			}
 			x = x.Multiply(d)
 			if x == nil {
-				return nil
+				return nil, errClassGroupOp
 			}
 		}
 	}
 
-	return x
+	return x, nil
 }
 
 // generate y = x ^ (2 ^T) and pi
-func generateProof(identity, x, y *ClassGroup, T, k, l int, powers map[int]*ClassGroup) *ClassGroup {
+func generateProof(identity, x, y *ClassGroup, T, k, l int, powers map[int]*ClassGroup) (*ClassGroup, error) {
 	//x_s = x.serialize()
 	x_s := x.Serialize()
 
@@ -226,12 +273,10 @@ func generateProof(identity, x, y *ClassGroup, T, k, l int, powers map[int]*Clas
 
 	B := hashPrime(x_s, y_s)
 
-	proof := evalOptimized(identity, x, B, T, k, l, powers)
-
-	return proof
+	return evalOptimized(identity, x, B, T, k, l, powers)
 }
 
-func calculateVDF(discriminant *big.Int, x *ClassGroup, iterations, int_size_bits int, stop <-chan struct{}) (y, proof *ClassGroup) {
+func calculateVDF(discriminant *big.Int, x *ClassGroup, iterations, int_size_bits int, stop <-chan struct{}) (y, proof *ClassGroup, err error) {
 	L, k, _ := approximateParameters(iterations)
 
 	loopCount := int(math.Ceil(float64(iterations) / float64(k*L)))
@@ -246,16 +291,19 @@ func calculateVDF(discriminant *big.Int, x *ClassGroup, iterations, int_size_bit
 	powers := iterateSquarings(x, powers_to_calculate, stop)
 
 	if powers == nil {
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	y = powers[iterations]
 
 	identity := IdentityForDiscriminant(discriminant)
 
-	proof = generateProof(identity, x, y, iterations, k, L, powers)
+	proof, err = generateProof(identity, x, y, iterations, k, L, powers)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	return y, proof
+	return y, proof, nil
 }
 
 func verifyProof(x, y, proof *ClassGroup, T int) bool {
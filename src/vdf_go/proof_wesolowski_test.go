@@ -0,0 +1,167 @@
+package vdf_go
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"math/big"
+	"testing"
+)
+
+// Digests of y||proof from GenerateVDF for "golden seed" at 512 bits, recorded
+// before squarings were done in place
+var goldenVDF = map[int]string{
+	1:    "4f8e7ebbba1ee27ba0a18d4249dee603ca239fa57e4b2dc4072fb7349939fa28",
+	100:  "e74d11b642f754c9551c22b2e6812b9a1d94627b1f978a1ca65b0498ab83c2d8",
+	1000: "6be29c4c5bd0a69c9b9aa609c4bb84e49de762954b1eb17a0798b9e99bbca09f",
+	5000: "f49463e78e64aa4c4abdde993cfeb30494a009d6a95c95cf6fe17203b749a529",
+}
+
+func TestGenerateVDFGolden(t *testing.T) {
+	seed := []byte("golden seed")
+	for iterations, want := range goldenVDF {
+		y, proof, err := GenerateVDF(seed, iterations, 512)
+		if err != nil {
+			t.Fatalf("GenerateVDF with %d iterations failed: %v", iterations, err)
+		}
+		sum := sha256.Sum256(append(y, proof...))
+		if got := hex.EncodeToString(sum[:]); got != want {
+			t.Errorf("GenerateVDF with %d iterations = %s, want %s", iterations, got, want)
+		}
+		if !VerifyVDF(seed, append(y, proof...), iterations, 512) {
+			t.Errorf("VerifyVDF rejected the proof for %d iterations", iterations)
+		}
+	}
+}
+
+// TestSquareInPlace checks in-place squaring matches Square and leaves other
+// ClassGroups sharing the input's values untouched
+func TestSquareInPlace(t *testing.T) {
+	D := CreateDiscriminant([]byte("square seed"), 512)
+	x := NewClassGroupFromAbDiscriminant(big.NewInt(2), big.NewInt(1), D)
+	original := x.Serialize()
+
+	want := x
+	got := x.copy()
+	var scratch squareScratch
+	for i := 0; i < 200; i++ {
+		want = want.Square()
+		if !got.squareInPlace(&scratch) {
+			t.Fatalf("squareInPlace failed at step %d", i)
+		}
+		if !got.Equal(want) {
+			t.Fatalf("squareInPlace differs from Square at step %d", i)
+		}
+	}
+
+	if !bytes.Equal(x.Serialize(), original) {
+		t.Error("squaring a copy modified the original")
+	}
+}
+
+// TestApproximateParametersClamp checks k stays in range even for the largest T
+func TestApproximateParametersClamp(t *testing.T) {
+	for _, T := range []int{1, 2, 7, 10, 1 << 20, 1 << 40, math.MaxInt} {
+		L, k, _ := approximateParameters(T)
+		if k < 1 || k > maxProofK || L < 1 {
+			t.Errorf("approximateParameters(%d) = L %d, k %d", T, L, k)
+		}
+	}
+}
+
+// TestBlockIndexOverflow checks a block too large for int64 is reported instead
+// of being truncated into a wrong table index
+func TestBlockIndexOverflow(t *testing.T) {
+	B := hashPrime([]byte("x"), []byte("y"))
+	const k, T = 70, 1000
+
+	found := false
+	for i := 0; i < 10; i++ {
+		block := getBlock(i, k, T, B)
+		_, err := blockIndex(i, k, T, B)
+		if block.IsInt64() {
+			continue
+		}
+		found = true
+		if err == nil {
+			t.Errorf("blockIndex(%d) accepted %v, which would truncate to %d", i, block, block.Int64())
+		}
+	}
+	if !found {
+		t.Fatal("no block exceeded int64, pick a different B")
+	}
+}
+
+// TestEvalOptimizedLargeK checks an unsafe k fails instead of producing a bad proof
+func TestEvalOptimizedLargeK(t *testing.T) {
+	D := CreateDiscriminant([]byte("large k"), 512)
+	identity := IdentityForDiscriminant(D)
+	x := NewClassGroupFromAbDiscriminant(big.NewInt(2), big.NewInt(1), D)
+	B := hashPrime(x.Serialize(), x.Serialize())
+
+	proof, err := evalOptimized(identity, x, B, 1000, 63, 1, map[int]*ClassGroup{0: x})
+	if err == nil || proof != nil {
+		t.Errorf("evalOptimized with k = 63 returned %v, %v", proof, err)
+	}
+}
+
+func BenchmarkIterateSquarings(b *testing.B) {
+	D := CreateDiscriminant([]byte("benchmark seed"), 512)
+	x := NewClassGroupFromAbDiscriminant(big.NewInt(2), big.NewInt(1), D)
+	powers := []int{0, 500, 1000}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		iterateSquarings(x, powers, nil)
+	}
+}
+
+// TestVerifyVDFMalformedBlob checks truncated and oversized proofs are rejected
+// instead of panicking
+func TestVerifyVDFMalformedBlob(t *testing.T) {
+	seed := []byte("malformed seed")
+	y, proof, err := GenerateVDF(seed, 10, 512)
+	if err != nil {
+		t.Fatalf("GenerateVDF failed: %v", err)
+	}
+	blob := append(y, proof...)
+	if !VerifyVDF(seed, blob, 10, 512) {
+		t.Fatal("VerifyVDF rejected a valid proof")
+	}
+
+	for _, bad := range [][]byte{
+		nil,
+		blob[:1],
+		blob[:len(blob)/2],
+		blob[:len(blob)-1],
+		append(append([]byte{}, blob...), 0),
+		append(append([]byte{}, blob...), blob...),
+	} {
+		if VerifyVDF(seed, bad, 10, 512) {
+			t.Errorf("VerifyVDF accepted a %d byte blob", len(bad))
+		}
+	}
+	if VerifyVDF(seed, blob, 10, 0) {
+		t.Error("VerifyVDF accepted a zero int size")
+	}
+}
+
+// TestClassGroupFromBytesLength checks a buffer that doesn't match the
+// discriminant's size is rejected
+func TestClassGroupFromBytesLength(t *testing.T) {
+	D := CreateDiscriminant([]byte("bytes seed"), 512)
+	buf := NewClassGroupFromAbDiscriminant(big.NewInt(2), big.NewInt(1), D).Serialize()
+	if _, ok := NewClassGroupFromBytesDiscriminant(buf, D); !ok {
+		t.Fatal("a serialized group was rejected")
+	}
+
+	for _, bad := range [][]byte{nil, buf[:len(buf)-1], append(append([]byte{}, buf...), 0)} {
+		if _, ok := NewClassGroupFromBytesDiscriminant(bad, D); ok {
+			t.Errorf("a %d byte buffer was accepted", len(bad))
+		}
+	}
+	if _, ok := NewClassGroupFromBytesDiscriminant(buf, nil); ok {
+		t.Error("a nil discriminant was accepted")
+	}
+}
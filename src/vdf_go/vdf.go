@@ -1,6 +1,7 @@
 package vdf_go
 
 import (
+	"log"
 	"sync/atomic"
 )
 
@@ -8,26 +9,37 @@ import (
 type VDF struct {
 	difficulty int
 	input      [32]byte
-	output     [516]byte
-	outputChan chan [516]byte
+	output     [OutputSize]byte
+	outputChan chan [OutputSize]byte
+	err        error // Why the last execution failed, nil when its output holds a proof
 	finished   int32
 }
 
-// size of long integers in quadratic function group
-const sizeInBits = 2048
+// SizeInBits is the size of long integers in the quadratic function group New uses
+const SizeInBits = 2048
+
+// ElementSize is the length of one serialized class group element at SizeInBits,
+// two integers of (SizeInBits+16)/16 bytes as written by ClassGroup.Serialize
+const ElementSize = 2 * ((SizeInBits + 16) >> 4)
+
+// OutputSize is the length of a VDF output, Y followed by the proof
+const OutputSize = 2 * ElementSize
 
 // New create a new instance of VDF.
 func New(difficulty int, input [32]byte) *VDF {
 	return &VDF{
 		difficulty: difficulty,
 		input:      input,
-		outputChan: make(chan [516]byte),
+		outputChan: make(chan [OutputSize]byte, 1),
 	}
 }
 
 // GetOutputChannel returns the vdf output channel.
-// VDF output consists of 258 bytes of serialized Y and  258 bytes of serialized Proof
-func (vdf *VDF) GetOutputChannel() chan [516]byte {
+// VDF output consists of ElementSize bytes of serialized Y and ElementSize bytes of serialized Proof.
+// The channel buffers one output, so Execute never waits for a reader and an unread output is
+// simply dropped with the VDF. Read it before executing the VDF again, later outputs are dropped
+// while it is full.
+func (vdf *VDF) GetOutputChannel() chan [OutputSize]byte {
 	return vdf.outputChan
 }
 
@@ -36,22 +48,32 @@ func (vdf *VDF) GetOutputChannel() chan [516]byte {
 func (vdf *VDF) Execute(stop <-chan struct{}) {
 	atomic.StoreInt32(&vdf.finished, 0)
 
-	yBuf, proofBuf := GenerateVDFWithStopChan(vdf.input[:], vdf.difficulty, sizeInBits, stop)
+	yBuf, proofBuf, err := GenerateVDFWithStopChan(vdf.input[:], vdf.difficulty, SizeInBits, stop)
+	vdf.err = err
 
+	vdf.output = [OutputSize]byte{}
 	copy(vdf.output[:], yBuf)
-	copy(vdf.output[258:], proofBuf)
+	copy(vdf.output[ElementSize:], proofBuf)
 
-	go func() {
-		vdf.outputChan <- vdf.output
-	}()
+	select {
+	case vdf.outputChan <- vdf.output:
+	default:
+		log.Printf("VDF output channel is full, dropping output")
+	}
 
 	atomic.StoreInt32(&vdf.finished, 1)
 }
 
 // Verify runs the verification of generated proof
 // currently on i7-6700K, verification takes about 350 ms
-func (vdf *VDF) Verify(proof [516]byte) bool {
-	return VerifyVDF(vdf.input[:], proof[:], vdf.difficulty, sizeInBits)
+func (vdf *VDF) Verify(proof [OutputSize]byte) bool {
+	return VerifyVDF(vdf.input[:], proof[:], vdf.difficulty, SizeInBits)
+}
+
+// Err returns why the last execution failed, its output is all zeros then and holds no
+// proof. Read it after receiving the output from the channel.
+func (vdf *VDF) Err() error {
+	return vdf.err
 }
 
 // IsFinished returns whether the vdf execution is finished or not.
@@ -60,6 +82,33 @@ func (vdf *VDF) IsFinished() bool {
 }
 
 // GetOutput returns the vdf output, which can be bytes of 0s is the vdf is not finished.
-func (vdf *VDF) GetOutput() [516]byte {
+func (vdf *VDF) GetOutput() [OutputSize]byte {
 	return vdf.output
 }
+
+// Y returns the serialized result part of the output
+func (vdf *VDF) Y() [ElementSize]byte {
+	y, _ := SplitOutput(vdf.output)
+	return y
+}
+
+// Proof returns the serialized proof part of the output
+func (vdf *VDF) Proof() [ElementSize]byte {
+	_, proof := SplitOutput(vdf.output)
+	return proof
+}
+
+// SplitOutput separates a VDF output into Y and the proof
+func SplitOutput(out [OutputSize]byte) (y [ElementSize]byte, proof [ElementSize]byte) {
+	copy(y[:], out[:ElementSize])
+	copy(proof[:], out[ElementSize:])
+	return y, proof
+}
+
+// JoinOutput is the inverse of SplitOutput
+func JoinOutput(y, proof [ElementSize]byte) [OutputSize]byte {
+	var out [OutputSize]byte
+	copy(out[:ElementSize], y[:])
+	copy(out[ElementSize:], proof[:])
+	return out
+}
@@ -0,0 +1,74 @@
+package vdf_go
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestOutputSize(t *testing.T) {
+	// Y and the proof are serialized exactly as ClassGroup.Serialize does at SizeInBits
+	D := CreateDiscriminant([]byte("size"), SizeInBits)
+	if got := len(IdentityForDiscriminant(D).Serialize()); got != ElementSize {
+		t.Errorf("serialized element has %d bytes, ElementSize is %d", got, ElementSize)
+	}
+	if OutputSize != 516 {
+		t.Errorf("OutputSize = %d, block.Block.Proof holds 516 bytes", OutputSize)
+	}
+}
+
+func TestSplitOutput(t *testing.T) {
+	vdf := New(50, [32]byte{1, 2, 3})
+	vdf.Execute(nil)
+	out := <-vdf.GetOutputChannel()
+
+	y, proof := SplitOutput(out)
+	if y != vdf.Y() || proof != vdf.Proof() {
+		t.Error("SplitOutput and the Y/Proof accessors disagree")
+	}
+	if JoinOutput(y, proof) != out {
+		t.Fatal("JoinOutput(SplitOutput(out)) does not round-trip")
+	}
+
+	// The split components verify on their own and through the joined output
+	if !VerifyVDF(vdf.input[:], append(y[:], proof[:]...), 50, SizeInBits) {
+		t.Error("VerifyVDF rejected the split components")
+	}
+	if !vdf.Verify(JoinOutput(y, proof)) {
+		t.Error("Verify rejected the rejoined output")
+	}
+
+	// Swapping the parts must not verify
+	if vdf.Verify(JoinOutput(proof, y)) {
+		t.Error("Verify accepted Y and proof swapped")
+	}
+}
+
+func TestExecuteUnreadOutput(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 5; i++ {
+		// Nobody reads the output, as when mining is cancelled
+		New(10, [32]byte{byte(i)}).Execute(nil)
+	}
+
+	// Give anything Execute started the chance to exit
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines before executing, %d after", before, after)
+	}
+}
+
+func TestExecuteErr(t *testing.T) {
+	vdf := New(10, [32]byte{7})
+	go vdf.Execute(nil)
+	output := <-vdf.GetOutputChannel()
+	if err := vdf.Err(); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if !vdf.Verify(output) {
+		t.Error("Output of an execution without error should verify")
+	}
+}
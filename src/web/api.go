@@ -0,0 +1,219 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/nanlour/da/src/block"
+	"github.com/nanlour/da/src/ecdsa_da"
+	"github.com/nanlour/da/src/rpc"
+)
+
+// apiOutput is one recipient of a transaction in API responses
+type apiOutput struct {
+	To     string  `json:"to"`
+	Amount float64 `json:"amount"`
+}
+
+// apiTxn is the JSON form of a transaction, byte fields are hex encoded
+type apiTxn struct {
+	Hash    string      `json:"hash"`
+	From    string      `json:"from"`
+	Amount  float64     `json:"amount"`
+	Height  uint64      `json:"height"`
+	Nonce   uint64      `json:"nonce"`
+	Outputs []apiOutput `json:"outputs"`
+}
+
+// apiBlock is the JSON form of a block, byte fields are hex encoded
+type apiBlock struct {
+	Hash           string `json:"hash"`
+	Height         uint64 `json:"height"`
+	PreHash        string `json:"pre_hash"`
+	EpochBeginHash string `json:"epoch_begin_hash"`
+	MinedBy        string `json:"mined_by"`
+	Txn            apiTxn `json:"txn"`
+}
+
+type apiBalance struct {
+	Address string  `json:"address"`
+	Balance float64 `json:"balance"`
+}
+
+// apiMempool is the JSON form of the pool statistics, senders are hex encoded
+type apiMempool struct {
+	Pending          int            `json:"pending"`
+	BySender         map[string]int `json:"by_sender"`
+	Outflow          float64        `json:"outflow"`
+	OldestAgeSeconds float64        `json:"oldest_age_seconds"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func newAPIBlock(b *block.Block) apiBlock {
+	hash := b.Hash()
+	txnHash := b.Txn.Hash()
+	miner := sha256.Sum256(b.PublicKey[:])
+
+	outputs := []apiOutput{}
+	for _, output := range b.Txn.TxOutputs() {
+		outputs = append(outputs, apiOutput{To: hex.EncodeToString(output.ToAddress[:]), Amount: output.Amount})
+	}
+
+	return apiBlock{
+		Hash:           hex.EncodeToString(hash[:]),
+		Height:         b.Height,
+		PreHash:        hex.EncodeToString(b.PreHash[:]),
+		EpochBeginHash: hex.EncodeToString(b.EpochBeginHash[:]),
+		MinedBy:        hex.EncodeToString(miner[:]),
+		Txn: apiTxn{
+			Hash:    hex.EncodeToString(txnHash[:]),
+			From:    hex.EncodeToString(b.Txn.FromAddress[:]),
+			Amount:  b.Txn.Amount,
+			Height:  b.Txn.Height,
+			Nonce:   b.Txn.Nonce,
+			Outputs: outputs,
+		},
+	}
+}
+
+// apiHandler serves the JSON explorer API under /api/
+func (s *WebServer) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/tip", s.handleAPITip)
+	mux.HandleFunc("GET /api/block/{hash}", s.handleAPIBlock)
+	mux.HandleFunc("GET /api/block/height/{height}", s.handleAPIBlockByHeight)
+	mux.HandleFunc("GET /api/balance/{address}", s.handleAPIBalance)
+	mux.HandleFunc("GET /api/mempool", s.handleAPIMempool)
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "unknown endpoint"})
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeAPIError reports a node error, errors about missing data become 404s
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, rpc.ErrBlockNotFound) || errors.Is(err, rpc.ErrAccountNotFound) {
+		status = http.StatusNotFound
+	}
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
+
+// parseHex32 decodes a 32-byte hex value from the URL
+func parseHex32(value string) ([32]byte, error) {
+	var result [32]byte
+	decoded, err := hex.DecodeString(value)
+	if err != nil || len(decoded) != 32 {
+		return result, fmt.Errorf("invalid 32-byte hex value %q", value)
+	}
+	copy(result[:], decoded)
+	return result, nil
+}
+
+func (s *WebServer) handleAPITip(w http.ResponseWriter, r *http.Request) {
+	tipHash, err := s.client.GetTip()
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	tip, err := s.client.GetBlockByHash(tipHash)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIBlock(tip))
+}
+
+func (s *WebServer) handleAPIBlock(w http.ResponseWriter, r *http.Request) {
+	hash, err := parseHex32(r.PathValue("hash"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+
+	b, err := s.client.GetBlockByHash(hash)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIBlock(b))
+}
+
+// handleAPIBlockByHeight walks back from the tip, the node has no height index over RPC
+func (s *WebServer) handleAPIBlockByHeight(w http.ResponseWriter, r *http.Request) {
+	height, err := strconv.ParseUint(r.PathValue("height"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid height"})
+		return
+	}
+
+	currentHash, err := s.client.GetTip()
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	for {
+		current, err := s.client.GetBlockByHash(currentHash)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		if current.Height == height {
+			writeJSON(w, http.StatusOK, newAPIBlock(current))
+			return
+		}
+		if current.Height < height || current.Height == 0 {
+			writeAPIError(w, rpc.ErrBlockNotFound)
+			return
+		}
+		currentHash = current.PreHash
+	}
+}
+
+func (s *WebServer) handleAPIBalance(w http.ResponseWriter, r *http.Request) {
+	address, err := ecdsa_da.ParseAddress(r.PathValue("address"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+
+	balance, err := s.client.GetBalanceByAddress(address)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, apiBalance{Address: hex.EncodeToString(address[:]), Balance: balance})
+}
+
+func (s *WebServer) handleAPIMempool(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.client.GetMempoolStats()
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	bySender := make(map[string]int, len(stats.BySender))
+	for sender, count := range stats.BySender {
+		bySender[hex.EncodeToString(sender[:])] = count
+	}
+	writeJSON(w, http.StatusOK, apiMempool{
+		Pending:          stats.Pending,
+		BySender:         bySender,
+		Outflow:          stats.Outflow,
+		OldestAgeSeconds: stats.OldestAge.Seconds(),
+	})
+}
@@ -0,0 +1,222 @@
+package web
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nanlour/da/src/block"
+	"github.com/nanlour/da/src/ecdsa_da"
+	"github.com/nanlour/da/src/rpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockClient serves a short fixed chain in place of a node
+type mockClient struct {
+	mu        sync.Mutex
+	tipCh     chan struct{}
+	tip       [32]byte
+	blocks    map[[32]byte]*block.Block
+	balances  map[[32]byte]float64
+	submitted [][32]byte
+}
+
+func newMockClient() *mockClient {
+	m := &mockClient{
+		tipCh:    make(chan struct{}),
+		blocks:   make(map[[32]byte]*block.Block),
+		balances: map[[32]byte]float64{{7}: 42},
+	}
+	var preHash [32]byte
+	for height := uint64(0); height < 3; height++ {
+		b := &block.Block{PreHash: preHash, Height: height}
+		b.Txn.FromAddress = [32]byte{1}
+		b.Txn.ToAddress = [32]byte{2}
+		b.Txn.Amount = float64(height)
+		b.Txn.Height = height
+		preHash = b.Hash()
+		m.blocks[preHash] = b
+	}
+	m.tip = preHash
+	return m
+}
+
+// extend mines a new tip on top of the current one and wakes up WaitForTip
+func (m *mockClient) extend() *block.Block {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := &block.Block{PreHash: m.tip, Height: m.blocks[m.tip].Height + 1}
+	m.tip = b.Hash()
+	m.blocks[m.tip] = b
+	close(m.tipCh)
+	m.tipCh = make(chan struct{})
+	return b
+}
+
+func (m *mockClient) GetTip() ([32]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.tip, nil
+}
+
+func (m *mockClient) GetBlockByHash(hash [32]byte) (*block.Block, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.blocks[hash]
+	if !ok {
+		return nil, rpc.ErrBlockNotFound
+	}
+	return b, nil
+}
+
+func (m *mockClient) GetBalanceByAddress(address [32]byte) (float64, error) {
+	balance, ok := m.balances[address]
+	if !ok {
+		return 0, rpc.ErrAccountNotFound
+	}
+	return balance, nil
+}
+
+func (m *mockClient) SubmitTxn(destination [32]byte, amount float64) ([32]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if amount > m.balances[[32]byte{7}] {
+		return [32]byte{}, errors.New("insufficient funds")
+	}
+	m.submitted = append(m.submitted, destination)
+	return [32]byte{9}, nil
+}
+
+func (m *mockClient) GetTransactionStatus(hash [32]byte) (*TxnStatus, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (m *mockClient) GetEpochInfo() (*EpochInfo, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (m *mockClient) GetMiningStats() (*MiningStats, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (m *mockClient) GetMempoolStats() (*MempoolStats, error) {
+	return &MempoolStats{
+		Pending:   2,
+		BySender:  map[[32]byte]int{{1}: 2},
+		Outflow:   3.5,
+		OldestAge: 45 * time.Second,
+	}, nil
+}
+
+func (m *mockClient) GetAddress() ([32]byte, error) {
+	return [32]byte{}, nil
+}
+
+func (m *mockClient) GetLastTenBlocks() ([]*block.Block, error) {
+	return nil, nil
+}
+
+func (m *mockClient) WaitForTip(known [32]byte, timeout time.Duration) ([32]byte, error) {
+	m.mu.Lock()
+	tip, changed := m.tip, m.tipCh
+	m.mu.Unlock()
+	if tip != known {
+		return tip, nil
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(timeout):
+	}
+	return m.GetTip()
+}
+
+func serveAPI(t *testing.T, client Client, path string) *httptest.ResponseRecorder {
+	server := &WebServer{client: client}
+	rec := httptest.NewRecorder()
+	server.apiHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	return rec
+}
+
+func TestAPITip(t *testing.T) {
+	client := newMockClient()
+	rec := serveAPI(t, client, "/api/tip")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var got apiBlock
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, hex.EncodeToString(client.tip[:]), got.Hash)
+	assert.Equal(t, uint64(2), got.Height)
+	assert.Len(t, got.Txn.Outputs, 1)
+}
+
+func TestAPIBlock(t *testing.T) {
+	client := newMockClient()
+	rec := serveAPI(t, client, "/api/block/"+hex.EncodeToString(client.tip[:]))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = serveAPI(t, client, "/api/block/"+hex.EncodeToString(make([]byte, 32)))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = serveAPI(t, client, "/api/block/nothex")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestAPIBlockByHeight(t *testing.T) {
+	client := newMockClient()
+	rec := serveAPI(t, client, "/api/block/height/1")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var got apiBlock
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, uint64(1), got.Height)
+	assert.Equal(t, uint64(1), got.Txn.Height)
+
+	rec = serveAPI(t, client, "/api/block/height/5")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = serveAPI(t, client, "/api/block/height/-1")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestAPIBalance(t *testing.T) {
+	client := newMockClient()
+	address := [32]byte{7}
+	rec := serveAPI(t, client, "/api/balance/"+hex.EncodeToString(address[:]))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var got apiBalance
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, 42.0, got.Balance)
+
+	rec = serveAPI(t, client, "/api/balance/"+ecdsa_da.EncodeAddress(address))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = serveAPI(t, client, "/api/balance/"+hex.EncodeToString(make([]byte, 32)))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = serveAPI(t, client, "/api/unknown")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestAPIMempool(t *testing.T) {
+	rec := serveAPI(t, newMockClient(), "/api/mempool")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var got apiMempool
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	sender := [32]byte{1}
+	assert.Equal(t, apiMempool{
+		Pending:          2,
+		BySender:         map[string]int{hex.EncodeToString(sender[:]): 2},
+		Outflow:          3.5,
+		OldestAgeSeconds: 45,
+	}, got)
+}
@@ -0,0 +1,35 @@
+package web
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"os"
+)
+
+// embeddedAssets holds the templates and static files built into the binary, so the UI works
+// from any working directory
+//
+//go:embed templates static
+var embeddedAssets embed.FS
+
+// loadAssets parses the templates and opens the static files under dir, which must hold a
+// templates and a static directory. An empty dir uses the embedded copies, a directory is
+// useful during development to pick up edits without rebuilding.
+func loadAssets(dir string) (*template.Template, fs.FS, error) {
+	var assets fs.FS = embeddedAssets
+	if dir != "" {
+		assets = os.DirFS(dir)
+	}
+
+	templates, err := template.ParseFS(assets, "templates/*.html")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse templates: %v", err)
+	}
+	static, err := fs.Sub(assets, "static")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open static files: %v", err)
+	}
+	return templates, static, nil
+}
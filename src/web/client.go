@@ -2,43 +2,65 @@ package web
 
 import (
 	"errors"
-	"net/rpc"
+	netRPC "net/rpc"
+	"time"
 
 	"github.com/nanlour/da/src/block"
+	"github.com/nanlour/da/src/rpc"
 )
 
+// Client is what the web server needs from a node, RPCClient talks to one over RPC
+type Client interface {
+	GetTip() ([32]byte, error)
+	GetBlockByHash(hash [32]byte) (*block.Block, error)
+	GetBalanceByAddress(address [32]byte) (float64, error)
+	SubmitTxn(destination [32]byte, amount float64) ([32]byte, error)
+	GetTransactionStatus(hash [32]byte) (*TxnStatus, error)
+	GetEpochInfo() (*EpochInfo, error)
+	GetMiningStats() (*MiningStats, error)
+	GetMempoolStats() (*MempoolStats, error)
+	GetAddress() ([32]byte, error)
+	GetLastTenBlocks() ([]*block.Block, error)
+	WaitForTip(known [32]byte, timeout time.Duration) ([32]byte, error)
+}
+
 // RPCClient handles communication with the blockchain RPC server
 type RPCClient struct {
-	client *rpc.Client
+	client *netRPC.Client
 }
 
 // NewRPCClient creates a new client connected to the RPC server
 func NewRPCClient(address string) (*RPCClient, error) {
-	client, err := rpc.Dial("tcp", address)
+	client, err := netRPC.Dial(rpc.SplitAddress(address))
 	if err != nil {
 		return nil, err
 	}
 	return &RPCClient{client: client}, nil
 }
 
+// call makes an RPC call, errors the node sent with a code come back as *rpc.Error
+func (c *RPCClient) call(method string, args any, reply any) error {
+	return rpc.ParseError(c.client.Call(method, args, reply))
+}
+
 // GetTip returns the hash of the latest block
 func (c *RPCClient) GetTip() ([32]byte, error) {
 	var result [32]byte
-	err := c.client.Call("BlockchainService.GetTip", struct{}{}, &result)
+	err := c.call("BlockchainService.GetTip", struct{}{}, &result)
 	return result, err
 }
 
 // GetBlockByHash returns a block by its hash
 func (c *RPCClient) GetBlockByHash(hash [32]byte) (*block.Block, error) {
 	var result block.Block
-	err := c.client.Call("BlockchainService.GetBlockByHash", hash, &result)
+	err := c.call("BlockchainService.GetBlockByHash", hash, &result)
 	return &result, err
 }
 
 // GetBalanceByAddress returns the balance for a given address
 func (c *RPCClient) GetBalanceByAddress(address [32]byte) (float64, error) {
 	var result float64
-	err := c.client.Call("BlockchainService.GetBalanceByAddress", address, &result)
+	err := c.call("BlockchainService.GetBalanceByAddress", address, &result)
 	return result, err
 }
 
@@ -52,7 +74,99 @@ func (c *RPCClient) SendTxn(destination [32]byte, amount float64) (bool, error)
 		Amount:      amount,
 	}
 	var result bool
-	err := c.client.Call("BlockchainService.SendTxn", args, &result)
+	err := c.call("BlockchainService.SendTxn", args, &result)
+	return result, err
+}
+
+// SubmitTxn sends a transaction and returns its hash
+func (c *RPCClient) SubmitTxn(destination [32]byte, amount float64) ([32]byte, error) {
+	args := struct {
+		Destination [32]byte
+		Amount      float64
+	}{
+		Destination: destination,
+		Amount:      amount,
+	}
+	var result [32]byte
+	err := c.call("BlockchainService.SubmitTxn", args, &result)
+	return result, err
+}
+
+// TxnStatus mirrors the confirmation status reported by the RPC server
+type TxnStatus struct {
+	Confirmed     bool
+	Pending       bool
+	BlockHeight   uint64
+	Confirmations uint64
+}
+
+// GetTransactionStatus returns the confirmation status of a transaction
+func (c *RPCClient) GetTransactionStatus(hash [32]byte) (*TxnStatus, error) {
+	var result TxnStatus
+	err := c.call("BlockchainService.GetTransactionStatus", hash, &result)
+	return &result, err
+}
+
+// EpochInfo mirrors the epoch and difficulty information reported by the RPC server
+type EpochInfo struct {
+	EpochBeginHash   [32]byte
+	StartHeight      uint64
+	TipHeight        uint64
+	Difficulty       uint64
+	MiningDifficulty uint64
+	DifficultyFloor  uint64
+	DifficultyCap    float64
+}
+
+// GetEpochInfo returns the current epoch and difficulty parameters
+func (c *RPCClient) GetEpochInfo() (*EpochInfo, error) {
+	var result EpochInfo
+	err := c.call("BlockchainService.GetEpochInfo", struct{}{}, &result)
+	return &result, err
+}
+
+// MiningStats mirrors the mining statistics reported by the RPC server
+type MiningStats struct {
+	Mining        bool
+	Difficulty    uint64
+	BlocksMined   uint64
+	LastBlockTime time.Time
+}
+
+// GetMiningStats returns the current mining difficulty and the blocks the node has mined
+func (c *RPCClient) GetMiningStats() (*MiningStats, error) {
+	var result MiningStats
+	err := c.call("BlockchainService.GetMiningStats", struct{}{}, &result)
+	return &result, err
+}
+
+// MempoolStats mirrors the transaction pool statistics reported by the RPC server
+type MempoolStats struct {
+	Pending   int
+	BySender  map[[32]byte]int
+	Outflow   float64
+	OldestAge time.Duration
+}
+
+// GetMempoolStats returns aggregate figures about the node's pending transactions
+func (c *RPCClient) GetMempoolStats() (*MempoolStats, error) {
+	var result MempoolStats
+	err := c.call("BlockchainService.GetMempoolStats", struct{}{}, &result)
+	return &result, err
+}
+
+// WaitForTip blocks until the tip hash differs from known or the timeout passes,
+// then returns the current tip hash
+func (c *RPCClient) WaitForTip(known [32]byte, timeout time.Duration) ([32]byte, error) {
+	args := struct {
+		Known   [32]byte
+		Timeout time.Duration
+	}{
+		Known:   known,
+		Timeout: timeout,
+	}
+	var result [32]byte
+	err := c.call("BlockchainService.WaitForTip", args, &result)
 	return result, err
 }
 
@@ -60,7 +174,7 @@ func (c *RPCClient) SendTxn(destination [32]byte, amount float64) (bool, error)
 func (c *RPCClient) GetAddress() ([32]byte, error) {
 	var result [32]byte
 	// Call the blockchain's GetAddress method
-	err := c.client.Call("BlockchainService.GetAddress", struct{}{}, &result)
+	err := c.call("BlockchainService.GetAddress", struct{}{}, &result)
 	return result, err
 }
 
@@ -88,9 +202,8 @@ func (c *RPCClient) GetLastTenBlocks() ([]*block.Block, error) {
 
 		blocks = append(blocks, currentBlock)
 
-		// If this is the genesis block (PreHash is zero), stop
-		var zeroHash [32]byte
-		if currentBlock.PreHash == zeroHash {
+		// If this is the genesis block, stop
+		if currentBlock.Height == 0 {
 			break
 		}
 
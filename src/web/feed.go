@@ -0,0 +1,191 @@
+package web
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nanlour/da/src/block"
+)
+
+const (
+	feedPollTimeout   = 30 * time.Second // Timeout passed to each WaitForTip long poll
+	feedRetryDelay    = time.Second      // Pause after a failed RPC call
+	feedMaxCatchUp    = 10               // Most blocks sent for a single tip change
+	feedWriteTimeout  = 10 * time.Second
+	feedSubscriberBuf = 16 // Messages queued per client before it is dropped as too slow
+)
+
+// feedMessage is what /ws sends to browsers for every new block
+type feedMessage struct {
+	Type  string   `json:"type"`
+	Block apiBlock `json:"block"`
+}
+
+// blockFeed follows the node's tip and fans new blocks out to WebSocket clients
+type blockFeed struct {
+	client   Client
+	upgrader websocket.Upgrader
+
+	mu          sync.Mutex
+	subscribers map[chan []byte]struct{}
+}
+
+func newBlockFeed(client Client) *blockFeed {
+	return &blockFeed{
+		client:      client,
+		subscribers: make(map[chan []byte]struct{}),
+	}
+}
+
+func (f *blockFeed) subscribe() chan []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch := make(chan []byte, feedSubscriberBuf)
+	f.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (f *blockFeed) unsubscribe(ch chan []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.subscribers[ch]; ok {
+		delete(f.subscribers, ch)
+		close(ch)
+	}
+}
+
+// broadcast queues msg for every client, a client whose queue is full is dropped
+func (f *blockFeed) broadcast(msg []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subscribers {
+		select {
+		case ch <- msg:
+		default:
+			delete(f.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// handleWS upgrades the request and streams new blocks until the client goes away
+func (f *blockFeed) handleWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := f.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ch := f.subscribe()
+	defer f.unsubscribe(ch)
+
+	// Browsers do not send anything, reading only notices the connection closing
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(feedWriteTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// run long polls the node for tip changes until quit is closed
+func (f *blockFeed) run(quit <-chan struct{}) {
+	var known [32]byte
+	for {
+		tip, err := f.client.GetTip()
+		if err == nil {
+			known = tip
+			break
+		}
+		log.Printf("Block feed failed to get tip: %v", err)
+		if !sleepOrQuit(feedRetryDelay, quit) {
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-quit:
+			return
+		default:
+		}
+
+		tip, err := f.client.WaitForTip(known, feedPollTimeout)
+		if err != nil {
+			log.Printf("Block feed failed to wait for tip: %v", err)
+			if !sleepOrQuit(feedRetryDelay, quit) {
+				return
+			}
+			continue
+		}
+		if tip == known {
+			continue
+		}
+
+		for _, b := range f.newBlocks(tip, known) {
+			msg, err := json.Marshal(feedMessage{Type: "block", Block: newAPIBlock(b)})
+			if err != nil {
+				log.Printf("Block feed failed to encode block: %v", err)
+				continue
+			}
+			f.broadcast(msg)
+		}
+		known = tip
+	}
+}
+
+// newBlocks walks back from tip to known and returns the blocks in between, oldest first
+func (f *blockFeed) newBlocks(tip, known [32]byte) []*block.Block {
+	var blocks []*block.Block
+	current := tip
+	for len(blocks) < feedMaxCatchUp && current != known {
+		b, err := f.client.GetBlockByHash(current)
+		if err != nil {
+			log.Printf("Block feed failed to get block: %v", err)
+			break
+		}
+		blocks = append(blocks, b)
+		if b.Height == 0 {
+			break
+		}
+		current = b.PreHash
+	}
+
+	for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+		blocks[i], blocks[j] = blocks[j], blocks[i]
+	}
+	return blocks
+}
+
+// sleepOrQuit waits for d and reports false if quit closed first
+func sleepOrQuit(d time.Duration, quit <-chan struct{}) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-quit:
+		return false
+	}
+}
@@ -0,0 +1,77 @@
+package web
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dialFeed connects a WebSocket client and waits until the feed has registered it
+func dialFeed(t *testing.T, server *httptest.Server, feed *blockFeed, want int) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		feed.mu.Lock()
+		defer feed.mu.Unlock()
+		return len(feed.subscribers) == want
+	}, 5*time.Second, 10*time.Millisecond)
+	return conn
+}
+
+func readFeedMessage(t *testing.T, conn *websocket.Conn) feedMessage {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+
+	var msg feedMessage
+	require.NoError(t, json.Unmarshal(data, &msg))
+	return msg
+}
+
+func TestBlockFeed(t *testing.T) {
+	client := newMockClient()
+	feed := newBlockFeed(client)
+	server := httptest.NewServer(http.HandlerFunc(feed.handleWS))
+	defer server.Close()
+
+	quit := make(chan struct{})
+	defer close(quit)
+	go feed.run(quit)
+
+	first := dialFeed(t, server, feed, 1)
+	defer first.Close()
+	second := dialFeed(t, server, feed, 2)
+
+	// Give run a moment to read the starting tip before it moves
+	time.Sleep(50 * time.Millisecond)
+	next := client.extend()
+	hash := next.Hash()
+
+	for _, conn := range []*websocket.Conn{first, second} {
+		msg := readFeedMessage(t, conn)
+		assert.Equal(t, "block", msg.Type)
+		assert.Equal(t, hex.EncodeToString(hash[:]), msg.Block.Hash)
+		assert.Equal(t, next.Height, msg.Block.Height)
+	}
+
+	// A disconnected client is unsubscribed and the others keep receiving
+	second.Close()
+	require.Eventually(t, func() bool {
+		feed.mu.Lock()
+		defer feed.mu.Unlock()
+		return len(feed.subscribers) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	next = client.extend()
+	msg := readFeedMessage(t, first)
+	assert.Equal(t, next.Height, msg.Block.Height)
+}
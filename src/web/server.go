@@ -5,38 +5,61 @@ import (
 	"encoding/hex"
 	"fmt"
 	"html/template"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
-	"path/filepath"
 	"strconv"
+
+	"github.com/nanlour/da/src/ecdsa_da"
 )
 
+// defaultBindAddr keeps the UI local unless another interface is asked for,
+// since anyone who can reach it can spend the node's funds through /send
+const defaultBindAddr = "127.0.0.1"
+
 // WebServer represents the web interface for blockchain
 type WebServer struct {
-	client     *RPCClient
-	port       int
-	templates  *template.Template
-	staticPath string
+	client    Client
+	bindAddr  string
+	port      int
+	templates *template.Template
+	static    fs.FS
+	feed      *blockFeed
+	csrf      *csrfProtector
 }
 
-// NewWebServer creates a new web server instance
-func NewWebServer(rpcAddress string, webPort int, templatesPath, staticPath string) (*WebServer, error) {
+// NewWebServer creates a new web server instance listening on bindAddr, an empty
+// bindAddr means defaultBindAddr. Templates and static files are read from assetsDir, or
+// from the copies built into the binary when it is empty.
+func NewWebServer(rpcAddress, bindAddr string, webPort int, assetsDir string) (*WebServer, error) {
+	if bindAddr == "" {
+		bindAddr = defaultBindAddr
+	}
+
 	client, err := NewRPCClient(rpcAddress)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to RPC server: %v", err)
 	}
 
-	// Parse all templates
-	templates, err := template.ParseGlob(filepath.Join(templatesPath, "*.html"))
+	templates, static, err := loadAssets(assetsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	csrf, err := newCSRFProtector()
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse templates: %v", err)
+		return nil, fmt.Errorf("failed to create CSRF key: %v", err)
 	}
 
 	return &WebServer{
-		client:     client,
-		port:       webPort,
-		templates:  templates,
-		staticPath: staticPath,
+		client:    client,
+		bindAddr:  bindAddr,
+		port:      webPort,
+		templates: templates,
+		static:    static,
+		feed:      newBlockFeed(client),
+		csrf:      csrf,
 	}, nil
 }
 
@@ -46,16 +69,30 @@ func (s *WebServer) Start() error {
 	http.HandleFunc("/", s.handleHome)
 	http.HandleFunc("/send", s.handleSend)
 	http.HandleFunc("/balance", s.handleBalance)
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(s.staticPath))))
+	http.HandleFunc("/status", s.handleStatus)
+	http.Handle("/api/", s.apiHandler())
+	http.HandleFunc("/ws", s.feed.handleWS)
+	http.Handle("/static/", http.StripPrefix("/static/", http.FileServerFS(s.static)))
 	http.HandleFunc("/debug", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain")
 		fmt.Fprintf(w, "Server is running. Templates: %v", s.templates.DefinedTemplates())
 	})
 
+	go s.feed.run(nil)
+
 	// Start server
-	addr := fmt.Sprintf("0.0.0.0:%d", s.port)
-	log.Printf("Web UI server starting on http://%s", addr)
-	return http.ListenAndServe(addr, nil)
+	listener, err := s.listen()
+	if err != nil {
+		return err
+	}
+	log.Printf("Web UI server starting on http://%s", listener.Addr())
+	return http.Serve(listener, nil)
+}
+
+// listen opens the TCP listener on the configured interface and port
+func (s *WebServer) listen() (net.Listener, error) {
+	addr := net.JoinHostPort(s.bindAddr, strconv.Itoa(s.port))
+	return net.Listen("tcp", addr)
 }
 
 // handleHome displays the home page with recent blocks and node info
@@ -74,6 +111,18 @@ func (s *WebServer) handleHome(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	epoch, err := s.client.GetEpochInfo()
+	if err != nil {
+		http.Error(w, "Failed to get epoch info: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	mining, err := s.client.GetMiningStats()
+	if err != nil {
+		http.Error(w, "Failed to get mining stats: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Format blocks for display
 	type DisplayBlock struct {
 		Hash    string
@@ -99,42 +148,71 @@ func (s *WebServer) handleHome(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data := struct {
-		Blocks  []DisplayBlock
-		Address string
+		Blocks         []DisplayBlock
+		Address        string
+		EncodedAddress string
+		Epoch          *EpochInfo
+		EpochHash      string
+		Mining         *MiningStats
 	}{
-		Blocks:  displayBlocks,
-		Address: hex.EncodeToString(address[:]),
+		Blocks:         displayBlocks,
+		Address:        hex.EncodeToString(address[:]),
+		EncodedAddress: ecdsa_da.EncodeAddress(address),
+		Epoch:          epoch,
+		EpochHash:      hex.EncodeToString(epoch.EpochBeginHash[:]),
+		Mining:         mining,
 	}
 
 	s.renderTemplate(w, "index_content", data)
 }
 
+// sendForm is the data behind the send page
+type sendForm struct {
+	Destination string
+	Amount      string
+	Error       string
+	CSRFToken   string
+}
+
+// renderSendForm shows the send page with a fresh CSRF token
+func (s *WebServer) renderSendForm(w http.ResponseWriter, status int, form sendForm) {
+	token, err := s.csrf.issue(w)
+	if err != nil {
+		http.Error(w, "Failed to create CSRF token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	form.CSRFToken = token
+
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
+	s.renderTemplate(w, "send_content", form)
+}
+
 // handleSend handles transaction sending requests
 func (s *WebServer) handleSend(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
-		s.renderTemplate(w, "send_content", nil)
+		s.renderSendForm(w, http.StatusOK, sendForm{})
 		return
 	}
 
 	if r.Method == http.MethodPost {
 		r.ParseForm()
 
-		// Parse destination address
-		destHex := r.FormValue("destination")
-		if len(destHex) != 64 { // 32 bytes as hex = 64 chars
-			http.Error(w, "Invalid address format", http.StatusBadRequest)
+		// Only accept forms served by this UI, not ones posted from other sites
+		if !s.csrf.valid(r) {
+			http.Error(w, "Invalid or missing CSRF token", http.StatusForbidden)
 			return
 		}
 
-		destBytes, err := hex.DecodeString(destHex)
-		if err != nil || len(destBytes) != 32 {
-			http.Error(w, "Invalid address format", http.StatusBadRequest)
+		// Parse destination address, either checksummed or raw hex
+		destHex := r.FormValue("destination")
+		destination, err := ecdsa_da.ParseAddress(destHex)
+		if err != nil {
+			http.Error(w, "Invalid address: "+err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		var destination [32]byte
-		copy(destination[:], destBytes)
-
 		// Parse amount
 		amountStr := r.FormValue("amount")
 		amount, err := strconv.ParseFloat(amountStr, 64)
@@ -144,25 +222,60 @@ func (s *WebServer) handleSend(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Send transaction
-		success, err := s.client.SendTxn(destination, amount)
+		txHash, err := s.client.SubmitTxn(destination, amount)
 		if err != nil {
-			http.Error(w, "Failed to send transaction: "+err.Error(), http.StatusInternalServerError)
+			// Show why the node refused, e.g. insufficient funds, alongside the form
+			s.renderSendForm(w, http.StatusBadRequest, sendForm{
+				Destination: destHex,
+				Amount:      amountStr,
+				Error:       err.Error(),
+			})
 			return
 		}
 
-		if !success {
-			http.Error(w, "Transaction failed", http.StatusInternalServerError)
+		// Redirect to the status page of the new transaction
+		http.Redirect(w, r, "/status?hash="+hex.EncodeToString(txHash[:]), http.StatusSeeOther)
+	}
+}
+
+// handleStatus displays the confirmation status of a transaction
+func (s *WebServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	hashHex := r.FormValue("hash")
+
+	data := struct {
+		Hash   string
+		Found  bool
+		Status *TxnStatus
+		Error  string
+	}{
+		Hash: hashHex,
+	}
+
+	if hashHex != "" {
+		hashBytes, err := hex.DecodeString(hashHex)
+		if err != nil || len(hashBytes) != 32 {
+			http.Error(w, "Invalid transaction hash format", http.StatusBadRequest)
 			return
 		}
 
-		// Redirect back to home page after successful transaction
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		var hash [32]byte
+		copy(hash[:], hashBytes)
+
+		status, err := s.client.GetTransactionStatus(hash)
+		if err != nil {
+			data.Error = err.Error()
+		} else {
+			data.Found = true
+			data.Status = status
+		}
 	}
+
+	s.renderTemplate(w, "status_content", data)
 }
 
 // handleBalance displays and queries account balances
 func (s *WebServer) handleBalance(w http.ResponseWriter, r *http.Request) {
-	var addressHex string
+	var addressHex, encoded string
 	var balance float64
 	var err error
 
@@ -170,20 +283,14 @@ func (s *WebServer) handleBalance(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
 		addressHex = r.FormValue("address")
 
-		// Validate address format
-		if len(addressHex) != 64 {
-			http.Error(w, "Invalid address format", http.StatusBadRequest)
-			return
-		}
-
-		addressBytes, err := hex.DecodeString(addressHex)
-		if err != nil || len(addressBytes) != 32 {
-			http.Error(w, "Invalid address format", http.StatusBadRequest)
+		// Accept both the checksummed encoding and raw hex
+		address, err := ecdsa_da.ParseAddress(addressHex)
+		if err != nil {
+			http.Error(w, "Invalid address: "+err.Error(), http.StatusBadRequest)
 			return
 		}
-
-		var address [32]byte
-		copy(address[:], addressBytes)
+		addressHex = hex.EncodeToString(address[:])
+		encoded = ecdsa_da.EncodeAddress(address)
 
 		// Query balance
 		balance, err = s.client.GetBalanceByAddress(address)
@@ -194,13 +301,15 @@ func (s *WebServer) handleBalance(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data := struct {
-		Address string
-		Balance float64
-		Success bool
+		Address        string
+		EncodedAddress string
+		Balance        float64
+		Success        bool
 	}{
-		Address: addressHex,
-		Balance: balance,
-		Success: r.Method == http.MethodPost && err == nil,
+		Address:        addressHex,
+		EncodedAddress: encoded,
+		Balance:        balance,
+		Success:        r.Method == http.MethodPost && err == nil,
 	}
 
 	s.renderTemplate(w, "balance_content", data)
@@ -0,0 +1,213 @@
+package web
+
+import (
+	"encoding/hex"
+	"html/template"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/nanlour/da/src/ecdsa_da"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenBindAddr(t *testing.T) {
+	server := &WebServer{bindAddr: "127.0.0.1", port: 0}
+	listener, err := server.listen()
+	require.NoError(t, err)
+	defer listener.Close()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	assert.True(t, addr.IP.Equal(net.IPv4(127, 0, 0, 1)), "listening on %v", addr.IP)
+	assert.False(t, addr.IP.IsUnspecified())
+
+	// Clients on the loopback interface can connect
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestListenInvalidBindAddr(t *testing.T) {
+	server := &WebServer{bindAddr: "203.0.113.1", port: 0}
+	_, err := server.listen()
+	assert.Error(t, err, "binding to an address this host does not have should fail")
+}
+
+// newTestServer serves the real templates on top of a mock client
+func newTestServer(t *testing.T, client Client) *WebServer {
+	templates, err := template.ParseGlob("templates/*.html")
+	require.NoError(t, err)
+	csrf, err := newCSRFProtector()
+	require.NoError(t, err)
+	return &WebServer{client: client, templates: templates, csrf: csrf}
+}
+
+var csrfFieldPattern = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// getSendForm loads the send page and returns its CSRF cookie and form token
+func getSendForm(t *testing.T, server *WebServer) (*http.Cookie, string) {
+	rec := httptest.NewRecorder()
+	server.handleSend(rec, httptest.NewRequest(http.MethodGet, "/send", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+	match := csrfFieldPattern.FindStringSubmatch(rec.Body.String())
+	require.NotNil(t, match, "send form should carry a CSRF token")
+	return cookies[0], match[1]
+}
+
+func postSend(server *WebServer, cookie *http.Cookie, token string) *httptest.ResponseRecorder {
+	return postSendTo(server, cookie, token, strings.Repeat("ab", 32))
+}
+
+func postSendTo(server *WebServer, cookie *http.Cookie, token, destination string) *httptest.ResponseRecorder {
+	form := url.Values{
+		"destination": {destination},
+		"amount":      {"1"},
+	}
+	if token != "" {
+		form.Set("csrf_token", token)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+
+	rec := httptest.NewRecorder()
+	server.handleSend(rec, req)
+	return rec
+}
+
+func TestSendCSRF(t *testing.T) {
+	client := newMockClient()
+	server := newTestServer(t, client)
+	cookie, token := getSendForm(t, server)
+
+	// No token at all
+	rec := postSend(server, nil, "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	// A form token without the cookie, as a cross-site form would send
+	rec = postSend(server, nil, token)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	// A matching pair not signed by this server
+	forged := &http.Cookie{Name: csrfFieldName, Value: "00.00"}
+	rec = postSend(server, forged, "00.00")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	// A token issued by another server instance
+	other := newTestServer(t, client)
+	otherCookie, otherToken := getSendForm(t, other)
+	rec = postSend(server, otherCookie, otherToken)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Empty(t, client.submitted)
+
+	// The token from our own form is accepted
+	rec = postSend(server, cookie, token)
+	assert.Equal(t, http.StatusSeeOther, rec.Code)
+	assert.Len(t, client.submitted, 1)
+}
+
+// corruptAddress changes one hex digit of the address part of an encoded address
+func corruptAddress(encoded string) string {
+	b := []byte(encoded)
+	i := len(ecdsa_da.AddressPrefix)
+	if b[i] == '0' {
+		b[i] = '1'
+	} else {
+		b[i] = '0'
+	}
+	return string(b)
+}
+
+func postBalance(server *WebServer, address string) *httptest.ResponseRecorder {
+	form := url.Values{"address": {address}}
+	req := httptest.NewRequest(http.MethodPost, "/balance", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	server.handleBalance(rec, req)
+	return rec
+}
+
+func TestBalanceEncodedAddress(t *testing.T) {
+	server := newTestServer(t, newMockClient())
+	address := [32]byte{7}
+	encoded := ecdsa_da.EncodeAddress(address)
+
+	for _, input := range []string{encoded, hex.EncodeToString(address[:])} {
+		rec := postBalance(server, input)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		assert.Contains(t, rec.Body.String(), "<strong>42</strong>")
+		assert.Contains(t, rec.Body.String(), encoded)
+	}
+
+	rec := postBalance(server, corruptAddress(encoded))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "bad checksum")
+
+	rec = postBalance(server, encoded[:len(encoded)-2])
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "wrong length")
+}
+
+func TestSendEncodedAddress(t *testing.T) {
+	client := newMockClient()
+	server := newTestServer(t, client)
+	cookie, token := getSendForm(t, server)
+	destination := [32]byte{0xab}
+	encoded := ecdsa_da.EncodeAddress(destination)
+
+	rec := postSendTo(server, cookie, token, corruptAddress(encoded))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "bad checksum")
+
+	rec = postSendTo(server, cookie, token, "abcd")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "wrong length")
+	assert.Empty(t, client.submitted)
+
+	// The RPC side still receives the raw bytes whichever form was entered
+	rec = postSendTo(server, cookie, token, encoded)
+	assert.Equal(t, http.StatusSeeOther, rec.Code)
+	rec = postSendTo(server, cookie, token, hex.EncodeToString(destination[:]))
+	assert.Equal(t, http.StatusSeeOther, rec.Code)
+	assert.Equal(t, [][32]byte{destination, destination}, client.submitted)
+}
+
+// TestEmbeddedAssets tests that the built in templates and static files are served when run
+// from a directory without them, and that a directory can be served instead
+func TestEmbeddedAssets(t *testing.T) {
+	sourceDir, err := filepath.Abs(".")
+	require.NoError(t, err)
+	t.Chdir(t.TempDir())
+
+	_, _, err = loadAssets(".")
+	assert.Error(t, err, "the working directory has no templates")
+
+	for _, dir := range []string{"", sourceDir} {
+		templates, static, err := loadAssets(dir)
+		require.NoError(t, err, "dir %q", dir)
+		csrf, err := newCSRFProtector()
+		require.NoError(t, err)
+		server := &WebServer{client: newMockClient(), templates: templates, static: static, csrf: csrf}
+
+		rec := httptest.NewRecorder()
+		server.handleSend(rec, httptest.NewRequest(http.MethodGet, "/send", nil))
+		assert.Equal(t, http.StatusOK, rec.Code, "dir %q", dir)
+		assert.Contains(t, rec.Body.String(), "csrf_token", "dir %q", dir)
+
+		rec = httptest.NewRecorder()
+		http.StripPrefix("/static/", http.FileServerFS(server.static)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/static/css/style.css", nil))
+		assert.Equal(t, http.StatusOK, rec.Code, "dir %q", dir)
+		assert.NotEmpty(t, rec.Body.String(), "dir %q", dir)
+	}
+}